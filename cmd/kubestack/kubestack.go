@@ -38,6 +38,8 @@ import (
 	cniSpecVersion "github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	// import plugins
 	_ "git.openstack.org/openstack/stackube/pkg/kubestack/plugins/openvswitch"
@@ -52,8 +54,9 @@ var (
 
 // OpenStack describes openstack client and its plugins.
 type OpenStack struct {
-	Client openstack.Interface
-	Plugin plugins.PluginInterface
+	Client     openstack.Interface
+	Plugin     plugins.PluginInterface
+	KubeClient kubernetes.Interface
 }
 
 func init() {
@@ -71,17 +74,33 @@ func loadNetConf(bytes []byte) (*kubestacktypes.NetConf, string, error) {
 	return n, n.CNIVersion, nil
 }
 
-func (os *OpenStack) getNetworkIDByNamespace(namespace string) (string, error) {
-	// Only support one network and network's name is same with namespace.
-	// TODO: make it general after multi-network is supported.
-	networkName := util.BuildNetworkName(namespace, namespace)
-	network, err := os.Client.GetNetworkByName(networkName)
+// getNetworkIDsForPod returns the IDs of networks the pod is attached to, the primary network comes first.
+func (os *OpenStack) getNetworkIDsForPod(podNamespace, podName string) ([]string, error) {
+	pod, err := os.KubeClient.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
 	if err != nil {
-		glog.Errorf("Get network by name %q failed: %v", networkName, err)
-		return "", err
+		glog.Errorf("Get pod %s/%s failed: %v", podNamespace, podName, err)
+		return nil, err
 	}
 
-	return network.Uid, nil
+	// The pod selects its networks by annotation, or uses the namespace's default network.
+	names, err := util.GetNetworkNames(os.KubeClient, podNamespace, pod.Annotations)
+	if err != nil {
+		glog.Errorf("Get network names for pod %s/%s failed: %v", podNamespace, podName, err)
+		return nil, err
+	}
+
+	networkIDs := make([]string, 0, len(names))
+	for _, name := range names {
+		networkName := util.BuildNetworkName(podNamespace, name)
+		network, err := os.Client.GetNetworkByName(networkName)
+		if err != nil {
+			glog.Errorf("Get network by name %q failed: %v", networkName, err)
+			return nil, err
+		}
+		networkIDs = append(networkIDs, network.Uid)
+	}
+
+	return networkIDs, nil
 }
 
 func getHostName() string {
@@ -121,8 +140,19 @@ func initOpenstack(stdinData []byte) (OpenStack, string, error) {
 		return OpenStack{}, "", err
 	}
 
+	// Init kubernetes client
+	k8sConfig, err := util.NewClusterConfig(n.KubernetesConfig)
+	if err != nil {
+		return OpenStack{}, "", fmt.Errorf("failed to build kubeconfig: %v", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return OpenStack{}, "", fmt.Errorf("failed to create kubernetes clientset: %v", err)
+	}
+
 	os := OpenStack{
-		Client: openStackClient,
+		Client:     openStackClient,
+		KubeClient: kubeClient,
 	}
 
 	// Init plugin
@@ -144,55 +174,35 @@ func initOpenstack(stdinData []byte) (OpenStack, string, error) {
 	return os, cniVersion, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	osClient, cniVersion, err := initOpenstack(args.StdinData)
-	if err != nil {
-		glog.Errorf("Init OpenStack failed: %v", err)
-		return err
-	}
-
-	// Get k8s args
-	podName, podNamespace, err := getK8sArgs(args.Args)
-	if err != nil {
-		glog.Errorf("GetK8sArgs failed: %v", err)
-		return err
-	}
-
-	// Get tenantID
-	tenantID, err := osClient.Client.GetTenantIDFromName(podNamespace)
-	if err != nil {
-		glog.Errorf("Get tenantID failed: %v", err)
-		return err
+// buildInterfaceName returns the name of the pod's interface with index, e.g. eth0, eth1...
+func buildInterfaceName(ifName string, index int) string {
+	if index == 0 {
+		return ifName
 	}
+	return fmt.Sprintf("%s%d", strings.TrimRight(ifName, "0123456789"), index)
+}
 
-	// Get networkID
-	networkID, err := osClient.getNetworkIDByNamespace(podNamespace)
-	if err != nil {
-		glog.Errorf("Get networkID failed: %v", err)
-		return err
-	}
-
-	// Build port name
-	portName := util.BuildPortName(podNamespace, podName)
-	podFullName := util.BuildFullPodName(podNamespace, podName)
-
+// setupPodInterface creates (or reuses) the port on network and plugs it into the pod's netns
+// with all fixed IPs of the port, which may be IPv4, IPv6 or both. Ports of the pod are
+// owned by deviceID. Only the primary interface gets the default routes.
+func (os *OpenStack) setupPodInterface(args *skel.CmdArgs, networkID, tenantID, portName, deviceID, ifName, netnsName string, primary bool) (brInterface, conInterface *current.Interface, ipConfigs []*current.IPConfig, err error) {
 	// Get port from openstack.
-	port, err := osClient.Client.GetPort(portName)
-	if err == util.ErrNotFound || port == nil {
+	port, err := os.Client.GetPort(portName)
+	if err == openstack.ErrNotFound {
 		// Port not found, create a new one.
-		portWithBinding, err := osClient.Client.CreatePort(networkID, tenantID, portName)
+		portWithBinding, err := os.Client.CreatePort(networkID, tenantID, portName, deviceID)
 		if err != nil {
 			glog.Errorf("CreatePort failed: %v", err)
-			return err
+			return nil, nil, nil, err
 		}
 		port = &portWithBinding.Port
 	} else if err != nil {
 		glog.Errorf("GetPort failed: %v", err)
-		return err
+		return nil, nil, nil, err
 	}
 	defer func() {
 		if err != nil {
-			if osClient.Client.DeletePortByID(port.ID) != nil {
+			if os.Client.DeletePortByID(port.ID) != nil {
 				glog.Warningf("Delete port %s failed", port.ID)
 			}
 		}
@@ -200,21 +210,131 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	deviceOwner := fmt.Sprintf("compute:%s", getHostName())
 	if port.DeviceOwner != deviceOwner {
-		err := osClient.Client.UpdatePortsBinding(port.ID, deviceOwner)
+		err = os.Client.UpdatePortsBinding(port.ID, deviceOwner)
 		if err != nil {
 			glog.Errorf("Update port %s failed: %v", portName, err)
+			return nil, nil, nil, err
+		}
+	}
+	glog.V(4).Infof("Port of interface %s is %v", ifName, port)
+
+	// Get subnets and gateways of all fixed IPs.
+	var ipcidrs, gateways []string
+	gatewayFamilies := make(map[string]bool)
+	for _, fixedIP := range port.FixedIPs {
+		subnet, err := os.Client.GetProviderSubnet(fixedIP.SubnetID)
+		if err != nil {
+			glog.Errorf("Get info of subnet %s failed: %v", fixedIP.SubnetID, err)
+			return nil, nil, nil, err
+		}
+
+		_, cidr, err := net.ParseCIDR(subnet.Cidr)
+		if err != nil {
+			glog.Errorf("Invalid CIDR %q of subnet %s: %v", subnet.Cidr, fixedIP.SubnetID, err)
+			return nil, nil, nil, err
+		}
+		prefixSize, _ := cidr.Mask.Size()
+		ipcidrs = append(ipcidrs, fmt.Sprintf("%s/%d", fixedIP.IPAddress, prefixSize))
+
+		version := "4"
+		if cidr.IP.To4() == nil {
+			version = "6"
+		}
+		// Only one default route per IP family.
+		if primary && subnet.Gateway != "" && !gatewayFamilies[version] {
+			gatewayFamilies[version] = true
+			gateways = append(gateways, subnet.Gateway)
+		}
+
+		ipConfigs = append(ipConfigs, &current.IPConfig{
+			Version: version,
+			Address: net.IPNet{
+				IP:   net.ParseIP(fixedIP.IPAddress),
+				Mask: cidr.Mask,
+			},
+			Gateway: net.ParseIP(subnet.Gateway),
+		})
+	}
+	if len(ipcidrs) == 0 {
+		err = fmt.Errorf("port %s has no fixed IPs", portName)
+		return nil, nil, nil, err
+	}
+
+	brInterface, conInterface, err = os.Plugin.SetupInterface(portName, args.ContainerID, port,
+		ipcidrs, gateways, ifName, netnsName)
+	if err != nil {
+		glog.Errorf("SetupInterface failed: %v", err)
+		return nil, nil, nil, err
+	}
+
+	return brInterface, conInterface, ipConfigs, nil
+}
+
+// teardownPodInterfaces destroys the pod's interfaces and deletes their ports.
+// Ports of the pod are found by its device ID, so ports after a failed interface
+// are deleted too.
+func (os *OpenStack) teardownPodInterfaces(args *skel.CmdArgs, podNamespace, podName string) error {
+	podPorts, err := os.Client.ListPodPorts(podNamespace, podName)
+	if err != nil {
+		glog.Errorf("List ports of pod %s failed: %v", podName, err)
+		return err
+	}
+	if len(podPorts) == 0 {
+		glog.V(4).Infof("Ports of pod %s already deleted", podName)
+		return nil
+	}
+
+	for i := range podPorts {
+		port := &podPorts[i]
+		glog.V(4).Infof("Pod %s's port is %v", podName, port)
+
+		// Delete interface
+		err = os.Plugin.DestroyInterface(port.Name, args.ContainerID, port)
+		if err != nil {
+			glog.Errorf("DestroyInterface for pod %s failed: %v", podName, err)
+			return err
+		}
+
+		// Delete port from openstack
+		err = os.Client.DeletePortByID(port.ID)
+		if err != nil {
+			glog.Errorf("Delete port %s failed: %v", port.Name, err)
 			return err
 		}
 	}
-	glog.V(4).Infof("Pod %s's port is %v", podName, port)
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	osClient, cniVersion, err := initOpenstack(args.StdinData)
+	if err != nil {
+		glog.Errorf("Init OpenStack failed: %v", err)
+		return err
+	}
+
+	// Get k8s args
+	podName, podNamespace, err := getK8sArgs(args.Args)
+	if err != nil {
+		glog.Errorf("GetK8sArgs failed: %v", err)
+		return err
+	}
+
+	// Get tenantID
+	tenantID, err := osClient.Client.GetTenantIDFromName(podNamespace)
+	if err != nil {
+		glog.Errorf("Get tenantID failed: %v", err)
+		return err
+	}
 
-	// Get subnet and gateway
-	subnet, err := osClient.Client.GetProviderSubnet(port.FixedIPs[0].SubnetID)
+	// Get networkIDs
+	networkIDs, err := osClient.getNetworkIDsForPod(podNamespace, podName)
 	if err != nil {
-		glog.Errorf("Get info of subnet %s failed: %v", port.FixedIPs[0].SubnetID, err)
+		glog.Errorf("Get networkIDs failed: %v", err)
 		return err
 	}
 
+	podFullName := util.BuildFullPodName(podNamespace, podName)
+
 	// Get network namespace.
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -222,10 +342,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	// Setup interface for pod
+	// Setup interfaces for pod
 	var netnsName string
-	_, cidr, _ := net.ParseCIDR(subnet.Cidr)
-	prefixSize, _ := cidr.Mask.Size()
 	if strings.HasPrefix(netnsBasePath, netns.Path()) {
 		// container runtime has already made the symlink for netns.
 		netnsName = path.Base(netns.Path())
@@ -236,46 +354,50 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return fmt.Errorf("error of symlink %q: %v", destPath, err)
 		}
 
+		// The symlink is only needed while setting up interfaces.
 		defer func() {
-			if err != nil {
-				if _, err := os.Stat(destPath); !os.IsNotExist(err) {
-					if err = os.Remove(destPath); err != nil && !os.IsNotExist(err) {
-						glog.Warningf("Failed to remove netns symlink %q: %v", destPath, err)
-					}
+			if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+				if err = os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+					glog.Warningf("Failed to remove netns symlink %q: %v", destPath, err)
 				}
 			}
 		}()
 	}
 
-	brInterface, conInterface, err := osClient.Plugin.SetupInterface(portName, args.ContainerID, port,
-		fmt.Sprintf("%s/%d", port.FixedIPs[0].IPAddress, prefixSize),
-		subnet.Gateway, args.IfName, netnsName)
-	if err != nil {
-		glog.Errorf("SetupInterface failed: %v", err)
-		return err
-	}
-
 	// Collect the result in this variable - this is ultimately what gets "returned"
 	// by this function by printing it to stdout.
 	result := &current.Result{}
-	// Populate container interface sandbox path
-	conInterface.Sandbox = netns.Path()
+	defer func() {
+		if err != nil {
+			if osClient.teardownPodInterfaces(args, podNamespace, podName) != nil {
+				glog.Warningf("Teardown interfaces of pod %s failed", podName)
+			}
+		}
+	}()
 
-	// Populate result.Interfaces
-	result.Interfaces = []*current.Interface{brInterface, conInterface}
-	// Populate result.IPs
-	ip := net.ParseIP(port.FixedIPs[0].IPAddress)
-	ipCidr := net.IPNet{
-		IP:   ip,
-		Mask: cidr.Mask,
-	}
-	gateway := net.ParseIP(subnet.Gateway)
-	containerIPConfig := &current.IPConfig{
-		Version: "4",
-		Address: ipCidr,
-		Gateway: gateway,
+	// The first network is the primary one, which is plugged as args.IfName and holds the default route.
+	deviceID := util.BuildPodDeviceID(podNamespace, podName)
+	for i, networkID := range networkIDs {
+		portName := util.BuildInterfacePortName(podNamespace, podName, i)
+		ifName := buildInterfaceName(args.IfName, i)
+		var brInterface, conInterface *current.Interface
+		var ipConfigs []*current.IPConfig
+		brInterface, conInterface, ipConfigs, err = osClient.setupPodInterface(args, networkID, tenantID, portName, deviceID, ifName, netnsName, i == 0)
+		if err != nil {
+			return err
+		}
+
+		// Populate container interface sandbox path
+		conInterface.Sandbox = netns.Path()
+
+		// Populate result.Interfaces and result.IPs
+		result.Interfaces = append(result.Interfaces, brInterface, conInterface)
+		conIndex := len(result.Interfaces) - 1
+		for _, ipConfig := range ipConfigs {
+			ipConfig.Interface = &conIndex
+			result.IPs = append(result.IPs, ipConfig)
+		}
 	}
-	result.IPs = []*current.IPConfig{containerIPConfig}
 
 	// Print result to stdout, in the format defined by the requested cniVersion.
 	return types.PrintResult(result, cniVersion)
@@ -295,33 +417,11 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	// Build port name
-	portName := util.BuildPortName(podNamespace, podName)
 	podFullName := util.BuildFullPodName(podNamespace, podName)
 
-	// Get port from openstack
-	port, err := osClient.Client.GetPort(portName)
-	if err != nil {
-		glog.Errorf("GetPort %s failed: %v", portName, err)
-		return err
-	}
-	if port == nil {
-		glog.Warningf("Port %s already deleted", portName)
-		return nil
-	}
-	glog.V(4).Infof("Pod %s's port is %v", podName, port)
-
-	// Delete interface
-	err = osClient.Plugin.DestroyInterface(portName, args.ContainerID, port)
-	if err != nil {
-		glog.Errorf("DestroyInterface for pod %s failed: %v", podName, err)
-		return err
-	}
-
-	// Delete port from openstack
-	err = osClient.Client.DeletePortByName(portName)
+	// Delete interfaces and ports of all networks.
+	err = osClient.teardownPodInterfaces(args, podNamespace, podName)
 	if err != nil {
-		glog.Errorf("Delete port %s failed: %v", portName, err)
 		return err
 	}
 
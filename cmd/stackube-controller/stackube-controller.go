@@ -25,8 +25,11 @@ import (
 
 	"git.openstack.org/openstack/stackube/pkg/auth-controller/rbacmanager"
 	"git.openstack.org/openstack/stackube/pkg/auth-controller/tenant"
+	"git.openstack.org/openstack/stackube/pkg/auth-controller/webhook"
+	"git.openstack.org/openstack/stackube/pkg/ingress-controller"
 	"git.openstack.org/openstack/stackube/pkg/network-controller"
 	"git.openstack.org/openstack/stackube/pkg/openstack"
+	"git.openstack.org/openstack/stackube/pkg/policy-controller"
 	"git.openstack.org/openstack/stackube/pkg/service-controller"
 	"git.openstack.org/openstack/stackube/pkg/util"
 
@@ -45,26 +48,38 @@ var (
 		"path to stackube config file")
 	userCIDR    = pflag.String("user-cidr", "10.244.0.0/16", "user Pod network CIDR")
 	userGateway = pflag.String("user-gateway", "10.244.0.1", "user Pod network gateway")
-	version     = pflag.Bool("version", false, "Display version")
-	VERSION     = "1.0beta"
+	dnsProvider = pflag.String("dns-provider", network.DNSProviderKubeDNS,
+		"the default DNS provider of namespaces: 'kube-dns' or 'coredns'")
+	passwordNamespace = pflag.String("password-secret-namespace", tenant.DefaultPasswordNamespace,
+		"namespace of the password Secrets of tenants, which must not be readable by tenant users")
+	rbacTemplates = pflag.String("rbac-templates-configmap", "kube-system/stackube-rbac-templates",
+		"namespace/name of the ConfigMap of RBAC templates of tenants, the default templates are used if it doesn't exist")
+	authWebhookBindAddress = pflag.String("auth-webhook-bind-address", "",
+		"address to serve the Keystone token authentication webhook of kube-apiserver at, e.g. ':8443', disabled if empty")
+	authWebhookCertFile = pflag.String("auth-webhook-tls-cert-file", "",
+		"TLS certificate file of the authentication webhook")
+	authWebhookKeyFile = pflag.String("auth-webhook-tls-private-key-file", "",
+		"TLS private key file of the authentication webhook")
+	version = pflag.Bool("version", false, "Display version")
+	VERSION = "1.0beta"
 )
 
 func startControllers(kubeClient *kubernetes.Clientset,
 	osClient openstack.Interface, kubeExtClient *extclientset.Clientset) error {
 	// Creates a new Tenant controller
-	tenantController, err := tenant.NewTenantController(kubeClient, osClient, kubeExtClient)
+	tenantController, err := tenant.NewTenantController(kubeClient, osClient, kubeExtClient, *passwordNamespace)
 	if err != nil {
 		return err
 	}
 
 	// Creates a new Network controller
-	networkController, err := network.NewNetworkController(kubeClient, osClient, kubeExtClient)
+	networkController, err := network.NewNetworkController(kubeClient, osClient, kubeExtClient, *dnsProvider)
 	if err != nil {
 		return err
 	}
 
 	// Creates a new RBAC controller
-	rbacController, err := rbacmanager.NewRBACController(kubeClient, osClient.GetCRDClient(), *userCIDR, *userGateway)
+	rbacController, err := rbacmanager.NewRBACController(kubeClient, osClient.GetCRDClient(), *userCIDR, *userGateway, *rbacTemplates)
 	if err != nil {
 		return err
 	}
@@ -75,6 +90,18 @@ func startControllers(kubeClient *kubernetes.Clientset,
 		return err
 	}
 
+	// Creates a new network policy controller
+	policyController, err := policy.NewPolicyController(kubeClient, osClient)
+	if err != nil {
+		return err
+	}
+
+	// Creates a new ingress controller
+	ingressController, err := ingress.NewIngressController(kubeClient, osClient)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wg, ctx := errgroup.WithContext(ctx)
 
@@ -88,6 +115,20 @@ func startControllers(kubeClient *kubernetes.Clientset,
 	// start service controller
 	wg.Go(func() error { return serviceController.Run(ctx.Done()) })
 
+	// start network policy controller
+	wg.Go(func() error { return policyController.Run(ctx.Done()) })
+
+	// start ingress controller
+	wg.Go(func() error { return ingressController.Run(ctx.Done()) })
+
+	// start authentication webhook
+	if *authWebhookBindAddress != "" {
+		authenticator := webhook.NewAuthenticator(osClient)
+		wg.Go(func() error {
+			return authenticator.Serve(*authWebhookBindAddress, *authWebhookCertFile, *authWebhookKeyFile, ctx.Done())
+		})
+	}
+
 	term := make(chan os.Signal)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
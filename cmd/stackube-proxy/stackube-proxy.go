@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"git.openstack.org/openstack/stackube/pkg/openstack"
 	"git.openstack.org/openstack/stackube/pkg/proxy"
@@ -35,6 +36,20 @@ var (
 		"path to kubernetes admin config file")
 	cloudconfig = pflag.String("cloudconfig", "/etc/stackube.conf",
 		"path to stackube config file")
+	hostnameOverride = pflag.String("hostname-override", "",
+		"the node name deciding local endpoints of services, defaults to the hostname")
+	proxyMode = pflag.String("proxy-mode", proxy.ProxyModeIPTables,
+		"which proxy mode to use: 'iptables' or 'ipvs'")
+	ipvsScheduler = pflag.String("ipvs-scheduler", "rr",
+		"the default IPVS scheduler in ipvs mode: 'rr', 'lc' or 'sh'")
+	clusterServices = pflag.StringSlice("cluster-services", proxy.DefaultClusterServices,
+		"cluster-wide services reachable in every tenant router, backed by a service in each namespace, "+
+			"as 'name=VIP:backing' ('[VIP]:backing' for IPv6), the backing service defaults to the service named 'name' "+
+			"and the VIP defaults to the cluster IP of the service named 'name' in kube-system")
+	metricsBindAddress = pflag.String("metrics-bind-address", "0.0.0.0:10249",
+		"the address serving metrics and healthz, empty to disable")
+	healthzTimeout = pflag.Duration("healthz-timeout", 2*time.Minute,
+		"healthz fails if the last successful sync is older than this")
 	version = pflag.Bool("version", false, "Display version")
 	VERSION = "1.0beta"
 )
@@ -74,7 +89,7 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	proxier, err := proxy.NewProxier(*kubeconfig, *cloudconfig)
+	proxier, err := proxy.NewProxier(*kubeconfig, *cloudconfig, *hostnameOverride, *proxyMode, *ipvsScheduler, *clusterServices)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -86,6 +101,12 @@ func main() {
 	go proxier.StartEndpointInformer(wait.NeverStop)
 	go proxier.StartInformerFactory(wait.NeverStop)
 
+	if *metricsBindAddress != "" {
+		go func() {
+			glog.Fatal(proxier.ServeMetrics(*metricsBindAddress, *healthzTimeout))
+		}()
+	}
+
 	if err := proxier.SyncLoop(); err != nil {
 		glog.Fatal(err)
 	}
@@ -61,6 +61,7 @@ sed -i s~_AUTH_URL_~${AUTH_URL:-}~g $TMP_CONF
 sed -i s/_USERNAME_/${USERNAME:-}/g $TMP_CONF
 sed -i s/_PASSWORD_/${PASSWORD:-}/g $TMP_CONF
 sed -i s/_TENANT_NAME_/${TENANT_NAME:-}/g $TMP_CONF
+sed -i s/_DOMAIN_NAME_/${DOMAIN_NAME:-Default}/g $TMP_CONF
 sed -i s/_REGION_/${REGION:-}/g $TMP_CONF
 sed -i s/_EXT_NET_ID_/${EXT_NET_ID:-}/g $TMP_CONF
 sed -i s/_PLUGIN_NAME_/${PLUGIN_NAME:-}/g $TMP_CONF
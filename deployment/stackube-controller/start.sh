@@ -32,8 +32,15 @@ sed -i s~_AUTH_URL_~${AUTH_URL:-}~g $TMP_CONF
 sed -i s/_USERNAME_/${USERNAME:-}/g $TMP_CONF
 sed -i s/_PASSWORD_/${PASSWORD:-}/g $TMP_CONF
 sed -i s/_TENANT_NAME_/${TENANT_NAME:-}/g $TMP_CONF
+sed -i s/_DOMAIN_NAME_/${DOMAIN_NAME:-Default}/g $TMP_CONF
+sed -i s/_PROJECT_DOMAIN_/${PROJECT_DOMAIN:-}/g $TMP_CONF
+sed -i s/_USER_DOMAIN_/${USER_DOMAIN:-}/g $TMP_CONF
+sed -i s/_MEMBER_ROLE_/${MEMBER_ROLE:-}/g $TMP_CONF
 sed -i s/_REGION_/${REGION:-}/g $TMP_CONF
 sed -i s/_EXT_NET_ID_/${EXT_NET_ID:-}/g $TMP_CONF
+sed -i s/_USE_OCTAVIA_/${USE_OCTAVIA:-false}/g $TMP_CONF
+sed -i s/_LB_PROVIDER_/${LB_PROVIDER:-}/g $TMP_CONF
+sed -i s/_CERTIFICATE_READERS_/${CERTIFICATE_READERS:-}/g $TMP_CONF
 
 # Move the temporary stackube config into place.
 STACKUBE_CONFIG_PATH='/etc/stackube.conf'
@@ -50,4 +57,9 @@ if [ -z $USER_GATEWAY ];then
 	USER_GATEWAY='10.244.0.1'
 fi
 
-./stackube-controller --v=3 --kubeconfig="" --user-cidr=${USER_CIDR} --user-gateway=${USER_GATEWAY}
\ No newline at end of file
+./stackube-controller --v=3 --kubeconfig="" --user-cidr=${USER_CIDR} --user-gateway=${USER_GATEWAY} \
+	--dns-provider="${DNS_PROVIDER:-kube-dns}" \
+	--password-secret-namespace="${PASSWORD_SECRET_NAMESPACE:-kube-system}" \
+	--auth-webhook-bind-address="${AUTH_WEBHOOK_BIND_ADDRESS:-}" \
+	--auth-webhook-tls-cert-file="${AUTH_WEBHOOK_TLS_CERT_FILE:-}" \
+	--auth-webhook-tls-private-key-file="${AUTH_WEBHOOK_TLS_PRIVATE_KEY_FILE:-}"
\ No newline at end of file
@@ -32,6 +32,7 @@ sed -i s~_AUTH_URL_~${AUTH_URL:-}~g $TMP_CONF
 sed -i s/_USERNAME_/${USERNAME:-}/g $TMP_CONF
 sed -i s/_PASSWORD_/${PASSWORD:-}/g $TMP_CONF
 sed -i s/_TENANT_NAME_/${TENANT_NAME:-}/g $TMP_CONF
+sed -i s/_DOMAIN_NAME_/${DOMAIN_NAME:-Default}/g $TMP_CONF
 sed -i s/_REGION_/${REGION:-}/g $TMP_CONF
 sed -i s/_EXT_NET_ID_/${EXT_NET_ID:-}/g $TMP_CONF
 
@@ -41,4 +42,6 @@ mv $TMP_CONF $STACKUBE_CONFIG_PATH
 echo "Wrote stackube config: $(cat ${STACKUBE_CONFIG_PATH})"
 
 # Start stackube-proxy in-cluster.
-./stackube-proxy --kubeconfig="" --v=3
\ No newline at end of file
+./stackube-proxy --kubeconfig="" --hostname-override="${NODE_NAME:-}" \
+	--proxy-mode="${PROXY_MODE:-iptables}" \
+	--cluster-services="${CLUSTER_SERVICES:-kube-dns}" --v=3
\ No newline at end of file
@@ -54,10 +54,11 @@ metadata:
   name: stackube-config
   namespace: kube-system
 data:
-  auth-url: "${KEYSTONE_ADMIN_URL}"
+  auth-url: "${KEYSTONE_ADMIN_URL%/v2.0}/v3"
   username: "admin"
   password: "${OS_PASSWORD}"
   tenant-name: "admin"
+  domain-name: "Default"
   region: "RegionOne"
   ext-net-id: "${public_network}"
   plugin-name: "ovs"
@@ -54,7 +54,7 @@ func (in *Network) DeepCopyInto(out *Network) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	out.Status = in.Status
 	return
 }
@@ -112,12 +112,129 @@ func (x *NetworkList) DeepCopyObject() runtime.Object {
 	}
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkSpec) DeepCopyInto(out *NetworkSpec) {
+	*out = *in
+	if in.DNSNameservers != nil {
+		in, out := &in.DNSNameservers, &out.DNSNameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.HostRoutes != nil {
+		in, out := &in.HostRoutes, &out.HostRoutes
+		*out = make([]HostRoute, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllocationPools != nil {
+		in, out := &in.AllocationPools, &out.AllocationPools
+		*out = make([]AllocationPool, len(*in))
+		copy(*out, *in)
+	}
+	if in.EnableDHCP != nil {
+		in, out := &in.EnableDHCP, &out.EnableDHCP
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Subnets != nil {
+		in, out := &in.Subnets, &out.Subnets
+		*out = make([]SubnetSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = new(DNSSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, creating a new NetworkSpec.
+func (x *NetworkSpec) DeepCopy() *NetworkSpec {
+	if x == nil {
+		return nil
+	}
+	out := new(NetworkSpec)
+	x.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DNSSpec) DeepCopyInto(out *DNSSpec) {
+	*out = *in
+	if in.Upstreams != nil {
+		in, out := &in.Upstreams, &out.Upstreams
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StubDomains != nil {
+		in, out := &in.StubDomains, &out.StubDomains
+		*out = make(map[string][]string, len(*in))
+		for key, val := range *in {
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				(*out)[key] = make([]string, len(val))
+				copy((*out)[key], val)
+			}
+		}
+	}
+	return
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, creating a new DNSSpec.
+func (x *DNSSpec) DeepCopy() *DNSSpec {
+	if x == nil {
+		return nil
+	}
+	out := new(DNSSpec)
+	x.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SubnetSpec) DeepCopyInto(out *SubnetSpec) {
+	*out = *in
+	if in.DNSNameservers != nil {
+		in, out := &in.DNSNameservers, &out.DNSNameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.HostRoutes != nil {
+		in, out := &in.HostRoutes, &out.HostRoutes
+		*out = make([]HostRoute, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllocationPools != nil {
+		in, out := &in.AllocationPools, &out.AllocationPools
+		*out = make([]AllocationPool, len(*in))
+		copy(*out, *in)
+	}
+	if in.EnableDHCP != nil {
+		in, out := &in.EnableDHCP, &out.EnableDHCP
+		*out = new(bool)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, creating a new SubnetSpec.
+func (x *SubnetSpec) DeepCopy() *SubnetSpec {
+	if x == nil {
+		return nil
+	}
+	out := new(SubnetSpec)
+	x.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Tenant) DeepCopyInto(out *Tenant) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	out.Status = in.Status
 	return
 }
@@ -141,6 +258,27 @@ func (x *Tenant) DeepCopyObject() runtime.Object {
 	}
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TenantSpec) DeepCopyInto(out *TenantSpec) {
+	*out = *in
+	if in.PasswordSecret != nil {
+		in, out := &in.PasswordSecret, &out.PasswordSecret
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, creating a new TenantSpec.
+func (x *TenantSpec) DeepCopy() *TenantSpec {
+	if x == nil {
+		return nil
+	}
+	out := new(TenantSpec)
+	x.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TenantList) DeepCopyInto(out *TenantList) {
 	*out = *in
@@ -57,6 +57,43 @@ const (
 	TenantTerminating = "Terminating"
 )
 
+// Finalizers of networks and tenants, the objects are kept until their resources
+// in OpenStack are torn down.
+const (
+	// NetworkFinalizer is the finalizer of networks.
+	NetworkFinalizer = GroupName + "/network"
+	// TenantFinalizer is the finalizer of tenants.
+	TenantFinalizer = GroupName + "/tenant"
+)
+
+// These are the steps of tearing down networks in order.
+const (
+	// TeardownLoadBalancers deletes the load balancers on the network.
+	TeardownLoadBalancers = "LoadBalancers"
+	// TeardownFloatingIPs releases the floating IPs of ports on the network.
+	TeardownFloatingIPs = "FloatingIPs"
+	// TeardownPorts deletes the ports of pods on the network.
+	TeardownPorts = "Ports"
+	// TeardownRouterInterfaces removes the subnets of the network from its router.
+	TeardownRouterInterfaces = "RouterInterfaces"
+	// TeardownNetwork deletes the network with its subnets and router.
+	TeardownNetwork = "Network"
+)
+
+// These are the steps of tearing down tenants in order.
+const (
+	// TeardownNetworks deletes the namespace of the tenant and waits for its
+	// networks to be torn down.
+	TeardownNetworks = "Networks"
+	// TeardownUsers deletes the users of the tenant.
+	TeardownUsers = "Users"
+	// TeardownProject deletes the project of the tenant.
+	TeardownProject = "Project"
+)
+
+// TeardownCompleted means all steps of the teardown are done.
+const TeardownCompleted = "Completed"
+
 // Network describes a Neutron network.
 // +k8s:deepcopy-gen=true
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -73,6 +110,7 @@ type Network struct {
 }
 
 // NetworkSpec is the spec of a network.
+// +k8s:deepcopy-gen=true
 type NetworkSpec struct {
 	// The CIDR of the network.
 	CIDR string `json:"cidr"`
@@ -81,6 +119,83 @@ type NetworkSpec struct {
 	// The network ID in Neutron.
 	// If provided, wouldn't create a network in Neutron.
 	NetworkID string `json:"networkID"`
+	// The DNS nameservers of the network.
+	DNSNameservers []string `json:"dnsNameservers,omitempty"`
+	// The host routes pushed to pods on the network.
+	HostRoutes []HostRoute `json:"hostRoutes,omitempty"`
+	// The allocation pools of pod IPs, default to the whole CIDR.
+	AllocationPools []AllocationPool `json:"allocationPools,omitempty"`
+	// Whether DHCP is enabled, default to true.
+	EnableDHCP *bool `json:"enableDHCP,omitempty"`
+	// The IPv6 address mode, one of slaac, dhcpv6-stateful and dhcpv6-stateless.
+	// Only valid for IPv6 CIDR.
+	IPv6AddressMode string `json:"ipv6AddressMode,omitempty"`
+	// The IPv6 router advertisement mode, one of slaac, dhcpv6-stateful and dhcpv6-stateless.
+	// Only valid for IPv6 CIDR.
+	IPv6RAMode string `json:"ipv6RAMode,omitempty"`
+	// Additional subnets of the network, the fields above describe the primary subnet.
+	Subnets []SubnetSpec `json:"subnets,omitempty"`
+	// The DNS server of the namespace, only used on the default network of the namespace.
+	DNS *DNSSpec `json:"dns,omitempty"`
+}
+
+// DNSSpec is the spec of the DNS server of a namespace.
+// +k8s:deepcopy-gen=true
+type DNSSpec struct {
+	// The DNS provider, one of kube-dns and coredns, default to the provider of
+	// stackube-controller.
+	Provider string `json:"provider,omitempty"`
+	// The upstream nameservers resolving names out of the cluster domain, default to
+	// the DNS nameservers of the network, or the nameservers of the node if both are empty.
+	Upstreams []string `json:"upstreams,omitempty"`
+	// The stub domains mapping domains to their nameservers.
+	StubDomains map[string][]string `json:"stubDomains,omitempty"`
+}
+
+// SubnetSpec is the spec of an additional subnet of a network.
+// +k8s:deepcopy-gen=true
+type SubnetSpec struct {
+	// The name of the subnet, which is unique in the network.
+	Name string `json:"name"`
+	// The CIDR of the subnet.
+	CIDR string `json:"cidr"`
+	// The gateway IP, default to the first IP of the CIDR.
+	Gateway string `json:"gateway,omitempty"`
+	// The DNS nameservers of the subnet.
+	DNSNameservers []string `json:"dnsNameservers,omitempty"`
+	// The host routes pushed to pods on the subnet.
+	HostRoutes []HostRoute `json:"hostRoutes,omitempty"`
+	// The allocation pools of pod IPs, default to the whole CIDR.
+	AllocationPools []AllocationPool `json:"allocationPools,omitempty"`
+	// Whether DHCP is enabled, default to true.
+	EnableDHCP *bool `json:"enableDHCP,omitempty"`
+	// The IPv6 address mode, only valid for IPv6 CIDR.
+	IPv6AddressMode string `json:"ipv6AddressMode,omitempty"`
+	// The IPv6 router advertisement mode, only valid for IPv6 CIDR.
+	IPv6RAMode string `json:"ipv6RAMode,omitempty"`
+}
+
+// IPv6 address and router advertisement modes of subnets.
+const (
+	IPv6ModeSLAAC           = "slaac"
+	IPv6ModeDHCPv6Stateful  = "dhcpv6-stateful"
+	IPv6ModeDHCPv6Stateless = "dhcpv6-stateless"
+)
+
+// HostRoute is a static route pushed to pods.
+type HostRoute struct {
+	// The destination CIDR.
+	Destination string `json:"destination"`
+	// The next hop IP.
+	Nexthop string `json:"nexthop"`
+}
+
+// AllocationPool is a range of IPs allocated to pods.
+type AllocationPool struct {
+	// The first IP of the pool.
+	Start string `json:"start"`
+	// The last IP of the pool.
+	End string `json:"end"`
 }
 
 // NetworkStatus is the status of a network.
@@ -89,6 +204,9 @@ type NetworkStatus struct {
 	State string `json:"state,omitempty"`
 	// Message describes why network is in current state.
 	Message string `json:"message,omitempty"`
+	// TeardownStep is the step of tearing down the network, an interrupted
+	// teardown is resumed from it.
+	TeardownStep string `json:"teardownStep,omitempty"`
 }
 
 // NetworkList is a list of networks.
@@ -119,22 +237,41 @@ type Tenant struct {
 }
 
 // TenantSpec is the spec of a tenant.
+// +k8s:deepcopy-gen=true
 type TenantSpec struct {
 	// The username of this user.
 	UserName string `json:"username"`
-	// The password of this user.
-	Password string `json:"password"`
+	// PasswordSecret references the Secret holding the password of this user,
+	// in the password Secret namespace of stackube-controller (kube-system by
+	// default). The Secret is generated if it doesn't exist. If not provided, the
+	// Secret is named <tenant>-password.
+	PasswordSecret *SecretKeyReference `json:"passwordSecret,omitempty"`
+	// Password is the password of this user.
+	// Deprecated: use PasswordSecret. It's only read to generate the password
+	// Secret of tenants created before password Secrets, changing it has no effect.
+	Password string `json:"password,omitempty"`
 	// The tenant ID in Keystone.
 	// If provided, wouldn't create a new tenant in Keystone.
 	TenantID string `json:"tenantID"`
 }
 
+// SecretKeyReference references a key of a Secret.
+type SecretKeyReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+	// Key of the Secret, it's password if not provided.
+	Key string `json:"key,omitempty"`
+}
+
 // TenantStatus is the status of a tenant.
 type TenantStatus struct {
 	// State describes the tenant state.
 	State string `json:"state,omitempty"`
 	// Message describes why tenant is in current state.
 	Message string `json:"message,omitempty"`
+	// TeardownStep is the step of tearing down the tenant, an interrupted
+	// teardown is resumed from it.
+	TeardownStep string `json:"teardownStep,omitempty"`
 }
 
 // TenantList is a list of tenants.
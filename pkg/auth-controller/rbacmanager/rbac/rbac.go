@@ -17,127 +17,215 @@ limitations under the License.
 package rbac
 
 import (
+	"git.openstack.org/openstack/stackube/pkg/util"
+
 	"k8s.io/api/rbac/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// GenerateRoleByNamespace generates default-role which has all the permissions in the namespace.
-func GenerateRoleByNamespace(namespace string) *v1beta1.Role {
-	policyRule := v1beta1.PolicyRule{
-		Verbs:     []string{v1beta1.VerbAll},
-		APIGroups: []string{v1beta1.APIGroupAll},
-		Resources: []string{v1beta1.ResourceAll},
-	}
-	role := &v1beta1.Role{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Role",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "default-role",
-			Namespace: namespace,
-		},
-		Rules: []v1beta1.PolicyRule{policyRule},
-	}
-	return role
+const (
+	// TemplateLabel is set on generated roles and bindings to the name of their
+	// template, objects with it which are no longer generated are deleted.
+	TemplateLabel = "stackube.kubernetes.io/rbac-template"
+	// TenantLabel is set on generated ClusterRoleBindings to the tenant name.
+	TenantLabel = "stackube.kubernetes.io/tenant"
+
+	// KeystonePrefix prefixes the usernames and groups which the authentication
+	// webhook sets for Keystone users, so that they can't clash with other users
+	// and groups of Kubernetes.
+	KeystonePrefix = "keystone:"
+)
+
+// KeystoneUser returns the username of the Keystone user, which is set by the
+// authentication webhook.
+func KeystoneUser(user string) string {
+	return KeystonePrefix + user
 }
 
-// GenerateRoleBinding generates rolebinding which allows user "tenant" has deault-role in the tenant namespace.
-func GenerateRoleBinding(namespace, tenant string) *v1beta1.RoleBinding {
-	subject := v1beta1.Subject{
-		Kind: "User",
-		Name: tenant,
+// ProjectGroup returns the group of users with any role on the Keystone project,
+// which is set by the authentication webhook.
+func ProjectGroup(project string) string {
+	return KeystonePrefix + project
+}
+
+// ProjectRoleGroup returns the group of users with the role on the Keystone project,
+// which is set by the authentication webhook.
+func ProjectRoleGroup(project, role string) string {
+	return ProjectGroup(project) + ":" + role
+}
+
+// BindingName returns the name of the binding generated by the template for the tenant.
+func BindingName(tenant, template string) string {
+	return tenant + "-" + template
+}
+
+// LegacyRoleNames are the names of Roles generated before they were labeled with
+// their templates.
+var LegacyRoleNames = []string{"default-role"}
+
+// LegacyClusterRoleNames are the names of ClusterRoles generated before they were
+// labeled with their templates.
+var LegacyClusterRoleNames = []string{"namespace-creater"}
+
+// LegacyRoleBindingNames returns the names of RoleBindings generated for the tenant
+// before they were labeled with their templates.
+func LegacyRoleBindingNames(tenant string) []string {
+	return []string{BindingName(tenant, "rolebinding"), BindingName(tenant, "rolebinding-sa")}
+}
+
+// LegacyClusterRoleBindingNames returns the names of ClusterRoleBindings generated
+// for the tenant before they were labeled with their templates.
+func LegacyClusterRoleBindingNames(tenant string) []string {
+	return []string{BindingName(tenant, "namespace-creater")}
+}
+
+// generateSubjects generates the subjects of the binding template for the tenant.
+// System namespaces are not tenants of Keystone projects, so Keystone users and
+// groups are never bound in them.
+func generateSubjects(binding BindingTemplate, namespace, tenant string) []v1beta1.Subject {
+	var subjects []v1beta1.Subject
+	if util.IsSystemNamespace(tenant) {
+		binding.TenantUser = false
+		binding.KeystoneRoles = nil
 	}
-	roleRef := v1beta1.RoleRef{
-		APIGroup: "rbac.authorization.k8s.io",
-		Kind:     "Role",
-		Name:     "default-role",
+	if binding.TenantUser {
+		subjects = append(subjects, v1beta1.Subject{
+			Kind: "User",
+			Name: tenant,
+		})
+	}
+	for _, role := range binding.KeystoneRoles {
+		group := ProjectGroup(tenant)
+		if role != AllKeystoneRoles {
+			group = ProjectRoleGroup(tenant, role)
+		}
+		subjects = append(subjects, v1beta1.Subject{
+			Kind: "Group",
+			Name: group,
+		})
 	}
-	roleBinding := &v1beta1.RoleBinding{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "RoleBinding",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      tenant + "-rolebinding",
+	for _, sa := range binding.ServiceAccounts {
+		subjects = append(subjects, v1beta1.Subject{
+			Kind:      "ServiceAccount",
+			Name:      sa,
 			Namespace: namespace,
-		},
-		Subjects: []v1beta1.Subject{subject},
-		RoleRef:  roleRef,
+		})
 	}
-	return roleBinding
+	return subjects
 }
 
-// GenerateServiceAccountRoleBinding generates rolebinding of service account in the namespace.
-func GenerateServiceAccountRoleBinding(namespace, tenant string) *v1beta1.RoleBinding {
-	subject := v1beta1.Subject{
-		Kind:      "ServiceAccount",
-		Name:      "default",
-		Namespace: namespace,
+// generateRoleRef generates the reference of the role the binding template binds.
+func generateRoleRef(binding BindingTemplate) v1beta1.RoleRef {
+	if binding.Role != "" {
+		return v1beta1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     binding.Role,
+		}
 	}
-	roleRef := v1beta1.RoleRef{
+	return v1beta1.RoleRef{
 		APIGroup: "rbac.authorization.k8s.io",
-		Kind:     "Role",
-		Name:     "default-role",
-	}
-	roleBinding := &v1beta1.RoleBinding{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "RoleBinding",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      tenant + "-rolebinding-sa",
-			Namespace: namespace,
-		},
-		Subjects: []v1beta1.Subject{subject},
-		RoleRef:  roleRef,
+		Kind:     "ClusterRole",
+		Name:     binding.ClusterRole,
 	}
-	return roleBinding
 }
 
-// GenerateClusterRole generates namespace-creater ClusterRole which has the permission of namespaces resource.
-func GenerateClusterRole() *v1beta1.ClusterRole {
-	policyRule := v1beta1.PolicyRule{
-		Verbs:     []string{v1beta1.VerbAll},
-		APIGroups: []string{v1beta1.APIGroupAll},
-		Resources: []string{"namespaces"},
+// GenerateRoles generates the Roles of the templates in the namespace.
+func (t *Templates) GenerateRoles(namespace string) []*v1beta1.Role {
+	var roles []*v1beta1.Role
+	for _, template := range t.Roles {
+		roles = append(roles, &v1beta1.Role{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "Role",
+				APIVersion: "rbac.authorization.k8s.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      template.Name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					TemplateLabel: template.Name,
+				},
+			},
+			Rules: template.Rules,
+		})
 	}
+	return roles
+}
 
-	clusterRole := &v1beta1.ClusterRole{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "ClusterRole",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "namespace-creater",
-		},
-		Rules: []v1beta1.PolicyRule{policyRule},
+// GenerateRoleBindings generates the RoleBindings of the templates for the tenant
+// in the namespace, bindings without subjects are omitted.
+func (t *Templates) GenerateRoleBindings(namespace, tenant string) []*v1beta1.RoleBinding {
+	var roleBindings []*v1beta1.RoleBinding
+	for _, template := range t.Bindings {
+		subjects := generateSubjects(template, namespace, tenant)
+		if len(subjects) == 0 {
+			continue
+		}
+		roleBindings = append(roleBindings, &v1beta1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "RoleBinding",
+				APIVersion: "rbac.authorization.k8s.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      BindingName(tenant, template.Name),
+				Namespace: namespace,
+				Labels: map[string]string{
+					TemplateLabel: template.Name,
+				},
+			},
+			Subjects: subjects,
+			RoleRef:  generateRoleRef(template),
+		})
 	}
-	return clusterRole
+	return roleBindings
 }
 
-// GenerateClusterRoleBindingByTenant generate ClusterRoleBinding which allows anyone in the "tenant" group to create namespace.
-func GenerateClusterRoleBindingByTenant(tenant string) *v1beta1.ClusterRoleBinding {
-	subject := v1beta1.Subject{
-		Kind: "Group",
-		Name: tenant,
-	}
-	roleRef := v1beta1.RoleRef{
-		APIGroup: "rbac.authorization.k8s.io",
-		Kind:     "ClusterRole",
-		Name:     "namespace-creater",
+// GenerateClusterRoles generates the ClusterRoles of the templates.
+func (t *Templates) GenerateClusterRoles() []*v1beta1.ClusterRole {
+	var clusterRoles []*v1beta1.ClusterRole
+	for _, template := range t.ClusterRoles {
+		clusterRoles = append(clusterRoles, &v1beta1.ClusterRole{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "ClusterRole",
+				APIVersion: "rbac.authorization.k8s.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: template.Name,
+				Labels: map[string]string{
+					TemplateLabel: template.Name,
+				},
+			},
+			Rules: template.Rules,
+		})
 	}
+	return clusterRoles
+}
 
-	clusterRoleBinding := &v1beta1.ClusterRoleBinding{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "ClusterRoleBinding",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name: tenant + "-namespace-creater",
-		},
-		Subjects: []v1beta1.Subject{subject},
-		RoleRef:  roleRef,
+// GenerateClusterRoleBindings generates the ClusterRoleBindings of the templates for
+// the tenant, whose namespace has the same name. Bindings without subjects are
+// omitted.
+func (t *Templates) GenerateClusterRoleBindings(tenant string) []*v1beta1.ClusterRoleBinding {
+	var clusterRoleBindings []*v1beta1.ClusterRoleBinding
+	for _, template := range t.ClusterBindings {
+		subjects := generateSubjects(template, tenant, tenant)
+		if len(subjects) == 0 {
+			continue
+		}
+		clusterRoleBindings = append(clusterRoleBindings, &v1beta1.ClusterRoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "ClusterRoleBinding",
+				APIVersion: "rbac.authorization.k8s.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: BindingName(tenant, template.Name),
+				Labels: map[string]string{
+					TemplateLabel: template.Name,
+					TenantLabel:   tenant,
+				},
+			},
+			Subjects: subjects,
+			RoleRef:  generateRoleRef(template),
+		})
 	}
-	return clusterRoleBinding
+	return clusterRoleBindings
 }
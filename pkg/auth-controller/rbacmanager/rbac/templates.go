@@ -0,0 +1,209 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbac
+
+import (
+	"fmt"
+
+	"github.com/ghodss/yaml"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/rbac/v1beta1"
+)
+
+const (
+	// TemplatesKey is the key of the templates in the templates ConfigMap.
+	TemplatesKey = "templates.yaml"
+
+	// AllKeystoneRoles binds all users with any role on the project of the tenant.
+	AllKeystoneRoles = "*"
+)
+
+// RoleTemplate is a Role created in the namespace of every tenant, or a
+// ClusterRole created once.
+type RoleTemplate struct {
+	Name  string               `json:"name"`
+	Rules []v1beta1.PolicyRule `json:"rules"`
+}
+
+// BindingTemplate binds a role to the subjects of every tenant. It's named
+// "<tenant>-<name>".
+type BindingTemplate struct {
+	Name string `json:"name"`
+	// Role is the name of a role template, ClusterRole is the name of a
+	// ClusterRole, exactly one of them is set. Cluster bindings only bind
+	// ClusterRoles.
+	Role        string `json:"role,omitempty"`
+	ClusterRole string `json:"clusterRole,omitempty"`
+	// KeystoneRoles binds the users with the Keystone roles on the project of
+	// the tenant, "*" binds all users of the project.
+	KeystoneRoles []string `json:"keystoneRoles,omitempty"`
+	// TenantUser binds the user of the tenant.
+	TenantUser bool `json:"tenantUser,omitempty"`
+	// ServiceAccounts binds the service accounts in the namespace of the tenant.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+// Templates are the roles and bindings every tenant gets.
+type Templates struct {
+	// Roles are created in the namespace of every tenant.
+	Roles []RoleTemplate `json:"roles,omitempty"`
+	// ClusterRoles are created once and shared by tenants.
+	ClusterRoles []RoleTemplate `json:"clusterRoles,omitempty"`
+	// Bindings are RoleBindings created in the namespace of every tenant.
+	Bindings []BindingTemplate `json:"bindings,omitempty"`
+	// ClusterBindings are ClusterRoleBindings created for every tenant.
+	ClusterBindings []BindingTemplate `json:"clusterBindings,omitempty"`
+}
+
+// DefaultTemplates returns the templates used if no templates are configured:
+// all users of the project and the default service account have all the
+// permissions in the namespace, and all users of the project could create
+// namespaces.
+func DefaultTemplates() *Templates {
+	return &Templates{
+		Roles: []RoleTemplate{
+			{
+				Name: "default-role",
+				Rules: []v1beta1.PolicyRule{{
+					Verbs:     []string{v1beta1.VerbAll},
+					APIGroups: []string{v1beta1.APIGroupAll},
+					Resources: []string{v1beta1.ResourceAll},
+				}},
+			},
+		},
+		ClusterRoles: []RoleTemplate{
+			{
+				Name: "namespace-creater",
+				Rules: []v1beta1.PolicyRule{{
+					Verbs:     []string{v1beta1.VerbAll},
+					APIGroups: []string{v1beta1.APIGroupAll},
+					Resources: []string{"namespaces"},
+				}},
+			},
+		},
+		Bindings: []BindingTemplate{
+			{
+				Name:          "rolebinding",
+				Role:          "default-role",
+				KeystoneRoles: []string{AllKeystoneRoles},
+				TenantUser:    true,
+			},
+			{
+				Name:            "rolebinding-sa",
+				Role:            "default-role",
+				ServiceAccounts: []string{"default"},
+			},
+		},
+		ClusterBindings: []BindingTemplate{
+			{
+				Name:          "namespace-creater",
+				ClusterRole:   "namespace-creater",
+				KeystoneRoles: []string{AllKeystoneRoles},
+			},
+		},
+	}
+}
+
+// ParseTemplates parses the templates in YAML or JSON and validates them.
+func ParseTemplates(data []byte) (*Templates, error) {
+	templates := &Templates{}
+	if err := yaml.Unmarshal(data, templates); err != nil {
+		return nil, fmt.Errorf("failed parse RBAC templates: %v", err)
+	}
+	if err := templates.validate(); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// TemplatesFromConfigMap parses the templates in the ConfigMap, the default
+// templates are returned if the ConfigMap is nil.
+func TemplatesFromConfigMap(configMap *apiv1.ConfigMap) (*Templates, error) {
+	if configMap == nil {
+		return DefaultTemplates(), nil
+	}
+
+	data, ok := configMap.Data[TemplatesKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no %s", configMap.Namespace, configMap.Name, TemplatesKey)
+	}
+	return ParseTemplates([]byte(data))
+}
+
+func (t *Templates) validate() error {
+	roles := make(map[string]bool)
+	for _, role := range t.Roles {
+		if role.Name == "" {
+			return fmt.Errorf("role template has no name")
+		}
+		if roles[role.Name] {
+			return fmt.Errorf("role template %q is given more than once", role.Name)
+		}
+		roles[role.Name] = true
+	}
+
+	clusterRoles := make(map[string]bool)
+	for _, role := range t.ClusterRoles {
+		if role.Name == "" {
+			return fmt.Errorf("cluster role template has no name")
+		}
+		if clusterRoles[role.Name] {
+			return fmt.Errorf("cluster role template %q is given more than once", role.Name)
+		}
+		clusterRoles[role.Name] = true
+	}
+
+	bindings := make(map[string]bool)
+	for _, binding := range t.Bindings {
+		if err := validateBinding(binding, bindings); err != nil {
+			return err
+		}
+		if (binding.Role == "") == (binding.ClusterRole == "") {
+			return fmt.Errorf("binding template %q must set exactly one of role and clusterRole", binding.Name)
+		}
+		if binding.Role != "" && !roles[binding.Role] {
+			return fmt.Errorf("binding template %q references unknown role template %q", binding.Name, binding.Role)
+		}
+	}
+
+	clusterBindings := make(map[string]bool)
+	for _, binding := range t.ClusterBindings {
+		if err := validateBinding(binding, clusterBindings); err != nil {
+			return err
+		}
+		if binding.Role != "" || binding.ClusterRole == "" {
+			return fmt.Errorf("cluster binding template %q must only set clusterRole", binding.Name)
+		}
+	}
+
+	return nil
+}
+
+func validateBinding(binding BindingTemplate, names map[string]bool) error {
+	if binding.Name == "" {
+		return fmt.Errorf("binding template has no name")
+	}
+	if names[binding.Name] {
+		return fmt.Errorf("binding template %q is given more than once", binding.Name)
+	}
+	names[binding.Name] = true
+
+	if len(binding.KeystoneRoles) == 0 && !binding.TenantUser && len(binding.ServiceAccounts) == 0 {
+		return fmt.Errorf("binding template %q has no subjects", binding.Name)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbac
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseTemplates(t *testing.T) {
+	testCases := []struct {
+		name      string
+		data      string
+		expectErr bool
+	}{
+		{
+			name: "valid templates",
+			data: `
+roles:
+- name: auditor
+  rules:
+  - apiGroups: ["*"]
+    resources: ["*"]
+    verbs: ["get", "list", "watch"]
+bindings:
+- name: auditors
+  role: auditor
+  keystoneRoles: ["auditor"]
+clusterBindings:
+- name: viewers
+  clusterRole: view
+  tenantUser: true
+`,
+		},
+		{
+			name:      "unknown role template",
+			data:      "bindings:\n- name: foo\n  role: missing\n  tenantUser: true\n",
+			expectErr: true,
+		},
+		{
+			name:      "both role and cluster role",
+			data:      "roles:\n- name: r\nbindings:\n- name: foo\n  role: r\n  clusterRole: view\n  tenantUser: true\n",
+			expectErr: true,
+		},
+		{
+			name:      "cluster binding of role",
+			data:      "roles:\n- name: r\nclusterBindings:\n- name: foo\n  role: r\n  tenantUser: true\n",
+			expectErr: true,
+		},
+		{
+			name:      "binding without subjects",
+			data:      "bindings:\n- name: foo\n  clusterRole: view\n",
+			expectErr: true,
+		},
+		{
+			name:      "duplicated binding",
+			data:      "bindings:\n- name: foo\n  clusterRole: view\n  tenantUser: true\n- name: foo\n  clusterRole: edit\n  tenantUser: true\n",
+			expectErr: true,
+		},
+		{
+			name:      "malformed",
+			data:      "roles: foo",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := ParseTemplates([]byte(tc.data))
+		if tc.expectErr && err == nil {
+			t.Errorf("%s: expected error, got nil", tc.name)
+		} else if !tc.expectErr && err != nil {
+			t.Errorf("%s: expected success, got error %v", tc.name, err)
+		}
+	}
+}
+
+func TestDefaultTemplatesRoundTrip(t *testing.T) {
+	data, err := json.Marshal(DefaultTemplates())
+	if err != nil {
+		t.Fatalf("Failed marshal default templates: %v", err)
+	}
+	templates, err := ParseTemplates(data)
+	if err != nil {
+		t.Fatalf("Failed parse default templates: %v", err)
+	}
+	if !reflect.DeepEqual(templates, DefaultTemplates()) {
+		t.Errorf("Expected default templates %v, got %v", DefaultTemplates(), templates)
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package rbacmanager
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
@@ -26,6 +28,7 @@ import (
 
 	"github.com/golang/glog"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/rbac/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
@@ -44,16 +47,33 @@ type Controller struct {
 	kubeCRDClient crdClient.Interface
 	userCIDR      string
 	userGateway   string
+	// templatesNamespace and templatesName are the ConfigMap of RBAC templates.
+	templatesNamespace string
+	templatesName      string
+	templatesLock      sync.RWMutex
+	templates          *rbac.Templates
+	// namespaceStore caches namespaces to reconcile them when templates change.
+	namespaceStore cache.Store
 }
 
-// NewRBACController creates a new RBAC controller.
+// NewRBACController creates a new RBAC controller. The roles and bindings of tenants
+// are generated from the templates in the rbacTemplates ConfigMap, given as
+// "namespace/name".
 func NewRBACController(kubeClient kubernetes.Interface, kubeCRDClient crdClient.Interface, userCIDR string,
-	userGateway string) (*Controller, error) {
+	userGateway string, rbacTemplates string) (*Controller, error) {
+	templatesNamespace, templatesName, err := cache.SplitMetaNamespaceKey(rbacTemplates)
+	if err != nil || templatesNamespace == "" || templatesName == "" {
+		return nil, fmt.Errorf("invalid RBAC templates ConfigMap %q, expected namespace/name", rbacTemplates)
+	}
+
 	c := &Controller{
-		k8sclient:     kubeClient,
-		kubeCRDClient: kubeCRDClient,
-		userCIDR:      userCIDR,
-		userGateway:   userGateway,
+		k8sclient:          kubeClient,
+		kubeCRDClient:      kubeCRDClient,
+		userCIDR:           userCIDR,
+		userGateway:        userGateway,
+		templatesNamespace: templatesNamespace,
+		templatesName:      templatesName,
+		templates:          rbac.DefaultTemplates(),
 	}
 
 	return c, nil
@@ -63,13 +83,24 @@ func NewRBACController(kubeClient kubernetes.Interface, kubeCRDClient crdClient.
 func (c *Controller) Run(stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 
+	// Load templates before syncing namespaces, so that they don't get the
+	// default templates first.
+	if err := c.loadTemplates(); err != nil {
+		glog.Errorf("Failed load RBAC templates from ConfigMap %s/%s, using the default ones: %v",
+			c.templatesNamespace, c.templatesName, err)
+	}
+	if err := c.syncClusterRoles(); err != nil {
+		glog.Errorf("Failed sync ClusterRoles: %v", err)
+	}
+
 	source := cache.NewListWatchFromClient(
 		c.k8sclient.Core().RESTClient(),
 		"namespaces",
 		apiv1.NamespaceAll,
 		fields.Everything())
 
-	_, namespaceInformor := cache.NewInformer(
+	var namespaceInformor cache.Controller
+	c.namespaceStore, namespaceInformor = cache.NewInformer(
 		source,
 		&apiv1.Namespace{},
 		resyncPeriod,
@@ -79,7 +110,30 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 			DeleteFunc: c.onDelete,
 		})
 
+	templatesSource := cache.NewListWatchFromClient(
+		c.k8sclient.CoreV1().RESTClient(),
+		"configmaps",
+		c.templatesNamespace,
+		fields.OneTermEqualSelector("metadata.name", c.templatesName))
+
+	_, templatesInformer := cache.NewInformer(
+		templatesSource,
+		&apiv1.ConfigMap{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.onTemplatesUpdate(obj.(*apiv1.ConfigMap))
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				c.onTemplatesUpdate(newObj.(*apiv1.ConfigMap))
+			},
+			DeleteFunc: func(obj interface{}) {
+				c.onTemplatesUpdate(nil)
+			},
+		})
+
 	go namespaceInformor.Run(stopCh)
+	go templatesInformer.Run(stopCh)
 	<-stopCh
 	return nil
 }
@@ -102,7 +156,7 @@ func (c *Controller) onAdd(obj interface{}) {
 	}
 	glog.V(4).Infof("Added namespace %s", namespace.Name)
 
-	c.syncRBAC(namespace)
+	c.syncRBAC(namespace, nil)
 }
 
 // createNetworkForTenant automatically create network for given non-system tenant
@@ -135,9 +189,9 @@ func (c *Controller) initSystemReservedTenantNetwork() error {
 			// always add tenant to system namespace
 			Namespace: util.SystemTenant,
 		},
+		// The password is generated by tenant controller.
 		Spec: crv1.TenantSpec{
 			UserName: util.SystemTenant,
-			Password: util.SystemPassword,
 		},
 	}
 
@@ -145,9 +199,7 @@ func (c *Controller) initSystemReservedTenantNetwork() error {
 		return err
 	}
 
-	// NOTE(harry): we do not support update Network, so although configurable,
-	// user can not update CIDR by changing the configuration, unless manually delete
-	// that system network. We may need to document this.
+	// Changes of the configured CIDR and gateway are synced by onUpdate.
 	network := &crv1.Network{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      util.SystemNetwork,
@@ -168,7 +220,41 @@ func (c *Controller) initSystemReservedTenantNetwork() error {
 }
 
 func (c *Controller) onUpdate(obj1, obj2 interface{}) {
-	// NOTE(mozhuli) not supported yet
+	namespace := obj2.(*apiv1.Namespace)
+
+	// All system namespaces share the system network, only sync it once.
+	if namespace.Name == util.SystemTenant {
+		if err := c.syncSystemNetwork(); err != nil {
+			glog.Error(err)
+		}
+	}
+
+	// Resyncs restore the generated roles and bindings which were changed or
+	// deleted by others.
+	c.syncRBAC(namespace, nil)
+}
+
+// syncSystemNetwork updates the system network with the configured CIDR and gateway,
+// the changes are applied to Neutron by network controller.
+func (c *Controller) syncSystemNetwork() error {
+	network, err := c.kubeCRDClient.GetNetwork(util.SystemTenant, util.SystemNetwork)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return c.initSystemReservedTenantNetwork()
+		}
+		return err
+	}
+
+	if network.Spec.CIDR == c.userCIDR && network.Spec.Gateway == c.userGateway {
+		return nil
+	}
+
+	glog.V(3).Infof("Updating system network from %s(gateway %s) to %s(gateway %s)",
+		network.Spec.CIDR, network.Spec.Gateway, c.userCIDR, c.userGateway)
+	networkCopy := network.DeepCopy()
+	networkCopy.Spec.CIDR = c.userCIDR
+	networkCopy.Spec.Gateway = c.userGateway
+	return c.kubeCRDClient.UpdateNetwork(networkCopy)
 }
 
 func (c *Controller) onDelete(obj interface{}) {
@@ -177,35 +263,40 @@ func (c *Controller) onDelete(obj interface{}) {
 	glog.V(3).Infof("RBAC controller received deleted namespace %#v\n", namespace)
 }
 
-func (c *Controller) syncRBAC(ns *apiv1.Namespace) error {
+// syncRBAC reconciles the roles and bindings generated from templates for the
+// tenant of the namespace, which has the same name. ClusterRoleBindings are only
+// generated for namespaces of Tenants, the existing ClusterRoleBindings are listed
+// if not given.
+func (c *Controller) syncRBAC(ns *apiv1.Namespace, clusterRoleBindings *v1beta1.ClusterRoleBindingList) error {
 	if ns.DeletionTimestamp != nil {
 		return nil
 	}
-	rbacClient := c.k8sclient.Rbac()
+	templates := c.getTemplates()
 
-	// Create role for tenant
-	role := rbac.GenerateRoleByNamespace(ns.Name)
-	_, err := rbacClient.Roles(ns.Name).Create(role)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		glog.Errorf("Failed create default-role in namespace %s for tenant %s: %v", ns.Name, ns.Name, err)
+	if err := c.syncRoles(ns.Name, templates.GenerateRoles(ns.Name)); err != nil {
+		glog.Errorf("Failed sync Roles in namespace %s: %v", ns.Name, err)
+		return err
+	}
+	if err := c.syncRoleBindings(ns.Name, ns.Name, templates.GenerateRoleBindings(ns.Name, ns.Name)); err != nil {
+		glog.Errorf("Failed sync RoleBindings in namespace %s for tenant %s: %v", ns.Name, ns.Name, err)
 		return err
 	}
-	glog.V(4).Infof("Created default-role in namespace %s for tenant %s", ns.Name, ns.Name)
+	glog.V(4).Infof("Synced RBAC in namespace %s for tenant %s", ns.Name, ns.Name)
 
-	// Create rolebinding for tenant
-	roleBinding := rbac.GenerateRoleBinding(ns.Name, ns.Name)
-	_, err = rbacClient.RoleBindings(ns.Name).Create(roleBinding)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		glog.Errorf("Failed create %s-rolebindings in namespace %s for tenant %s: %v", ns.Name, ns.Name, ns.Name, err)
+	tenant, err := c.kubeCRDClient.GetTenant(ns.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
-	saRoleBinding := rbac.GenerateServiceAccountRoleBinding(ns.Name, ns.Name)
-	_, err = rbacClient.RoleBindings(ns.Name).Create(saRoleBinding)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		glog.Errorf("Failed create %s-rolebindings-sa in namespace %s for tenant %s: %v", ns.Name, ns.Name, ns.Name, err)
+	// ClusterRoleBindings of deleted tenants are deleted by tenant controller.
+	if tenant.DeletionTimestamp != nil {
+		return nil
+	}
+	if err := c.syncClusterRoleBindings(tenant.Name, templates.GenerateClusterRoleBindings(tenant.Name), clusterRoleBindings); err != nil {
+		glog.Errorf("Failed sync ClusterRoleBindings for tenant %s: %v", tenant.Name, err)
 		return err
 	}
-
-	glog.V(4).Infof("Created %s-rolebindings in namespace %s for tenant %s", ns.Name, ns.Name, ns.Name)
 	return nil
 }
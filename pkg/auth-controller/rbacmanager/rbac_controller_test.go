@@ -26,13 +26,17 @@ import (
 	crdClient "git.openstack.org/openstack/stackube/pkg/kubecrd"
 	"git.openstack.org/openstack/stackube/pkg/util"
 	"k8s.io/api/core/v1"
+	"k8s.io/api/rbac/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	userCIDR    = "10.244.0.0/16"
-	userGateway = "10.244.0.1"
+	userCIDR      = "10.244.0.0/16"
+	userGateway   = "10.244.0.1"
+	rbacTemplates = "kube-system/stackube-rbac-templates"
 )
 
 var systemTenant = &crv1.Tenant{
@@ -42,7 +46,6 @@ var systemTenant = &crv1.Tenant{
 	},
 	Spec: crv1.TenantSpec{
 		UserName: util.SystemTenant,
-		Password: util.SystemPassword,
 	},
 }
 
@@ -86,7 +89,10 @@ func newController() (*Controller, *crdClient.FakeCRDClient, *fake.Clientset, er
 		return nil, nil, nil, err
 	}
 
-	controller, _ := NewRBACController(client, kubeCRDClient, userCIDR, userGateway)
+	controller, err := NewRBACController(client, kubeCRDClient, userCIDR, userGateway, rbacTemplates)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	return controller, kubeCRDClient, client, nil
 }
@@ -238,25 +244,48 @@ func TestInitSystemReservedTenantNetwork(t *testing.T) {
 	}
 }
 
-func testRBAC(t *testing.T, client *fake.Clientset, namespace string) {
-	roleBinding, err := client.Rbac().RoleBindings(namespace).Get(namespace+"-rolebinding", metav1.GetOptions{})
+func TestSyncSystemNetwork(t *testing.T) {
+	controller, kubeCRDClient, _, err := newController()
 	if err != nil {
-		t.Fatalf("Failed get roleBindings: %v", err)
+		t.Fatalf("Failed start a new fake controller: %v", err)
 	}
 
-	if !reflect.DeepEqual(roleBinding, rbac.GenerateRoleBinding(namespace, namespace)) {
-		t.Errorf("Created rolebinding has incorrect parameters: %v", roleBinding)
+	// Inject system network with outdated CIDR.
+	network := systemNetwork.DeepCopy()
+	network.Spec.CIDR = "10.244.0.0/24"
+	kubeCRDClient.SetNetworks(network)
+
+	if err := controller.syncSystemNetwork(); err != nil {
+		t.Fatalf("Failed sync system network: %v", err)
 	}
 
-	saroleBinding, err := client.Rbac().RoleBindings(namespace).Get(namespace+"-rolebinding-sa", metav1.GetOptions{})
-	if err != nil {
-		t.Fatalf("Failed get ServiceAccount roleBindings: %v", err)
+	updated := kubeCRDClient.Networks[util.SystemNetwork]
+	if updated.Spec.CIDR != userCIDR || updated.Spec.Gateway != userGateway {
+		t.Errorf("Expected system network to be updated to %s, got %v", userCIDR, updated.Spec)
 	}
+}
 
-	if !reflect.DeepEqual(saroleBinding, rbac.GenerateServiceAccountRoleBinding(namespace, namespace)) {
-		t.Errorf("Created rolebinding has incorrect parameters: %v", saroleBinding)
+func testRBAC(t *testing.T, client *fake.Clientset, namespace string) {
+	templates := rbac.DefaultTemplates()
+	for _, expected := range templates.GenerateRoles(namespace) {
+		role, err := client.Rbac().Roles(namespace).Get(expected.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed get role %s: %v", expected.Name, err)
+		}
+		if !reflect.DeepEqual(role, expected) {
+			t.Errorf("Created role has incorrect parameters: %v", role)
+		}
 	}
 
+	for _, expected := range templates.GenerateRoleBindings(namespace, namespace) {
+		roleBinding, err := client.Rbac().RoleBindings(namespace).Get(expected.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed get roleBinding %s: %v", expected.Name, err)
+		}
+		if !reflect.DeepEqual(roleBinding, expected) {
+			t.Errorf("Created rolebinding has incorrect parameters: %v", roleBinding)
+		}
+	}
 }
 
 func TestSyncRBAC(t *testing.T) {
@@ -267,8 +296,178 @@ func TestSyncRBAC(t *testing.T) {
 		t.Fatalf("Failed start a new fake controller: %v", err)
 	}
 	ns := newNamespace(testNamespace)
-	controller.syncRBAC(ns)
+	controller.syncRBAC(ns, nil)
+	testRBAC(t, client, testNamespace)
+}
+
+func TestSyncRBACSystemNamespace(t *testing.T) {
+	controller, _, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+	if err := controller.syncRBAC(newNamespace(metav1.NamespaceSystem), nil); err != nil {
+		t.Fatalf("Failed sync RBAC: %v", err)
+	}
+
+	roleBindings, err := client.Rbac().RoleBindings(metav1.NamespaceSystem).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed list rolebindings: %v", err)
+	}
+	if len(roleBindings.Items) != 1 || roleBindings.Items[0].Name != metav1.NamespaceSystem+"-rolebinding-sa" {
+		t.Fatalf("Expected only rolebinding-sa in system namespace, got %v", roleBindings.Items)
+	}
+	for _, subject := range roleBindings.Items[0].Subjects {
+		if subject.Kind != "ServiceAccount" {
+			t.Errorf("Unexpected subject %v bound in system namespace", subject)
+		}
+	}
+}
+
+func TestSyncRBACUpdatesLegacyBindings(t *testing.T) {
+	testNamespace := "test"
+	controller, _, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+
+	// Inject unlabeled rolebinding which only binds the tenant user.
+	roleBinding := rbac.DefaultTemplates().GenerateRoleBindings(testNamespace, testNamespace)[0]
+	roleBinding.Labels = nil
+	roleBinding.Subjects = roleBinding.Subjects[:1]
+	if _, err := client.Rbac().RoleBindings(testNamespace).Create(roleBinding); err != nil {
+		t.Fatalf("Failed create rolebinding: %v", err)
+	}
+
+	if err := controller.syncRBAC(newNamespace(testNamespace), nil); err != nil {
+		t.Fatalf("Failed sync RBAC: %v", err)
+	}
+	testRBAC(t, client, testNamespace)
+}
+
+func TestSyncClusterRoles(t *testing.T) {
+	controller, _, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+	if err := controller.syncClusterRoles(); err != nil {
+		t.Fatalf("Failed sync cluster roles: %v", err)
+	}
+
+	for _, expected := range rbac.DefaultTemplates().GenerateClusterRoles() {
+		clusterRole, err := client.Rbac().ClusterRoles().Get(expected.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed get cluster role %s: %v", expected.Name, err)
+		}
+		if !reflect.DeepEqual(clusterRole, expected) {
+			t.Errorf("Created cluster role has incorrect parameters: %v", clusterRole)
+		}
+	}
+}
+
+const auditorTemplates = `
+roles:
+- name: auditor
+  rules:
+  - apiGroups: ["*"]
+    resources: ["*"]
+    verbs: ["get", "list", "watch"]
+bindings:
+- name: auditors
+  role: auditor
+  keystoneRoles: ["auditor"]
+- name: ci
+  clusterRole: edit
+  serviceAccounts: ["ci"]
+clusterBindings:
+- name: viewers
+  clusterRole: view
+  keystoneRoles: ["*"]
+`
+
+func TestReconcileTemplates(t *testing.T) {
+	testNamespace := "test"
+	controller, kubeCRDClient, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+	kubeCRDClient.SetTenants(&crv1.Tenant{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testNamespace,
+			Namespace: util.SystemTenant,
+		},
+	})
+	ns := newNamespace(testNamespace)
+	controller.namespaceStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	controller.namespaceStore.Add(ns)
+
+	// Sync with the default templates.
+	if err := controller.syncClusterRoles(); err != nil {
+		t.Fatalf("Failed sync cluster roles: %v", err)
+	}
+	if err := controller.syncRBAC(ns, nil); err != nil {
+		t.Fatalf("Failed sync RBAC: %v", err)
+	}
 	testRBAC(t, client, testNamespace)
+	if _, err := client.Rbac().ClusterRoleBindings().Get(testNamespace+"-namespace-creater", metav1.GetOptions{}); err != nil {
+		t.Fatalf("Failed get cluster role binding: %v", err)
+	}
+
+	// Invalid templates are ignored.
+	controller.onTemplatesUpdate(&v1.ConfigMap{
+		Data: map[string]string{rbac.TemplatesKey: "bindings:\n- name: foo\n  role: missing\n"},
+	})
+	if !reflect.DeepEqual(controller.getTemplates(), rbac.DefaultTemplates()) {
+		t.Errorf("Expected invalid templates to be ignored, got %v", controller.getTemplates())
+	}
+
+	controller.onTemplatesUpdate(&v1.ConfigMap{
+		Data: map[string]string{rbac.TemplatesKey: auditorTemplates},
+	})
+
+	// Obsolete roles and bindings are deleted.
+	if _, err := client.Rbac().Roles(testNamespace).Get("default-role", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected default-role to be deleted, got %v", err)
+	}
+	for _, name := range []string{testNamespace + "-rolebinding", testNamespace + "-rolebinding-sa"} {
+		if _, err := client.Rbac().RoleBindings(testNamespace).Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("Expected rolebinding %s to be deleted, got %v", name, err)
+		}
+	}
+	if _, err := client.Rbac().ClusterRoles().Get("namespace-creater", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected cluster role namespace-creater to be deleted, got %v", err)
+	}
+	if _, err := client.Rbac().ClusterRoleBindings().Get(testNamespace+"-namespace-creater", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected cluster role binding to be deleted, got %v", err)
+	}
+
+	// Roles and bindings of the new templates are created.
+	if _, err := client.Rbac().Roles(testNamespace).Get("auditor", metav1.GetOptions{}); err != nil {
+		t.Errorf("Failed get role auditor: %v", err)
+	}
+	roleBinding, err := client.Rbac().RoleBindings(testNamespace).Get(testNamespace+"-auditors", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get rolebinding: %v", err)
+	}
+	expectedSubjects := []v1beta1.Subject{{Kind: "Group", Name: "keystone:" + testNamespace + ":auditor"}}
+	if !reflect.DeepEqual(roleBinding.Subjects, expectedSubjects) {
+		t.Errorf("Expected subjects %v, got %v", expectedSubjects, roleBinding.Subjects)
+	}
+	roleBinding, err = client.Rbac().RoleBindings(testNamespace).Get(testNamespace+"-ci", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get rolebinding: %v", err)
+	}
+	expectedSubjects = []v1beta1.Subject{{Kind: "ServiceAccount", Name: "ci", Namespace: testNamespace}}
+	if roleBinding.RoleRef.Kind != "ClusterRole" || roleBinding.RoleRef.Name != "edit" || !reflect.DeepEqual(roleBinding.Subjects, expectedSubjects) {
+		t.Errorf("Created rolebinding has incorrect parameters: %v", roleBinding)
+	}
+	clusterRoleBinding, err := client.Rbac().ClusterRoleBindings().Get(testNamespace+"-viewers", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get cluster role binding: %v", err)
+	}
+	expectedSubjects = []v1beta1.Subject{{Kind: "Group", Name: "keystone:" + testNamespace}}
+	if clusterRoleBinding.Labels[rbac.TenantLabel] != testNamespace || !reflect.DeepEqual(clusterRoleBinding.Subjects, expectedSubjects) {
+		t.Errorf("Created cluster role binding has incorrect parameters: %v", clusterRoleBinding)
+	}
 }
 
 func TestOnAdd(t *testing.T) {
@@ -432,3 +631,57 @@ func TestOnAdd(t *testing.T) {
 		tc.expectedFn(tc.namespace)
 	}
 }
+
+func TestOnUpdateResyncsRBAC(t *testing.T) {
+	testNamespace := "test"
+	controller, _, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+	ns := newNamespace(testNamespace)
+	if err := controller.syncRBAC(ns, nil); err != nil {
+		t.Fatalf("Failed sync RBAC: %v", err)
+	}
+
+	// Generated rolebindings deleted by others are restored on resync.
+	if err := client.Rbac().RoleBindings(testNamespace).Delete(testNamespace+"-rolebinding", &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed delete rolebinding: %v", err)
+	}
+	controller.onUpdate(ns, ns)
+	testRBAC(t, client, testNamespace)
+}
+
+func TestReconcileAllListsClusterRoleBindingsOnce(t *testing.T) {
+	controller, kubeCRDClient, client, err := newController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake controller: %v", err)
+	}
+	controller.namespaceStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, name := range []string{"test1", "test2", "test3"} {
+		kubeCRDClient.SetTenants(&crv1.Tenant{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: util.SystemTenant,
+			},
+		})
+		controller.namespaceStore.Add(newNamespace(name))
+	}
+
+	client.ClearActions()
+	controller.reconcileAll()
+
+	lists := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "clusterrolebindings" {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("Expected ClusterRoleBindings to be listed once, got %d", lists)
+	}
+	for _, name := range []string{"test1", "test2", "test3"} {
+		if _, err := client.Rbac().ClusterRoleBindings().Get(name+"-namespace-creater", metav1.GetOptions{}); err != nil {
+			t.Errorf("Failed get cluster role binding of %s: %v", name, err)
+		}
+	}
+}
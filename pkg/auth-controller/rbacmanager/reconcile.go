@@ -0,0 +1,355 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbacmanager
+
+import (
+	"fmt"
+	"reflect"
+
+	"git.openstack.org/openstack/stackube/pkg/auth-controller/rbacmanager/rbac"
+
+	"github.com/golang/glog"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/rbac/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// getTemplates returns the current RBAC templates.
+func (c *Controller) getTemplates() *rbac.Templates {
+	c.templatesLock.RLock()
+	defer c.templatesLock.RUnlock()
+	return c.templates
+}
+
+// loadTemplates loads the RBAC templates from the templates ConfigMap, the default
+// templates are used if it doesn't exist.
+func (c *Controller) loadTemplates() error {
+	configMap, err := c.k8sclient.CoreV1().ConfigMaps(c.templatesNamespace).Get(c.templatesName, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		configMap = nil
+	}
+
+	templates, err := rbac.TemplatesFromConfigMap(configMap)
+	if err != nil {
+		return err
+	}
+	c.templatesLock.Lock()
+	c.templates = templates
+	c.templatesLock.Unlock()
+	return nil
+}
+
+// onTemplatesUpdate reconciles all namespaces with the changed templates, invalid
+// templates are ignored and the previous ones are kept.
+func (c *Controller) onTemplatesUpdate(configMap *apiv1.ConfigMap) {
+	templates, err := rbac.TemplatesFromConfigMap(configMap)
+	if err != nil {
+		glog.Errorf("Invalid RBAC templates in ConfigMap %s/%s, keeping the previous ones: %v",
+			c.templatesNamespace, c.templatesName, err)
+		return
+	}
+	if reflect.DeepEqual(templates, c.getTemplates()) {
+		return
+	}
+
+	c.templatesLock.Lock()
+	c.templates = templates
+	c.templatesLock.Unlock()
+	glog.V(3).Infof("RBAC templates changed, reconciling all namespaces")
+	c.reconcileAll()
+}
+
+// reconcileAll reconciles the ClusterRoles and the RBAC of all namespaces with
+// the templates.
+func (c *Controller) reconcileAll() {
+	if err := c.syncClusterRoles(); err != nil {
+		glog.Errorf("Failed sync ClusterRoles: %v", err)
+	}
+	if c.namespaceStore == nil {
+		return
+	}
+	// ClusterRoleBindings are listed once for all namespaces, each sync only
+	// deletes the ones of its own tenant.
+	clusterRoleBindings, err := c.k8sclient.Rbac().ClusterRoleBindings().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Failed list ClusterRoleBindings: %v", err)
+		return
+	}
+	for _, obj := range c.namespaceStore.List() {
+		ns := obj.(*apiv1.Namespace)
+		if err := c.syncRBAC(ns, clusterRoleBindings); err != nil {
+			glog.Errorf("Failed sync RBAC of namespace %s: %v", ns.Name, err)
+		}
+	}
+}
+
+// isGenerated returns true if the object was generated from templates, either
+// labeled with its template or named as generated before labels.
+func isGenerated(meta metav1.ObjectMeta, legacyNames []string) bool {
+	if _, ok := meta.Labels[rbac.TemplateLabel]; ok {
+		return true
+	}
+	for _, name := range legacyNames {
+		if meta.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isTenantClusterRoleBinding returns true if the ClusterRoleBinding was generated
+// for the tenant, either labeled with the tenant or named as generated for it
+// before labels.
+func isTenantClusterRoleBinding(meta metav1.ObjectMeta, tenant string) bool {
+	if owner, ok := meta.Labels[rbac.TenantLabel]; ok {
+		return owner == tenant
+	}
+	return isGenerated(meta, rbac.LegacyClusterRoleBindingNames(tenant))
+}
+
+// mergeLabels returns the existing labels with the desired ones, and whether they
+// changed.
+func mergeLabels(existing, desired map[string]string) (map[string]string, bool) {
+	merged := make(map[string]string)
+	for k, v := range existing {
+		merged[k] = v
+	}
+	changed := false
+	for k, v := range desired {
+		if merged[k] != v {
+			merged[k] = v
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+// syncRoles creates or updates the Roles in the namespace, and deletes the
+// generated Roles which are obsolete.
+func (c *Controller) syncRoles(namespace string, roles []*v1beta1.Role) error {
+	client := c.k8sclient.Rbac().Roles(namespace)
+	desired := make(map[string]bool)
+	for _, role := range roles {
+		desired[role.Name] = true
+		existing, err := client.Get(role.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if _, err := client.Create(role); err != nil {
+				return fmt.Errorf("failed create Role %s/%s: %v", namespace, role.Name, err)
+			}
+			glog.V(4).Infof("Created Role %s/%s", namespace, role.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		labels, changed := mergeLabels(existing.Labels, role.Labels)
+		if !changed && reflect.DeepEqual(existing.Rules, role.Rules) {
+			continue
+		}
+		existingCopy := existing.DeepCopy()
+		existingCopy.Labels = labels
+		existingCopy.Rules = role.Rules
+		if _, err := client.Update(existingCopy); err != nil {
+			return fmt.Errorf("failed update Role %s/%s: %v", namespace, role.Name, err)
+		}
+		glog.V(4).Infof("Updated Role %s/%s", namespace, role.Name)
+	}
+
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, role := range list.Items {
+		if desired[role.Name] || !isGenerated(role.ObjectMeta, rbac.LegacyRoleNames) {
+			continue
+		}
+		if err := client.Delete(role.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed delete obsolete Role %s/%s: %v", namespace, role.Name, err)
+		}
+		glog.V(4).Infof("Deleted obsolete Role %s/%s", namespace, role.Name)
+	}
+	return nil
+}
+
+// syncRoleBindings creates or updates the RoleBindings of the tenant in the
+// namespace, and deletes the generated RoleBindings which are obsolete.
+// RoleBindings whose role changed are recreated, since roleRef is immutable.
+func (c *Controller) syncRoleBindings(namespace, tenant string, roleBindings []*v1beta1.RoleBinding) error {
+	client := c.k8sclient.Rbac().RoleBindings(namespace)
+	desired := make(map[string]bool)
+	for _, roleBinding := range roleBindings {
+		desired[roleBinding.Name] = true
+		existing, err := client.Get(roleBinding.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		create := apierrors.IsNotFound(err)
+		if !create && !reflect.DeepEqual(existing.RoleRef, roleBinding.RoleRef) {
+			if err := client.Delete(roleBinding.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed delete RoleBinding %s/%s: %v", namespace, roleBinding.Name, err)
+			}
+			create = true
+		}
+		if create {
+			if _, err := client.Create(roleBinding); err != nil {
+				return fmt.Errorf("failed create RoleBinding %s/%s: %v", namespace, roleBinding.Name, err)
+			}
+			glog.V(4).Infof("Created RoleBinding %s/%s", namespace, roleBinding.Name)
+			continue
+		}
+
+		labels, changed := mergeLabels(existing.Labels, roleBinding.Labels)
+		if !changed && reflect.DeepEqual(existing.Subjects, roleBinding.Subjects) {
+			continue
+		}
+		existingCopy := existing.DeepCopy()
+		existingCopy.Labels = labels
+		existingCopy.Subjects = roleBinding.Subjects
+		if _, err := client.Update(existingCopy); err != nil {
+			return fmt.Errorf("failed update RoleBinding %s/%s: %v", namespace, roleBinding.Name, err)
+		}
+		glog.V(4).Infof("Updated RoleBinding %s/%s", namespace, roleBinding.Name)
+	}
+
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, roleBinding := range list.Items {
+		if desired[roleBinding.Name] || !isGenerated(roleBinding.ObjectMeta, rbac.LegacyRoleBindingNames(tenant)) {
+			continue
+		}
+		if err := client.Delete(roleBinding.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed delete obsolete RoleBinding %s/%s: %v", namespace, roleBinding.Name, err)
+		}
+		glog.V(4).Infof("Deleted obsolete RoleBinding %s/%s", namespace, roleBinding.Name)
+	}
+	return nil
+}
+
+// syncClusterRoles creates or updates the ClusterRoles of the templates, and
+// deletes the generated ClusterRoles which are obsolete.
+func (c *Controller) syncClusterRoles() error {
+	client := c.k8sclient.Rbac().ClusterRoles()
+	desired := make(map[string]bool)
+	for _, clusterRole := range c.getTemplates().GenerateClusterRoles() {
+		desired[clusterRole.Name] = true
+		existing, err := client.Get(clusterRole.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if _, err := client.Create(clusterRole); err != nil {
+				return fmt.Errorf("failed create ClusterRole %s: %v", clusterRole.Name, err)
+			}
+			glog.V(4).Infof("Created ClusterRole %s", clusterRole.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		labels, changed := mergeLabels(existing.Labels, clusterRole.Labels)
+		if !changed && reflect.DeepEqual(existing.Rules, clusterRole.Rules) {
+			continue
+		}
+		existingCopy := existing.DeepCopy()
+		existingCopy.Labels = labels
+		existingCopy.Rules = clusterRole.Rules
+		if _, err := client.Update(existingCopy); err != nil {
+			return fmt.Errorf("failed update ClusterRole %s: %v", clusterRole.Name, err)
+		}
+		glog.V(4).Infof("Updated ClusterRole %s", clusterRole.Name)
+	}
+
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, clusterRole := range list.Items {
+		if desired[clusterRole.Name] || !isGenerated(clusterRole.ObjectMeta, rbac.LegacyClusterRoleNames) {
+			continue
+		}
+		if err := client.Delete(clusterRole.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed delete obsolete ClusterRole %s: %v", clusterRole.Name, err)
+		}
+		glog.V(4).Infof("Deleted obsolete ClusterRole %s", clusterRole.Name)
+	}
+	return nil
+}
+
+// syncClusterRoleBindings creates or updates the ClusterRoleBindings of the
+// tenant, and deletes the generated ClusterRoleBindings of the tenant which are
+// obsolete. ClusterRoleBindings whose role changed are recreated. The existing
+// ClusterRoleBindings are listed if not given.
+func (c *Controller) syncClusterRoleBindings(tenant string, clusterRoleBindings []*v1beta1.ClusterRoleBinding, existingList *v1beta1.ClusterRoleBindingList) error {
+	client := c.k8sclient.Rbac().ClusterRoleBindings()
+	desired := make(map[string]bool)
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		desired[clusterRoleBinding.Name] = true
+		existing, err := client.Get(clusterRoleBinding.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		create := apierrors.IsNotFound(err)
+		if !create && !reflect.DeepEqual(existing.RoleRef, clusterRoleBinding.RoleRef) {
+			if err := client.Delete(clusterRoleBinding.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed delete ClusterRoleBinding %s: %v", clusterRoleBinding.Name, err)
+			}
+			create = true
+		}
+		if create {
+			if _, err := client.Create(clusterRoleBinding); err != nil {
+				return fmt.Errorf("failed create ClusterRoleBinding %s: %v", clusterRoleBinding.Name, err)
+			}
+			glog.V(4).Infof("Created ClusterRoleBinding %s", clusterRoleBinding.Name)
+			continue
+		}
+
+		labels, changed := mergeLabels(existing.Labels, clusterRoleBinding.Labels)
+		if !changed && reflect.DeepEqual(existing.Subjects, clusterRoleBinding.Subjects) {
+			continue
+		}
+		existingCopy := existing.DeepCopy()
+		existingCopy.Labels = labels
+		existingCopy.Subjects = clusterRoleBinding.Subjects
+		if _, err := client.Update(existingCopy); err != nil {
+			return fmt.Errorf("failed update ClusterRoleBinding %s: %v", clusterRoleBinding.Name, err)
+		}
+		glog.V(4).Infof("Updated ClusterRoleBinding %s", clusterRoleBinding.Name)
+	}
+
+	if existingList == nil {
+		var err error
+		existingList, err = client.List(metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	for _, clusterRoleBinding := range existingList.Items {
+		if desired[clusterRoleBinding.Name] || !isTenantClusterRoleBinding(clusterRoleBinding.ObjectMeta, tenant) {
+			continue
+		}
+		if err := client.Delete(clusterRoleBinding.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed delete obsolete ClusterRoleBinding %s: %v", clusterRoleBinding.Name, err)
+		}
+		glog.V(4).Infof("Deleted obsolete ClusterRoleBinding %s", clusterRoleBinding.Name)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	"git.openstack.org/openstack/stackube/pkg/util"
+
+	"github.com/golang/glog"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultPasswordNamespace is the default namespace of password Secrets, which
+	// is not covered by any tenant role.
+	DefaultPasswordNamespace = apismetav1.NamespaceSystem
+	// legacyPasswordNamespace is where password Secrets were kept with tenants,
+	// they are moved to the password namespace.
+	legacyPasswordNamespace = util.SystemTenant
+
+	// defaultPasswordKey is the key of the password in password Secrets.
+	defaultPasswordKey = "password"
+	// passwordSecretSuffix is appended to the tenant name to name the password
+	// Secret if the tenant doesn't reference one.
+	passwordSecretSuffix = "-password"
+	// passwordLength is the number of random bytes of generated passwords.
+	passwordLength = 24
+
+	// passwordSecretTenantLabel is set on generated password Secrets to the
+	// tenant name, they are deleted with the tenant.
+	passwordSecretTenantLabel = "stackube.kubernetes.io/tenant"
+	// passwordVersionAnnotation is set on tenants to the resource version of the
+	// password Secret which the Keystone user's password is set from.
+	passwordVersionAnnotation = "stackube.kubernetes.io/password-version"
+)
+
+// passwordSecretRef returns the reference of the tenant's password Secret.
+func passwordSecretRef(tenant *crv1.Tenant) crv1.SecretKeyReference {
+	ref := crv1.SecretKeyReference{
+		Name: tenant.Name + passwordSecretSuffix,
+	}
+	if tenant.Spec.PasswordSecret != nil {
+		ref = *tenant.Spec.PasswordSecret
+	}
+	if ref.Key == "" {
+		ref.Key = defaultPasswordKey
+	}
+	return ref
+}
+
+// generatePassword returns a random password.
+func generatePassword() (string, error) {
+	b := make([]byte, passwordLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ensurePasswordSecret returns the password Secret of the tenant, the Secret is
+// created if it doesn't exist. It's moved from the legacy namespace if it's there,
+// or created with the deprecated spec.password of tenants created before password
+// Secrets, or with a random password.
+func (c *TenantController) ensurePasswordSecret(tenant *crv1.Tenant) (*apiv1.Secret, error) {
+	ref := passwordSecretRef(tenant)
+	secret, err := c.k8sClient.CoreV1().Secrets(c.passwordNamespace).Get(ref.Name, apismetav1.GetOptions{})
+	if err == nil {
+		return secret, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if c.passwordNamespace != legacyPasswordNamespace {
+		secret, err = c.moveLegacyPasswordSecret(ref.Name)
+		if err != nil || secret != nil {
+			return secret, err
+		}
+	}
+
+	password := tenant.Spec.Password
+	if password == "" {
+		password, err = generatePassword()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate password: %v", err)
+		}
+	}
+	secret = &apiv1.Secret{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:      ref.Name,
+			Namespace: c.passwordNamespace,
+			Labels: map[string]string{
+				passwordSecretTenantLabel: tenant.Name,
+			},
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"username": []byte(tenant.Spec.UserName),
+			ref.Key:    []byte(password),
+		},
+	}
+	secret, err = c.k8sClient.CoreV1().Secrets(c.passwordNamespace).Create(secret)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("Generated password secret %s for tenant %s", ref.Name, tenant.Name)
+	return secret, nil
+}
+
+// moveLegacyPasswordSecret moves the password Secret from the legacy namespace,
+// where it's readable by the users of the default tenant, to the password
+// namespace. It returns nil if the Secret isn't in the legacy namespace.
+func (c *TenantController) moveLegacyPasswordSecret(name string) (*apiv1.Secret, error) {
+	legacy, err := c.k8sClient.CoreV1().Secrets(legacyPasswordNamespace).Get(name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &apiv1.Secret{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:        legacy.Name,
+			Namespace:   c.passwordNamespace,
+			Labels:      legacy.Labels,
+			Annotations: legacy.Annotations,
+		},
+		Type: legacy.Type,
+		Data: legacy.Data,
+	}
+	secret, err = c.k8sClient.CoreV1().Secrets(c.passwordNamespace).Create(secret)
+	if err != nil {
+		return nil, err
+	}
+	err = c.k8sClient.CoreV1().Secrets(legacyPasswordNamespace).Delete(name, &apismetav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	glog.V(3).Infof("Moved password secret %s from namespace %s to %s", name, legacyPasswordNamespace, c.passwordNamespace)
+	return secret, nil
+}
+
+// getPassword returns the password of the tenant from the password Secret.
+func getPassword(tenant *crv1.Tenant, secret *apiv1.Secret) (string, error) {
+	ref := passwordSecretRef(tenant)
+	password, ok := secret.Data[ref.Key]
+	if !ok || len(password) == 0 {
+		return "", fmt.Errorf("secret %s has no password at key %s", secret.Name, ref.Key)
+	}
+	return string(password), nil
+}
+
+// syncPassword updates the password of the tenant's Keystone user from the
+// password Secret if the Secret changed since the last update.
+func (c *TenantController) syncPassword(tenant *crv1.Tenant, secret *apiv1.Secret) error {
+	version := tenant.Annotations[passwordVersionAnnotation]
+	if version == secret.ResourceVersion {
+		return nil
+	}
+
+	password, err := getPassword(tenant, secret)
+	if err != nil {
+		return err
+	}
+	// Users of tenants created before password Secrets already have the
+	// deprecated spec.password, which is adopted without rotating.
+	if version == "" && tenant.Spec.Password != "" && password == tenant.Spec.Password {
+		glog.V(3).Infof("Adopted password of user %s of tenant %s", tenant.Spec.UserName, tenant.Name)
+		return c.setPasswordVersion(tenant, secret.ResourceVersion)
+	}
+	if err := c.openstackClient.UpdateUserPassword(tenant.Spec.UserName, password); err != nil {
+		return fmt.Errorf("failed to update password of user %s: %v", tenant.Spec.UserName, err)
+	}
+	glog.V(3).Infof("Rotated password of user %s of tenant %s", tenant.Spec.UserName, tenant.Name)
+
+	return c.setPasswordVersion(tenant, secret.ResourceVersion)
+}
+
+// setPasswordVersion records the resource version of the password Secret which
+// the Keystone user's password is set from.
+func (c *TenantController) setPasswordVersion(tenant *crv1.Tenant, version string) error {
+	newTenant := tenant.DeepCopy()
+	if newTenant.Annotations == nil {
+		newTenant.Annotations = make(map[string]string)
+	}
+	newTenant.Annotations[passwordVersionAnnotation] = version
+	return c.kubeCRDClient.UpdateTenant(newTenant)
+}
+
+// onSecretUpdate rotates the passwords of the tenants whose password Secret
+// changed. Tenants without the password version are not created yet, their
+// passwords are set by syncTenant.
+func (c *TenantController) onSecretUpdate(obj interface{}) {
+	secret, ok := obj.(*apiv1.Secret)
+	if !ok || c.tenantStore == nil {
+		return
+	}
+
+	for _, obj := range c.tenantStore.List() {
+		tenant := obj.(*crv1.Tenant)
+		if passwordSecretRef(tenant).Name != secret.Name {
+			continue
+		}
+		if tenant.Annotations[passwordVersionAnnotation] == "" {
+			continue
+		}
+		if err := c.syncPassword(tenant, secret); err != nil {
+			glog.Errorf("Failed sync password of tenant %s: %v", tenant.Name, err)
+		}
+	}
+}
+
+// deletePasswordSecret deletes the password Secret of the tenant if it was
+// generated by the controller.
+func (c *TenantController) deletePasswordSecret(tenant *crv1.Tenant) error {
+	ref := passwordSecretRef(tenant)
+	secret, err := c.k8sClient.CoreV1().Secrets(c.passwordNamespace).Get(ref.Name, apismetav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if secret.Labels[passwordSecretTenantLabel] != tenant.Name {
+		return nil
+	}
+
+	err = c.k8sClient.CoreV1().Secrets(c.passwordNamespace).Delete(ref.Name, &apismetav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"fmt"
+
+	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	"git.openstack.org/openstack/stackube/pkg/auth-controller/rbacmanager/rbac"
+	"git.openstack.org/openstack/stackube/pkg/util"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// tenantTeardownStep is a step of tearing down a tenant, it must be idempotent.
+// It returns a message if it's waiting for resources to be torn down.
+type tenantTeardownStep struct {
+	name string
+	run  func(tenant *crv1.Tenant) (string, error)
+}
+
+// tenantTeardownSteps returns the steps of tearing down tenants in order.
+func (c *TenantController) tenantTeardownSteps() []tenantTeardownStep {
+	return []tenantTeardownStep{
+		{name: crv1.TeardownNetworks, run: c.teardownNetworks},
+		{name: crv1.TeardownUsers, run: c.teardownUsers},
+		{name: crv1.TeardownProject, run: c.teardownProject},
+	}
+}
+
+// ensureTenantFinalizer adds the finalizer to the tenant, so that the tenant is
+// kept until it's torn down.
+func (c *TenantController) ensureTenantFinalizer(tenant *crv1.Tenant) error {
+	if util.HasFinalizer(tenant.Finalizers, crv1.TenantFinalizer) {
+		return nil
+	}
+
+	tenant.Finalizers = append(tenant.Finalizers, crv1.TenantFinalizer)
+	return c.kubeCRDClient.UpdateTenant(tenant)
+}
+
+// teardownTenant tears down the deleted tenant step by step and removes its
+// finalizer at last. The step in progress is recorded in the tenant status, an
+// interrupted teardown is resumed from it on the next sync.
+func (c *TenantController) teardownTenant(tenant *crv1.Tenant) error {
+	if !util.HasFinalizer(tenant.Finalizers, crv1.TenantFinalizer) {
+		return nil
+	}
+
+	if tenant.Status.TeardownStep != crv1.TeardownCompleted {
+		steps := c.tenantTeardownSteps()
+		start := 0
+		for i, step := range steps {
+			if step.name == tenant.Status.TeardownStep {
+				start = i
+			}
+		}
+
+		for _, step := range steps[start:] {
+			if tenant.Status.TeardownStep != step.name {
+				c.updateTeardownStatus(tenant, step.name, "")
+			}
+
+			waiting, err := step.run(tenant)
+			if err != nil {
+				c.updateTeardownStatus(tenant, step.name, fmt.Sprintf("Teardown step %s failed: %v", step.name, err))
+				return fmt.Errorf("teardown step %s of tenant %s failed: %v", step.name, tenant.Name, err)
+			}
+			if waiting != "" {
+				c.updateTeardownStatus(tenant, step.name, waiting)
+				glog.V(4).Infof("Teardown step %s of tenant %s: %s", step.name, tenant.Name, waiting)
+				return nil
+			}
+			glog.V(4).Infof("Teardown step %s of tenant %s done", step.name, tenant.Name)
+		}
+	}
+
+	tenant.Status.State = crv1.TenantTerminating
+	tenant.Status.Message = ""
+	tenant.Status.TeardownStep = crv1.TeardownCompleted
+	tenant.Finalizers = util.RemoveFinalizer(tenant.Finalizers, crv1.TenantFinalizer)
+	if err := c.kubeCRDClient.UpdateTenant(tenant); err != nil {
+		return fmt.Errorf("failed remove finalizer of tenant %s: %v", tenant.Name, err)
+	}
+	glog.V(3).Infof("Tenant %s torn down", tenant.Name)
+	return nil
+}
+
+// updateTeardownStatus reports the progress of tearing down the tenant, the
+// tenant isn't updated if its status doesn't change.
+func (c *TenantController) updateTeardownStatus(tenant *crv1.Tenant, step, message string) {
+	status := tenant.Status
+	if status.State == crv1.TenantTerminating && status.TeardownStep == step && status.Message == message {
+		return
+	}
+
+	tenant.Status.State = crv1.TenantTerminating
+	tenant.Status.TeardownStep = step
+	tenant.Status.Message = message
+	if err := c.kubeCRDClient.UpdateTenant(tenant); err != nil {
+		glog.Warningf("Failed update status of tenant %s: %v", tenant.Name, err)
+	}
+}
+
+// deleteClusterRoleBindings deletes the ClusterRoleBindings generated for the
+// tenant, including the ones generated before they were labeled.
+func (c *TenantController) deleteClusterRoleBindings(tenantName string) error {
+	client := c.k8sClient.Rbac().ClusterRoleBindings()
+	list, err := client.List(apismetav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{rbac.TenantLabel: tenantName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	names := rbac.LegacyClusterRoleBindingNames(tenantName)
+	for _, clusterRoleBinding := range list.Items {
+		names = append(names, clusterRoleBinding.Name)
+	}
+
+	for _, name := range names {
+		err := client.Delete(name, &apismetav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		glog.V(4).Infof("Deleted ClusterRoleBinding %s", name)
+	}
+	return nil
+}
+
+// teardownNetworks deletes the ClusterRoleBindings and the namespace of the
+// tenant, and waits for the networks in the namespace to be torn down by the
+// network controller.
+func (c *TenantController) teardownNetworks(tenant *crv1.Tenant) (string, error) {
+	tenantName := tenant.Name
+	if err := c.deleteClusterRoleBindings(tenantName); err != nil {
+		return "", fmt.Errorf("failed delete ClusterRoleBindings: %v", err)
+	}
+
+	// Delete automatically created network
+	// TODO(harry) so that we can not deal with network with different name and namespace,
+	// we need to document that.
+	if err := c.kubeCRDClient.DeleteNetwork(tenantName); err != nil {
+		return "", err
+	}
+
+	// Delete namespace, the other networks are deleted with it.
+	err := c.deleteNamespace(tenantName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed delete namespace: %v", err)
+	}
+	glog.V(4).Infof("Deleted namespace %s", tenantName)
+
+	networks, err := c.kubeCRDClient.ListNetworks(tenantName)
+	if err != nil {
+		return "", fmt.Errorf("failed list networks: %v", err)
+	}
+	if len(networks) > 0 {
+		return fmt.Sprintf("Waiting for %d networks to be torn down", len(networks)), nil
+	}
+	return "", nil
+}
+
+// teardownUsers deletes the users of the tenant and the generated password Secret.
+func (c *TenantController) teardownUsers(tenant *crv1.Tenant) (string, error) {
+	if err := c.openstackClient.DeleteAllUsersOnTenant(tenant.Name); err != nil {
+		return "", fmt.Errorf("failed delete users: %v", err)
+	}
+
+	if err := c.deletePasswordSecret(tenant); err != nil {
+		return "", fmt.Errorf("failed delete password secret: %v", err)
+	}
+	return "", nil
+}
+
+// teardownProject deletes the project of the tenant in Keystone, unless it was
+// given by the tenant spec.
+func (c *TenantController) teardownProject(tenant *crv1.Tenant) (string, error) {
+	if tenant.Spec.TenantID != "" {
+		return "", nil
+	}
+
+	if err := c.openstackClient.DeleteTenant(tenant.Name); err != nil {
+		return "", fmt.Errorf("failed delete project: %v", err)
+	}
+	return "", nil
+}
@@ -18,6 +18,8 @@ package tenant
 
 import (
 	"fmt"
+	"reflect"
+	"time"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
 	crdClient "git.openstack.org/openstack/stackube/pkg/kubecrd"
@@ -27,24 +29,33 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+const (
+	// tenantResyncPeriod is the period of retrying teardowns of deleted tenants.
+	tenantResyncPeriod = time.Minute
+)
+
 // TenantController manages the life cycle of Tenant.
 type TenantController struct {
 	k8sClient       kubernetes.Interface
 	kubeCRDClient   crdClient.Interface
 	openstackClient openstack.Interface
+	// tenantStore caches tenants to find the tenants of changed password Secrets.
+	tenantStore cache.Store
+	// passwordNamespace is the namespace of password Secrets.
+	passwordNamespace string
 }
 
 // NewTenantController creates a new tenant controller.
 func NewTenantController(kubeClient kubernetes.Interface,
 	osClient openstack.Interface,
-	kubeExtClient *apiextensionsclient.Clientset) (*TenantController, error) {
+	kubeExtClient *apiextensionsclient.Clientset,
+	passwordNamespace string) (*TenantController, error) {
 	// initialize CRD if it does not exist
 	_, err := crdClient.CreateTenantCRD(kubeExtClient)
 	if err != nil && !apierrors.IsAlreadyExists(err) {
@@ -52,13 +63,10 @@ func NewTenantController(kubeClient kubernetes.Interface,
 	}
 
 	c := &TenantController{
-		kubeCRDClient:   osClient.GetCRDClient(),
-		k8sClient:       kubeClient,
-		openstackClient: osClient,
-	}
-
-	if err = c.createClusterRoles(); err != nil {
-		return nil, fmt.Errorf("failed to create cluster roles to kube-apiserver: %v", err)
+		kubeCRDClient:     osClient.GetCRDClient(),
+		k8sClient:         kubeClient,
+		openstackClient:   osClient,
+		passwordNamespace: passwordNamespace,
 	}
 
 	return c, nil
@@ -74,17 +82,37 @@ func (c *TenantController) Run(stopCh <-chan struct{}) error {
 		apiv1.NamespaceAll,
 		fields.Everything())
 
-	_, tenantInformor := cache.NewInformer(
+	var tenantInformor cache.Controller
+	c.tenantStore, tenantInformor = cache.NewInformer(
 		source,
 		&crv1.Tenant{},
-		0,
+		tenantResyncPeriod,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc:    c.onAdd,
 			UpdateFunc: c.onUpdate,
 			DeleteFunc: c.onDelete,
 		})
 
+	// Password Secrets are in the password namespace.
+	secretSource := cache.NewListWatchFromClient(
+		c.k8sClient.CoreV1().RESTClient(),
+		"secrets",
+		c.passwordNamespace,
+		fields.Everything())
+
+	_, secretInformer := cache.NewInformer(
+		secretSource,
+		&apiv1.Secret{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: c.onSecretUpdate,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				c.onSecretUpdate(newObj)
+			},
+		})
+
 	go tenantInformor.Run(stopCh)
+	go secretInformer.Run(stopCh)
 	<-stopCh
 	return nil
 }
@@ -100,61 +128,79 @@ func (c *TenantController) onAdd(obj interface{}) {
 	}
 
 	newTenant := copyObj.(*crv1.Tenant)
+
+	// The tenant was deleted while the controller wasn't running.
+	if newTenant.DeletionTimestamp != nil {
+		if err := c.teardownTenant(newTenant); err != nil {
+			glog.Errorf("Failed teardown tenant %s: %v", newTenant.Name, err)
+		}
+		return
+	}
+
 	c.syncTenant(newTenant)
 }
 
 func (c *TenantController) onUpdate(obj1, obj2 interface{}) {
-	glog.Warning("tenant updates is not supported yet.")
-}
+	oldTenant := obj1.(*crv1.Tenant)
+	newTenant := obj2.(*crv1.Tenant)
+	if newTenant.DeletionTimestamp != nil {
+		// Updates of tenants being torn down are made by the teardown itself,
+		// unfinished teardowns are retried on periodic resyncs.
+		if oldTenant.DeletionTimestamp != nil && oldTenant.ResourceVersion != newTenant.ResourceVersion {
+			return
+		}
 
-func (c *TenantController) onDelete(obj interface{}) {
-	tenant, ok := obj.(*crv1.Tenant)
-	if !ok {
+		copyObj, err := c.kubeCRDClient.Scheme().Copy(newTenant)
+		if err != nil {
+			glog.Errorf("ERROR creating a deep copy of tenant object: %#v\n", err)
+			return
+		}
+		if err := c.teardownTenant(copyObj.(*crv1.Tenant)); err != nil {
+			glog.Errorf("Failed teardown tenant %s: %v", newTenant.Name, err)
+		}
 		return
 	}
 
-	glog.V(3).Infof("Tenant controller received deleted tenant %#v\n", tenant)
-
-	deleteOptions := &apismetav1.DeleteOptions{
-		TypeMeta: apismetav1.TypeMeta{
-			Kind:       "ClusterRoleBinding",
-			APIVersion: "rbac.authorization.k8s.io/v1beta1",
-		},
-	}
-	tenantName := tenant.Name
-	err := c.k8sClient.Rbac().ClusterRoleBindings().Delete(tenantName+"-namespace-creater", deleteOptions)
-	if err != nil && !apierrors.IsNotFound(err) {
-		glog.Errorf("Failed delete ClusterRoleBinding for tenant %s: %v", tenantName, err)
-	} else {
-		glog.V(4).Infof("Deleted ClusterRoleBinding %s", tenantName)
+	if reflect.DeepEqual(oldTenant.Spec, newTenant.Spec) {
+		return
 	}
 
-	// Delete automatically created network
-	// TODO(harry) so that we can not deal with network with different name and namespace,
-	// we need to document that.
-	if err := c.kubeCRDClient.DeleteNetwork(tenantName); err != nil {
-		glog.Errorf("failed to delete network for tenant: %v", tenantName)
+	// Only switching password Secrets is supported, the deprecated password is
+	// ignored.
+	oldSpec := oldTenant.Spec.DeepCopy()
+	oldSpec.PasswordSecret = newTenant.Spec.PasswordSecret
+	oldSpec.Password = newTenant.Spec.Password
+	if !reflect.DeepEqual(*oldSpec, newTenant.Spec) {
+		glog.Warning("tenant updates is not supported yet.")
+		return
 	}
 
-	// Delete namespace
-	err = c.deleteNamespace(tenantName)
+	secret, err := c.ensurePasswordSecret(newTenant)
 	if err != nil {
-		glog.Errorf("Delete namespace %s failed: %v", tenantName, err)
-	} else {
-		glog.V(4).Infof("Deleted namespace %s", tenantName)
+		glog.Errorf("Failed get password secret of tenant %s: %v", newTenant.Name, err)
+		return
 	}
+	if err := c.syncPassword(newTenant, secret); err != nil {
+		glog.Errorf("Failed sync password of tenant %s: %v", newTenant.Name, err)
+	}
+}
 
-	// Delete all users on a tenant
-	err = c.openstackClient.DeleteAllUsersOnTenant(tenantName)
-	if err != nil {
-		glog.Errorf("Failed delete all users in the tenant %s: %v", tenantName, err)
+func (c *TenantController) onDelete(obj interface{}) {
+	tenant, ok := obj.(*crv1.Tenant)
+	if !ok {
+		return
 	}
 
-	// Delete tenant in keystone
-	if tenant.Spec.TenantID == "" {
-		err = c.openstackClient.DeleteTenant(tenantName)
-		if err != nil {
-			glog.Errorf("Failed delete tenant %s: %v", tenantName, err)
+	glog.V(3).Infof("Tenant controller received deleted tenant %#v\n", tenant)
+
+	// Tenants with the finalizer are torn down before they are deleted, others
+	// are cleaned up here as much as possible.
+	if tenant.Status.TeardownStep == crv1.TeardownCompleted {
+		return
+	}
+	for _, step := range c.tenantTeardownSteps() {
+		if _, err := step.run(tenant); err != nil {
+			glog.Errorf("Failed teardown step %s of tenant %s: %v", step.name, tenant.Name, err)
 		}
 	}
 }
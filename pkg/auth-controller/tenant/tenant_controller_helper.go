@@ -18,7 +18,6 @@ package tenant
 
 import (
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
-	"git.openstack.org/openstack/stackube/pkg/auth-controller/rbacmanager/rbac"
 	"git.openstack.org/openstack/stackube/pkg/openstack"
 
 	"github.com/golang/glog"
@@ -28,16 +27,27 @@ import (
 )
 
 func (c *TenantController) syncTenant(tenant *crv1.Tenant) {
-	roleBinding := rbac.GenerateClusterRoleBindingByTenant(tenant.Name)
-	_, err := c.k8sClient.Rbac().ClusterRoleBindings().Create(roleBinding)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		glog.Errorf("Failed create ClusterRoleBinding for tenant %s: %v", tenant.Name, err)
+	// The tenant is kept until its resources are torn down.
+	if err := c.ensureTenantFinalizer(tenant); err != nil {
+		glog.Errorf("Failed add finalizer to tenant %s: %v", tenant.Name, err)
+		return
+	}
+
+	// Get the password of the user, which is generated if not given
+	secret, err := c.ensurePasswordSecret(tenant)
+	if err != nil {
+		glog.Errorf("Failed get password secret of tenant %s: %v", tenant.Name, err)
 		return
 	}
-	glog.V(4).Infof("Created ClusterRoleBindings %s-namespace-creater for tenant %s", tenant.Name, tenant.Name)
+	password, err := getPassword(tenant, secret)
+	if err != nil {
+		glog.Errorf("Failed get password of tenant %s: %v", tenant.Name, err)
+		return
+	}
+
 	if tenant.Spec.TenantID != "" {
 		// Create user with the spec username and password in the given tenant
-		err = c.openstackClient.CreateUser(tenant.Spec.UserName, tenant.Spec.Password, tenant.Spec.TenantID)
+		err = c.openstackClient.CreateUser(tenant.Spec.UserName, password, tenant.Spec.TenantID)
 		if err != nil && !openstack.IsAlreadyExists(err) {
 			glog.Errorf("Failed create user %s: %v", tenant.Spec.UserName, err)
 			return
@@ -50,14 +60,20 @@ func (c *TenantController) syncTenant(tenant *crv1.Tenant) {
 			return
 		}
 		// Create user with the spec username and password in the created tenant
-		err = c.openstackClient.CreateUser(tenant.Spec.UserName, tenant.Spec.Password, tenantID)
+		err = c.openstackClient.CreateUser(tenant.Spec.UserName, password, tenantID)
 		if err != nil {
 			glog.Errorf("Failed create user %s: %v", tenant.Spec.UserName, err)
 			return
 		}
 	}
 
-	// Create namespace which name is the same as the tenant's name
+	// The user may exist already with another password
+	if err = c.syncPassword(tenant, secret); err != nil {
+		glog.Errorf("Failed sync password of tenant %s: %v", tenant.Name, err)
+	}
+
+	// Create namespace which name is the same as the tenant's name, the roles and
+	// bindings of the tenant are generated from templates by RBAC controller.
 	err = c.createNamespace(tenant.Name)
 	if err != nil {
 		glog.Errorf("Failed create namespace %s: %v", tenant.Name, err)
@@ -66,17 +82,6 @@ func (c *TenantController) syncTenant(tenant *crv1.Tenant) {
 	glog.V(4).Infof("Created namespace %s for tenant %s", tenant.Name, tenant.Name)
 }
 
-func (c *TenantController) createClusterRoles() error {
-	nsCreater := rbac.GenerateClusterRole()
-	_, err := c.k8sClient.Rbac().ClusterRoles().Create(nsCreater)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		glog.Errorf("Failed create ClusterRoles namespace-creater: %v", err)
-		return err
-	}
-	glog.V(4).Info("Created ClusterRoles namespace-creater")
-	return nil
-}
-
 func (c *TenantController) createNamespace(namespace string) error {
 	_, err := c.k8sClient.CoreV1().Namespaces().Create(&apiv1.Namespace{
 		ObjectMeta: apismetav1.ObjectMeta{
@@ -18,7 +18,6 @@ package tenant
 
 import (
 	"fmt"
-	"reflect"
 	"testing"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
@@ -26,8 +25,11 @@ import (
 	crdClient "git.openstack.org/openstack/stackube/pkg/kubecrd"
 	"git.openstack.org/openstack/stackube/pkg/openstack"
 	"git.openstack.org/openstack/stackube/pkg/util"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
@@ -41,23 +43,34 @@ var systemTenant = &crv1.Tenant{
 	},
 	Spec: crv1.TenantSpec{
 		UserName: util.SystemTenant,
-		Password: util.SystemPassword,
 	},
 }
 
-func newTenant(name, userName, password, tenantID string) *crv1.Tenant {
+func newTenant(name, userName, tenantID string) *crv1.Tenant {
 	return &crv1.Tenant{
 		ObjectMeta: apismetav1.ObjectMeta{
 			Name: name,
 		},
 		Spec: crv1.TenantSpec{
 			UserName: userName,
-			Password: password,
 			TenantID: tenantID,
 		},
 	}
 }
 
+func newPasswordSecret(name, resourceVersion, password string) *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:            name,
+			Namespace:       DefaultPasswordNamespace,
+			ResourceVersion: resourceVersion,
+		},
+		Data: map[string][]byte{
+			"token": []byte(password),
+		},
+	}
+}
+
 func newNetwork(name string) *crv1.Network {
 	return &crv1.Network{
 		ObjectMeta: apismetav1.ObjectMeta{
@@ -76,13 +89,10 @@ func newTenantController() (*TenantController, *crdClient.FakeCRDClient, *openst
 	client := fake.NewSimpleClientset()
 
 	c := &TenantController{
-		kubeCRDClient:   kubeCRDClient,
-		k8sClient:       client,
-		openstackClient: osClient,
-	}
-
-	if err = c.createClusterRoles(); err != nil {
-		return nil, nil, nil, nil, fmt.Errorf("failed to create cluster roles to kube-apiserver: %v", err)
+		kubeCRDClient:     kubeCRDClient,
+		k8sClient:         client,
+		openstackClient:   osClient,
+		passwordNamespace: DefaultPasswordNamespace,
 	}
 
 	return c, kubeCRDClient, osClient, client, nil
@@ -120,27 +130,6 @@ func TestOperateNamespace(t *testing.T) {
 	}
 }
 
-func TestCreateClusterRoles(t *testing.T) {
-	// Created a new fake TenantController.
-	controller, _, _, client, err := newTenantController()
-	if err != nil {
-		t.Fatalf("Failed start a new fake TenantController")
-	}
-	err = controller.createClusterRoles()
-	if err != nil {
-		t.Fatalf("Create cluster role error:%v", err)
-	}
-
-	clusterRole, err := client.Rbac().ClusterRoles().Get("namespace-creater", apismetav1.GetOptions{})
-	if err != nil {
-		t.Fatalf("Failed get cluster role: %v", err)
-	}
-
-	if !reflect.DeepEqual(clusterRole, rbac.GenerateClusterRole()) {
-		t.Errorf("Created cluster role has incorrect parameters: %v", clusterRole)
-	}
-}
-
 func TestOnAdd(t *testing.T) {
 	var controller *TenantController
 	var kubeCRDClient *crdClient.FakeCRDClient
@@ -165,15 +154,11 @@ func TestOnAdd(t *testing.T) {
 					t.Fatalf("Failed start a new fake TenantController")
 				}
 				// Add default tenant
+				kubeCRDClient.SetTenants(systemTenant)
 				controller.onAdd(systemTenant)
 
 			},
 			expectedFn: func(tenantName string) error {
-				// test ClusterRoleBinding created
-				err := testClusterRoleBindingCreated(t, client, tenantName)
-				if err != nil {
-					return err
-				}
 				// test tenant created
 				tenant, ok := osClient.Tenants[tenantName]
 				if !ok {
@@ -202,16 +187,12 @@ func TestOnAdd(t *testing.T) {
 			tenantName: "foo1",
 			updateFn: func(tenantName string) {
 				// Add tenant
-				tenant := newTenant(tenantName, tenantName, password, "")
+				tenant := newTenant(tenantName, tenantName, "")
+				kubeCRDClient.SetTenants(tenant)
 				controller.onAdd(tenant)
 
 			},
 			expectedFn: func(tenantName string) error {
-				// test ClusterRoleBinding created
-				err := testClusterRoleBindingCreated(t, client, tenantName)
-				if err != nil {
-					return err
-				}
 				// test tenant created
 				tenant, ok := osClient.Tenants[tenantName]
 				if !ok {
@@ -227,6 +208,15 @@ func TestOnAdd(t *testing.T) {
 					user.TenantID != tenant.ID {
 					return fmt.Errorf("the created %s user has incorrect parameters: %v", tenantName, user)
 				}
+				// test password secret generated
+				err = testPasswordSecretCreated(t, client, osClient, tenantName)
+				if err != nil {
+					return err
+				}
+				// test finalizer added
+				if !util.HasFinalizer(kubeCRDClient.Tenants[tenantName].Finalizers, crv1.TenantFinalizer) {
+					return fmt.Errorf("expected finalizer added to %s tenant, got %v", tenantName, kubeCRDClient.Tenants[tenantName].Finalizers)
+				}
 				// test namespace created
 				err = testNamespaceCreated(t, client, tenantName)
 				if err != nil {
@@ -240,19 +230,15 @@ func TestOnAdd(t *testing.T) {
 			tenantName: "foo2",
 			updateFn: func(tenantName string) {
 
-				tenant := newTenant(tenantName, tenantName, password, tenantID)
+				tenant := newTenant(tenantName, tenantName, tenantID)
 				// Injects fake tenant.
 				osClient.SetTenant(tenantName, tenantID)
+				kubeCRDClient.SetTenants(tenant)
 
 				controller.onAdd(tenant)
 
 			},
 			expectedFn: func(tenantName string) error {
-				// test ClusterRoleBinding created
-				err := testClusterRoleBindingCreated(t, client, tenantName)
-				if err != nil {
-					return err
-				}
 				// test user created
 				user, ok := osClient.Users[tenantID]
 				if !ok {
@@ -274,19 +260,15 @@ func TestOnAdd(t *testing.T) {
 			tenantName: "foo3",
 			updateFn: func(tenantName string) {
 
-				tenant := newTenant(tenantName, tenantName, password, "")
+				tenant := newTenant(tenantName, tenantName, "")
 				// Injects fake tenant.
 				osClient.SetTenant(tenantName, tenantID)
+				kubeCRDClient.SetTenants(tenant)
 
 				controller.onAdd(tenant)
 
 			},
 			expectedFn: func(tenantName string) error {
-				// test ClusterRoleBinding created
-				err := testClusterRoleBindingCreated(t, client, tenantName)
-				if err != nil {
-					return err
-				}
 				// test user created
 				tenant, _ := osClient.Tenants[tenantName]
 				user, ok := osClient.Users[tenant.ID]
@@ -309,19 +291,15 @@ func TestOnAdd(t *testing.T) {
 			tenantName: "foo4",
 			updateFn: func(tenantName string) {
 
-				tenant := newTenant(tenantName, tenantName, password, "")
+				tenant := newTenant(tenantName, tenantName, "")
 				// Injects error.
 				osClient.InjectError("CreateUser", fmt.Errorf("Failed create user"))
+				kubeCRDClient.SetTenants(tenant)
 
 				controller.onAdd(tenant)
 
 			},
 			expectedFn: func(tenantName string) error {
-				// test ClusterRoleBinding created
-				err := testClusterRoleBindingCreated(t, client, tenantName)
-				if err != nil {
-					return err
-				}
 				// test no user created
 				tenant, _ := osClient.Tenants[tenantName]
 				user, ok := osClient.Users[tenant.ID]
@@ -370,9 +348,14 @@ func TestOnDelete(t *testing.T) {
 				network := newNetwork(tenantName)
 				kubeCRDClient.SetNetworks(network)
 				// Add tenant
-				ns := newTenant(tenantName, tenantName, password, "")
+				ns := newTenant(tenantName, tenantName, "")
+				kubeCRDClient.SetTenants(ns)
 				controller.onAdd(ns)
 				tenantID = osClient.Tenants[tenantName].ID
+				// Injects ClusterRoleBindings generated by RBAC controller
+				for _, clusterRoleBinding := range rbac.DefaultTemplates().GenerateClusterRoleBindings(tenantName) {
+					client.Rbac().ClusterRoleBindings().Create(clusterRoleBinding)
+				}
 				// Delete tenant
 				controller.onDelete(ns)
 
@@ -398,6 +381,11 @@ func TestOnDelete(t *testing.T) {
 				if ok {
 					return fmt.Errorf("expected %s user to be deleted, got %v", tenantName, user)
 				}
+				// test generated password secret deleted
+				_, err = client.CoreV1().Secrets(DefaultPasswordNamespace).Get(tenantName+passwordSecretSuffix, apismetav1.GetOptions{})
+				if !apierrors.IsNotFound(err) {
+					return fmt.Errorf("expected password secret to be deleted, got error %v", err)
+				}
 				// test namespace deleted
 				err = testNamespaceDeleted(t, client, tenantName)
 				if err != nil {
@@ -421,10 +409,11 @@ func TestOnDelete(t *testing.T) {
 				kubeCRDClient.SetNetworks(network)
 
 				tenantID = "123"
-				ns := newTenant(tenantName, tenantName, password, tenantID)
+				ns := newTenant(tenantName, tenantName, tenantID)
 				// Injects fake tenant
 				osClient.SetTenant(tenantName, tenantID)
 				// Add tenant
+				kubeCRDClient.SetTenants(ns)
 				controller.onAdd(ns)
 				tenantID = osClient.Tenants[tenantName].ID
 				// Delete tenant
@@ -471,14 +460,227 @@ func TestOnDelete(t *testing.T) {
 	}
 }
 
-func testClusterRoleBindingCreated(t *testing.T, client *fake.Clientset, tenantName string) error {
-	clusterRoleBinding, err := client.Rbac().ClusterRoleBindings().Get(tenantName+"-namespace-creater", apismetav1.GetOptions{})
+func TestTeardown(t *testing.T) {
+	controller, kubeCRDClient, osClient, client, err := newTenantController()
 	if err != nil {
-		t.Fatalf("Failed get ClusterRoleBinding: %v", err)
+		t.Fatalf("Failed start a new fake TenantController")
+	}
+
+	tenantName := "foo"
+	tenant := newTenant(tenantName, tenantName, "")
+	kubeCRDClient.SetTenants(tenant)
+	controller.onAdd(tenant)
+	tenantID := osClient.Tenants[tenantName].ID
+
+	// Networks of the namespace are torn down by the network controller.
+	network := newNetwork("db")
+	network.Namespace = tenantName
+	kubeCRDClient.SetNetworks(network)
+
+	deleted := kubeCRDClient.Tenants[tenantName].DeepCopy()
+	now := apismetav1.Now()
+	deleted.DeletionTimestamp = &now
+	kubeCRDClient.SetTenants(deleted)
+	controller.onUpdate(tenant, deleted)
+
+	synced := kubeCRDClient.Tenants[tenantName]
+	if synced.Status.State != crv1.TenantTerminating || synced.Status.TeardownStep != crv1.TeardownNetworks {
+		t.Errorf("Expected tenant waiting for networks, got %v", synced.Status)
+	}
+	if !util.HasFinalizer(synced.Finalizers, crv1.TenantFinalizer) {
+		t.Errorf("Expected finalizer kept, got %v", synced.Finalizers)
+	}
+	if err := testNamespaceDeleted(t, client, tenantName); err != nil {
+		t.Error(err)
+	}
+	if _, ok := osClient.Users[tenantID]; !ok {
+		t.Errorf("Expected user kept until networks are torn down")
+	}
+
+	// Failed steps are resumed on resync.
+	delete(kubeCRDClient.Networks, network.Name)
+	osClient.InjectError("DeleteAllUsersOnTenant", fmt.Errorf("keystone unavailable"))
+	controller.onUpdate(synced, synced)
+	synced = kubeCRDClient.Tenants[tenantName]
+	if synced.Status.TeardownStep != crv1.TeardownUsers || synced.Status.Message == "" {
+		t.Errorf("Expected failed step %s reported, got %v", crv1.TeardownUsers, synced.Status)
+	}
+	if _, ok := osClient.Tenants[tenantName]; !ok {
+		t.Errorf("Expected project kept until users are deleted")
+	}
+
+	controller.onUpdate(synced, synced)
+	synced = kubeCRDClient.Tenants[tenantName]
+	if synced.Status.TeardownStep != crv1.TeardownCompleted {
+		t.Errorf("Expected teardown completed, got %v", synced.Status)
+	}
+	if util.HasFinalizer(synced.Finalizers, crv1.TenantFinalizer) {
+		t.Errorf("Expected finalizer removed, got %v", synced.Finalizers)
+	}
+	if _, ok := osClient.Users[tenantID]; ok {
+		t.Errorf("Expected user deleted")
+	}
+	if _, ok := osClient.Tenants[tenantName]; ok {
+		t.Errorf("Expected project deleted")
 	}
 
-	if !reflect.DeepEqual(clusterRoleBinding, rbac.GenerateClusterRoleBindingByTenant(tenantName)) {
-		return fmt.Errorf("created ClusterRoleBinding has incorrect parameters: %v", clusterRoleBinding)
+	// Torn down tenants are not cleaned up again.
+	calls := len(osClient.GetCalledNames())
+	controller.onDelete(synced)
+	if called := osClient.GetCalledNames(); len(called) != calls {
+		t.Errorf("Expected no calls, got %v", called[calls:])
+	}
+}
+
+func TestPasswordRotation(t *testing.T) {
+	controller, kubeCRDClient, osClient, client, err := newTenantController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake TenantController")
+	}
+	controller.tenantStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	tenantName := "foo"
+	secretName := "foo-credentials"
+	tenant := newTenant(tenantName, tenantName, "")
+	tenant.Spec.PasswordSecret = &crv1.SecretKeyReference{Name: secretName, Key: "token"}
+	kubeCRDClient.SetTenants(tenant)
+	if _, err := client.CoreV1().Secrets(DefaultPasswordNamespace).Create(newPasswordSecret(secretName, "1", password)); err != nil {
+		t.Fatalf("Failed create secret: %v", err)
+	}
+
+	// The user is created with the password of the referenced secret.
+	controller.onAdd(tenant)
+	if osClient.UserPasswords[tenantName] != password {
+		t.Errorf("Expected password %q, got %q", password, osClient.UserPasswords[tenantName])
+	}
+	synced := kubeCRDClient.Tenants[tenantName]
+	if synced.Annotations[passwordVersionAnnotation] != "1" {
+		t.Errorf("Expected password version 1, got %v", synced.Annotations)
+	}
+	controller.tenantStore.Add(synced)
+
+	// Unchanged secrets don't rotate the password.
+	calls := len(osClient.GetCalledNames())
+	controller.onSecretUpdate(newPasswordSecret(secretName, "1", password))
+	if called := osClient.GetCalledNames(); len(called) != calls {
+		t.Errorf("Expected no calls, got %v", called[calls:])
+	}
+
+	// Changed secrets rotate the password.
+	newPassword := "654321"
+	controller.onSecretUpdate(newPasswordSecret(secretName, "2", newPassword))
+	if osClient.UserPasswords[tenantName] != newPassword {
+		t.Errorf("Expected password %q, got %q", newPassword, osClient.UserPasswords[tenantName])
+	}
+	if version := kubeCRDClient.Tenants[tenantName].Annotations[passwordVersionAnnotation]; version != "2" {
+		t.Errorf("Expected password version 2, got %q", version)
+	}
+
+	// The referenced secret isn't deleted with the tenant.
+	controller.onDelete(tenant)
+	if _, err := client.CoreV1().Secrets(DefaultPasswordNamespace).Get(secretName, apismetav1.GetOptions{}); err != nil {
+		t.Errorf("Expected secret %s to be kept, got error %v", secretName, err)
+	}
+}
+
+func TestLegacyPassword(t *testing.T) {
+	controller, kubeCRDClient, osClient, client, err := newTenantController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake TenantController")
+	}
+
+	// The user of the tenant was created with the deprecated spec.password.
+	tenantName := "foo"
+	tenant := newTenant(tenantName, tenantName, "")
+	tenant.Spec.Password = password
+	kubeCRDClient.SetTenants(tenant)
+
+	// The generated secret holds the legacy password.
+	secret, err := controller.ensurePasswordSecret(tenant)
+	if err != nil {
+		t.Fatalf("Failed ensure password secret: %v", err)
+	}
+	if got := string(secret.Data[defaultPasswordKey]); got != password {
+		t.Errorf("Expected password %q in secret, got %q", password, got)
+	}
+	if _, err := client.CoreV1().Secrets(DefaultPasswordNamespace).Get(tenantName+passwordSecretSuffix, apismetav1.GetOptions{}); err != nil {
+		t.Errorf("Expected password secret to be created, got error %v", err)
+	}
+
+	// The legacy password is adopted without rotating.
+	secret.ResourceVersion = "1"
+	if err := controller.syncPassword(tenant, secret); err != nil {
+		t.Fatalf("Failed sync password: %v", err)
+	}
+	for _, name := range osClient.GetCalledNames() {
+		if name == "UpdateUserPassword" {
+			t.Errorf("Expected password not to be updated")
+		}
+	}
+	if version := kubeCRDClient.Tenants[tenantName].Annotations[passwordVersionAnnotation]; version != "1" {
+		t.Errorf("Expected password version 1, got %q", version)
+	}
+
+	// Secrets changed afterwards rotate the password.
+	newPassword := "654321"
+	osClient.UserPasswords[tenantName] = password
+	synced := kubeCRDClient.Tenants[tenantName]
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	secret.Data[defaultPasswordKey] = []byte(newPassword)
+	if err := controller.syncPassword(synced, secret); err != nil {
+		t.Fatalf("Failed sync password: %v", err)
+	}
+	if osClient.UserPasswords[tenantName] != newPassword {
+		t.Errorf("Expected password %q, got %q", newPassword, osClient.UserPasswords[tenantName])
+	}
+}
+
+func TestMoveLegacyPasswordSecret(t *testing.T) {
+	controller, _, _, client, err := newTenantController()
+	if err != nil {
+		t.Fatalf("Failed start a new fake TenantController")
+	}
+
+	// The password secret was generated in the legacy namespace.
+	tenantName := "foo"
+	tenant := newTenant(tenantName, tenantName, "")
+	legacy := newPasswordSecret(tenantName+passwordSecretSuffix, "", password)
+	legacy.Namespace = legacyPasswordNamespace
+	legacy.Labels = map[string]string{passwordSecretTenantLabel: tenantName}
+	legacy.Data = map[string][]byte{defaultPasswordKey: []byte(password)}
+	if _, err := client.CoreV1().Secrets(legacyPasswordNamespace).Create(legacy); err != nil {
+		t.Fatalf("Failed create secret: %v", err)
+	}
+
+	secret, err := controller.ensurePasswordSecret(tenant)
+	if err != nil {
+		t.Fatalf("Failed ensure password secret: %v", err)
+	}
+	if secret.Namespace != DefaultPasswordNamespace || string(secret.Data[defaultPasswordKey]) != password ||
+		secret.Labels[passwordSecretTenantLabel] != tenantName {
+		t.Errorf("Expected password secret moved with its password and labels, got %v", secret)
+	}
+	if _, err := client.CoreV1().Secrets(DefaultPasswordNamespace).Get(legacy.Name, apismetav1.GetOptions{}); err != nil {
+		t.Errorf("Expected password secret in namespace %s, got error %v", DefaultPasswordNamespace, err)
+	}
+	if _, err := client.CoreV1().Secrets(legacyPasswordNamespace).Get(legacy.Name, apismetav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected legacy password secret deleted, got %v", err)
+	}
+}
+
+func testPasswordSecretCreated(t *testing.T, client *fake.Clientset, osClient *openstack.FakeOSClient, tenantName string) error {
+	secret, err := client.CoreV1().Secrets(DefaultPasswordNamespace).Get(tenantName+passwordSecretSuffix, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get password secret: %v", err)
+	}
+
+	password := string(secret.Data[defaultPasswordKey])
+	if len(password) == 0 || secret.Labels[passwordSecretTenantLabel] != tenantName {
+		return fmt.Errorf("generated password secret has incorrect parameters: %v", secret)
+	}
+	if osClient.UserPasswords[tenantName] != password {
+		return fmt.Errorf("expected user password from secret %q, got %q", password, osClient.UserPasswords[tenantName])
 	}
 	return nil
 }
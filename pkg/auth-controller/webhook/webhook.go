@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.openstack.org/openstack/stackube/pkg/auth-controller/rbacmanager/rbac"
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+
+	"github.com/golang/glog"
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+)
+
+const (
+	// AuthenticatePath is the path TokenReviews are posted to.
+	AuthenticatePath = "/authenticate"
+
+	// extraProjectID is the key of the Keystone project ID in the extra of users.
+	extraProjectID = "stackube.kubernetes.io/project-id"
+
+	// systemPrefix is the prefix of the users and groups reserved by Kubernetes.
+	systemPrefix = "system:"
+	// groupSeparator separates the project and the role in the groups of project
+	// roles, so it's not allowed in project and role names.
+	groupSeparator = ":"
+)
+
+// Authenticator authenticates Keystone tokens for kube-apiserver by serving
+// TokenReviews of the token authentication webhook.
+type Authenticator struct {
+	osClient openstack.Interface
+}
+
+// NewAuthenticator creates a new Authenticator validating tokens with Keystone.
+func NewAuthenticator(osClient openstack.Interface) *Authenticator {
+	return &Authenticator{
+		osClient: osClient,
+	}
+}
+
+// userInfo maps the Keystone identity to the Kubernetes user. The username is
+// "keystone:<username>", the groups are "keystone:<project>" and
+// "keystone:<project>:<role>" for each role on the project, so that RoleBindings
+// of tenants apply to them.
+func userInfo(identity *openstack.TokenIdentity) authenticationv1beta1.UserInfo {
+	user := authenticationv1beta1.UserInfo{
+		Username: rbac.KeystoneUser(identity.UserName),
+		UID:      identity.UserID,
+	}
+	if identity.ProjectName == "" {
+		return user
+	}
+
+	user.Groups = append(user.Groups, rbac.ProjectGroup(identity.ProjectName))
+	for _, role := range identity.Roles {
+		// The group of the role would be taken as another project's.
+		if strings.Contains(role, groupSeparator) {
+			glog.Warningf("Omitted group of role %q of user %s with %q", role, identity.UserName, groupSeparator)
+			continue
+		}
+		user.Groups = append(user.Groups, rbac.ProjectRoleGroup(identity.ProjectName, role))
+	}
+	user.Extra = map[string]authenticationv1beta1.ExtraValue{
+		extraProjectID: {identity.ProjectID},
+	}
+	return user
+}
+
+// authenticate returns the status of reviewing the token. Invalid tokens are
+// unauthenticated, failures of validating tokens are reported as errors.
+func (a *Authenticator) authenticate(token string) authenticationv1beta1.TokenReviewStatus {
+	if token == "" {
+		return authenticationv1beta1.TokenReviewStatus{}
+	}
+
+	identity, err := a.osClient.AuthenticateToken(token)
+	if err != nil {
+		if err == openstack.ErrInvalidToken {
+			return authenticationv1beta1.TokenReviewStatus{}
+		}
+		glog.Errorf("Failed validate token: %v", err)
+		return authenticationv1beta1.TokenReviewStatus{
+			Error: fmt.Sprintf("failed validate token: %v", err),
+		}
+	}
+
+	// Keystone names can't pretend to be users or groups of Kubernetes.
+	if strings.HasPrefix(identity.UserName, systemPrefix) || strings.HasPrefix(identity.ProjectName, systemPrefix) {
+		glog.Warningf("Rejected token of user %s of project %q with reserved name", identity.UserName, identity.ProjectName)
+		return authenticationv1beta1.TokenReviewStatus{}
+	}
+	// Groups of projects with the separator would clash with groups of project roles.
+	if strings.Contains(identity.ProjectName, groupSeparator) {
+		glog.Warningf("Rejected token of user %s of project %q with %q", identity.UserName, identity.ProjectName, groupSeparator)
+		return authenticationv1beta1.TokenReviewStatus{}
+	}
+
+	glog.V(4).Infof("Authenticated user %s of project %q", identity.UserName, identity.ProjectName)
+	return authenticationv1beta1.TokenReviewStatus{
+		Authenticated: true,
+		User:          userInfo(identity),
+	}
+}
+
+// ServeHTTP reviews the TokenReview posted by kube-apiserver.
+func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	review := &authenticationv1beta1.TokenReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+		http.Error(w, fmt.Sprintf("failed decode TokenReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review.Status = a.authenticate(review.Spec.Token)
+	// Don't send the token back.
+	review.Spec = authenticationv1beta1.TokenReviewSpec{}
+	if review.APIVersion == "" {
+		review.APIVersion = authenticationv1beta1.SchemeGroupVersion.String()
+	}
+	if review.Kind == "" {
+		review.Kind = "TokenReview"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		glog.Errorf("Failed write TokenReview: %v", err)
+	}
+}
+
+// Serve serves TokenReviews on /authenticate at address until stopCh is closed,
+// over TLS with certFile and keyFile if they are given.
+func (a *Authenticator) Serve(address, certFile, keyFile string, stopCh <-chan struct{}) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("both TLS certificate and private key of authentication webhook are required")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(AuthenticatePath, a)
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	var err error
+	if certFile == "" {
+		glog.Warningf("Serving authentication webhook on %s without TLS, tokens are sent in plain text", address)
+		err = server.ListenAndServe()
+	} else {
+		glog.Infof("Serving authentication webhook on %s", address)
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
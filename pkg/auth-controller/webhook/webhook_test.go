@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+)
+
+func reviewToken(t *testing.T, authenticator *Authenticator, token string) *authenticationv1beta1.TokenReview {
+	body := fmt.Sprintf(`{"apiVersion":"authentication.k8s.io/v1beta1","kind":"TokenReview","spec":{"token":%q}}`, token)
+	recorder := httptest.NewRecorder()
+	authenticator.ServeHTTP(recorder, httptest.NewRequest("POST", AuthenticatePath, strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	review := &authenticationv1beta1.TokenReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), review); err != nil {
+		t.Fatalf("Failed decode TokenReview: %v", err)
+	}
+	if review.Spec.Token != "" {
+		t.Errorf("Expected token not to be sent back, got %q", review.Spec.Token)
+	}
+	return review
+}
+
+func TestAuthenticate(t *testing.T) {
+	osClient := openstack.NewFake(nil)
+	osClient.SetTokenIdentity("project-token", &openstack.TokenIdentity{
+		UserID:      "u1",
+		UserName:    "alice",
+		ProjectID:   "p1",
+		ProjectName: "test",
+		Roles:       []string{"member", "admin"},
+	})
+	osClient.SetTokenIdentity("unscoped-token", &openstack.TokenIdentity{
+		UserID:   "u2",
+		UserName: "bob",
+	})
+	osClient.SetTokenIdentity("system-user-token", &openstack.TokenIdentity{
+		UserID:   "u3",
+		UserName: "system:admin",
+	})
+	osClient.SetTokenIdentity("system-project-token", &openstack.TokenIdentity{
+		UserID:      "u4",
+		UserName:    "carol",
+		ProjectID:   "p2",
+		ProjectName: "system:masters",
+		Roles:       []string{"member"},
+	})
+	osClient.SetTokenIdentity("colon-project-token", &openstack.TokenIdentity{
+		UserID:      "u5",
+		UserName:    "dave",
+		ProjectID:   "p3",
+		ProjectName: "test:admin",
+		Roles:       []string{"member"},
+	})
+	osClient.SetTokenIdentity("colon-role-token", &openstack.TokenIdentity{
+		UserID:      "u6",
+		UserName:    "eve",
+		ProjectID:   "p1",
+		ProjectName: "test",
+		Roles:       []string{"member", "admin:x"},
+	})
+	authenticator := NewAuthenticator(osClient)
+
+	testCases := []struct {
+		name     string
+		token    string
+		inject   error
+		expected authenticationv1beta1.TokenReviewStatus
+	}{
+		{
+			name:  "project scoped token",
+			token: "project-token",
+			expected: authenticationv1beta1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1beta1.UserInfo{
+					Username: "keystone:alice",
+					UID:      "u1",
+					Groups:   []string{"keystone:test", "keystone:test:member", "keystone:test:admin"},
+					Extra: map[string]authenticationv1beta1.ExtraValue{
+						extraProjectID: {"p1"},
+					},
+				},
+			},
+		},
+		{
+			name:  "unscoped token",
+			token: "unscoped-token",
+			expected: authenticationv1beta1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1beta1.UserInfo{
+					Username: "keystone:bob",
+					UID:      "u2",
+				},
+			},
+		},
+		{
+			name:     "system user",
+			token:    "system-user-token",
+			expected: authenticationv1beta1.TokenReviewStatus{},
+		},
+		{
+			name:     "system project",
+			token:    "system-project-token",
+			expected: authenticationv1beta1.TokenReviewStatus{},
+		},
+		{
+			name:     "project with separator",
+			token:    "colon-project-token",
+			expected: authenticationv1beta1.TokenReviewStatus{},
+		},
+		{
+			name:  "role with separator",
+			token: "colon-role-token",
+			expected: authenticationv1beta1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1beta1.UserInfo{
+					Username: "keystone:eve",
+					UID:      "u6",
+					Groups:   []string{"keystone:test", "keystone:test:member"},
+					Extra: map[string]authenticationv1beta1.ExtraValue{
+						extraProjectID: {"p1"},
+					},
+				},
+			},
+		},
+		{
+			name:     "invalid token",
+			token:    "invalid-token",
+			expected: authenticationv1beta1.TokenReviewStatus{},
+		},
+		{
+			name:   "keystone failure",
+			token:  "project-token",
+			inject: fmt.Errorf("keystone unavailable"),
+			expected: authenticationv1beta1.TokenReviewStatus{
+				Error: "failed validate token: keystone unavailable",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		if tc.inject != nil {
+			osClient.InjectError("AuthenticateToken", tc.inject)
+		}
+		review := reviewToken(t, authenticator, tc.token)
+		if review.Kind != "TokenReview" || review.APIVersion != "authentication.k8s.io/v1beta1" {
+			t.Errorf("%s: expected TokenReview of authentication.k8s.io/v1beta1, got %s of %s", tc.name, review.Kind, review.APIVersion)
+		}
+		if !reflect.DeepEqual(review.Status, tc.expected) {
+			t.Errorf("%s: expected status %+v, got %+v", tc.name, tc.expected, review.Status)
+		}
+	}
+}
+
+func TestServeHTTPRejectsBadRequests(t *testing.T) {
+	authenticator := NewAuthenticator(openstack.NewFake(nil))
+
+	recorder := httptest.NewRecorder()
+	authenticator.ServeHTTP(recorder, httptest.NewRequest("GET", AuthenticatePath, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	authenticator.ServeHTTP(recorder, httptest.NewRequest("POST", AuthenticatePath, strings.NewReader("{")))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for malformed body, got %d", recorder.Code)
+	}
+}
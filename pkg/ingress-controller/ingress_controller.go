@@ -0,0 +1,458 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	informersV1 "k8s.io/client-go/informers/core/v1"
+	extensionsinformers "k8s.io/client-go/informers/extensions/v1beta1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+	"git.openstack.org/openstack/stackube/pkg/util"
+	"github.com/golang/glog"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+
+	concurrentIngressSyncs = 1
+)
+
+// Controller programs a LBaaS load balancer for the ingresses of each namespace.
+//
+// The load balancer has a HTTP listener, and a HTTPS listener terminating TLS with
+// the certificates of the ingresses if there are any. Each backend service port gets
+// a pool, whose members are kept in sync with the endpoints of the service, and each
+// host and path of the ingresses gets a L7 policy redirecting to the pool.
+type Controller struct {
+	kubeClient        kubernetes.Interface
+	osClient          openstack.Interface
+	factory           informers.SharedInformerFactory
+	ingressInformer   extensionsinformers.IngressInformer
+	serviceInformer   informersV1.ServiceInformer
+	endpointsInformer informersV1.EndpointsInformer
+	secretInformer    informersV1.SecretInformer
+
+	// namespaces whose ingresses need to be synced
+	queue workqueue.RateLimitingInterface
+
+	certificatesLock sync.Mutex
+	// certificates maps namespaces to the certificates kept by the last cleanup,
+	// which is skipped while the ingresses keep using the same certificates.
+	certificates map[string]string
+}
+
+// NewIngressController returns a new Ingress controller.
+func NewIngressController(kubeClient kubernetes.Interface, osClient openstack.Interface) (*Controller, error) {
+	factory := informers.NewSharedInformerFactory(kubeClient, resyncPeriod)
+	c := &Controller{
+		kubeClient:        kubeClient,
+		osClient:          osClient,
+		factory:           factory,
+		ingressInformer:   factory.Extensions().V1beta1().Ingresses(),
+		serviceInformer:   factory.Core().V1().Services(),
+		endpointsInformer: factory.Core().V1().Endpoints(),
+		secretInformer:    factory.Core().V1().Secrets(),
+		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ingress"),
+		certificates:      make(map[string]string),
+	}
+
+	c.ingressInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueNamespace,
+		UpdateFunc: func(old, cur interface{}) {
+			oldIngress := old.(*extensions.Ingress)
+			curIngress := cur.(*extensions.Ingress)
+			if !reflect.DeepEqual(oldIngress.Spec, curIngress.Spec) ||
+				!reflect.DeepEqual(oldIngress.Annotations, curIngress.Annotations) {
+				c.enqueueNamespace(cur)
+			}
+		},
+		DeleteFunc: c.enqueueNamespace,
+	})
+
+	c.serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueIngressNamespace,
+		UpdateFunc: func(old, cur interface{}) {
+			oldService := old.(*v1.Service)
+			curService := cur.(*v1.Service)
+			if !reflect.DeepEqual(oldService.Spec.Ports, curService.Spec.Ports) {
+				c.enqueueIngressNamespace(cur)
+			}
+		},
+		DeleteFunc: c.enqueueIngressNamespace,
+	})
+
+	c.endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueIngressNamespace,
+		UpdateFunc: func(old, cur interface{}) {
+			oldEndpoints := old.(*v1.Endpoints)
+			curEndpoints := cur.(*v1.Endpoints)
+			if !reflect.DeepEqual(oldEndpoints.Subsets, curEndpoints.Subsets) {
+				c.enqueueIngressNamespace(cur)
+			}
+		},
+		DeleteFunc: c.enqueueIngressNamespace,
+	})
+
+	// Certificates are rotated when the secrets are updated.
+	c.secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueIngressNamespace,
+		UpdateFunc: func(old, cur interface{}) {
+			oldSecret := old.(*v1.Secret)
+			curSecret := cur.(*v1.Secret)
+			if oldSecret.ResourceVersion != curSecret.ResourceVersion {
+				c.enqueueIngressNamespace(cur)
+			}
+		},
+	})
+
+	return c, nil
+}
+
+// Run starts workers which sync the load balancers of ingresses.
+func (c *Controller) Run(stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	glog.Info("Starting ingress controller")
+	defer glog.Info("Shutting down ingress controller")
+
+	go c.factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.ingressInformer.Informer().HasSynced,
+		c.serviceInformer.Informer().HasSynced, c.endpointsInformer.Informer().HasSynced,
+		c.secretInformer.Informer().HasSynced) {
+		return fmt.Errorf("failed to cache ingresses, services, endpoints and secrets")
+	}
+
+	for i := 0; i < concurrentIngressSyncs; i++ {
+		go wait.Until(c.worker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	return nil
+}
+
+// enqueueNamespace enqueues the namespace of the object.
+func (c *Controller) enqueueNamespace(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", obj, err)
+		return
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		glog.Errorf("Couldn't split key %q: %v", key, err)
+		return
+	}
+	c.queue.Add(namespace)
+}
+
+// enqueueIngressNamespace enqueues the namespace of the object if it has ingresses.
+func (c *Controller) enqueueIngressNamespace(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", obj, err)
+		return
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		glog.Errorf("Couldn't split key %q: %v", key, err)
+		return
+	}
+
+	ingresses, err := c.ingressInformer.Lister().Ingresses(namespace).List(labels.Everything())
+	if err != nil {
+		glog.Errorf("List ingresses in namespace %s failed: %v", namespace, err)
+		return
+	}
+	if len(ingresses) > 0 {
+		c.queue.Add(namespace)
+	}
+}
+
+func (c *Controller) worker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.syncNamespace(key.(string)); err != nil {
+		glog.Errorf("Error syncing ingresses of namespace %q (will retry): %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// syncNamespace ensures the load balancer of the ingresses in the namespace, or deletes
+// it if there are no ingresses any more.
+func (c *Controller) syncNamespace(namespace string) error {
+	startTime := time.Now()
+	defer func() {
+		glog.V(4).Infof("Finished syncing ingresses of namespace %q (%v)", namespace, time.Now().Sub(startTime))
+	}()
+
+	allIngresses, err := c.ingressInformer.Lister().Ingresses(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	var ingresses []*extensions.Ingress
+	for _, ingress := range allIngresses {
+		if isStackubeIngress(ingress) {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+
+	lbName := buildLoadBalancerName(namespace)
+	if len(ingresses) == 0 {
+		return c.deleteLoadBalancer(namespace)
+	}
+	sortIngresses(ingresses)
+
+	// The load balancer is on the default network of the namespace.
+	name, err := util.GetNetworkName(c.kubeClient, namespace, nil)
+	if err != nil {
+		glog.Errorf("Get network name for namespace %q failed: %v", namespace, err)
+		return err
+	}
+	networkName := util.BuildNetworkName(namespace, name)
+	network, err := c.osClient.GetNetworkByName(networkName)
+	if err != nil {
+		glog.Errorf("Get network by name %q failed: %v", networkName, err)
+		return err
+	}
+	vipSubnet, err := openstack.VIPSubnet(network)
+	if err != nil {
+		glog.Errorf("Get VIP subnet for ingresses of namespace %q failed: %v", namespace, err)
+		return err
+	}
+
+	rules, ingressBackends := buildIngressRules(ingresses)
+	backends := make([]openstack.IngressBackend, 0, len(ingressBackends))
+	for _, backend := range ingressBackends {
+		backends = append(backends, openstack.IngressBackend{
+			Name:      buildBackendName(backend),
+			Endpoints: c.getBackendEndpoints(namespace, backend),
+		})
+	}
+
+	certificateRefs, err := c.ensureCertificates(namespace, ingresses)
+	if err != nil {
+		glog.Errorf("Ensure certificates for ingresses of namespace %q failed: %v", namespace, err)
+		return err
+	}
+
+	lb, err := c.osClient.EnsureIngressLoadBalancer(&openstack.IngressLoadBalancer{
+		Name:             lbName,
+		TenantID:         network.TenantID,
+		SubnetID:         vipSubnet.Uid,
+		MemberSubnets:    network.Subnets,
+		FloatingNetwork:  ingresses[0].Annotations[util.FloatingNetworkAnnotation],
+		TLSContainerRefs: certificateRefs,
+		Backends:         backends,
+		Rules:            rules,
+	})
+	if err != nil {
+		glog.Errorf("EnsureIngressLoadBalancer %q failed: %v", lbName, err)
+		return err
+	}
+
+	// the listeners don't refer to old certificates any more.
+	if err := c.deleteObsoleteCertificates(namespace, certificateRefs); err != nil {
+		return err
+	}
+
+	status := v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{{IP: lb.ExternalIP}},
+	}
+	for _, ingress := range ingresses {
+		if err := c.updateStatus(ingress, status); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBackendEndpoints returns the endpoints of the backend, which are empty if the
+// service doesn't exist yet.
+func (c *Controller) getBackendEndpoints(namespace string, backend *extensions.IngressBackend) []openstack.Endpoint {
+	service, err := c.serviceInformer.Lister().Services(namespace).Get(backend.ServiceName)
+	if err != nil {
+		glog.V(4).Infof("Get service %s/%s for ingress failed: %v", namespace, backend.ServiceName, err)
+		return nil
+	}
+	servicePort, err := getServicePort(service, backend)
+	if err != nil {
+		glog.Warningf("Ingress backend %s is invalid: %v", buildBackendName(backend), err)
+		return nil
+	}
+	endpoints, err := c.endpointsInformer.Lister().Endpoints(namespace).Get(backend.ServiceName)
+	if err != nil {
+		glog.V(4).Infof("Get endpoints %s/%s for ingress failed: %v", namespace, backend.ServiceName, err)
+		return nil
+	}
+
+	return getEndpoints(endpoints, servicePort)
+}
+
+// ensureCertificates stores the certificates of the TLS secrets of ingresses and returns
+// their references.
+func (c *Controller) ensureCertificates(namespace string, ingresses []*extensions.Ingress) ([]string, error) {
+	var refs []string
+	seenSecrets := make(map[string]bool)
+	for _, ingress := range ingresses {
+		for _, tls := range ingress.Spec.TLS {
+			if tls.SecretName == "" || seenSecrets[tls.SecretName] {
+				continue
+			}
+			seenSecrets[tls.SecretName] = true
+
+			store := c.osClient.GetCertificateStore()
+			if store == nil {
+				return nil, fmt.Errorf("certificate store is not available")
+			}
+
+			secret, err := c.secretInformer.Lister().Secrets(namespace).Get(tls.SecretName)
+			if err != nil {
+				return nil, err
+			}
+			if secret.Type != v1.SecretTypeTLS {
+				return nil, fmt.Errorf("secret %s/%s is not of type %s", secret.Namespace, secret.Name, v1.SecretTypeTLS)
+			}
+			certificate, privateKey := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+			if len(certificate) == 0 || len(privateKey) == 0 {
+				return nil, fmt.Errorf("secret %s/%s has no certificate or private key", secret.Namespace, secret.Name)
+			}
+
+			ref, err := store.EnsureCertificate(buildCertificateName(namespace, certificate, privateKey),
+				certificate, privateKey)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, nil
+}
+
+// deleteObsoleteCertificates deletes certificates of the namespace except the ones in use.
+func (c *Controller) deleteObsoleteCertificates(namespace string, keepRefs []string) error {
+	store := c.osClient.GetCertificateStore()
+	if store == nil {
+		return nil
+	}
+
+	keep := make(map[string]bool)
+	for _, ref := range keepRefs {
+		keep[ref] = true
+	}
+	kept := make([]string, 0, len(keep))
+	for ref := range keep {
+		kept = append(kept, ref)
+	}
+	sort.Strings(kept)
+
+	c.certificatesLock.Lock()
+	defer c.certificatesLock.Unlock()
+	if last, ok := c.certificates[namespace]; ok && last == strings.Join(kept, ",") {
+		return nil
+	}
+
+	refs, err := store.ListCertificates(buildCertificatePrefix(namespace))
+	if err != nil {
+		glog.Errorf("List certificates of namespace %q failed: %v", namespace, err)
+		return err
+	}
+	for name, ref := range refs {
+		if keep[ref] {
+			continue
+		}
+		if err := store.DeleteCertificate(ref); err != nil {
+			glog.Errorf("Delete certificate %q failed: %v", name, err)
+			return err
+		}
+		glog.V(3).Infof("Certificate %q of ingresses in namespace %q deleted", name, namespace)
+	}
+	c.certificates[namespace] = strings.Join(kept, ",")
+
+	return nil
+}
+
+// deleteLoadBalancer deletes the load balancer and certificates of the namespace.
+func (c *Controller) deleteLoadBalancer(namespace string) error {
+	lbName := buildLoadBalancerName(namespace)
+	exists, err := c.osClient.LoadBalancerExist(lbName)
+	if err != nil {
+		glog.Errorf("Check load balancer %q failed: %v", lbName, err)
+		return err
+	}
+	if exists {
+		if err := c.osClient.EnsureLoadBalancerDeleted(lbName); err != nil {
+			glog.Errorf("Delete load balancer %q failed: %v", lbName, err)
+			return err
+		}
+		glog.V(3).Infof("Load balancer of ingresses in namespace %q deleted", namespace)
+	}
+
+	return c.deleteObsoleteCertificates(namespace, nil)
+}
+
+// updateStatus reports the load balancer in the ingress status.
+func (c *Controller) updateStatus(ingress *extensions.Ingress, status v1.LoadBalancerStatus) error {
+	if reflect.DeepEqual(ingress.Status.LoadBalancer, status) {
+		return nil
+	}
+
+	// Make a copy so we don't mutate the shared informer cache
+	updated := &extensions.Ingress{}
+	ingress.DeepCopyInto(updated)
+	updated.Status.LoadBalancer = status
+	_, err := c.kubeClient.Extensions().Ingresses(updated.Namespace).UpdateStatus(updated)
+	if err != nil && !errors.IsNotFound(err) {
+		glog.Errorf("Update status of ingress %s/%s failed: %v", ingress.Namespace, ingress.Name, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+)
+
+const (
+	lbPrefix = "stackube-ingress"
+
+	// ingressClassAnnotation selects the controller of an ingress, ingresses without
+	// it or with stackubeIngressClass are handled by stackube.
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+	stackubeIngressClass   = "stackube"
+)
+
+// buildLoadBalancerName returns the name of the load balancer of the namespace, which
+// doesn't match load balancers of services.
+func buildLoadBalancerName(namespace string) string {
+	return fmt.Sprintf("%s_%s", lbPrefix, namespace)
+}
+
+// buildCertificatePrefix returns the name prefix of the certificates of the namespace.
+func buildCertificatePrefix(namespace string) string {
+	return buildLoadBalancerName(namespace) + "_"
+}
+
+// buildCertificateName names the certificate by its content, so a changed secret
+// gets a new certificate.
+func buildCertificateName(namespace string, certificate, privateKey []byte) string {
+	hash := sha256.Sum256(append(append([]byte{}, certificate...), privateKey...))
+	return fmt.Sprintf("%s%x", buildCertificatePrefix(namespace), hash[:5])
+}
+
+// buildBackendName returns the name of the pool of the service port.
+func buildBackendName(backend *extensions.IngressBackend) string {
+	return fmt.Sprintf("%s-%s", backend.ServiceName, backend.ServicePort.String())
+}
+
+// isStackubeIngress returns whether the ingress should be handled by stackube.
+func isStackubeIngress(ingress *extensions.Ingress) bool {
+	class := ingress.Annotations[ingressClassAnnotation]
+	return class == "" || class == stackubeIngressClass
+}
+
+// sortIngresses sorts ingresses by name, which decides the precedence of duplicated rules.
+func sortIngresses(ingresses []*extensions.Ingress) {
+	sort.Slice(ingresses, func(i, j int) bool {
+		return ingresses[i].Name < ingresses[j].Name
+	})
+}
+
+// buildIngressRules translates the rules and default backends of ingresses to load
+// balancer rules and returns them with the backends they refer to. A host and path
+// claimed by several ingresses is routed by the first one.
+func buildIngressRules(ingresses []*extensions.Ingress) ([]openstack.IngressRule, []*extensions.IngressBackend) {
+	var rules []openstack.IngressRule
+	var backends []*extensions.IngressBackend
+	seenRules := make(map[string]bool)
+	seenBackends := make(map[string]bool)
+
+	addRule := func(host, path string, backend *extensions.IngressBackend) {
+		if path == "" {
+			path = "/"
+		}
+		key := host + "\n" + path
+		if seenRules[key] {
+			return
+		}
+		seenRules[key] = true
+
+		name := buildBackendName(backend)
+		rules = append(rules, openstack.IngressRule{Host: host, Path: path, Backend: name})
+		if !seenBackends[name] {
+			seenBackends[name] = true
+			backends = append(backends, backend)
+		}
+	}
+
+	for _, ingress := range ingresses {
+		for _, rule := range ingress.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for i := range rule.HTTP.Paths {
+				addRule(rule.Host, rule.HTTP.Paths[i].Path, &rule.HTTP.Paths[i].Backend)
+			}
+		}
+	}
+	// Default backends match all requests, they are added last so that they
+	// never hide the rules of other ingresses.
+	for _, ingress := range ingresses {
+		if ingress.Spec.Backend != nil {
+			addRule("", "/", ingress.Spec.Backend)
+		}
+	}
+
+	return rules, backends
+}
+
+// getServicePort returns the port of the service referred by the backend.
+func getServicePort(service *v1.Service, backend *extensions.IngressBackend) (*v1.ServicePort, error) {
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+		if port.Protocol == v1.ProtocolUDP {
+			continue
+		}
+		if (backend.ServicePort.Type == intstr.String && port.Name == backend.ServicePort.StrVal) ||
+			(backend.ServicePort.Type == intstr.Int && port.Port == backend.ServicePort.IntVal) {
+			return port, nil
+		}
+	}
+
+	return nil, fmt.Errorf("service %s/%s has no TCP port %s", service.Namespace, service.Name,
+		backend.ServicePort.String())
+}
+
+// getEndpoints returns the endpoints of the service port, endpoint ports are matched
+// with service ports by name, which may be empty for single port services.
+func getEndpoints(endpoints *v1.Endpoints, servicePort *v1.ServicePort) []openstack.Endpoint {
+	results := make([]openstack.Endpoint, 0)
+	for i := range endpoints.Subsets {
+		ep := endpoints.Subsets[i]
+		for _, port := range ep.Ports {
+			if port.Name != servicePort.Name {
+				continue
+			}
+			for _, ip := range ep.Addresses {
+				results = append(results, openstack.Endpoint{
+					Address: ip.IP,
+					Port:    int(port.Port),
+				})
+			}
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const namespace = "test"
+
+func newController(t *testing.T) (*Controller, *openstack.FakeOSClient, *fake.Clientset) {
+	osClient := openstack.NewFake(nil)
+	osClient.SetNetwork(&drivertypes.Network{
+		Name:     "kube-test-test",
+		TenantID: "123",
+		Subnets: []*drivertypes.Subnet{
+			{Uid: "789", Name: "kube-test-test-v6-subnet", Cidr: "fd00::/64"},
+			{Uid: "456", Name: "kube-test-test-subnet", Cidr: "10.0.0.0/24"},
+		},
+	})
+	client := fake.NewSimpleClientset()
+
+	controller, err := NewIngressController(client, osClient)
+	if err != nil {
+		t.Fatalf("Create ingress controller failed: %v", err)
+	}
+
+	controller.serviceInformer.Informer().GetStore().Add(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+				{Name: "admin", Port: 8081, Protocol: v1.ProtocolTCP},
+			},
+		},
+	})
+	controller.endpointsInformer.Informer().GetStore().Add(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.244.0.10"}},
+			Ports: []v1.EndpointPort{
+				{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP},
+				{Name: "admin", Port: 9090, Protocol: v1.ProtocolTCP},
+			},
+		}},
+	})
+
+	return controller, osClient, client
+}
+
+func newIngress(name string) *extensions.Ingress {
+	return &extensions.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: extensions.IngressSpec{
+			Rules: []extensions.IngressRule{{
+				Host: "foo.example.com",
+				IngressRuleValue: extensions.IngressRuleValue{
+					HTTP: &extensions.HTTPIngressRuleValue{
+						Paths: []extensions.HTTPIngressPath{
+							{Path: "/", Backend: extensions.IngressBackend{ServiceName: "web", ServicePort: intstr.FromInt(80)}},
+							{Path: "/admin", Backend: extensions.IngressBackend{ServiceName: "web", ServicePort: intstr.FromString("admin")}},
+						},
+					},
+				},
+			}},
+		},
+	}
+}
+
+func TestBuildIngressRules(t *testing.T) {
+	first := newIngress("a")
+	second := newIngress("b")
+	second.Spec.Backend = &extensions.IngressBackend{ServiceName: "default", ServicePort: intstr.FromInt(80)}
+
+	rules, backends := buildIngressRules([]*extensions.Ingress{first, second})
+	expected := []openstack.IngressRule{
+		{Host: "foo.example.com", Path: "/", Backend: "web-80"},
+		{Host: "foo.example.com", Path: "/admin", Backend: "web-admin"},
+		{Host: "", Path: "/", Backend: "default-80"},
+	}
+	if !reflect.DeepEqual(expected, rules) {
+		t.Errorf("Expected rules %v, got %v", expected, rules)
+	}
+	if len(backends) != 3 {
+		t.Errorf("Expected 3 backends, got %v", backends)
+	}
+}
+
+func TestSyncNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stackube-certificates")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := openstack.NewFileCertificateStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	controller, osClient, client := newController(t)
+	osClient.CertificateStore = store
+
+	ingress := newIngress("web")
+	ingress.Spec.TLS = []extensions.IngressTLS{{Hosts: []string{"foo.example.com"}, SecretName: "web-tls"}}
+	client.Extensions().Ingresses(namespace).Create(ingress)
+	controller.ingressInformer.Informer().GetStore().Add(ingress)
+	// Ingresses of other controllers are ignored.
+	other := newIngress("other")
+	other.Annotations = map[string]string{ingressClassAnnotation: "nginx"}
+	controller.ingressInformer.Informer().GetStore().Add(other)
+	controller.secretInformer.Informer().GetStore().Add(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: namespace},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       []byte("cert"),
+			v1.TLSPrivateKeyKey: []byte("key"),
+		},
+	})
+
+	if err := controller.syncNamespace(namespace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lbName := buildLoadBalancerName(namespace)
+	lb, ok := osClient.IngressLoadBalancers[lbName]
+	if !ok {
+		t.Fatalf("Expected load balancer %s, got %v", lbName, osClient.IngressLoadBalancers)
+	}
+	// The VIP is on the primary IPv4 subnet, not on the first one.
+	if lb.TenantID != "123" || lb.SubnetID != "456" || len(lb.MemberSubnets) != 2 || len(lb.TLSContainerRefs) != 1 {
+		t.Errorf("Unexpected load balancer %v", lb)
+	}
+	expectedBackends := []openstack.IngressBackend{
+		{Name: "web-80", Endpoints: []openstack.Endpoint{{Address: "10.244.0.10", Port: 8080}}},
+		{Name: "web-admin", Endpoints: []openstack.Endpoint{{Address: "10.244.0.10", Port: 9090}}},
+	}
+	if !reflect.DeepEqual(expectedBackends, lb.Backends) {
+		t.Errorf("Expected backends %v, got %v", expectedBackends, lb.Backends)
+	}
+
+	updated, err := client.Extensions().Ingresses(namespace).Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedStatus := v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: lb.ExternalIP}}}
+	if !reflect.DeepEqual(expectedStatus, updated.Status.LoadBalancer) {
+		t.Errorf("Expected status %v, got %v", expectedStatus, updated.Status.LoadBalancer)
+	}
+
+	// The load balancer and certificates are deleted with the last ingress.
+	controller.ingressInformer.Informer().GetStore().Delete(ingress)
+	if err := controller.syncNamespace(namespace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(osClient.IngressLoadBalancers) != 0 {
+		t.Errorf("Expected no load balancers, got %v", osClient.IngressLoadBalancers)
+	}
+	certificates, _ := store.ListCertificates(buildCertificatePrefix(namespace))
+	if len(certificates) != 0 {
+		t.Errorf("Expected no certificates, got %v", certificates)
+	}
+}
@@ -40,6 +40,10 @@ type Interface interface {
 	UpdateTenant(tenant *crv1.Tenant) error
 	// AddNetwork adds Network CRD object by given object.
 	AddNetwork(network *crv1.Network) error
+	// GetNetwork returns Network CRD object by namespace and networkName.
+	GetNetwork(namespace, networkName string) (*crv1.Network, error)
+	// ListNetworks returns Network CRD objects in the namespace.
+	ListNetworks(namespace string) ([]crv1.Network, error)
 	// UpdateNetwork updates Network CRD object by given object.
 	UpdateNetwork(network *crv1.Network) error
 	// DeleteNetwork deletes Network CRD object by networkName.
@@ -91,6 +95,7 @@ func (c *CRDClient) Scheme() *runtime.Scheme {
 }
 
 // UpdateNetwork updates Network CRD object by given object.
+// The object is refreshed with the updated one, so it could be updated again.
 func (c *CRDClient) UpdateNetwork(network *crv1.Network) error {
 	err := c.client.Put().
 		Name(network.Name).
@@ -98,7 +103,7 @@ func (c *CRDClient) UpdateNetwork(network *crv1.Network) error {
 		Resource(crv1.NetworkResourcePlural).
 		Body(network).
 		Do().
-		Error()
+		Into(network)
 
 	if err != nil {
 		glog.Errorf("ERROR updating network: %v\n", err)
@@ -108,7 +113,8 @@ func (c *CRDClient) UpdateNetwork(network *crv1.Network) error {
 	return nil
 }
 
-// UpdateTenant updates Network CRD object by given object.
+// UpdateTenant updates Tenant CRD object by given object.
+// The object is refreshed with the updated one, so it could be updated again.
 func (c *CRDClient) UpdateTenant(tenant *crv1.Tenant) error {
 	err := c.client.Put().
 		Name(tenant.Name).
@@ -116,7 +122,7 @@ func (c *CRDClient) UpdateTenant(tenant *crv1.Tenant) error {
 		Resource(crv1.TenantResourcePlural).
 		Body(tenant).
 		Do().
-		Error()
+		Into(tenant)
 
 	if err != nil {
 		glog.Errorf("ERROR updating tenant: %v\n", err)
@@ -169,7 +175,35 @@ func (c *CRDClient) AddNetwork(network *crv1.Network) error {
 	return nil
 }
 
-// DeleteNetwork deletes Network CRD object by networkName.
+// GetNetwork returns Network CRD object by namespace and networkName.
+func (c *CRDClient) GetNetwork(namespace, networkName string) (*crv1.Network, error) {
+	network := crv1.Network{}
+	err := c.client.Get().
+		Resource(crv1.NetworkResourcePlural).
+		Namespace(namespace).
+		Name(networkName).
+		Do().Into(&network)
+	if err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+// ListNetworks returns Network CRD objects in the namespace.
+func (c *CRDClient) ListNetworks(namespace string) ([]crv1.Network, error) {
+	networks := crv1.NetworkList{}
+	err := c.client.Get().
+		Resource(crv1.NetworkResourcePlural).
+		Namespace(namespace).
+		Do().Into(&networks)
+	if err != nil {
+		return nil, err
+	}
+	return networks.Items, nil
+}
+
+// DeleteNetwork deletes Network CRD object by networkName, it's a no-op if the
+// network doesn't exist.
 // NOTE: the automatically created network for tenant use namespace as name.
 func (c *CRDClient) DeleteNetwork(networkName string) error {
 	err := c.client.Delete().
@@ -177,7 +211,7 @@ func (c *CRDClient) DeleteNetwork(networkName string) error {
 		Namespace(networkName).
 		Name(networkName).
 		Do().Error()
-	if err != nil {
+	if err != nil && !apierrors.IsNotFound(err) {
 		return fmt.Errorf("failed to delete Network: %v", err)
 	}
 	return nil
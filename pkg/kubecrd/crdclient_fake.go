@@ -21,6 +21,7 @@ import (
 	"sync"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
 )
@@ -173,7 +174,7 @@ func (f *FakeCRDClient) GetTenant(tenantName string) (*crv1.Tenant, error) {
 
 	tenant, ok := f.Tenants[tenantName]
 	if !ok {
-		return nil, fmt.Errorf("Tenant %s not found", tenantName)
+		return nil, apierrors.NewNotFound(crv1.Resource(crv1.TenantResourcePlural), tenantName)
 	}
 
 	return tenant, nil
@@ -210,6 +211,41 @@ func (f *FakeCRDClient) AddNetwork(network *crv1.Network) error {
 	return nil
 }
 
+// GetNetwork is a test implementation of Interface.GetNetwork.
+func (f *FakeCRDClient) GetNetwork(namespace, networkName string) (*crv1.Network, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("GetNetwork", networkName)
+	if err := f.getError("GetNetwork"); err != nil {
+		return nil, err
+	}
+
+	network, ok := f.Networks[networkName]
+	if !ok || network.Namespace != namespace {
+		return nil, apierrors.NewNotFound(crv1.Resource(crv1.NetworkResourcePlural), networkName)
+	}
+
+	return network, nil
+}
+
+// ListNetworks is a test implementation of Interface.ListNetworks.
+func (f *FakeCRDClient) ListNetworks(namespace string) ([]crv1.Network, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("ListNetworks", namespace)
+	if err := f.getError("ListNetworks"); err != nil {
+		return nil, err
+	}
+
+	var networks []crv1.Network
+	for _, network := range f.Networks {
+		if network.Namespace == namespace {
+			networks = append(networks, *network)
+		}
+	}
+	return networks, nil
+}
+
 // UpdateTenant is a test implementation of Interface.UpdateTenant.
 func (f *FakeCRDClient) UpdateTenant(tenant *crv1.Tenant) error {
 	f.Lock()
@@ -70,7 +70,7 @@ func (p *OVSPlugin) buildVethName(portID string) (string, string) {
 	return ("qvb" + portID)[:14], ("qvo" + portID)[:14]
 }
 
-func (p *OVSPlugin) SetupSandboxInterface(podName, podInfraContainerID string, port *ports.Port, ipcidr, gateway, ifName, netns string) (*current.Interface, error) {
+func (p *OVSPlugin) SetupSandboxInterface(podName, podInfraContainerID string, port *ports.Port, ipcidrs, gateways []string, ifName, netns string) (*current.Interface, error) {
 	vibName, vifName := p.buildSandboxInterfaceName(port.ID)
 	ret, err := util.RunCommand("ip", "link", "add", vibName, "type", "veth", "peer", "name", vifName)
 	if err != nil {
@@ -122,18 +122,28 @@ func (p *OVSPlugin) SetupSandboxInterface(podName, podInfraContainerID string, p
 		return nil, err
 	}
 
-	ret, err = util.RunCommand("ip", "netns", "exec", netns, "ip", "addr", "add", "dev", ifName, ipcidr)
-	if err != nil {
-		glog.Warningf("SetupInterface failed, ret:%s, error:%v", strings.Join(ret, "\n"), err)
-		p.DestroyInterface(podName, podInfraContainerID, port)
-		return nil, err
+	for _, ipcidr := range ipcidrs {
+		ret, err = util.RunCommand("ip", "netns", "exec", netns, "ip", "addr", "add", "dev", ifName, ipcidr)
+		if err != nil {
+			glog.Warningf("SetupInterface failed, ret:%s, error:%v", strings.Join(ret, "\n"), err)
+			p.DestroyInterface(podName, podInfraContainerID, port)
+			return nil, err
+		}
 	}
 
-	ret, err = util.RunCommand("ip", "netns", "exec", netns, "ip", "route", "add", "default", "via", gateway)
-	if err != nil {
-		glog.Warningf("SetupInterface failed, ret:%s, error:%v", strings.Join(ret, "\n"), err)
-		p.DestroyInterface(podName, podInfraContainerID, port)
-		return nil, err
+	// Only the primary interface of the pod is given gateways, one per IP family.
+	for _, gateway := range gateways {
+		if strings.Contains(gateway, ":") {
+			// IPv6 default route may have been learnt from router advertisement already.
+			ret, err = util.RunCommand("ip", "netns", "exec", netns, "ip", "-6", "route", "replace", "default", "via", gateway, "dev", ifName)
+		} else {
+			ret, err = util.RunCommand("ip", "netns", "exec", netns, "ip", "route", "add", "default", "via", gateway)
+		}
+		if err != nil {
+			glog.Warningf("SetupInterface failed, ret:%s, error:%v", strings.Join(ret, "\n"), err)
+			p.DestroyInterface(podName, podInfraContainerID, port)
+			return nil, err
+		}
 	}
 
 	ret, err = util.RunCommand("ip", "link", "set", "dev", vibName, "up")
@@ -143,11 +153,6 @@ func (p *OVSPlugin) SetupSandboxInterface(podName, podInfraContainerID string, p
 		return nil, err
 	}
 
-	_, err = util.RunCommand("rm", "-f", fmt.Sprintf("/var/run/netns/%s", netns))
-	if err != nil {
-		glog.V(5).Infof("Warning: remove netns symlink failed: %v", err)
-	}
-
 	return &current.Interface{
 		Name: p.buildTapName(port.ID),
 		Mac:  port.MACAddress,
@@ -225,14 +230,14 @@ func (p *OVSPlugin) SetupOVSInterface(podName, podInfraContainerID string, port
 	}, nil
 }
 
-func (p *OVSPlugin) SetupInterface(podName, podInfraContainerID string, port *ports.Port, ipcidr, gateway, ifName, netns string) (*current.Interface, *current.Interface, error) {
+func (p *OVSPlugin) SetupInterface(podName, podInfraContainerID string, port *ports.Port, ipcidrs, gateways []string, ifName, netns string) (*current.Interface, *current.Interface, error) {
 	brInterface, err := p.SetupOVSInterface(podName, podInfraContainerID, port)
 	if err != nil {
 		glog.Errorf("SetupOVSInterface failed: %v", err)
 		return nil, nil, err
 	}
 
-	conInterface, err := p.SetupSandboxInterface(podName, podInfraContainerID, port, ipcidr, gateway, ifName, netns)
+	conInterface, err := p.SetupSandboxInterface(podName, podInfraContainerID, port, ipcidrs, gateways, ifName, netns)
 	if err != nil {
 		glog.Errorf("SetupSandboxInterface failed: %v", err)
 		return nil, nil, err
@@ -26,7 +26,11 @@ import (
 )
 
 type PluginInterface interface {
-	SetupInterface(podName, podInfraContainerID string, port *ports.Port, ipcidr, gateway, ifName, netns string) (*current.Interface, *current.Interface, error)
+	// SetupInterface plugs port into netns as ifName with all addresses in ipcidrs,
+	// which may mix IPv4 and IPv6. A default route is added via each of gateways,
+	// which is empty except for the primary interface, so that a pod with several
+	// interfaces only gets one default route per IP family.
+	SetupInterface(podName, podInfraContainerID string, port *ports.Port, ipcidrs, gateways []string, ifName, netns string) (*current.Interface, *current.Interface, error)
 	DestroyInterface(podName, podInfraContainerID string, port *ports.Port) error
 	Init(integrationBridge string) error
 }
@@ -0,0 +1,557 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	apiv1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/api/extensions/v1beta1"
+	rbacv1beta1 "k8s.io/api/rbac/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kuberuntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	"git.openstack.org/openstack/stackube/pkg/util"
+)
+
+const (
+	// DNSProviderKubeDNS runs kube-dns with dnsmasq in each namespace.
+	DNSProviderKubeDNS = "kube-dns"
+	// DNSProviderCoreDNS runs CoreDNS in each namespace.
+	DNSProviderCoreDNS = "coredns"
+
+	// dnsServiceName is the service of DNS servers of all providers, so that the DNS
+	// server of a namespace is reachable at the same address whatever the provider is.
+	dnsServiceName = "kube-dns"
+	// dnsSpecHashAnnotation records the hash of the rendered deployment, so that
+	// changes of the spec, e.g. upgraded images, are applied to existing deployments.
+	dnsSpecHashAnnotation = "stackube.kubernetes.io/dns-spec-hash"
+)
+
+// dnsProvider renders the objects of the DNS server of a namespace. The deployment,
+// the config map and the service account with its role of a provider are all named
+// by the provider.
+type dnsProvider interface {
+	// deployment renders the deployment of the DNS server.
+	deployment(args *dnsArgs) (*v1beta1.Deployment, error)
+	// configMap renders the config of the DNS server.
+	configMap(args *dnsArgs) (*apiv1.ConfigMap, error)
+	// role renders the role of the service account running the DNS server, which is
+	// nil if the DNS server runs as the default service account.
+	role(args *dnsArgs) *rbacv1beta1.Role
+}
+
+var dnsProviders = map[string]dnsProvider{
+	DNSProviderKubeDNS: &kubeDNSProvider{},
+	DNSProviderCoreDNS: &coreDNSProvider{},
+}
+
+// isValidDNSProvider checks the DNS provider is supported.
+func isValidDNSProvider(provider string) bool {
+	_, ok := dnsProviders[provider]
+	return ok
+}
+
+// dnsArgs are the parameters of the DNS server of a namespace.
+type dnsArgs struct {
+	Namespace      string
+	DNSDomain      string
+	KubernetesHost string
+	KubernetesPort string
+	// Upstreams are the nameservers resolving names out of the cluster domain, the
+	// nameservers of the node are used if it's empty.
+	Upstreams []string
+	// StubDomains maps domains to their nameservers.
+	StubDomains map[string][]string
+}
+
+// newDNSArgs builds the parameters of the DNS server from the default network of
+// the namespace.
+func newDNSArgs(network *crv1.Network) *dnsArgs {
+	args := &dnsArgs{
+		Namespace:      network.Namespace,
+		DNSDomain:      defaultDNSDomain,
+		KubernetesHost: os.Getenv("KUBERNETES_SERVICE_HOST"),
+		KubernetesPort: os.Getenv("KUBERNETES_SERVICE_PORT"),
+		Upstreams:      network.Spec.DNSNameservers,
+	}
+	if dns := network.Spec.DNS; dns != nil {
+		if len(dns.Upstreams) > 0 {
+			args.Upstreams = dns.Upstreams
+		}
+		args.StubDomains = dns.StubDomains
+	}
+
+	return args
+}
+
+// kubeDNSProvider runs kube-dns, dnsmasq and sidecar, stub domains and upstreams
+// are configured by the kube-dns config map.
+type kubeDNSProvider struct{}
+
+func (p *kubeDNSProvider) deployment(args *dnsArgs) (*v1beta1.Deployment, error) {
+	tempArgs := struct{ Namespace, DNSDomain, KubeDNSImage, DNSMasqImage, SidecarImage, KubernetesHost, KubernetesPort string }{
+		Namespace:      args.Namespace,
+		DNSDomain:      args.DNSDomain,
+		KubeDNSImage:   defaultKubeDNSImage,
+		DNSMasqImage:   defaultDNSMasqImage,
+		SidecarImage:   defaultSideCarImage,
+		KubernetesHost: args.KubernetesHost,
+		KubernetesPort: args.KubernetesPort,
+	}
+	return renderDeployment(kubeDNSDeployment, tempArgs)
+}
+
+func (p *kubeDNSProvider) configMap(args *dnsArgs) (*apiv1.ConfigMap, error) {
+	data := make(map[string]string)
+	if len(args.StubDomains) > 0 {
+		stubDomains, err := json.Marshal(args.StubDomains)
+		if err != nil {
+			return nil, err
+		}
+		data["stubDomains"] = string(stubDomains)
+	}
+	if len(args.Upstreams) > 0 {
+		upstreams, err := json.Marshal(args.Upstreams)
+		if err != nil {
+			return nil, err
+		}
+		data["upstreamNameservers"] = string(upstreams)
+	}
+
+	return newDNSConfigMap(DNSProviderKubeDNS, args.Namespace, data), nil
+}
+
+func (p *kubeDNSProvider) role(args *dnsArgs) *rbacv1beta1.Role {
+	return nil
+}
+
+// coreDNSProvider runs CoreDNS with a Corefile only serving the namespace.
+type coreDNSProvider struct{}
+
+func (p *coreDNSProvider) deployment(args *dnsArgs) (*v1beta1.Deployment, error) {
+	tempArgs := struct{ Namespace, CoreDNSImage, KubernetesHost, KubernetesPort string }{
+		Namespace:      args.Namespace,
+		CoreDNSImage:   defaultCoreDNSImage,
+		KubernetesHost: args.KubernetesHost,
+		KubernetesPort: args.KubernetesPort,
+	}
+	return renderDeployment(coreDNSDeployment, tempArgs)
+}
+
+func (p *coreDNSProvider) configMap(args *dnsArgs) (*apiv1.ConfigMap, error) {
+	return newDNSConfigMap(DNSProviderCoreDNS, args.Namespace, map[string]string{
+		"Corefile": buildCorefile(args),
+	}), nil
+}
+
+// role only allows CoreDNS to read the objects of its own namespace, which is also
+// the only namespace served by the Corefile.
+func (p *coreDNSProvider) role(args *dnsArgs) *rbacv1beta1.Role {
+	return &rbacv1beta1.Role{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:      DNSProviderCoreDNS,
+			Namespace: args.Namespace,
+			Labels:    map[string]string{"k8s-app": "kube-dns"},
+		},
+		Rules: []rbacv1beta1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"endpoints", "services", "pods"},
+			Verbs:     []string{"get", "list", "watch"},
+		}},
+	}
+}
+
+// buildCorefile builds the Corefile serving the cluster domain of the namespace,
+// stub domains and other names by upstreams.
+func buildCorefile(args *dnsArgs) string {
+	upstreams := "/etc/resolv.conf"
+	if len(args.Upstreams) > 0 {
+		upstreams = strings.Join(args.Upstreams, " ")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `.:53 {
+    errors
+    health
+    kubernetes %s in-addr.arpa ip6.arpa {
+        pods insecure
+        namespaces %s
+        fallthrough in-addr.arpa ip6.arpa
+    }
+    prometheus :9153
+    forward . %s
+    cache 30
+    loop
+    reload
+    loadbalance
+}
+`, args.DNSDomain, args.Namespace, upstreams)
+
+	domains := make([]string, 0, len(args.StubDomains))
+	for domain := range args.StubDomains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Fprintf(&buf, `%s:53 {
+    errors
+    cache 30
+    forward . %s
+}
+`, domain, strings.Join(args.StubDomains[domain], " "))
+	}
+
+	return buf.String()
+}
+
+// renderDeployment renders the deployment template and records the hash of the
+// result in the deployment.
+func renderDeployment(strtmpl string, obj interface{}) (*v1beta1.Deployment, error) {
+	deploymentBytes, err := parseTemplate(strtmpl, obj)
+	if err != nil {
+		return nil, err
+	}
+	deployment := &v1beta1.Deployment{}
+	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), deploymentBytes, deployment); err != nil {
+		return nil, fmt.Errorf("unable to decode DNS deployment %v", err)
+	}
+
+	hash := fnv.New32a()
+	hash.Write(deploymentBytes)
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[dnsSpecHashAnnotation] = fmt.Sprintf("%x", hash.Sum32())
+	return deployment, nil
+}
+
+func newDNSConfigMap(name, namespace string, data map[string]string) *apiv1.ConfigMap {
+	return &apiv1.ConfigMap{
+		ObjectMeta: apismetav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"k8s-app": "kube-dns"},
+		},
+		Data: data,
+	}
+}
+
+// dnsProviderOf returns the DNS provider of the default network of a namespace.
+func (c *NetworkController) dnsProviderOf(network *crv1.Network) string {
+	if network.Spec.DNS != nil && network.Spec.DNS.Provider != "" {
+		return network.Spec.DNS.Provider
+	}
+	return c.dnsProvider
+}
+
+// syncDNS reconciles the DNS server of the namespace with the default network of
+// the namespace. Missing objects are created, drifted or outdated objects are
+// updated, and objects of other providers are deleted.
+func (c *NetworkController) syncDNS(network *crv1.Network) error {
+	providerName := c.dnsProviderOf(network)
+	provider, ok := dnsProviders[providerName]
+	if !ok {
+		return fmt.Errorf("unknown DNS provider %q", providerName)
+	}
+
+	args := newDNSArgs(network)
+	if role := provider.role(args); role != nil {
+		if err := c.ensureDNSRole(role); err != nil {
+			return err
+		}
+	}
+	configMap, err := provider.configMap(args)
+	if err != nil {
+		return fmt.Errorf("unable to render %s config: %v", providerName, err)
+	}
+	if err := c.ensureConfigMap(configMap); err != nil {
+		return err
+	}
+	deployment, err := provider.deployment(args)
+	if err != nil {
+		return err
+	}
+	if err := c.ensureDeployment(deployment); err != nil {
+		return err
+	}
+	if err := c.ensureDNSService(network.Namespace); err != nil {
+		return err
+	}
+
+	// Remove DNS servers of previous providers.
+	for name, other := range dnsProviders {
+		if name == providerName {
+			continue
+		}
+		if err := c.deleteDNSProvider(network.Namespace, name, other.role(args) != nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteDNS deletes the DNS server of the namespace.
+func (c *NetworkController) deleteDNS(namespace string) {
+	args := &dnsArgs{Namespace: namespace}
+	for name, provider := range dnsProviders {
+		if err := c.deleteDNSProvider(namespace, name, provider.role(args) != nil); err != nil {
+			glog.Warningf("error on deleting %s in namespace %s: %v", name, namespace, err)
+		}
+	}
+
+	// Delete kube-dns services for non-system namespaces.
+	if !util.IsSystemNamespace(namespace) {
+		err := c.k8sclient.Core().Services(namespace).Delete(dnsServiceName, apismetav1.NewDeleteOptions(0))
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.Warningf("error on deleting kube-dns service: %v", err)
+		}
+	}
+}
+
+// deleteDNSProvider deletes the deployment and the config map of the DNS provider,
+// and its service account with the role if hasRole.
+func (c *NetworkController) deleteDNSProvider(namespace, name string, hasRole bool) error {
+	_, err := c.k8sclient.ExtensionsV1beta1().Deployments(namespace).Get(name, apismetav1.GetOptions{})
+	if err == nil {
+		glog.V(3).Infof("Deleting DNS deployment %s/%s", namespace, name)
+		err = c.deleteDeployment(namespace, name)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete deployment %s: %v", name, err)
+	}
+
+	err = c.k8sclient.Core().ConfigMaps(namespace).Delete(name, apismetav1.NewDeleteOptions(0))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete config map %s: %v", name, err)
+	}
+
+	if !hasRole {
+		return nil
+	}
+	err = c.k8sclient.Rbac().RoleBindings(namespace).Delete(name, apismetav1.NewDeleteOptions(0))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete role binding %s: %v", name, err)
+	}
+	err = c.k8sclient.Rbac().Roles(namespace).Delete(name, apismetav1.NewDeleteOptions(0))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete role %s: %v", name, err)
+	}
+	err = c.k8sclient.Core().ServiceAccounts(namespace).Delete(name, apismetav1.NewDeleteOptions(0))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete service account %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// ensureDNSRole creates the service account running the DNS server, and binds it to
+// the role, which is updated if its rules are changed.
+func (c *NetworkController) ensureDNSRole(role *rbacv1beta1.Role) error {
+	serviceAccounts := c.k8sclient.Core().ServiceAccounts(role.Namespace)
+	_, err := serviceAccounts.Get(role.Name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = serviceAccounts.Create(&apiv1.ServiceAccount{
+			ObjectMeta: apismetav1.ObjectMeta{
+				Name:      role.Name,
+				Namespace: role.Namespace,
+				Labels:    role.Labels,
+			},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to ensure the %s service account: %v", role.Name, err)
+	}
+
+	roles := c.k8sclient.Rbac().Roles(role.Namespace)
+	existing, err := roles.Get(role.Name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = roles.Create(role)
+	} else if err == nil && !reflect.DeepEqual(existing.Rules, role.Rules) {
+		glog.V(3).Infof("Updating DNS role %s/%s", role.Namespace, role.Name)
+		existing.Rules = role.Rules
+		_, err = roles.Update(existing)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to ensure the %s role: %v", role.Name, err)
+	}
+
+	roleBindings := c.k8sclient.Rbac().RoleBindings(role.Namespace)
+	_, err = roleBindings.Get(role.Name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = roleBindings.Create(&rbacv1beta1.RoleBinding{
+			ObjectMeta: apismetav1.ObjectMeta{
+				Name:      role.Name,
+				Namespace: role.Namespace,
+				Labels:    role.Labels,
+			},
+			RoleRef: rbacv1beta1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Role",
+				Name:     role.Name,
+			},
+			Subjects: []rbacv1beta1.Subject{{
+				Kind:      "ServiceAccount",
+				Name:      role.Name,
+				Namespace: role.Namespace,
+			}},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to ensure the %s role binding: %v", role.Name, err)
+	}
+
+	return nil
+}
+
+// ensureDeployment creates the deployment, or updates it if it's outdated or its
+// containers drift from the spec.
+func (c *NetworkController) ensureDeployment(deployment *v1beta1.Deployment) error {
+	deployments := c.k8sclient.ExtensionsV1beta1().Deployments(deployment.Namespace)
+	existing, err := deployments.Get(deployment.Name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := deployments.Create(deployment); err != nil {
+			return fmt.Errorf("unable to create a new %s deployment: %v", deployment.Name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get the %s deployment: %v", deployment.Name, err)
+	}
+
+	if !deploymentChanged(existing, deployment) {
+		return nil
+	}
+	glog.V(3).Infof("Updating DNS deployment %s/%s", deployment.Namespace, deployment.Name)
+	existing.Labels = deployment.Labels
+	existing.Annotations = deployment.Annotations
+	existing.Spec = deployment.Spec
+	if _, err := deployments.Update(existing); err != nil {
+		return fmt.Errorf("unable to update the %s deployment: %v", deployment.Name, err)
+	}
+
+	return nil
+}
+
+// deploymentChanged checks whether the existing deployment is rendered from another
+// spec, or its replicas or containers are changed by others. Other fields are
+// defaulted by apiserver, so they are not compared.
+func deploymentChanged(existing, wanted *v1beta1.Deployment) bool {
+	if existing.Annotations[dnsSpecHashAnnotation] != wanted.Annotations[dnsSpecHashAnnotation] {
+		return true
+	}
+	if !reflect.DeepEqual(existing.Spec.Replicas, wanted.Spec.Replicas) {
+		return true
+	}
+
+	existingContainers := existing.Spec.Template.Spec.Containers
+	wantedContainers := wanted.Spec.Template.Spec.Containers
+	if len(existingContainers) != len(wantedContainers) {
+		return true
+	}
+	for i := range wantedContainers {
+		if existingContainers[i].Name != wantedContainers[i].Name ||
+			existingContainers[i].Image != wantedContainers[i].Image ||
+			!reflect.DeepEqual(existingContainers[i].Args, wantedContainers[i].Args) ||
+			!reflect.DeepEqual(existingContainers[i].Command, wantedContainers[i].Command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ensureConfigMap creates the config map, or updates it if its data is changed.
+func (c *NetworkController) ensureConfigMap(configMap *apiv1.ConfigMap) error {
+	configMaps := c.k8sclient.Core().ConfigMaps(configMap.Namespace)
+	existing, err := configMaps.Get(configMap.Name, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := configMaps.Create(configMap); err != nil {
+			return fmt.Errorf("unable to create a new %s config map: %v", configMap.Name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get the %s config map: %v", configMap.Name, err)
+	}
+
+	// Empty data is decoded as nil.
+	if (len(existing.Data) == 0 && len(configMap.Data) == 0) || reflect.DeepEqual(existing.Data, configMap.Data) {
+		return nil
+	}
+	glog.V(3).Infof("Updating DNS config map %s/%s", configMap.Namespace, configMap.Name)
+	existing.Labels = configMap.Labels
+	existing.Data = configMap.Data
+	if _, err := configMaps.Update(existing); err != nil {
+		return fmt.Errorf("unable to update the %s config map: %v", configMap.Name, err)
+	}
+
+	return nil
+}
+
+// ensureDNSService creates the kube-dns service, or updates its ports and selector
+// if they are changed. The cluster IP of the service is kept.
+func (c *NetworkController) ensureDNSService(namespace string) error {
+	tempArgs := struct{ Namespace string }{
+		Namespace: namespace,
+	}
+	dnsServiceBytes, err := parseTemplate(kubeDNSService, tempArgs)
+	if err != nil {
+		return err
+	}
+	dnsService := &apiv1.Service{}
+	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsServiceBytes, dnsService); err != nil {
+		return fmt.Errorf("unable to decode kube-dns service %v", err)
+	}
+
+	services := c.k8sclient.Core().Services(namespace)
+	existing, err := services.Get(dnsServiceName, apismetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := services.Create(dnsService); err != nil {
+			return fmt.Errorf("unable to create a new kube-dns service: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get the kube-dns service: %v", err)
+	}
+
+	if reflect.DeepEqual(existing.Spec.Ports, dnsService.Spec.Ports) &&
+		reflect.DeepEqual(existing.Spec.Selector, dnsService.Spec.Selector) {
+		return nil
+	}
+	glog.V(3).Infof("Updating kube-dns service in namespace %s", namespace)
+	existing.Spec.Ports = dnsService.Spec.Ports
+	existing.Spec.Selector = dnsService.Spec.Selector
+	if _, err := services.Update(existing); err != nil {
+		return fmt.Errorf("unable to update the kube-dns service: %v", err)
+	}
+
+	return nil
+}
@@ -18,21 +18,18 @@ package network
 
 import (
 	"fmt"
-	"os"
+	"reflect"
 	"time"
 
 	"github.com/golang/glog"
 	apiv1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	kuberuntime "k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/cache"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
@@ -46,6 +43,10 @@ const (
 	defaultKubeDNSImage = "stackube/k8s-dns-kube-dns-amd64:1.14.4"
 	defaultDNSMasqImage = "stackube/k8s-dns-dnsmasq-nanny-amd64:1.14.4"
 	defaultSideCarImage = "stackube/k8s-dns-sidecar-amd64:1.14.4"
+	defaultCoreDNSImage = "coredns/coredns:1.2.6"
+
+	// networkResyncPeriod is the period of reconciling DNS servers with networks.
+	networkResyncPeriod = 5 * time.Minute
 )
 
 // NetworkController manages the life cycle of Network.
@@ -54,6 +55,8 @@ type NetworkController struct {
 	kubeCRDClient   kubecrd.Interface
 	driver          openstack.Interface
 	networkInformer cache.Controller
+	// dnsProvider is the DNS provider of namespaces whose networks don't set one.
+	dnsProvider string
 }
 
 // Run the network controller.
@@ -66,8 +69,13 @@ func (c *NetworkController) Run(stopCh <-chan struct{}) error {
 	return nil
 }
 
-// NewNetworkController creates a new NetworkController.
-func NewNetworkController(kubeClient kubernetes.Interface, osClient openstack.Interface, kubeExtClient *apiextensionsclient.Clientset) (*NetworkController, error) {
+// NewNetworkController creates a new NetworkController, dnsProvider is the default
+// DNS provider of namespaces.
+func NewNetworkController(kubeClient kubernetes.Interface, osClient openstack.Interface, kubeExtClient *apiextensionsclient.Clientset, dnsProvider string) (*NetworkController, error) {
+	if !isValidDNSProvider(dnsProvider) {
+		return nil, fmt.Errorf("unknown DNS provider %q", dnsProvider)
+	}
+
 	// initialize CRD if it does not exist
 	_, err := kubecrd.CreateNetworkCRD(kubeExtClient)
 	if err != nil && !apierrors.IsAlreadyExists(err) {
@@ -83,11 +91,12 @@ func NewNetworkController(kubeClient kubernetes.Interface, osClient openstack.In
 		k8sclient:     kubeClient,
 		kubeCRDClient: osClient.GetCRDClient(),
 		driver:        osClient,
+		dnsProvider:   dnsProvider,
 	}
 	_, networkInformer := cache.NewInformer(
 		source,
 		&crv1.Network{},
-		0,
+		networkResyncPeriod,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc:    networkController.onAdd,
 			UpdateFunc: networkController.onUpdate,
@@ -114,6 +123,20 @@ func (c *NetworkController) onAdd(obj interface{}) {
 
 	networkCopy := copyObj.(*crv1.Network)
 
+	// The network was deleted while the controller wasn't running.
+	if networkCopy.DeletionTimestamp != nil {
+		if err := c.teardownNetwork(networkCopy); err != nil {
+			glog.Errorf("Teardown network failed: %v", err)
+		}
+		return
+	}
+
+	// The network is kept until it's torn down in Neutron.
+	if err := c.ensureNetworkFinalizer(networkCopy); err != nil {
+		glog.Errorf("Add finalizer to network %s failed: %v", networkCopy.Name, err)
+		return
+	}
+
 	// This will:
 	// 1. Create Network in Neutron
 	// 2. Update Network CRD object status to Active or Failed
@@ -123,21 +146,74 @@ func (c *NetworkController) onAdd(obj interface{}) {
 		return
 	}
 
-	// create kube-dns in this namespace.
-	namespace := networkCopy.Namespace
-	if err := c.createKubeDNSDeployment(namespace); err != nil {
-		glog.Errorf("Create kube-dns deployment failed: %v", err)
+	c.syncDefaultNetworkDNS(networkCopy)
+}
+
+// syncDefaultNetworkDNS reconciles the DNS server of the namespace if network is the
+// default network of the namespace, the DNS server only runs on the default network.
+func (c *NetworkController) syncDefaultNetworkDNS(network *crv1.Network) {
+	isDefault, err := c.isDefaultNetwork(network)
+	if err != nil {
+		glog.Errorf("Check default network of namespace %s failed: %v", network.Namespace, err)
 		return
 	}
-
-	if err := c.createKubeDNSService(namespace); err != nil {
-		glog.Errorf("Create kube-dns service failed: %v", err)
+	if !isDefault {
 		return
 	}
+
+	if err := c.syncDNS(network); err != nil {
+		glog.Errorf("Sync DNS of namespace %s failed: %v", network.Namespace, err)
+	}
 }
 
 func (c *NetworkController) onUpdate(oldObj, newObj interface{}) {
-	// NOTE(harry) not supported yet
+	oldNetwork := oldObj.(*crv1.Network)
+	network := newObj.(*crv1.Network)
+
+	if network.DeletionTimestamp != nil {
+		// Updates of networks being torn down are made by the teardown itself,
+		// failed teardowns are retried on periodic resyncs.
+		if oldNetwork.DeletionTimestamp != nil && oldNetwork.ResourceVersion != network.ResourceVersion {
+			return
+		}
+
+		copyObj, err := c.kubeCRDClient.Scheme().Copy(network)
+		if err != nil {
+			glog.Errorf("ERROR creating a deep copy of network object: %v\n", err)
+			return
+		}
+		if err := c.teardownNetwork(copyObj.(*crv1.Network)); err != nil {
+			glog.Errorf("Teardown network failed: %v", err)
+		}
+		return
+	}
+
+	// DNS servers are reconciled on every update including periodic resyncs, so
+	// that drifts are repaired and upgrades are rolled out. Only active networks
+	// exist in Neutron.
+	if network.Status.State == crv1.NetworkActive {
+		c.syncDefaultNetworkDNS(network)
+	}
+
+	// Status updates also come here, only spec changes need to be applied to
+	// the driver, the DNS spec isn't part of the driver network.
+	oldSpec, spec := oldNetwork.Spec, network.Spec
+	oldSpec.DNS, spec.DNS = nil, nil
+	if reflect.DeepEqual(oldSpec, spec) {
+		return
+	}
+	glog.V(3).Infof("[NETWORK CONTROLLER] OnUpdate %#v\n", network)
+
+	copyObj, err := c.kubeCRDClient.Scheme().Copy(network)
+	if err != nil {
+		glog.Errorf("ERROR creating a deep copy of network object: %v\n", err)
+		return
+	}
+
+	networkCopy := copyObj.(*crv1.Network)
+	if err := c.updateNetworkInDriver(oldNetwork, networkCopy); err != nil {
+		glog.Errorf("Update network in driver failed: %v", err)
+	}
 }
 
 func (c *NetworkController) onDelete(obj interface{}) {
@@ -149,15 +225,18 @@ func (c *NetworkController) onDelete(obj interface{}) {
 
 	glog.V(4).Infof("NetworkController: network %s deleted", net.Name)
 
-	// Delete kube-dns deployment.
-	if err := c.deleteDeployment(net.Namespace, "kube-dns"); err != nil {
-		glog.Warningf("error on deleting kube-dns deployment: %v", err)
+	// Networks with the finalizer are torn down before they are deleted, others
+	// are cleaned up here.
+	if net.Status.TeardownStep == crv1.TeardownCompleted {
+		return
 	}
-	// Delete kube-dns services for non-system namespaces.
-	if !util.IsSystemNamespace(net.Namespace) {
-		if err := c.k8sclient.Core().Services(net.Namespace).Delete("kube-dns", apismetav1.NewDeleteOptions(0)); err != nil {
-			glog.Warningf("error on deleting kube-dns service: %v", err)
-		}
+
+	isDefault, err := c.isDefaultNetwork(net)
+	if err != nil {
+		glog.Warningf("error on checking default network of namespace %s: %v", net.Namespace, err)
+	}
+	if isDefault {
+		c.deleteDNS(net.Namespace)
 	}
 
 	// Delete neutron network created by stackube.
@@ -172,39 +251,6 @@ func (c *NetworkController) onDelete(obj interface{}) {
 	}
 }
 
-func (c *NetworkController) createKubeDNSDeployment(namespace string) error {
-	tempArgs := struct{ Namespace, DNSDomain, KubeDNSImage, DNSMasqImage, SidecarImage, KubernetesHost, KubernetesPort string }{
-		Namespace:    namespace,
-		DNSDomain:    defaultDNSDomain,
-		KubeDNSImage: defaultKubeDNSImage,
-		DNSMasqImage: defaultDNSMasqImage,
-		SidecarImage: defaultSideCarImage,
-	}
-	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
-		tempArgs.KubernetesHost = host
-	}
-	if port := os.Getenv("KUBERNETES_SERVICE_PORT"); port != "" {
-		tempArgs.KubernetesPort = port
-	}
-	dnsDeploymentBytes, err := parseTemplate(kubeDNSDeployment, tempArgs)
-	kubeDNSDeploy := &v1beta1.Deployment{}
-	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsDeploymentBytes, kubeDNSDeploy); err != nil {
-		return fmt.Errorf("unable to decode kube-dns deployment %v", err)
-	}
-	_, err = c.k8sclient.ExtensionsV1beta1().Deployments(namespace).Create(kubeDNSDeploy)
-	if err != nil {
-		if !apierrors.IsAlreadyExists(err) {
-			return fmt.Errorf("unable to create a new kube-dns deployment: %v", err)
-		}
-
-		if _, err = c.k8sclient.ExtensionsV1beta1().Deployments(namespace).Update(kubeDNSDeploy); err != nil {
-			return fmt.Errorf("unable to update the kube-dns deployment: %v", err)
-		}
-	}
-
-	return nil
-}
-
 func (c *NetworkController) deleteDeployment(namespace, name string) error {
 	if err := c.k8sclient.ExtensionsV1beta1().Deployments(namespace).Delete(name, apismetav1.NewDeleteOptions(0)); err != nil {
 		return err
@@ -228,26 +274,3 @@ func (c *NetworkController) deleteDeployment(namespace, name string) error {
 
 	return nil
 }
-
-func (c *NetworkController) createKubeDNSService(namespace string) error {
-	tempArgs := struct{ Namespace string }{
-		Namespace: namespace,
-	}
-	dnsServiceBytes, err := parseTemplate(kubeDNSService, tempArgs)
-	dnsService := &apiv1.Service{}
-	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsServiceBytes, dnsService); err != nil {
-		return fmt.Errorf("unable to decode kube-dns service %v", err)
-	}
-	_, err = c.k8sclient.Core().Services(namespace).Create(dnsService)
-	if err != nil {
-		if !apierrors.IsAlreadyExists(err) {
-			return fmt.Errorf("unable to create a new kube-dns service: %v", err)
-		}
-
-		if _, err = c.k8sclient.Core().Services(namespace).Update(dnsService); err != nil {
-			return fmt.Errorf("unable to update the kube-dns service: %v", err)
-		}
-	}
-
-	return nil
-}
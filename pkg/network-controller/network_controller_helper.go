@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"net"
 	"time"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
@@ -27,6 +28,7 @@ import (
 	"git.openstack.org/openstack/stackube/pkg/util"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -61,22 +63,17 @@ func (c *NetworkController) addNetworkToDriver(kubeNetwork *crv1.Network) error
 		return fmt.Errorf("failed to fetch tenantID for tenantName: %v, error: %v abort! \n", tenantName, err)
 	}
 
+	if err := validateNetworkSpec(&kubeNetwork.Spec); err != nil {
+		kubeNetwork.Status.State = crv1.NetworkFailed
+		kubeNetwork.Status.Message = err.Error()
+		c.kubeCRDClient.UpdateNetwork(kubeNetwork)
+		return err
+	}
+
 	networkName := util.BuildNetworkName(tenantName, kubeNetwork.GetName())
 
 	// Translate Kubernetes network to OpenStack network
-	driverNetwork := &drivertypes.Network{
-		Name:     networkName,
-		TenantID: tenantID,
-		Subnets: []*drivertypes.Subnet{
-			{
-				// network: subnet = 1:1
-				Name:     networkName + "-" + subnetSuffix,
-				Cidr:     kubeNetwork.Spec.CIDR,
-				Gateway:  kubeNetwork.Spec.Gateway,
-				Tenantid: tenantID,
-			},
-		},
-	}
+	driverNetwork := buildDriverNetwork(kubeNetwork, networkName, tenantID)
 
 	glog.V(4).Infof("[NetworkController]: adding network %s", driverNetwork.Name)
 
@@ -130,6 +127,236 @@ func (c *NetworkController) addNetworkToDriver(kubeNetwork *crv1.Network) error
 	return nil
 }
 
+// updateNetworkInDriver applies spec changes of the network to Neutron and
+// reflects the progress in network status.
+func (c *NetworkController) updateNetworkInDriver(oldNetwork, kubeNetwork *crv1.Network) error {
+	if kubeNetwork.Spec.NetworkID != oldNetwork.Spec.NetworkID {
+		c.updateNetworkStatus(kubeNetwork, crv1.NetworkFailed, "networkID can't be changed")
+		return fmt.Errorf("networkID of network %s can't be changed", kubeNetwork.Name)
+	}
+	// The network is not managed by stackube.
+	if kubeNetwork.Spec.NetworkID != "" {
+		glog.V(4).Infof("[NetworkController]: network %s is provided by networkID, skip updating", kubeNetwork.Name)
+		return nil
+	}
+
+	if err := validateNetworkSpec(&kubeNetwork.Spec); err != nil {
+		c.updateNetworkStatus(kubeNetwork, crv1.NetworkFailed, err.Error())
+		return err
+	}
+
+	networkName := util.BuildNetworkName(kubeNetwork.GetNamespace(), kubeNetwork.GetName())
+	glog.V(4).Infof("[NetworkController]: updating network %s", networkName)
+	c.updateNetworkStatus(kubeNetwork, crv1.NetworkPending, "Updating network")
+
+	osNetwork, err := c.driver.GetNetworkByName(networkName)
+	if err != nil {
+		c.updateNetworkStatus(kubeNetwork, crv1.NetworkFailed, fmt.Sprintf("Get network failed: %v", err))
+		return fmt.Errorf("get network %s failed: %v", networkName, err)
+	}
+
+	driverNetwork := buildDriverNetwork(kubeNetwork, networkName, osNetwork.TenantID)
+	if err := c.driver.UpdateNetwork(driverNetwork); err != nil {
+		c.updateNetworkStatus(kubeNetwork, crv1.NetworkFailed, fmt.Sprintf("Update network failed: %v", err))
+		return fmt.Errorf("update network %s failed: %v", networkName, err)
+	}
+
+	c.updateNetworkStatus(kubeNetwork, crv1.NetworkActive, "")
+	return nil
+}
+
+func (c *NetworkController) updateNetworkStatus(kubeNetwork *crv1.Network, state, message string) {
+	kubeNetwork.Status.State = state
+	kubeNetwork.Status.Message = message
+	if err := c.kubeCRDClient.UpdateNetwork(kubeNetwork); err != nil {
+		glog.Warningf("[NetworkController]: update status of network %s failed: %v", kubeNetwork.Name, err)
+	}
+}
+
+// buildDriverNetwork translates Kubernetes network to OpenStack network.
+func buildDriverNetwork(kubeNetwork *crv1.Network, networkName, tenantID string) *drivertypes.Network {
+	spec := kubeNetwork.Spec
+	// The primary subnet is described by the top level fields of spec.
+	subnets := []*drivertypes.Subnet{
+		buildDriverSubnet(networkName+"-"+subnetSuffix, tenantID, crv1.SubnetSpec{
+			CIDR:            spec.CIDR,
+			Gateway:         spec.Gateway,
+			DNSNameservers:  spec.DNSNameservers,
+			HostRoutes:      spec.HostRoutes,
+			AllocationPools: spec.AllocationPools,
+			EnableDHCP:      spec.EnableDHCP,
+			IPv6AddressMode: spec.IPv6AddressMode,
+			IPv6RAMode:      spec.IPv6RAMode,
+		}),
+	}
+	for _, sub := range spec.Subnets {
+		subnets = append(subnets, buildDriverSubnet(networkName+"-"+sub.Name+"-"+subnetSuffix, tenantID, sub))
+	}
+
+	return &drivertypes.Network{
+		Name:     networkName,
+		TenantID: tenantID,
+		Subnets:  subnets,
+	}
+}
+
+func buildDriverSubnet(name, tenantID string, sub crv1.SubnetSpec) *drivertypes.Subnet {
+	subnet := &drivertypes.Subnet{
+		Name:       name,
+		Cidr:       sub.CIDR,
+		Gateway:    sub.Gateway,
+		Tenantid:   tenantID,
+		Dnsservers: sub.DNSNameservers,
+		EnableDHCP: true,
+		IPVersion:  4,
+	}
+	if ip, _, err := net.ParseCIDR(sub.CIDR); err == nil && ip.To4() == nil {
+		subnet.IPVersion = 6
+		subnet.IPv6AddressMode = sub.IPv6AddressMode
+		subnet.IPv6RAMode = sub.IPv6RAMode
+	}
+	if sub.EnableDHCP != nil {
+		subnet.EnableDHCP = *sub.EnableDHCP
+	}
+	for _, r := range sub.HostRoutes {
+		subnet.Routes = append(subnet.Routes, &drivertypes.Route{
+			DestinationCIDR: r.Destination,
+			Nexthop:         r.Nexthop,
+		})
+	}
+	for _, p := range sub.AllocationPools {
+		subnet.Pools = append(subnet.Pools, &drivertypes.AllocationPool{
+			Start: p.Start,
+			End:   p.End,
+		})
+	}
+
+	return subnet
+}
+
+// validateNetworkSpec checks names, CIDRs, allocation pools and IPv6 modes of the subnets.
+func validateNetworkSpec(spec *crv1.NetworkSpec) error {
+	if err := validateIPv6Modes(spec.CIDR, spec.IPv6AddressMode, spec.IPv6RAMode); err != nil {
+		return err
+	}
+	if err := validateAllocationPools(spec.CIDR, spec.AllocationPools); err != nil {
+		return err
+	}
+
+	names := sets.NewString()
+	for _, sub := range spec.Subnets {
+		if sub.Name == "" {
+			return fmt.Errorf("name of subnet %s is empty", sub.CIDR)
+		}
+		if names.Has(sub.Name) {
+			return fmt.Errorf("subnet %s is duplicated", sub.Name)
+		}
+		names.Insert(sub.Name)
+
+		if _, _, err := net.ParseCIDR(sub.CIDR); err != nil {
+			return fmt.Errorf("invalid CIDR %q of subnet %s", sub.CIDR, sub.Name)
+		}
+		if err := validateIPv6Modes(sub.CIDR, sub.IPv6AddressMode, sub.IPv6RAMode); err != nil {
+			return fmt.Errorf("subnet %s: %v", sub.Name, err)
+		}
+		if err := validateAllocationPools(sub.CIDR, sub.AllocationPools); err != nil {
+			return fmt.Errorf("subnet %s: %v", sub.Name, err)
+		}
+	}
+
+	if spec.DNS != nil {
+		return validateDNSSpec(spec.DNS)
+	}
+
+	return nil
+}
+
+// validateDNSSpec checks the DNS provider and nameservers.
+func validateDNSSpec(dns *crv1.DNSSpec) error {
+	if dns.Provider != "" && !isValidDNSProvider(dns.Provider) {
+		return fmt.Errorf("unknown DNS provider %q", dns.Provider)
+	}
+	for _, upstream := range dns.Upstreams {
+		if net.ParseIP(upstream) == nil {
+			return fmt.Errorf("invalid upstream nameserver %q", upstream)
+		}
+	}
+	for domain, nameservers := range dns.StubDomains {
+		if len(nameservers) == 0 {
+			return fmt.Errorf("stub domain %s has no nameservers", domain)
+		}
+		for _, nameserver := range nameservers {
+			if net.ParseIP(nameserver) == nil {
+				return fmt.Errorf("invalid nameserver %q of stub domain %s", nameserver, domain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateAllocationPools checks both ends of the pools are within cidr, and the
+// start of each pool is not after its end.
+func validateAllocationPools(cidr string, pools []crv1.AllocationPool) error {
+	if len(pools) == 0 {
+		return nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q of allocation pools", cidr)
+	}
+	for _, p := range pools {
+		start, end := net.ParseIP(p.Start), net.ParseIP(p.End)
+		if start == nil || end == nil {
+			return fmt.Errorf("invalid allocation pool %s-%s", p.Start, p.End)
+		}
+		if !ipNet.Contains(start) || !ipNet.Contains(end) {
+			return fmt.Errorf("allocation pool %s-%s is not within %s", p.Start, p.End, cidr)
+		}
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			return fmt.Errorf("start of allocation pool %s-%s is after its end", p.Start, p.End)
+		}
+	}
+
+	return nil
+}
+
+var validIPv6Modes = sets.NewString(crv1.IPv6ModeSLAAC, crv1.IPv6ModeDHCPv6Stateful, crv1.IPv6ModeDHCPv6Stateless)
+
+// validateIPv6Modes checks IPv6 modes are only set for IPv6 CIDR and have valid values.
+func validateIPv6Modes(cidr, addressMode, raMode string) error {
+	if addressMode == "" && raMode == "" {
+		return nil
+	}
+
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("IPv6 modes are only valid for IPv6 CIDR, but got %q", cidr)
+	}
+	for _, mode := range []string{addressMode, raMode} {
+		if mode != "" && !validIPv6Modes.Has(mode) {
+			return fmt.Errorf("invalid IPv6 mode %q", mode)
+		}
+	}
+	// Neutron requires the two modes to be the same if both are set.
+	if addressMode != "" && raMode != "" && addressMode != raMode {
+		return fmt.Errorf("IPv6 address mode %q and RA mode %q mismatch", addressMode, raMode)
+	}
+
+	return nil
+}
+
+// isDefaultNetwork checks whether the network is the default network of its namespace.
+func (c *NetworkController) isDefaultNetwork(network *crv1.Network) (bool, error) {
+	defaultNetwork, err := util.GetDefaultNetworkName(c.k8sclient, network.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	return network.Name == defaultNetwork, nil
+}
+
 func parseTemplate(strtmpl string, obj interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	tmpl, err := template.New("template").Parse(strtmpl)
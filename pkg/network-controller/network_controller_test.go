@@ -18,8 +18,8 @@ package network
 
 import (
 	"fmt"
-	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
@@ -29,7 +29,7 @@ import (
 	"git.openstack.org/openstack/stackube/pkg/util"
 
 	apiv1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apismetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kuberuntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
@@ -51,7 +51,6 @@ var systemTenant = &crv1.Tenant{
 	},
 	Spec: crv1.TenantSpec{
 		UserName: util.SystemTenant,
-		Password: util.SystemPassword,
 	},
 }
 
@@ -101,12 +100,13 @@ func newNetworkController() (*NetworkController, *crdClient.FakeCRDClient, *open
 		k8sclient:     client,
 		kubeCRDClient: kubeCRDClient,
 		driver:        osClient,
+		dnsProvider:   DNSProviderCoreDNS,
 	}
 
 	return c, kubeCRDClient, osClient, client, nil
 }
 
-func TestCreateKubeDNSDeployment(t *testing.T) {
+func TestSyncDNS(t *testing.T) {
 	testNamespace := "foo"
 	// Created a new fake NetworkController.
 	controller, _, _, client, err := newNetworkController()
@@ -114,37 +114,92 @@ func TestCreateKubeDNSDeployment(t *testing.T) {
 		t.Fatalf("Failed start a new fake NetworkController")
 	}
 
-	err = controller.createKubeDNSDeployment(testNamespace)
+	network := newNetwork(testNamespace, "")
+	network.Spec.DNSNameservers = []string{"8.8.8.8"}
+	network.Spec.DNS = &crv1.DNSSpec{
+		StubDomains: map[string][]string{"acme.local": {"1.2.3.4"}},
+	}
+	if err := controller.syncDNS(network); err != nil {
+		t.Fatalf("Sync DNS in namespace %v error: %v", testNamespace, err)
+	}
+	if err := testDNSDeploymentCreated(t, client, network); err != nil {
+		t.Error(err)
+	}
+	if err := testKubeDNSServiceCreated(t, client, testNamespace); err != nil {
+		t.Error(err)
+	}
+	configMap, err := client.Core().ConfigMaps(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{})
 	if err != nil {
-		t.Fatalf("Create kube-dns deployment in namespace %v error: %v", testNamespace, err)
+		t.Fatalf("Failed get coredns config map in namespace %s: %v", testNamespace, err)
+	}
+	corefile := configMap.Data["Corefile"]
+	for _, expected := range []string{"namespaces foo\n", "forward . 8.8.8.8\n", "acme.local:53 {\n    errors\n    cache 30\n    forward . 1.2.3.4\n"} {
+		if !strings.Contains(corefile, expected) {
+			t.Errorf("Expected %q in Corefile, got:\n%s", expected, corefile)
+		}
 	}
 
-	kubeDNSDeploy, err := client.ExtensionsV1beta1().Deployments(testNamespace).Get("kube-dns", apismetav1.GetOptions{})
-	if err != nil {
-		t.Fatalf("Failed get kube-dns deployment in namespace %s: %v", testNamespace, err)
+	// CoreDNS runs as its own service account, which only reads the namespace.
+	deployment, _ := client.ExtensionsV1beta1().Deployments(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{})
+	if deployment.Spec.Template.Spec.ServiceAccountName != DNSProviderCoreDNS {
+		t.Errorf("Expected coredns service account, got %q", deployment.Spec.Template.Spec.ServiceAccountName)
 	}
-	// Generates the kube-dns deployment template
-	tempArgs := struct{ Namespace, DNSDomain, KubeDNSImage, DNSMasqImage, SidecarImage, KubernetesHost, KubernetesPort string }{
-		Namespace:    testNamespace,
-		DNSDomain:    defaultDNSDomain,
-		KubeDNSImage: defaultKubeDNSImage,
-		DNSMasqImage: defaultDNSMasqImage,
-		SidecarImage: defaultSideCarImage,
+	if _, err := client.Core().ServiceAccounts(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); err != nil {
+		t.Errorf("Failed get coredns service account in namespace %s: %v", testNamespace, err)
 	}
-	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
-		tempArgs.KubernetesHost = host
+	if _, err := client.Rbac().Roles(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); err != nil {
+		t.Errorf("Failed get coredns role in namespace %s: %v", testNamespace, err)
 	}
-	if port := os.Getenv("KUBERNETES_SERVICE_PORT"); port != "" {
-		tempArgs.KubernetesPort = port
+	roleBinding, err := client.Rbac().RoleBindings(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get coredns role binding in namespace %s: %v", testNamespace, err)
 	}
-	dnsDeploymentBytes, err := parseTemplate(kubeDNSDeployment, tempArgs)
-	kubeDNSDeployTemplate := &v1beta1.Deployment{}
-	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsDeploymentBytes, kubeDNSDeployTemplate); err != nil {
-		t.Fatalf("unable to decode kube-dns deployment in namespace %s:%v", testNamespace, err)
+	if len(roleBinding.Subjects) != 1 || roleBinding.Subjects[0].Kind != "ServiceAccount" ||
+		roleBinding.Subjects[0].Name != DNSProviderCoreDNS || roleBinding.Subjects[0].Namespace != testNamespace {
+		t.Errorf("Expected coredns service account bound, got %v", roleBinding.Subjects)
 	}
 
-	if !reflect.DeepEqual(kubeDNSDeploy, kubeDNSDeployTemplate) {
-		t.Errorf("Created kube-dns deployment in namespace %s has incorrect parameters: %v", testNamespace, kubeDNSDeploy)
+	// Drifts are repaired.
+	deployment, _ = client.ExtensionsV1beta1().Deployments(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{})
+	deployment.Spec.Template.Spec.Containers[0].Image = "coredns/coredns:latest"
+	client.ExtensionsV1beta1().Deployments(testNamespace).Update(deployment)
+	if err := controller.syncDNS(network); err != nil {
+		t.Fatalf("Sync DNS in namespace %v error: %v", testNamespace, err)
+	}
+	if err := testDNSDeploymentCreated(t, client, network); err != nil {
+		t.Error(err)
+	}
+
+	// Switching provider replaces the DNS server.
+	network.Spec.DNS.Provider = DNSProviderKubeDNS
+	if err := controller.syncDNS(network); err != nil {
+		t.Fatalf("Sync DNS in namespace %v error: %v", testNamespace, err)
+	}
+	if err := testDNSDeploymentCreated(t, client, network); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.ExtensionsV1beta1().Deployments(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected coredns deployment deleted, got %v", err)
+	}
+	if _, err := client.Core().ConfigMaps(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected coredns config map deleted, got %v", err)
+	}
+	if _, err := client.Rbac().Roles(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected coredns role deleted, got %v", err)
+	}
+	if _, err := client.Core().ServiceAccounts(testNamespace).Get(DNSProviderCoreDNS, apismetav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected coredns service account deleted, got %v", err)
+	}
+	configMap, err = client.Core().ConfigMaps(testNamespace).Get(DNSProviderKubeDNS, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get kube-dns config map in namespace %s: %v", testNamespace, err)
+	}
+	expectedData := map[string]string{
+		"stubDomains":         `{"acme.local":["1.2.3.4"]}`,
+		"upstreamNameservers": `["8.8.8.8"]`,
+	}
+	if !reflect.DeepEqual(configMap.Data, expectedData) {
+		t.Errorf("Expected kube-dns config %v, got %v", expectedData, configMap.Data)
 	}
 }
 
@@ -156,7 +211,11 @@ func TestDeleteDeployment(t *testing.T) {
 		t.Fatalf("Failed start a new fake NetworkController")
 	}
 
-	err = controller.createKubeDNSDeployment(testNamespace)
+	deployment, err := dnsProviders[DNSProviderKubeDNS].deployment(newDNSArgs(newNetwork(testNamespace, "")))
+	if err != nil {
+		t.Fatalf("Render kube-dns deployment error: %v", err)
+	}
+	err = controller.ensureDeployment(deployment)
 	if err != nil {
 		t.Fatalf("Create kube-dns deployment in namespace %v error: %v", testNamespace, err)
 	}
@@ -172,7 +231,7 @@ func TestDeleteDeployment(t *testing.T) {
 	}
 }
 
-func TestCreateKubeDNSService(t *testing.T) {
+func TestEnsureDNSService(t *testing.T) {
 	testNamespace := "foo"
 	// Created a new fake NetworkController.
 	controller, _, _, client, err := newNetworkController()
@@ -180,27 +239,26 @@ func TestCreateKubeDNSService(t *testing.T) {
 		t.Fatalf("Failed start a new fake NetworkController")
 	}
 
-	err = controller.createKubeDNSService(testNamespace)
+	err = controller.ensureDNSService(testNamespace)
 	if err != nil {
 		t.Fatalf("Create kube-dns service in namespace %v error: %v", testNamespace, err)
 	}
+	if err := testKubeDNSServiceCreated(t, client, testNamespace); err != nil {
+		t.Error(err)
+	}
 
-	kubeDNSSVC, err := client.Core().Services(testNamespace).Get("kube-dns", apismetav1.GetOptions{})
+	// Changed ports are restored and the cluster IP is kept.
+	svc, _ := client.Core().Services(testNamespace).Get("kube-dns", apismetav1.GetOptions{})
+	svc.Spec.ClusterIP = "10.96.0.10"
+	svc.Spec.Ports = svc.Spec.Ports[:1]
+	client.Core().Services(testNamespace).Update(svc)
+	err = controller.ensureDNSService(testNamespace)
 	if err != nil {
-		t.Fatalf("Failed get kube-dns service in namespace %s: %v", testNamespace, err)
+		t.Fatalf("Update kube-dns service in namespace %v error: %v", testNamespace, err)
 	}
-	// Generates the kube-dns service template
-	tempArgs := struct{ Namespace string }{
-		Namespace: testNamespace,
-	}
-	dnsServiceBytes, err := parseTemplate(kubeDNSService, tempArgs)
-	dnsService := &apiv1.Service{}
-	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsServiceBytes, dnsService); err != nil {
-		t.Fatalf("unable to decode kube-dns service in namespace %s: %v", testNamespace, err)
-	}
-
-	if !reflect.DeepEqual(kubeDNSSVC, dnsService) {
-		t.Errorf("Created kube-dns service in namespace %s has incorrect parameters: %v", testNamespace, kubeDNSSVC)
+	svc, _ = client.Core().Services(testNamespace).Get("kube-dns", apismetav1.GetOptions{})
+	if len(svc.Spec.Ports) != 2 || svc.Spec.ClusterIP != "10.96.0.10" {
+		t.Errorf("Expected kube-dns service restored with its cluster IP, got %v", svc.Spec)
 	}
 }
 
@@ -253,9 +311,13 @@ func TestOnAdd(t *testing.T) {
 				if net.Status.State != crv1.NetworkActive {
 					return fmt.Errorf("expected %s network status Active,got %v", networkName, net.Status.State)
 				}
+				// test finalizer added
+				if !util.HasFinalizer(net.Finalizers, crv1.NetworkFinalizer) {
+					return fmt.Errorf("expected finalizer added to %s network, got %v", networkName, net.Finalizers)
+				}
 
 				// test kube-dns deployment created
-				err = testKubeDNSDeploymentCreated(t, client, networkName)
+				err = testDNSDeploymentCreated(t, client, newNetwork(networkName, ""))
 				if err != nil {
 					return err
 				}
@@ -300,7 +362,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment created
-				err = testKubeDNSDeploymentCreated(t, client, networkName)
+				err = testDNSDeploymentCreated(t, client, newNetwork(networkName, ""))
 				if err != nil {
 					return err
 				}
@@ -345,7 +407,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment created
-				err = testKubeDNSDeploymentCreated(t, client, networkName)
+				err = testDNSDeploymentCreated(t, client, newNetwork(networkName, ""))
 				if err != nil {
 					return err
 				}
@@ -385,7 +447,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment not created
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -427,7 +489,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment not created
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -471,7 +533,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment not created
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -515,7 +577,7 @@ func TestOnAdd(t *testing.T) {
 				}
 
 				// test kube-dns deployment not created
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -540,7 +602,6 @@ func TestOnAdd(t *testing.T) {
 
 func TestOnDelete(t *testing.T) {
 	var controller *NetworkController
-	var kubeCRDClient *crdClient.FakeCRDClient
 	var osClient *openstack.FakeOSClient
 	var client *fake.Clientset
 	var err error
@@ -557,14 +618,12 @@ func TestOnDelete(t *testing.T) {
 			updateFn: func(networkName string) {
 
 				// Created a new fake NetworkController
-				controller, kubeCRDClient, osClient, client, err = newNetworkController()
+				controller, _, osClient, client, err = newNetworkController()
 				if err != nil {
 					t.Fatalf("Failed start a new fake NetworkController")
 				}
-				// Create kube-dns deployment
-				controller.createKubeDNSDeployment(networkName)
-				// Create kube-dns svc
-				controller.createKubeDNSService(networkName)
+				// Create DNS server
+				controller.syncDNS(newNetwork(networkName, ""))
 				// openstack injects fake network
 				net := osNetwork(util.BuildNetworkName(networkName, networkName), "", "")
 				osClient.SetNetwork(net)
@@ -582,7 +641,7 @@ func TestOnDelete(t *testing.T) {
 				}
 
 				// test kube-dns deployment deleted
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -600,14 +659,12 @@ func TestOnDelete(t *testing.T) {
 			updateFn: func(networkName string) {
 
 				// Created a new fake NetworkController
-				controller, kubeCRDClient, osClient, client, err = newNetworkController()
+				controller, _, osClient, client, err = newNetworkController()
 				if err != nil {
 					t.Fatalf("Failed start a new fake NetworkController")
 				}
-				// Create kube-dns deployment
-				controller.createKubeDNSDeployment(networkName)
-				// Create kube-dns svc
-				controller.createKubeDNSService(networkName)
+				// Create DNS server
+				controller.syncDNS(newNetwork(networkName, ""))
 				// openstack injects fake network
 				net := osNetwork(util.BuildNetworkName(networkName, networkName), "", "")
 				osClient.SetNetwork(net)
@@ -627,7 +684,7 @@ func TestOnDelete(t *testing.T) {
 				}
 
 				// test kube-dns deployment deleted
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -645,14 +702,12 @@ func TestOnDelete(t *testing.T) {
 			updateFn: func(networkName string) {
 
 				// Created a new fake NetworkController
-				controller, kubeCRDClient, osClient, client, err = newNetworkController()
+				controller, _, osClient, client, err = newNetworkController()
 				if err != nil {
 					t.Fatalf("Failed start a new fake NetworkController")
 				}
-				// Create kube-dns deployment
-				controller.createKubeDNSDeployment(networkName)
-				// Create kube-dns svc
-				controller.createKubeDNSService(networkName)
+				// Create DNS server
+				controller.syncDNS(newNetwork(networkName, ""))
 				// openstack injects fake network
 				net := osNetwork(util.BuildNetworkName(networkName, networkName), "", networkID)
 				osClient.SetNetwork(net)
@@ -670,7 +725,7 @@ func TestOnDelete(t *testing.T) {
 				}
 
 				// test kube-dns deployment deleted
-				err = testKubeDNSDeploymentDeletedOrNoCreated(t, client, networkName)
+				err = testDNSDeploymentDeletedOrNoCreated(t, client, networkName)
 				if err != nil {
 					return err
 				}
@@ -693,42 +748,318 @@ func TestOnDelete(t *testing.T) {
 	}
 }
 
-func testKubeDNSDeploymentCreated(t *testing.T, client *fake.Clientset, namespace string) error {
-	kubeDNSDeploy, err := client.ExtensionsV1beta1().Deployments(namespace).Get("kube-dns", apismetav1.GetOptions{})
+func TestTeardownNetwork(t *testing.T) {
+	networkName := "foo"
+	controller, kubeCRDClient, osClient, _, err := newNetworkController()
 	if err != nil {
-		t.Fatalf("Failed get kube-dns deployment in namespace %s: %v", namespace, err)
+		t.Fatalf("Failed start a new fake NetworkController")
 	}
-	// Generates the kube-dns deployment template
-	tempArgs := struct{ Namespace, DNSDomain, KubeDNSImage, DNSMasqImage, SidecarImage, KubernetesHost, KubernetesPort string }{
-		Namespace:    namespace,
-		DNSDomain:    defaultDNSDomain,
-		KubeDNSImage: defaultKubeDNSImage,
-		DNSMasqImage: defaultDNSMasqImage,
-		SidecarImage: defaultSideCarImage,
+
+	osNet := osNetwork(util.BuildNetworkName(networkName, networkName), tenantID, networkID)
+	osNet.Subnets = []*drivertypes.Subnet{{Uid: "789"}}
+	osClient.SetNetwork(osNet)
+	osClient.SetLoadbalancer(&openstack.LoadBalancer{Name: "lb", SubnetID: "789"})
+	osClient.SetPort(networkID, "compute:nova", "pod")
+	osClient.SetPort(networkID, "network:router_interface", "router")
+
+	network := newNetwork(networkName, "")
+	network.Finalizers = []string{crv1.NetworkFinalizer}
+	network.Status.State = crv1.NetworkActive
+	deleted := network.DeepCopy()
+	now := apismetav1.Now()
+	deleted.DeletionTimestamp = &now
+	kubeCRDClient.SetNetworks(deleted)
+
+	// The teardown stops at the failed step and keeps the network.
+	osClient.InjectError("DeletePortsOnNetwork", fmt.Errorf("neutron unavailable"))
+	controller.onUpdate(network, deleted)
+	synced := kubeCRDClient.Networks[networkName]
+	if synced.Status.State != crv1.NetworkTerminating || synced.Status.TeardownStep != crv1.TeardownPorts || synced.Status.Message == "" {
+		t.Errorf("Expected failed step %s reported, got %v", crv1.TeardownPorts, synced.Status)
 	}
-	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
-		tempArgs.KubernetesHost = host
+	if !util.HasFinalizer(synced.Finalizers, crv1.NetworkFinalizer) {
+		t.Errorf("Expected finalizer kept, got %v", synced.Finalizers)
 	}
-	if port := os.Getenv("KUBERNETES_SERVICE_PORT"); port != "" {
-		tempArgs.KubernetesPort = port
+	if _, ok := osClient.LoadBalancers["lb"]; ok {
+		t.Errorf("Expected load balancer deleted")
 	}
-	dnsDeploymentBytes, err := parseTemplate(kubeDNSDeployment, tempArgs)
-	kubeDNSDeployTemplate := &v1beta1.Deployment{}
-	if err = kuberuntime.DecodeInto(scheme.Codecs.UniversalDecoder(), dnsDeploymentBytes, kubeDNSDeployTemplate); err != nil {
-		t.Fatalf("unable to decode kube-dns deployment in namespace %s:%v", namespace, err)
+	if len(osClient.Ports[networkID]) != 2 {
+		t.Errorf("Expected ports kept, got %v", osClient.Ports[networkID])
 	}
 
-	if !reflect.DeepEqual(kubeDNSDeploy, kubeDNSDeployTemplate) {
-		return fmt.Errorf("Created kube-dns deployment in namespace %s has incorrect parameters: %v", namespace, kubeDNSDeploy)
+	// The teardown is resumed from the failed step on resync.
+	calls := len(osClient.GetCalledNames())
+	controller.onUpdate(synced, synced)
+	synced = kubeCRDClient.Networks[networkName]
+	if synced.Status.TeardownStep != crv1.TeardownCompleted {
+		t.Errorf("Expected teardown completed, got %v", synced.Status)
+	}
+	if util.HasFinalizer(synced.Finalizers, crv1.NetworkFinalizer) {
+		t.Errorf("Expected finalizer removed, got %v", synced.Finalizers)
+	}
+	if len(osClient.Ports[networkID]) != 0 {
+		t.Errorf("Expected ports deleted, got %v", osClient.Ports[networkID])
+	}
+	if _, ok := osClient.Networks[osNet.Name]; ok {
+		t.Errorf("Expected network deleted")
+	}
+	expected := []string{"DeletePortsOnNetwork", "DeleteRouterInterfaces", "DeleteNetwork"}
+	called := osClient.GetCalledNames()[calls:]
+	for _, name := range expected {
+		found := false
+		for _, c := range called {
+			found = found || c == name
+		}
+		if !found {
+			t.Errorf("Expected %s called, got %v", name, called)
+		}
+	}
+	for _, c := range called {
+		if c == "DeleteLoadBalancersOnNetwork" {
+			t.Errorf("Expected completed steps not rerun, got %v", called)
+		}
 	}
-	return nil
 }
 
-func testKubeDNSDeploymentDeletedOrNoCreated(t *testing.T, client *fake.Clientset, namespace string) error {
-	_, err := client.ExtensionsV1beta1().Deployments(namespace).Get("kube-dns", apismetav1.GetOptions{})
+func TestOnUpdate(t *testing.T) {
+	networkName := "foo"
 
-	if err.Error() != fmt.Errorf("deployments.extensions \"kube-dns\" not found").Error() {
-		t.Errorf("Unexpected error: %v", err)
+	testCases := []struct {
+		testName      string
+		updateFn      func(network *crv1.Network)
+		injectError   error
+		expectedState string
+	}{
+		{
+			testName: "Update DNS nameservers and host routes,success",
+			updateFn: func(network *crv1.Network) {
+				network.Spec.DNSNameservers = []string{"8.8.8.8"}
+				network.Spec.HostRoutes = []crv1.HostRoute{{Destination: "192.168.0.0/24", Nexthop: "10.244.0.254"}}
+			},
+			expectedState: crv1.NetworkActive,
+		},
+		{
+			testName: "Update gateway,failed in openstack",
+			updateFn: func(network *crv1.Network) {
+				network.Spec.Gateway = "10.244.0.254"
+			},
+			injectError:   fmt.Errorf("update network failed"),
+			expectedState: crv1.NetworkFailed,
+		},
+		{
+			testName: "Update networkID,failed",
+			updateFn: func(network *crv1.Network) {
+				network.Spec.NetworkID = networkID
+			},
+			expectedState: crv1.NetworkFailed,
+		},
+	}
+
+	for tci, tc := range testCases {
+		controller, kubeCRDClient, osClient, _, err := newNetworkController()
+		if err != nil {
+			t.Fatalf("Failed start a new fake NetworkController")
+		}
+		oldNetwork := newNetwork(networkName, "")
+		kubeCRDClient.SetNetworks(oldNetwork)
+		osClient.SetNetwork(osNetwork(util.BuildNetworkName(networkName, networkName), tenantID, ""))
+		if tc.injectError != nil {
+			osClient.InjectError("UpdateNetwork", tc.injectError)
+		}
+
+		network := oldNetwork.DeepCopy()
+		tc.updateFn(network)
+		controller.onUpdate(oldNetwork, network)
+
+		net := kubeCRDClient.Networks[networkName]
+		if net.Status.State != tc.expectedState {
+			t.Errorf("Case[%d]: %s expected network status %s, got %v", tci, tc.testName, tc.expectedState, net.Status.State)
+		}
+	}
+}
+
+func TestBuildDriverNetwork(t *testing.T) {
+	networkName := util.BuildNetworkName("foo", "foo")
+	disableDHCP := false
+	network := newNetwork("foo", "")
+	network.Spec.DNSNameservers = []string{"8.8.8.8"}
+	network.Spec.Subnets = []crv1.SubnetSpec{
+		{
+			Name:            "db",
+			CIDR:            "10.245.0.0/24",
+			HostRoutes:      []crv1.HostRoute{{Destination: "192.168.0.0/24", Nexthop: "10.245.0.254"}},
+			AllocationPools: []crv1.AllocationPool{{Start: "10.245.0.10", End: "10.245.0.100"}},
+			EnableDHCP:      &disableDHCP,
+		},
+		{
+			Name:            "v6",
+			CIDR:            "fd00:10::/64",
+			IPv6AddressMode: crv1.IPv6ModeSLAAC,
+			IPv6RAMode:      crv1.IPv6ModeSLAAC,
+		},
+	}
+
+	driverNetwork := buildDriverNetwork(network, networkName, tenantID)
+	if len(driverNetwork.Subnets) != 3 {
+		t.Fatalf("Expected 3 subnets, got %v", driverNetwork.Subnets)
+	}
+
+	primary := driverNetwork.Subnets[0]
+	if primary.Name != networkName+"-subnet" || primary.Cidr != userCIDR || !primary.EnableDHCP ||
+		!reflect.DeepEqual(primary.Dnsservers, network.Spec.DNSNameservers) {
+		t.Errorf("The primary subnet has incorrect parameters: %v", primary)
+	}
+
+	db := driverNetwork.Subnets[1]
+	if db.Name != networkName+"-db-subnet" || db.Cidr != "10.245.0.0/24" || db.EnableDHCP ||
+		len(db.Routes) != 1 || len(db.Pools) != 1 {
+		t.Errorf("The db subnet has incorrect parameters: %v", db)
+	}
+	if primary.IPVersion != 4 || db.IPVersion != 4 {
+		t.Errorf("Expected IPv4 subnets, got %v and %v", primary, db)
+	}
+
+	v6 := driverNetwork.Subnets[2]
+	if v6.IPVersion != 6 || v6.IPv6AddressMode != crv1.IPv6ModeSLAAC || v6.IPv6RAMode != crv1.IPv6ModeSLAAC {
+		t.Errorf("The v6 subnet has incorrect parameters: %v", v6)
+	}
+}
+
+func TestValidateNetworkSpec(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		subnets   []crv1.SubnetSpec
+		expectErr bool
+	}{
+		{
+			testName: "Valid subnets",
+			subnets:  []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24"}, {Name: "b", CIDR: "10.0.1.0/24"}},
+		},
+		{
+			testName:  "Subnet without name",
+			subnets:   []crv1.SubnetSpec{{CIDR: "10.0.0.0/24"}},
+			expectErr: true,
+		},
+		{
+			testName:  "Duplicated subnets",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24"}, {Name: "a", CIDR: "10.0.1.0/24"}},
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid CIDR",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0"}},
+			expectErr: true,
+		},
+		{
+			testName: "Valid IPv6 subnet",
+			subnets:  []crv1.SubnetSpec{{Name: "a", CIDR: "fd00::/64", IPv6AddressMode: crv1.IPv6ModeSLAAC, IPv6RAMode: crv1.IPv6ModeSLAAC}},
+		},
+		{
+			testName:  "IPv6 mode on IPv4 subnet",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24", IPv6AddressMode: crv1.IPv6ModeSLAAC}},
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid IPv6 mode",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "fd00::/64", IPv6RAMode: "dhcp"}},
+			expectErr: true,
+		},
+		{
+			testName:  "Mismatched IPv6 modes",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "fd00::/64", IPv6AddressMode: crv1.IPv6ModeSLAAC, IPv6RAMode: crv1.IPv6ModeDHCPv6Stateful}},
+			expectErr: true,
+		},
+		{
+			testName: "Valid allocation pool",
+			subnets:  []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24", AllocationPools: []crv1.AllocationPool{{Start: "10.0.0.10", End: "10.0.0.20"}}}},
+		},
+		{
+			testName:  "Allocation pool ending outside CIDR",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24", AllocationPools: []crv1.AllocationPool{{Start: "10.0.0.10", End: "10.0.1.20"}}}},
+			expectErr: true,
+		},
+		{
+			testName:  "Allocation pool starting after its end",
+			subnets:   []crv1.SubnetSpec{{Name: "a", CIDR: "10.0.0.0/24", AllocationPools: []crv1.AllocationPool{{Start: "10.0.0.20", End: "10.0.0.10"}}}},
+			expectErr: true,
+		},
+	}
+
+	for tci, tc := range testCases {
+		err := validateNetworkSpec(&crv1.NetworkSpec{Subnets: tc.subnets})
+		if tc.expectErr != (err != nil) {
+			t.Errorf("Case[%d]: %s expected error %v, got %v", tci, tc.testName, tc.expectErr, err)
+		}
+	}
+}
+
+func TestValidateDNSSpec(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		dns       *crv1.DNSSpec
+		expectErr bool
+	}{
+		{
+			testName: "Valid DNS",
+			dns: &crv1.DNSSpec{
+				Provider:    DNSProviderKubeDNS,
+				Upstreams:   []string{"8.8.8.8", "2001:4860:4860::8888"},
+				StubDomains: map[string][]string{"acme.local": {"1.2.3.4"}},
+			},
+		},
+		{
+			testName:  "Unknown provider",
+			dns:       &crv1.DNSSpec{Provider: "bind"},
+			expectErr: true,
+		},
+		{
+			testName:  "Invalid upstream",
+			dns:       &crv1.DNSSpec{Upstreams: []string{"dns.google"}},
+			expectErr: true,
+		},
+		{
+			testName:  "Stub domain without nameservers",
+			dns:       &crv1.DNSSpec{StubDomains: map[string][]string{"acme.local": nil}},
+			expectErr: true,
+		},
+	}
+
+	for tci, tc := range testCases {
+		err := validateNetworkSpec(&crv1.NetworkSpec{DNS: tc.dns})
+		if tc.expectErr != (err != nil) {
+			t.Errorf("Case[%d]: %s expected error %v, got %v", tci, tc.testName, tc.expectErr, err)
+		}
+	}
+}
+
+func testDNSDeploymentCreated(t *testing.T, client *fake.Clientset, network *crv1.Network) error {
+	provider := DNSProviderCoreDNS
+	if network.Spec.DNS != nil && network.Spec.DNS.Provider != "" {
+		provider = network.Spec.DNS.Provider
+	}
+	namespace := network.Namespace
+	dnsDeploy, err := client.ExtensionsV1beta1().Deployments(namespace).Get(provider, apismetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed get %s deployment in namespace %s: %v", provider, namespace, err)
+	}
+	// Generates the DNS deployment template
+	dnsDeployTemplate, err := dnsProviders[provider].deployment(newDNSArgs(network))
+	if err != nil {
+		t.Fatalf("unable to render %s deployment in namespace %s:%v", provider, namespace, err)
+	}
+
+	if !reflect.DeepEqual(dnsDeploy, dnsDeployTemplate) {
+		return fmt.Errorf("Created %s deployment in namespace %s has incorrect parameters: %v", provider, namespace, dnsDeploy)
+	}
+	return nil
+}
+
+func testDNSDeploymentDeletedOrNoCreated(t *testing.T, client *fake.Clientset, namespace string) error {
+	for provider := range dnsProviders {
+		_, err := client.ExtensionsV1beta1().Deployments(namespace).Get(provider, apismetav1.GetOptions{})
+		if !apierrors.IsNotFound(err) {
+			t.Errorf("Unexpected error: %v", err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+
+	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	"git.openstack.org/openstack/stackube/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// networkTeardownStep is a step of tearing down the resources of a network in
+// Neutron, it must be idempotent.
+type networkTeardownStep struct {
+	name string
+	run  func(networkName string) error
+}
+
+// networkTeardownSteps returns the steps of tearing down networks in order.
+func (c *NetworkController) networkTeardownSteps() []networkTeardownStep {
+	return []networkTeardownStep{
+		{name: crv1.TeardownLoadBalancers, run: c.driver.DeleteLoadBalancersOnNetwork},
+		{name: crv1.TeardownFloatingIPs, run: c.driver.DeleteFloatingIPsOnNetwork},
+		{name: crv1.TeardownPorts, run: c.driver.DeletePortsOnNetwork},
+		{name: crv1.TeardownRouterInterfaces, run: c.driver.DeleteRouterInterfaces},
+		{name: crv1.TeardownNetwork, run: c.driver.DeleteNetwork},
+	}
+}
+
+// ensureNetworkFinalizer adds the finalizer to the network, so that the network
+// is kept until it's torn down in Neutron.
+func (c *NetworkController) ensureNetworkFinalizer(kubeNetwork *crv1.Network) error {
+	if util.HasFinalizer(kubeNetwork.Finalizers, crv1.NetworkFinalizer) {
+		return nil
+	}
+
+	kubeNetwork.Finalizers = append(kubeNetwork.Finalizers, crv1.NetworkFinalizer)
+	return c.kubeCRDClient.UpdateNetwork(kubeNetwork)
+}
+
+// teardownNetwork tears down the deleted network step by step and removes its
+// finalizer at last. The step in progress is recorded in the network status, an
+// interrupted teardown is resumed from it on the next sync.
+func (c *NetworkController) teardownNetwork(kubeNetwork *crv1.Network) error {
+	if !util.HasFinalizer(kubeNetwork.Finalizers, crv1.NetworkFinalizer) {
+		return nil
+	}
+
+	isDefault, err := c.isDefaultNetwork(kubeNetwork)
+	if err != nil {
+		glog.Warningf("error on checking default network of namespace %s: %v", kubeNetwork.Namespace, err)
+	}
+	if isDefault {
+		c.deleteDNS(kubeNetwork.Namespace)
+	}
+
+	// Networks provided by networkID are not managed by stackube.
+	if kubeNetwork.Spec.NetworkID == "" && kubeNetwork.Status.TeardownStep != crv1.TeardownCompleted {
+		networkName := util.BuildNetworkName(kubeNetwork.GetNamespace(), kubeNetwork.GetName())
+		steps := c.networkTeardownSteps()
+		start := 0
+		for i, step := range steps {
+			if step.name == kubeNetwork.Status.TeardownStep {
+				start = i
+			}
+		}
+
+		for _, step := range steps[start:] {
+			if kubeNetwork.Status.TeardownStep != step.name {
+				kubeNetwork.Status.TeardownStep = step.name
+				c.updateNetworkStatus(kubeNetwork, crv1.NetworkTerminating, "")
+			}
+
+			if err := step.run(networkName); err != nil {
+				c.updateNetworkStatus(kubeNetwork, crv1.NetworkTerminating, fmt.Sprintf("Teardown step %s failed: %v", step.name, err))
+				return fmt.Errorf("teardown step %s of network %s failed: %v", step.name, networkName, err)
+			}
+			glog.V(4).Infof("[NetworkController]: teardown step %s of network %s done", step.name, networkName)
+		}
+	}
+
+	kubeNetwork.Status.State = crv1.NetworkTerminating
+	kubeNetwork.Status.Message = ""
+	kubeNetwork.Status.TeardownStep = crv1.TeardownCompleted
+	kubeNetwork.Finalizers = util.RemoveFinalizer(kubeNetwork.Finalizers, crv1.NetworkFinalizer)
+	if err := c.kubeCRDClient.UpdateNetwork(kubeNetwork); err != nil {
+		return fmt.Errorf("remove finalizer of network %s failed: %v", kubeNetwork.Name, err)
+	}
+	glog.V(4).Infof("[NetworkController]: network %s torn down", kubeNetwork.Name)
+	return nil
+}
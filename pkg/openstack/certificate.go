@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+)
+
+const (
+	certificateStoreBarbican = "barbican"
+	certificateStoreFile     = "file"
+
+	barbicanPageSize = 100
+)
+
+// CertificateStore stores the certificates of TERMINATED_HTTPS listeners.
+type CertificateStore interface {
+	// EnsureCertificate stores the certificate and the private key by name if it doesn't
+	// exist yet, and returns the reference of it.
+	EnsureCertificate(name string, certificate, privateKey []byte) (string, error)
+	// ListCertificates returns references of certificates whose names start with the prefix.
+	ListCertificates(prefix string) (map[string]string, error)
+	// DeleteCertificate deletes the certificate by reference.
+	DeleteCertificate(ref string) error
+}
+
+// newCertificateStore creates the certificate store selected by the config.
+func newCertificateStore(provider *gophercloud.ProviderClient, cfg Config) (CertificateStore, error) {
+	switch cfg.LoadBalancer.CertificateStore {
+	case "", certificateStoreBarbican:
+		store, err := newBarbicanStore(provider, gophercloud.EndpointOpts{
+			Region: cfg.Global.Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, reader := range strings.Split(cfg.LoadBalancer.CertificateReaders, ",") {
+			if reader = strings.TrimSpace(reader); reader != "" {
+				store.readers = append(store.readers, reader)
+			}
+		}
+		return store, nil
+	case certificateStoreFile:
+		return NewFileCertificateStore(cfg.LoadBalancer.CertificateDir)
+	}
+
+	return nil, fmt.Errorf("unknown certificate store %q", cfg.LoadBalancer.CertificateStore)
+}
+
+// barbicanStore stores certificates as Barbican certificate containers, which are
+// referenced by listeners of both Neutron LBaaS and Octavia. Containers are owned
+// by the Stackube user, so the users of the load balancer service are granted
+// read access by ACLs.
+type barbicanStore struct {
+	client *gophercloud.ServiceClient
+	// readers are IDs of users granted read access to containers and secrets.
+	readers []string
+}
+
+// barbicanACL grants read access to the users besides the project of the owner.
+type barbicanACL struct {
+	Read struct {
+		Users         []string `json:"users"`
+		ProjectAccess bool     `json:"project-access"`
+	} `json:"read"`
+}
+
+type barbicanSecretRef struct {
+	Name      string `json:"name"`
+	SecretRef string `json:"secret_ref"`
+}
+
+type barbicanContainer struct {
+	Name         string              `json:"name"`
+	Type         string              `json:"type,omitempty"`
+	ContainerRef string              `json:"container_ref,omitempty"`
+	SecretRefs   []barbicanSecretRef `json:"secret_refs"`
+}
+
+func newBarbicanStore(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*barbicanStore, error) {
+	eo.ApplyDefaults("key-manager")
+	url, err := provider.EndpointLocator(eo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &barbicanStore{
+		client: &gophercloud.ServiceClient{
+			ProviderClient: provider,
+			Endpoint:       url,
+			ResourceBase:   url + "v1/",
+		},
+	}, nil
+}
+
+// EnsureCertificate stores the certificate and the private key as a certificate container.
+func (s *barbicanStore) EnsureCertificate(name string, certificate, privateKey []byte) (string, error) {
+	ref, err := s.getContainerRef(name)
+	if err != nil {
+		return "", err
+	}
+	if ref != "" {
+		return ref, nil
+	}
+
+	certificateRef, err := s.createSecret(name+"-certificate", "certificate", certificate)
+	if err != nil {
+		return "", err
+	}
+	privateKeyRef, err := s.createSecret(name+"-private-key", "private", privateKey)
+	if err != nil {
+		s.deleteSecret(certificateRef)
+		return "", err
+	}
+
+	container := barbicanContainer{
+		Name: name,
+		Type: "certificate",
+		SecretRefs: []barbicanSecretRef{
+			{Name: "certificate", SecretRef: certificateRef},
+			{Name: "private_key", SecretRef: privateKeyRef},
+		},
+	}
+	var result struct {
+		ContainerRef string `json:"container_ref"`
+	}
+	_, err = s.client.Post(s.client.ServiceURL("containers"), container, &result, &gophercloud.RequestOpts{
+		OkCodes: []int{201},
+	})
+	if err != nil {
+		glog.Errorf("Create certificate container %q failed: %v", name, err)
+		s.deleteSecret(certificateRef)
+		s.deleteSecret(privateKeyRef)
+		return "", err
+	}
+
+	for _, ref := range []string{certificateRef, privateKeyRef, result.ContainerRef} {
+		if err := s.setReadACL(ref); err != nil {
+			glog.Errorf("Set ACL of %q failed: %v", ref, err)
+			s.DeleteCertificate(result.ContainerRef)
+			return "", err
+		}
+	}
+
+	glog.V(3).Infof("Certificate container %q created: %s", name, result.ContainerRef)
+	return result.ContainerRef, nil
+}
+
+// getContainerRef returns the reference of the container by name, which is empty
+// if the container doesn't exist.
+func (s *barbicanStore) getContainerRef(name string) (string, error) {
+	var page struct {
+		Containers []barbicanContainer `json:"containers"`
+	}
+	query := url.Values{"name": {name}}
+	if _, err := s.client.Get(s.client.ServiceURL("containers")+"?"+query.Encode(), &page, nil); err != nil {
+		return "", err
+	}
+
+	for _, c := range page.Containers {
+		if c.Name == name {
+			return c.ContainerRef, nil
+		}
+	}
+	return "", nil
+}
+
+// setReadACL grants the readers read access to the secret or the container.
+func (s *barbicanStore) setReadACL(ref string) error {
+	if len(s.readers) == 0 {
+		return nil
+	}
+
+	acl := barbicanACL{}
+	acl.Read.Users = s.readers
+	acl.Read.ProjectAccess = true
+	_, err := s.client.Put(ref+"/acl", acl, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200, 201},
+	})
+	return err
+}
+
+// ListCertificates returns references of certificate containers by name.
+func (s *barbicanStore) ListCertificates(prefix string) (map[string]string, error) {
+	containers, err := s.listContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]string)
+	for _, c := range containers {
+		if c.Type == "certificate" && strings.HasPrefix(c.Name, prefix) {
+			refs[c.Name] = c.ContainerRef
+		}
+	}
+	return refs, nil
+}
+
+// DeleteCertificate deletes the certificate container with its secrets.
+func (s *barbicanStore) DeleteCertificate(ref string) error {
+	var container barbicanContainer
+	if _, err := s.client.Get(ref, &container, nil); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := s.client.Delete(ref, nil); err != nil && !isNotFound(err) {
+		glog.Errorf("Delete certificate container %q failed: %v", ref, err)
+		return err
+	}
+	for _, secret := range container.SecretRefs {
+		if err := s.deleteSecret(secret.SecretRef); err != nil {
+			return err
+		}
+	}
+
+	glog.V(3).Infof("Certificate container %q deleted", ref)
+	return nil
+}
+
+func (s *barbicanStore) listContainers() ([]barbicanContainer, error) {
+	var containers []barbicanContainer
+	for offset := 0; ; {
+		var page struct {
+			Containers []barbicanContainer `json:"containers"`
+			Total      int                 `json:"total"`
+		}
+		url := fmt.Sprintf("%s?limit=%d&offset=%d", s.client.ServiceURL("containers"), barbicanPageSize, offset)
+		if _, err := s.client.Get(url, &page, nil); err != nil {
+			return nil, err
+		}
+
+		containers = append(containers, page.Containers...)
+		offset += len(page.Containers)
+		if len(page.Containers) == 0 || offset >= page.Total {
+			return containers, nil
+		}
+	}
+}
+
+func (s *barbicanStore) createSecret(name, secretType string, payload []byte) (string, error) {
+	body := map[string]interface{}{
+		"name":                 name,
+		"secret_type":          secretType,
+		"payload":              string(payload),
+		"payload_content_type": "text/plain",
+	}
+	var result struct {
+		SecretRef string `json:"secret_ref"`
+	}
+	_, err := s.client.Post(s.client.ServiceURL("secrets"), body, &result, &gophercloud.RequestOpts{
+		OkCodes: []int{201},
+	})
+	if err != nil {
+		glog.Errorf("Create secret %q failed: %v", name, err)
+		return "", err
+	}
+
+	return result.SecretRef, nil
+}
+
+func (s *barbicanStore) deleteSecret(ref string) error {
+	if _, err := s.client.Delete(ref, nil); err != nil && !isNotFound(err) {
+		glog.Errorf("Delete secret %q failed: %v", ref, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileCertificateRefPrefix = "file://"
+	fileCertificateSuffix    = ".pem"
+)
+
+// fileCertificateStore keeps certificates as PEM files in a local directory. It's a
+// stand-in of Barbican for tests and development, load balancers can't read them.
+type fileCertificateStore struct {
+	dir string
+}
+
+// NewFileCertificateStore returns a certificate store in the local directory.
+func NewFileCertificateStore(dir string) (CertificateStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("certificate directory not set")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileCertificateStore{dir: dir}, nil
+}
+
+// EnsureCertificate writes the certificate and the private key to a file.
+func (s *fileCertificateStore) EnsureCertificate(name string, certificate, privateKey []byte) (string, error) {
+	path := filepath.Join(s.dir, name+fileCertificateSuffix)
+	if _, err := os.Stat(path); err == nil {
+		return fileCertificateRefPrefix + path, nil
+	}
+
+	data := append(append([]byte{}, certificate...), privateKey...)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return fileCertificateRefPrefix + path, nil
+}
+
+// ListCertificates returns references of certificate files by name.
+func (s *fileCertificateStore) ListCertificates(prefix string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]string)
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), fileCertificateSuffix)
+		if f.IsDir() || name == f.Name() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		refs[name] = fileCertificateRefPrefix + filepath.Join(s.dir, f.Name())
+	}
+	return refs, nil
+}
+
+// DeleteCertificate removes the certificate file.
+func (s *fileCertificateStore) DeleteCertificate(ref string) error {
+	err := os.Remove(strings.TrimPrefix(ref, fileCertificateRefPrefix))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBarbican serves the Barbican secrets, containers and ACLs of certificates.
+type fakeBarbican struct {
+	sync.Mutex
+	url        string
+	nextID     int
+	containers []barbicanContainer
+	// acls are users with read access by reference.
+	acls map[string][]string
+	// requests are "<method> <path>" of all requests served.
+	requests []string
+}
+
+func (f *fakeBarbican) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/containers":
+		result := []barbicanContainer{}
+		for _, c := range f.containers {
+			if name := r.URL.Query().Get("name"); name == "" || name == c.Name {
+				result = append(result, c)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"containers": result, "total": len(result)})
+	case r.Method == "POST" && r.URL.Path == "/secrets":
+		f.nextID++
+		writeJSON(w, http.StatusCreated, map[string]string{"secret_ref": fmt.Sprintf("%s/secrets/%d", f.url, f.nextID)})
+	case r.Method == "POST" && r.URL.Path == "/containers":
+		var container barbicanContainer
+		json.NewDecoder(r.Body).Decode(&container)
+		f.nextID++
+		container.ContainerRef = fmt.Sprintf("%s/containers/%d", f.url, f.nextID)
+		f.containers = append(f.containers, container)
+		writeJSON(w, http.StatusCreated, map[string]string{"container_ref": container.ContainerRef})
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/acl"):
+		var acl barbicanACL
+		json.NewDecoder(r.Body).Decode(&acl)
+		f.acls[f.url+strings.TrimSuffix(r.URL.Path, "/acl")] = acl.Read.Users
+		writeJSON(w, http.StatusOK, map[string]string{"acl_ref": f.url + r.URL.Path})
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBarbicanEnsureCertificate(t *testing.T) {
+	barbican := &fakeBarbican{acls: make(map[string][]string)}
+	server := httptest.NewServer(barbican)
+	defer server.Close()
+	barbican.url = server.URL
+	barbican.containers = []barbicanContainer{{Name: "other", Type: "certificate", ContainerRef: server.URL + "/containers/other"}}
+	store := &barbicanStore{client: newTestServiceClient(server), readers: []string{"octavia"}}
+
+	ref, err := store.EnsureCertificate("stackube-web", []byte("cert"), []byte("key"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The container and its secrets are readable by the load balancer service.
+	expectedACLs := map[string][]string{
+		server.URL + "/secrets/1":    {"octavia"},
+		server.URL + "/secrets/2":    {"octavia"},
+		server.URL + "/containers/3": {"octavia"},
+	}
+	if ref != server.URL+"/containers/3" || !reflect.DeepEqual(barbican.acls, expectedACLs) {
+		t.Errorf("Expected container %s with ACLs %v, got %s with %v", server.URL+"/containers/3", expectedACLs, ref, barbican.acls)
+	}
+
+	// Existing containers are looked up by name.
+	barbican.requests = nil
+	existing, err := store.EnsureCertificate("stackube-web", []byte("cert"), []byte("key"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedRequests := []string{"GET /containers?name=stackube-web"}
+	if existing != ref || !reflect.DeepEqual(barbican.requests, expectedRequests) {
+		t.Errorf("Expected container %s by requests %v, got %s by %v", ref, expectedRequests, existing, barbican.requests)
+	}
+}
@@ -20,18 +20,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
 	crdClient "git.openstack.org/openstack/stackube/pkg/kubecrd"
 	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
 	"git.openstack.org/openstack/stackube/pkg/util"
 
-	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
-	"github.com/gophercloud/gophercloud/openstack/identity/v2/tenants"
-	"github.com/gophercloud/gophercloud/openstack/identity/v2/users"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/portsbinding"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
@@ -42,6 +40,7 @@ import (
 	"github.com/gophercloud/gophercloud/pagination"
 
 	gcfg "gopkg.in/gcfg.v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 const (
@@ -61,6 +60,7 @@ var (
 
 	ErrNotFound        = errors.New("NotFound")
 	ErrMultipleResults = errors.New("MultipleResults")
+	ErrInvalidToken    = errors.New("InvalidToken")
 )
 
 // Interface should be implemented by a openstack client.
@@ -73,38 +73,69 @@ type Interface interface {
 	GetTenantIDFromName(tenantName string) (string, error)
 	// CheckTenantByID checks tenant exist or not by tenantID.
 	CheckTenantByID(tenantID string) (bool, error)
-	// CreateUser creates user with username, password in the tenant.
+	// CreateUser creates user with username, password and assigns it a role in the tenant.
 	CreateUser(username, password, tenantID string) error
+	// UpdateUserPassword updates the password of the user by username.
+	UpdateUserPassword(username, password string) error
 	// DeleteAllUsersOnTenant deletes all users on the tenant.
 	DeleteAllUsersOnTenant(tenantName string) error
+	// AuthenticateToken validates the token and returns the identity it's issued to.
+	AuthenticateToken(token string) (*TokenIdentity, error)
 	// CreateNetwork creates network.
 	CreateNetwork(network *drivertypes.Network) error
+	// UpdateNetwork updates subnets of the network.
+	UpdateNetwork(network *drivertypes.Network) error
 	// GetNetworkByID gets network by networkID.
 	GetNetworkByID(networkID string) (*drivertypes.Network, error)
 	// GetNetworkByName gets network by networkName.
 	GetNetworkByName(networkName string) (*drivertypes.Network, error)
 	// DeleteNetwork deletes network by networkName.
 	DeleteNetwork(networkName string) error
+	// DeleteLoadBalancersOnNetwork deletes the load balancers on the network by networkName.
+	DeleteLoadBalancersOnNetwork(networkName string) error
+	// DeleteFloatingIPsOnNetwork releases the floating IPs of ports on the network by networkName.
+	DeleteFloatingIPsOnNetwork(networkName string) error
+	// DeletePortsOnNetwork deletes the ports except router interfaces on the network by networkName.
+	DeletePortsOnNetwork(networkName string) error
+	// DeleteRouterInterfaces removes the subnets of the network by networkName from its router.
+	DeleteRouterInterfaces(networkName string) error
 	// GetProviderSubnet gets provider subnet by id
 	GetProviderSubnet(osSubnetID string) (*drivertypes.Subnet, error)
-	// CreatePort creates port by neworkID, tenantID and portName.
-	CreatePort(networkID, tenantID, portName string) (*portsbinding.Port, error)
+	// CreatePort creates port by neworkID, tenantID and portName for device by deviceID.
+	CreatePort(networkID, tenantID, portName, deviceID string) (*portsbinding.Port, error)
 	// GetPort gets port by portName.
 	GetPort(name string) (*ports.Port, error)
 	// ListPorts lists ports by networkID and deviceOwner.
 	ListPorts(networkID, deviceOwner string) ([]ports.Port, error)
+	// ListPodPorts lists ports of all interfaces of the pod.
+	ListPodPorts(namespace, podName string) ([]ports.Port, error)
 	// DeletePortByName deletes port by portName.
 	DeletePortByName(portName string) error
 	// DeletePortByID deletes port by portID.
 	DeletePortByID(portID string) error
 	// UpdatePortsBinding updates port binding.
 	UpdatePortsBinding(portID, deviceOwner string) error
+	// UpdatePortSecurityGroups replaces security groups of the port.
+	UpdatePortSecurityGroups(port *ports.Port, securityGroupIDs []string) error
+	// EnsureSecurityGroup ensures a security group with exactly the given rules exists.
+	EnsureSecurityGroup(sg *SecurityGroup) (string, error)
+	// DeleteSecurityGroup deletes security group by name in the tenant.
+	DeleteSecurityGroup(name, tenantID string) error
+	// GetSecurityGroupID gets the ID of security group by name in the tenant.
+	GetSecurityGroupID(name, tenantID string) (string, error)
+	// GetDefaultSecurityGroupID gets the ID of the allow-all security group of the tenant.
+	GetDefaultSecurityGroupID(tenantID string) (string, error)
 	// LoadBalancerExist returns whether a load balancer has already been exist.
 	LoadBalancerExist(name string) (bool, error)
 	// EnsureLoadBalancer ensures a load balancer is created.
 	EnsureLoadBalancer(lb *LoadBalancer) (*LoadBalancerStatus, error)
+	// EnsureIngressLoadBalancer ensures the load balancer of ingresses is created.
+	EnsureIngressLoadBalancer(lb *IngressLoadBalancer) (*LoadBalancerStatus, error)
 	// EnsureLoadBalancerDeleted ensures a load balancer is deleted.
 	EnsureLoadBalancerDeleted(name string) error
+	// GetCertificateStore returns the store of load balancer certificates, which is
+	// nil if it's not available.
+	GetCertificateStore() CertificateStore
 	// GetCRDClient returns the CRDClient.
 	GetCRDClient() crdClient.Interface
 	// GetPluginName returns the plugin name.
@@ -115,9 +146,25 @@ type Interface interface {
 
 // Client implements the openstack client Interface.
 type Client struct {
-	Identity          *gophercloud.ServiceClient
-	Provider          *gophercloud.ProviderClient
-	Network           *gophercloud.ServiceClient
+	// Identity serves the identity v3 API.
+	Identity *gophercloud.ServiceClient
+	Provider *gophercloud.ProviderClient
+	Network  *gophercloud.ServiceClient
+	// ProjectDomainID is the domain of projects of tenants.
+	ProjectDomainID string
+	// UserDomainID is the domain of users of tenants.
+	UserDomainID string
+	// MemberRoleID is the role assigned to users of tenants on their projects.
+	MemberRoleID string
+	// identityOpts are resolved into the domains and the member role on first use,
+	// since only the tenant and user paths need them.
+	identityOpts IdentityOpts
+	identityLock sync.Mutex
+	// LoadBalancer serves the LBaaS v2 API, which is either Neutron or Octavia.
+	LoadBalancer      *gophercloud.ServiceClient
+	UseOctavia        bool
+	LBProvider        string
+	CertificateStore  CertificateStore
 	Region            string
 	ExtNetID          string
 	PluginName        string
@@ -130,6 +177,35 @@ type PluginOpts struct {
 	IntegrationBridge string `gcfg:"integration-bridge"`
 }
 
+// IdentityOpts selects where tenants are created in identity v3.
+type IdentityOpts struct {
+	// ProjectDomain is the name or ID of the domain of projects, it's the default
+	// domain if not set.
+	ProjectDomain string `gcfg:"project-domain"`
+	// UserDomain is the name or ID of the domain of users, it's the project
+	// domain if not set.
+	UserDomain string `gcfg:"user-domain"`
+	// MemberRole is the role assigned to users on their projects, it's member
+	// if not set.
+	MemberRole string `gcfg:"member-role"`
+}
+
+// LoadBalancerOpts selects the service of load balancers.
+type LoadBalancerOpts struct {
+	// UseOctavia uses Octavia instead of the deprecated Neutron LBaaS v2 extension.
+	UseOctavia bool `gcfg:"use-octavia"`
+	// LBProvider is the provider of new load balancers, e.g. amphora or ovn.
+	LBProvider string `gcfg:"lb-provider"`
+	// CertificateStore stores certificates of TLS load balancers, it's barbican
+	// or file, which is only for tests and development.
+	CertificateStore string `gcfg:"certificate-store"`
+	// CertificateDir is the directory of the file certificate store.
+	CertificateDir string `gcfg:"certificate-dir"`
+	// CertificateReaders is a comma separated list of IDs of users granted read
+	// access to Barbican certificates, e.g. the service user of Octavia.
+	CertificateReaders string `gcfg:"certificate-readers"`
+}
+
 // Config used to configure the openstack client.
 type Config struct {
 	Global struct {
@@ -137,18 +213,29 @@ type Config struct {
 		Username   string `gcfg:"username"`
 		Password   string `gcfg:"password"`
 		TenantName string `gcfg:"tenant-name"`
+		// DomainName is the domain of the user and the project to authenticate
+		// with, it's the default domain if not set.
+		DomainName string `gcfg:"domain-name"`
 		Region     string `gcfg:"region"`
 		ExtNetID   string `gcfg:"ext-net-id"`
 	}
-	Plugin PluginOpts
+	Plugin       PluginOpts
+	Identity     IdentityOpts
+	LoadBalancer LoadBalancerOpts
 }
 
 func toAuthOptions(cfg Config) gophercloud.AuthOptions {
+	domainName := cfg.Global.DomainName
+	if domainName == "" {
+		domainName = defaultDomainName
+	}
+
 	return gophercloud.AuthOptions{
 		IdentityEndpoint: cfg.Global.AuthUrl,
 		Username:         cfg.Global.Username,
 		Password:         cfg.Global.Password,
 		TenantName:       cfg.Global.TenantName,
+		DomainName:       domainName,
 		AllowReauth:      true,
 	}
 }
@@ -172,9 +259,7 @@ func NewClient(config string, kubeConfig string) (Interface, error) {
 		return nil, err
 	}
 
-	identity, err := openstack.NewIdentityV2(provider, gophercloud.EndpointOpts{
-		Availability: gophercloud.AvailabilityAdmin,
-	})
+	identity, err := newIdentityV3(provider)
 	if err != nil {
 		return nil, err
 	}
@@ -187,6 +272,23 @@ func NewClient(config string, kubeConfig string) (Interface, error) {
 		return nil, err
 	}
 
+	lbClient := network
+	if cfg.LoadBalancer.UseOctavia {
+		lbClient, err = newOctaviaV2(provider, gophercloud.EndpointOpts{
+			Region: cfg.Global.Region,
+		})
+		if err != nil {
+			glog.Warningf("Failed to find octavia endpoint: %v", err)
+			return nil, err
+		}
+	}
+
+	certificateStore, err := newCertificateStore(provider, cfg)
+	if err != nil {
+		// Only TLS load balancers need the certificate store.
+		glog.Warningf("Failed to create certificate store, TLS load balancers are not supported: %v", err)
+	}
+
 	// Create CRD client
 	k8sConfig, err := util.NewClusterConfig(kubeConfig)
 	if err != nil {
@@ -201,15 +303,36 @@ func NewClient(config string, kubeConfig string) (Interface, error) {
 		Identity:          identity,
 		Provider:          provider,
 		Network:           network,
+		LoadBalancer:      lbClient,
+		UseOctavia:        cfg.LoadBalancer.UseOctavia,
+		LBProvider:        cfg.LoadBalancer.LBProvider,
+		CertificateStore:  certificateStore,
 		Region:            cfg.Global.Region,
 		ExtNetID:          cfg.Global.ExtNetID,
 		PluginName:        cfg.Plugin.PluginName,
 		IntegrationBridge: cfg.Plugin.IntegrationBridge,
 		CRDClient:         kubeCRDClient,
+		identityOpts:      cfg.Identity,
 	}
 	return client, nil
 }
 
+// newOctaviaV2 creates a ServiceClient of the Octavia load-balancer endpoint, which
+// serves the same LBaaS v2 API as Neutron.
+func newOctaviaV2(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*gophercloud.ServiceClient, error) {
+	eo.ApplyDefaults("load-balancer")
+	url, err := provider.EndpointLocator(eo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gophercloud.ServiceClient{
+		ProviderClient: provider,
+		Endpoint:       url,
+		ResourceBase:   url + "v2.0/",
+	}, nil
+}
+
 func readConfig(config string) (Config, error) {
 	conf, err := os.Open(config)
 	if err != nil {
@@ -223,6 +346,11 @@ func readConfig(config string) (Config, error) {
 	return cfg, nil
 }
 
+// GetCertificateStore returns the store of load balancer certificates.
+func (os *Client) GetCertificateStore() CertificateStore {
+	return os.CertificateStore
+}
+
 // GetCRDClient returns the CRDClient.
 func (os *Client) GetCRDClient() crdClient.Interface {
 	return os.CRDClient
@@ -258,111 +386,19 @@ func (os *Client) GetTenantIDFromName(tenantName string) (string, error) {
 
 	// Otherwise, fetch tenantID from OpenStack
 	var tenantID string
-	err = tenants.List(os.Identity, nil).EachPage(func(page pagination.Page) (bool, error) {
-		tenantList, err1 := tenants.ExtractTenants(page)
-		if err1 != nil {
-			return false, err1
-		}
-		for _, t := range tenantList {
-			if t.Name == tenantName {
-				tenantID = t.ID
-				break
-			}
-		}
-		return true, nil
-	})
-	if err != nil {
+	project, err := os.getProjectByName(tenantName)
+	if err != nil && !isNotFound(err) {
 		return "", err
 	}
+	if project != nil {
+		tenantID = project.ID
+	}
 
 	glog.V(3).Infof("Got tenantID: %v for tenantName: %v", tenantID, tenantName)
 
 	return tenantID, nil
 }
 
-// CreateTenant creates tenant by tenantname.
-func (os *Client) CreateTenant(tenantName string) (string, error) {
-	createOpts := tenants.CreateOpts{
-		Name:        tenantName,
-		Description: "stackube",
-		Enabled:     gophercloud.Enabled,
-	}
-
-	_, err := tenants.Create(os.Identity, createOpts).Extract()
-	if err != nil && !IsAlreadyExists(err) {
-		glog.Errorf("Failed to create tenant %s: %v", tenantName, err)
-		return "", err
-	}
-	glog.V(4).Infof("Tenant %s created", tenantName)
-	tenantID, err := os.GetTenantIDFromName(tenantName)
-	if err != nil {
-		return "", err
-	}
-	return tenantID, nil
-}
-
-// DeleteTenant deletes tenant by tenantName.
-func (os *Client) DeleteTenant(tenantName string) error {
-	return tenants.List(os.Identity, nil).EachPage(func(page pagination.Page) (bool, error) {
-		tenantList, err := tenants.ExtractTenants(page)
-		if err != nil {
-			return false, err
-		}
-		for _, t := range tenantList {
-			if t.Name == tenantName {
-				err := tenants.Delete(os.Identity, t.ID).ExtractErr()
-				if err != nil {
-					glog.Errorf("Delete openstack tenant %s error: %v", tenantName, err)
-					return false, err
-				}
-				glog.V(4).Infof("Tenant %s deleted", tenantName)
-				break
-			}
-		}
-		return true, nil
-	})
-}
-
-// CreateUser creates user with username, password in the tenant.
-func (os *Client) CreateUser(username, password, tenantID string) error {
-	opts := users.CreateOpts{
-		Name:     username,
-		TenantID: tenantID,
-		Enabled:  gophercloud.Enabled,
-		Password: password,
-	}
-	_, err := users.Create(os.Identity, opts).Extract()
-	if err != nil && !IsAlreadyExists(err) {
-		glog.Errorf("Failed to create user %s: %v", username, err)
-		return err
-	}
-	glog.V(4).Infof("User %s created", username)
-	return nil
-}
-
-// DeleteAllUsersOnTenant deletes all users on the tenant.
-func (os *Client) DeleteAllUsersOnTenant(tenantName string) error {
-	tenantID, err := os.GetTenantIDFromName(tenantName)
-	if err != nil {
-		return nil
-	}
-	return users.ListUsers(os.Identity, tenantID).EachPage(func(page pagination.Page) (bool, error) {
-		usersList, err := users.ExtractUsers(page)
-		if err != nil {
-			return false, err
-		}
-		for _, u := range usersList {
-			res := users.Delete(os.Identity, u.ID)
-			if res.Err != nil {
-				glog.Errorf("Delete openstack user %s error: %v", u.Name, err)
-				return false, err
-			}
-			glog.V(4).Infof("User %s deleted", u.Name)
-		}
-		return true, nil
-	})
-}
-
 // IsAlreadyExists determines if the err is an error which indicates that a specified resource already exists.
 func IsAlreadyExists(err error) bool {
 	return reasonForError(err) == StatusCodeAlreadyExists
@@ -435,6 +471,14 @@ func (os *Client) GetProviderSubnet(osSubnetID string) (*drivertypes.Subnet, err
 		routes = append(routes, &route)
 	}
 
+	var pools []*drivertypes.AllocationPool
+	for _, p := range s.AllocationPools {
+		pools = append(pools, &drivertypes.AllocationPool{
+			Start: p.Start,
+			End:   p.End,
+		})
+	}
+
 	providerSubnet := drivertypes.Subnet{
 		Uid:        s.ID,
 		Cidr:       s.CIDR,
@@ -442,6 +486,9 @@ func (os *Client) GetProviderSubnet(osSubnetID string) (*drivertypes.Subnet, err
 		Name:       s.Name,
 		Dnsservers: s.DNSNameservers,
 		Routes:     routes,
+		Pools:      pools,
+		EnableDHCP: s.EnableDHCP,
+		IPVersion:  s.IPVersion,
 	}
 
 	return &providerSubnet, nil
@@ -545,47 +592,70 @@ func (os *Client) CreateNetwork(network *drivertypes.Network) error {
 	network.Status = os.ToProviderStatus(osNet.Status)
 	network.Uid = osNet.ID
 	for _, sub := range network.Subnets {
-		// create subnet
-		subnetOpts := subnets.CreateOpts{
-			NetworkID:      networkID,
-			CIDR:           sub.Cidr,
-			Name:           sub.Name,
-			IPVersion:      gophercloud.IPv4,
-			TenantID:       network.TenantID,
-			GatewayIP:      &sub.Gateway,
-			DNSNameservers: sub.Dnsservers,
-		}
-		s, err := subnets.Create(os.Network, subnetOpts).Extract()
+		_, err := os.createSubnet(networkID, osRouter.ID, network.TenantID, sub)
 		if err != nil {
-			glog.Errorf("Create openstack subnet %s failed: %v", sub.Name, err)
 			delErr := os.DeleteNetwork(network.Name)
 			if delErr != nil {
 				glog.Errorf("Delete openstack network %s failed: %v", network.Name, delErr)
 			}
 			return err
 		}
+	}
 
-		// add subnet to router
-		opts := routers.AddInterfaceOpts{
-			SubnetID: s.ID,
-		}
-		_, err = routers.AddInterface(os.Network, osRouter.ID, opts).Extract()
+	return nil
+}
+
+// UpdateNetwork updates subnets of the network, subnets are matched by name
+// and the missing ones are created.
+// Neutron doesn't allow changing the CIDR of a subnet, so the CIDR could only
+// be expanded, by adding subnets which cover the rest of the new CIDR.
+func (os *Client) UpdateNetwork(network *drivertypes.Network) error {
+	osNetwork, err := os.getOpenStackNetworkByName(network.Name)
+	if err != nil {
+		glog.Errorf("Get openstack network %s failed: %v", network.Name, err)
+		return err
+	}
+
+	router, err := os.getRouterByName(network.Name)
+	if err != nil {
+		glog.Errorf("Get openstack router %s failed: %v", network.Name, err)
+		return err
+	}
+	if router == nil {
+		return fmt.Errorf("router of network %s not found", network.Name)
+	}
+
+	existingSubnets := make(map[string]*subnets.Subnet)
+	for _, subnetID := range osNetwork.Subnets {
+		s, err := subnets.Get(os.Network, subnetID).Extract()
 		if err != nil {
-			glog.Errorf("Create openstack subnet %s failed: %v", sub.Name, err)
-			delErr := os.DeleteNetwork(network.Name)
-			if delErr != nil {
-				glog.Errorf("Delete openstack network %s failed: %v", network.Name, delErr)
-			}
+			glog.Errorf("Get openstack subnet %s failed: %v", subnetID, err)
 			return err
 		}
+		existingSubnets[s.Name] = s
 	}
 
-	return nil
-}
+	for _, sub := range network.Subnets {
+		s, ok := existingSubnets[sub.Name]
+		if !ok {
+			_, err := os.createSubnet(osNetwork.ID, router.ID, osNetwork.TenantID, sub)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.updateSubnet(router.ID, s, sub); err != nil {
+			return err
+		}
+
+		if s.CIDR != sub.Cidr {
+			if err := os.expandSubnet(osNetwork.ID, router.ID, osNetwork.TenantID, s, sub, existingSubnets); err != nil {
+				return err
+			}
+		}
+	}
 
-// UpdateNetwork updates network.
-func (os *Client) UpdateNetwork(network *drivertypes.Network) error {
-	// TODO: update network subnets
 	return nil
 }
 
@@ -611,10 +681,14 @@ func (os *Client) getRouterByName(name string) (*routers.Router, error) {
 	return result, nil
 }
 
-// DeleteNetwork deletes network by networkName.
+// DeleteNetwork deletes network by networkName, it's a no-op if the network
+// doesn't exist.
 func (os *Client) DeleteNetwork(networkName string) error {
 	osNetwork, err := os.getOpenStackNetworkByName(networkName)
 	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
 		glog.Errorf("Get openstack network failed: %v", err)
 		return err
 	}
@@ -631,7 +705,7 @@ func (os *Client) DeleteNetwork(networkName string) error {
 			}
 
 			for _, port := range portList {
-				if port.DeviceOwner == "network:router_interface" {
+				if port.DeviceOwner == deviceOwnerRouterInterface {
 					continue
 				}
 
@@ -658,14 +732,14 @@ func (os *Client) DeleteNetwork(networkName string) error {
 			if router != nil {
 				opts := routers.RemoveInterfaceOpts{SubnetID: subnet}
 				_, err := routers.RemoveInterface(os.Network, router.ID, opts).Extract()
-				if err != nil {
+				if err != nil && !isNotFound(err) {
 					glog.Errorf("Get openstack router %s error: %v", networkName, err)
 					return err
 				}
 			}
 
 			err = subnets.Delete(os.Network, subnet).ExtractErr()
-			if err != nil {
+			if err != nil && !isNotFound(err) {
 				glog.Errorf("Delete openstack subnet %s error: %v", subnet, err)
 				return err
 			}
@@ -674,7 +748,7 @@ func (os *Client) DeleteNetwork(networkName string) error {
 		// delete router
 		if router != nil {
 			err = routers.Delete(os.Network, router.ID).ExtractErr()
-			if err != nil {
+			if err != nil && !isNotFound(err) {
 				glog.Errorf("Delete openstack router %s error: %v", router.ID, err)
 				return err
 			}
@@ -682,7 +756,7 @@ func (os *Client) DeleteNetwork(networkName string) error {
 
 		// delete network
 		err = networks.Delete(os.Network, osNetwork.ID).ExtractErr()
-		if err != nil {
+		if err != nil && !isNotFound(err) {
 			glog.Errorf("Delete openstack network %s error: %v", osNetwork.ID, err)
 			return err
 		}
@@ -691,35 +765,6 @@ func (os *Client) DeleteNetwork(networkName string) error {
 	return nil
 }
 
-// CheckTenantByID checks tenant exist or not by tenantID.
-func (os *Client) CheckTenantByID(tenantID string) (bool, error) {
-	opts := tenants.ListOpts{}
-	pager := tenants.List(os.Identity, &opts)
-
-	var found bool
-	err := pager.EachPage(func(page pagination.Page) (bool, error) {
-
-		tenantList, err := tenants.ExtractTenants(page)
-		if err != nil {
-			return false, err
-		}
-
-		if len(tenantList) == 0 {
-			return false, ErrNotFound
-		}
-
-		for _, t := range tenantList {
-			if t.ID == tenantID || t.Name == tenantID {
-				found = true
-			}
-		}
-
-		return true, nil
-	})
-
-	return found, err
-}
-
 // GetPort gets port by portName.
 func (os *Client) GetPort(name string) (*ports.Port, error) {
 	opts := ports.ListOpts{Name: name}
@@ -795,7 +840,8 @@ func (os *Client) ensureSecurityGroup(tenantID string) (string, error) {
 		}
 	}
 
-	var secGroupsRules int
+	// Ether types which already have ingress rules.
+	etherTypes := sets.NewString()
 	listopts := rules.ListOpts{
 		TenantID:   tenantID,
 		Direction:  string(rules.DirIngress),
@@ -809,7 +855,9 @@ func (os *Client) ensureSecurityGroup(tenantID string) (string, error) {
 			return false, err
 		}
 
-		secGroupsRules = len(r)
+		for _, rule := range r {
+			etherTypes.Insert(rule.EtherType)
+		}
 
 		return true, err
 	})
@@ -817,14 +865,18 @@ func (os *Client) ensureSecurityGroup(tenantID string) (string, error) {
 		return "", err
 	}
 
-	// create new rules
-	if secGroupsRules == 0 {
+	// create new rules for both IPv4 and IPv6
+	for _, etherType := range []rules.RuleEtherType{rules.EtherType4, rules.EtherType6} {
+		if etherTypes.Has(string(etherType)) {
+			continue
+		}
+
 		// create egress rule
 		_, err = rules.Create(os.Network, rules.CreateOpts{
 			TenantID:   tenantID,
 			SecGroupID: securitygroup.ID,
 			Direction:  rules.DirEgress,
-			EtherType:  rules.EtherType4,
+			EtherType:  etherType,
 		}).Extract()
 
 		// create ingress rule
@@ -832,7 +884,7 @@ func (os *Client) ensureSecurityGroup(tenantID string) (string, error) {
 			TenantID:   tenantID,
 			SecGroupID: securitygroup.ID,
 			Direction:  rules.DirIngress,
-			EtherType:  rules.EtherType4,
+			EtherType:  etherType,
 		}).Extract()
 		if err != nil {
 			return "", err
@@ -842,8 +894,8 @@ func (os *Client) ensureSecurityGroup(tenantID string) (string, error) {
 	return securitygroup.ID, nil
 }
 
-// CreatePort creates port by neworkID, tenantID and portName.
-func (os *Client) CreatePort(networkID, tenantID, portName string) (*portsbinding.Port, error) {
+// CreatePort creates port by neworkID, tenantID and portName for device by deviceID.
+func (os *Client) CreatePort(networkID, tenantID, portName, deviceID string) (*portsbinding.Port, error) {
 	securitygroup, err := os.ensureSecurityGroup(tenantID)
 	if err != nil {
 		glog.Errorf("EnsureSecurityGroup failed: %v", err)
@@ -857,7 +909,7 @@ func (os *Client) CreatePort(networkID, tenantID, portName string) (*portsbindin
 			Name:           portName,
 			AdminStateUp:   &adminStateUp,
 			TenantID:       tenantID,
-			DeviceID:       uuid.Generate().String(),
+			DeviceID:       deviceID,
 			DeviceOwner:    fmt.Sprintf("compute:%s", getHostName()),
 			SecurityGroups: []string{securitygroup},
 		},
@@ -900,6 +952,38 @@ func (os *Client) ListPorts(networkID, deviceOwner string) ([]ports.Port, error)
 	return results, nil
 }
 
+// ListPodPorts lists ports of all interfaces of the pod by its device ID. Ports
+// created before they were owned by pods are looked up by the primary port name.
+func (os *Client) ListPodPorts(namespace, podName string) ([]ports.Port, error) {
+	var results []ports.Port
+	opts := ports.ListOpts{DeviceID: util.BuildPodDeviceID(namespace, podName)}
+	pager := ports.List(os.Network, opts)
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		portList, err := ports.ExtractPorts(page)
+		if err != nil {
+			glog.Errorf("Get openstack ports error: %v", err)
+			return false, err
+		}
+
+		results = append(results, portList...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		return results, nil
+	}
+
+	port, err := os.GetPort(util.BuildPortName(namespace, podName))
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []ports.Port{*port}, nil
+}
+
 // DeletePortByName deletes port by portName
 func (os *Client) DeletePortByName(portName string) error {
 	port, err := os.GetPort(portName)
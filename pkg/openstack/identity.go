@@ -0,0 +1,495 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+)
+
+const (
+	// defaultDomainID is the ID of the domain created by keystone-manage bootstrap.
+	defaultDomainID = "default"
+	// defaultDomainName is the name of the default domain, which is used to
+	// authenticate if no domain is configured.
+	defaultDomainName = "Default"
+	// defaultMemberRole is the role assigned to tenant users on their projects.
+	defaultMemberRole = "member"
+)
+
+// fallbackMemberRoles are the member roles of older keystone deployments, which are
+// tried if the member role is not found.
+var fallbackMemberRoles = []string{"_member_", "Member"}
+
+// keystoneDomain is a domain of identity v3.
+type keystoneDomain struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// keystoneProject is a project of identity v3, which is a tenant of stackube.
+type keystoneProject struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DomainID    string `json:"domain_id"`
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// keystoneUser is a user of identity v3.
+type keystoneUser struct {
+	ID               string `json:"id,omitempty"`
+	Name             string `json:"name"`
+	DomainID         string `json:"domain_id"`
+	DefaultProjectID string `json:"default_project_id,omitempty"`
+	Password         string `json:"password,omitempty"`
+	Enabled          bool   `json:"enabled"`
+}
+
+// keystoneRoleAssignment is a role assignment of identity v3, the user is empty
+// for role assignments of groups.
+type keystoneRoleAssignment struct {
+	User *struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Domain struct {
+			ID string `json:"id"`
+		} `json:"domain"`
+	} `json:"user"`
+}
+
+// keystoneToken is a token of identity v3, the project is empty for tokens not
+// scoped to projects.
+type keystoneToken struct {
+	User struct {
+		ID     string         `json:"id"`
+		Name   string         `json:"name"`
+		Domain keystoneDomain `json:"domain"`
+	} `json:"user"`
+	Project *struct {
+		ID     string         `json:"id"`
+		Name   string         `json:"name"`
+		Domain keystoneDomain `json:"domain"`
+	} `json:"project"`
+	Roles []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"roles"`
+}
+
+// TokenIdentity is the identity a Keystone token is issued to.
+type TokenIdentity struct {
+	UserID   string
+	UserName string
+	// ProjectID and ProjectName are the project in the project domain the token
+	// is scoped to, they are empty if the token isn't scoped to a tenant.
+	ProjectID   string
+	ProjectName string
+	// Roles are the names of the user's roles on the project.
+	Roles []string
+}
+
+// newIdentityV3 creates a ServiceClient of the identity v3 endpoint the provider
+// is authenticated with.
+func newIdentityV3(provider *gophercloud.ProviderClient) (*gophercloud.ServiceClient, error) {
+	endpoint := provider.IdentityEndpoint
+	if endpoint == "" {
+		// The version was discovered from the root of the auth URL.
+		endpoint = provider.IdentityBase + "v3/"
+	}
+	if !strings.HasSuffix(endpoint, "/v3/") {
+		return nil, fmt.Errorf("identity v3 is required, but auth-url %q is not a v3 endpoint", endpoint)
+	}
+
+	return &gophercloud.ServiceClient{
+		ProviderClient: provider,
+		Endpoint:       endpoint,
+		Type:           "identity",
+	}, nil
+}
+
+// identityURL returns the URL of identity resource with the query.
+func (os *Client) identityURL(query url.Values, parts ...string) string {
+	u := os.Identity.ServiceURL(parts...)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// resolveDomainID returns the ID of the domain by name or ID.
+func (os *Client) resolveDomainID(domain string) (string, error) {
+	var domains struct {
+		Domains []keystoneDomain `json:"domains"`
+	}
+	if _, err := os.Identity.Get(os.identityURL(url.Values{"name": {domain}}, "domains"), &domains, nil); err != nil {
+		return "", err
+	}
+	if len(domains.Domains) > 0 {
+		return domains.Domains[0].ID, nil
+	}
+
+	var result struct {
+		Domain keystoneDomain `json:"domain"`
+	}
+	if _, err := os.Identity.Get(os.identityURL(nil, "domains", domain), &result, nil); err != nil {
+		if isNotFound(err) {
+			return "", fmt.Errorf("domain %q not found", domain)
+		}
+		return "", err
+	}
+	return result.Domain.ID, nil
+}
+
+// ensureDomains resolves the domains of projects and users of tenants if they are
+// not resolved yet.
+func (os *Client) ensureDomains() error {
+	os.identityLock.Lock()
+	defer os.identityLock.Unlock()
+	if os.ProjectDomainID != "" && os.UserDomainID != "" {
+		return nil
+	}
+
+	projectDomain := os.identityOpts.ProjectDomain
+	if projectDomain == "" {
+		projectDomain = defaultDomainID
+	}
+	projectDomainID, err := os.resolveDomainID(projectDomain)
+	if err != nil {
+		return fmt.Errorf("failed to get project domain: %v", err)
+	}
+
+	userDomainID := projectDomainID
+	if os.identityOpts.UserDomain != "" {
+		userDomainID, err = os.resolveDomainID(os.identityOpts.UserDomain)
+		if err != nil {
+			return fmt.Errorf("failed to get user domain: %v", err)
+		}
+	}
+
+	os.ProjectDomainID = projectDomainID
+	os.UserDomainID = userDomainID
+	glog.V(3).Infof("Tenants are created in domain %s with users in domain %s", projectDomainID, userDomainID)
+	return nil
+}
+
+// ensureMemberRole resolves the member role of tenant users if it's not resolved
+// yet, falling back to the member roles of older keystone deployments.
+func (os *Client) ensureMemberRole() error {
+	os.identityLock.Lock()
+	defer os.identityLock.Unlock()
+	if os.MemberRoleID != "" {
+		return nil
+	}
+
+	memberRole := os.identityOpts.MemberRole
+	if memberRole == "" {
+		memberRole = defaultMemberRole
+	}
+	for _, role := range append([]string{memberRole}, fallbackMemberRoles...) {
+		roleID, err := os.resolveRoleID(role)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get member role: %v", err)
+		}
+		if role != memberRole {
+			glog.Warningf("Member role %q not found, using role %q", memberRole, role)
+		}
+		os.MemberRoleID = roleID
+		glog.V(3).Infof("Users of tenants are assigned role %s", roleID)
+		return nil
+	}
+
+	return fmt.Errorf("failed to get member role: none of %q and %q is found", memberRole, fallbackMemberRoles)
+}
+
+// resolveRoleID returns the ID of the role by name.
+func (os *Client) resolveRoleID(role string) (string, error) {
+	var roles struct {
+		Roles []struct {
+			ID string `json:"id"`
+		} `json:"roles"`
+	}
+	if _, err := os.Identity.Get(os.identityURL(url.Values{"name": {role}}, "roles"), &roles, nil); err != nil {
+		return "", err
+	}
+	if len(roles.Roles) == 0 {
+		return "", ErrNotFound
+	}
+	return roles.Roles[0].ID, nil
+}
+
+// getProjectByName gets the project by name in the project domain.
+func (os *Client) getProjectByName(name string) (*keystoneProject, error) {
+	if err := os.ensureDomains(); err != nil {
+		return nil, err
+	}
+
+	var projects struct {
+		Projects []keystoneProject `json:"projects"`
+	}
+	query := url.Values{"name": {name}, "domain_id": {os.ProjectDomainID}}
+	if _, err := os.Identity.Get(os.identityURL(query, "projects"), &projects, nil); err != nil {
+		return nil, err
+	}
+	if len(projects.Projects) == 0 {
+		return nil, ErrNotFound
+	}
+	return &projects.Projects[0], nil
+}
+
+// getUserByName gets the user by name in the user domain.
+func (os *Client) getUserByName(name string) (*keystoneUser, error) {
+	if err := os.ensureDomains(); err != nil {
+		return nil, err
+	}
+
+	var users struct {
+		Users []keystoneUser `json:"users"`
+	}
+	query := url.Values{"name": {name}, "domain_id": {os.UserDomainID}}
+	if _, err := os.Identity.Get(os.identityURL(query, "users"), &users, nil); err != nil {
+		return nil, err
+	}
+	if len(users.Users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users.Users[0], nil
+}
+
+// CreateTenant creates tenant by tenantname.
+func (os *Client) CreateTenant(tenantName string) (string, error) {
+	if err := os.ensureDomains(); err != nil {
+		return "", err
+	}
+
+	project := keystoneProject{
+		Name:        tenantName,
+		DomainID:    os.ProjectDomainID,
+		Description: "stackube",
+		Enabled:     true,
+	}
+	_, err := os.Identity.Post(os.identityURL(nil, "projects"), map[string]interface{}{"project": project}, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{201},
+	})
+	if err != nil && !IsAlreadyExists(err) {
+		glog.Errorf("Failed to create tenant %s: %v", tenantName, err)
+		return "", err
+	}
+	glog.V(4).Infof("Tenant %s created", tenantName)
+	tenantID, err := os.GetTenantIDFromName(tenantName)
+	if err != nil {
+		return "", err
+	}
+	return tenantID, nil
+}
+
+// DeleteTenant deletes tenant by tenantName.
+func (os *Client) DeleteTenant(tenantName string) error {
+	project, err := os.getProjectByName(tenantName)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := os.Identity.Delete(os.identityURL(nil, "projects", project.ID), nil); err != nil && !isNotFound(err) {
+		glog.Errorf("Delete openstack tenant %s error: %v", tenantName, err)
+		return err
+	}
+	glog.V(4).Infof("Tenant %s deleted", tenantName)
+	return nil
+}
+
+// CheckTenantByID checks tenant exist or not by tenantID.
+func (os *Client) CheckTenantByID(tenantID string) (bool, error) {
+	var result struct {
+		Project keystoneProject `json:"project"`
+	}
+	_, err := os.Identity.Get(os.identityURL(nil, "projects", tenantID), &result, nil)
+	if err == nil {
+		return true, nil
+	}
+	if !isNotFound(err) {
+		return false, err
+	}
+
+	// The tenant may be given by name.
+	_, err = os.getProjectByName(tenantID)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateUser creates user with username, password in the user domain, and assigns
+// the member role on the tenant to it.
+func (os *Client) CreateUser(username, password, tenantID string) error {
+	if err := os.ensureDomains(); err != nil {
+		return err
+	}
+	if err := os.ensureMemberRole(); err != nil {
+		return err
+	}
+
+	user := keystoneUser{
+		Name:             username,
+		DomainID:         os.UserDomainID,
+		DefaultProjectID: tenantID,
+		Password:         password,
+		Enabled:          true,
+	}
+	var result struct {
+		User keystoneUser `json:"user"`
+	}
+	_, err := os.Identity.Post(os.identityURL(nil, "users"), map[string]interface{}{"user": user}, &result, &gophercloud.RequestOpts{
+		OkCodes: []int{201},
+	})
+	if err != nil {
+		if !IsAlreadyExists(err) {
+			glog.Errorf("Failed to create user %s: %v", username, err)
+			return err
+		}
+		existing, err := os.getUserByName(username)
+		if err != nil {
+			glog.Errorf("Failed to get user %s: %v", username, err)
+			return err
+		}
+		result.User = *existing
+	}
+	glog.V(4).Infof("User %s created", username)
+
+	_, err = os.Identity.Put(os.identityURL(nil, "projects", tenantID, "users", result.User.ID, "roles", os.MemberRoleID), nil, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{204},
+	})
+	if err != nil {
+		glog.Errorf("Failed to assign role %s on tenant %s to user %s: %v", os.MemberRoleID, tenantID, username, err)
+		return err
+	}
+	glog.V(4).Infof("Role %s on tenant %s assigned to user %s", os.MemberRoleID, tenantID, username)
+	return nil
+}
+
+// UpdateUserPassword updates the password of the user by username in the user domain.
+func (os *Client) UpdateUserPassword(username, password string) error {
+	user, err := os.getUserByName(username)
+	if err != nil {
+		glog.Errorf("Failed to get user %s: %v", username, err)
+		return err
+	}
+
+	body := map[string]interface{}{
+		"user": map[string]string{"password": password},
+	}
+	_, err = os.Identity.Patch(os.identityURL(nil, "users", user.ID), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if err != nil {
+		glog.Errorf("Failed to update password of user %s: %v", username, err)
+		return err
+	}
+	glog.V(4).Infof("Password of user %s updated", username)
+	return nil
+}
+
+// DeleteAllUsersOnTenant deletes all users of the user domain which have roles
+// on the tenant.
+func (os *Client) DeleteAllUsersOnTenant(tenantName string) error {
+	tenantID, err := os.GetTenantIDFromName(tenantName)
+	if err != nil || tenantID == "" {
+		return nil
+	}
+	if err := os.ensureDomains(); err != nil {
+		return err
+	}
+
+	var assignments struct {
+		RoleAssignments []keystoneRoleAssignment `json:"role_assignments"`
+	}
+	query := url.Values{"scope.project.id": {tenantID}, "include_names": {"true"}}
+	if _, err := os.Identity.Get(os.identityURL(query, "role_assignments"), &assignments, nil); err != nil {
+		return err
+	}
+
+	deleted := make(map[string]bool)
+	for _, assignment := range assignments.RoleAssignments {
+		u := assignment.User
+		if u == nil || u.Domain.ID != os.UserDomainID || deleted[u.ID] {
+			continue
+		}
+		if _, err := os.Identity.Delete(os.identityURL(nil, "users", u.ID), nil); err != nil && !isNotFound(err) {
+			glog.Errorf("Delete openstack user %s error: %v", u.Name, err)
+			return err
+		}
+		deleted[u.ID] = true
+		glog.V(4).Infof("User %s deleted", u.Name)
+	}
+	return nil
+}
+
+// AuthenticateToken validates the token and returns the identity it's issued to.
+// Only tokens of users in the user domain are valid, tokens scoped to projects
+// out of the project domain are taken as unscoped.
+func (os *Client) AuthenticateToken(token string) (*TokenIdentity, error) {
+	if err := os.ensureDomains(); err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Token keystoneToken `json:"token"`
+	}
+	_, err := os.Identity.Get(os.identityURL(nil, "auth", "tokens"), &result, &gophercloud.RequestOpts{
+		MoreHeaders: map[string]string{"X-Subject-Token": token},
+		OkCodes:     []int{200, 203},
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrInvalidToken
+		}
+		glog.Errorf("Failed to validate token: %v", err)
+		return nil, err
+	}
+
+	t := result.Token
+	if t.User.Domain.ID != os.UserDomainID {
+		glog.V(4).Infof("Token of user %s out of user domain %s is rejected", t.User.Name, os.UserDomainID)
+		return nil, ErrInvalidToken
+	}
+
+	identity := &TokenIdentity{
+		UserID:   t.User.ID,
+		UserName: t.User.Name,
+	}
+	if t.Project != nil && t.Project.Domain.ID == os.ProjectDomainID {
+		identity.ProjectID = t.Project.ID
+		identity.ProjectName = t.Project.Name
+		for _, role := range t.Roles {
+			identity.Roles = append(identity.Roles, role.Name)
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// fakeTokens are the bodies of validating tokens by token.
+var fakeTokens = map[string]string{
+	"project-token": `{"token": {
+		"user": {"id": "u1", "name": "alice", "domain": {"id": "users"}},
+		"project": {"id": "p1", "name": "test", "domain": {"id": "projects"}},
+		"roles": [{"id": "r1", "name": "member"}, {"id": "r2", "name": "admin"}]}}`,
+	"unscoped-token": `{"token": {
+		"user": {"id": "u1", "name": "alice", "domain": {"id": "users"}}}}`,
+	"foreign-project-token": `{"token": {
+		"user": {"id": "u1", "name": "alice", "domain": {"id": "users"}},
+		"project": {"id": "p2", "name": "admin", "domain": {"id": "default"}},
+		"roles": [{"id": "r2", "name": "admin"}]}}`,
+	"foreign-user-token": `{"token": {
+		"user": {"id": "u2", "name": "admin", "domain": {"id": "default"}},
+		"project": {"id": "p1", "name": "test", "domain": {"id": "projects"}},
+		"roles": [{"id": "r2", "name": "admin"}]}}`,
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/auth/tokens" || r.Header.Get("X-Auth-Token") != "admin-token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		token := r.Header.Get("X-Subject-Token")
+		if token == "failure-token" {
+			http.Error(w, "keystone failure", http.StatusInternalServerError)
+			return
+		}
+		body, ok := fakeTokens[token]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	client := &Client{
+		Identity:        newTestServiceClient(server),
+		ProjectDomainID: "projects",
+		UserDomainID:    "users",
+	}
+
+	testCases := []struct {
+		name      string
+		token     string
+		expected  *TokenIdentity
+		expectErr error
+	}{
+		{
+			name:  "project scoped token",
+			token: "project-token",
+			expected: &TokenIdentity{
+				UserID:      "u1",
+				UserName:    "alice",
+				ProjectID:   "p1",
+				ProjectName: "test",
+				Roles:       []string{"member", "admin"},
+			},
+		},
+		{
+			name:     "unscoped token",
+			token:    "unscoped-token",
+			expected: &TokenIdentity{UserID: "u1", UserName: "alice"},
+		},
+		{
+			// Projects out of the project domain aren't tenants.
+			name:     "token scoped to project out of project domain",
+			token:    "foreign-project-token",
+			expected: &TokenIdentity{UserID: "u1", UserName: "alice"},
+		},
+		{
+			name:      "token of user out of user domain",
+			token:     "foreign-user-token",
+			expectErr: ErrInvalidToken,
+		},
+		{
+			name:      "unknown token",
+			token:     "unknown-token",
+			expectErr: ErrInvalidToken,
+		},
+	}
+
+	for _, tc := range testCases {
+		identity, err := client.AuthenticateToken(tc.token)
+		if err != tc.expectErr {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.expectErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(identity, tc.expected) {
+			t.Errorf("%s: expected identity %+v, got %+v", tc.name, tc.expected, identity)
+		}
+	}
+
+	// Failures of Keystone are not taken as invalid tokens.
+	if _, err := client.AuthenticateToken("failure-token"); err == nil || err == ErrInvalidToken {
+		t.Errorf("Expected failure of validating token, got %v", err)
+	}
+}
+
+func TestEnsureMemberRole(t *testing.T) {
+	testCases := []struct {
+		name       string
+		memberRole string
+		roles      map[string]string
+		expected   string
+		expectErr  bool
+	}{
+		{
+			name:     "default member role",
+			roles:    map[string]string{"member": "r1", "_member_": "r2"},
+			expected: "r1",
+		},
+		{
+			name:       "configured member role",
+			memberRole: "tenant",
+			roles:      map[string]string{"member": "r1", "tenant": "r3"},
+			expected:   "r3",
+		},
+		{
+			name:     "fallback to _member_",
+			roles:    map[string]string{"_member_": "r2", "Member": "r4"},
+			expected: "r2",
+		},
+		{
+			name:     "fallback to Member",
+			roles:    map[string]string{"Member": "r4"},
+			expected: "r4",
+		},
+		{
+			name:      "no member role",
+			roles:     map[string]string{"admin": "r5"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		roles := tc.roles
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.URL.Path != "/roles" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			body := `{"roles": []}`
+			if id, ok := roles[r.URL.Query().Get("name")]; ok {
+				body = `{"roles": [{"id": "` + id + `"}]}`
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+
+		client := &Client{
+			Identity:     newTestServiceClient(server),
+			identityOpts: IdentityOpts{MemberRole: tc.memberRole},
+		}
+		err := client.ensureMemberRole()
+		server.Close()
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got member role %q", tc.name, client.MemberRoleID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected success, got %v", tc.name, err)
+			continue
+		}
+		if client.MemberRoleID != tc.expected {
+			t.Errorf("%s: expected member role %q, got %q", tc.name, tc.expected, client.MemberRoleID)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+)
+
+const (
+	ingressHTTPPort  = 80
+	ingressHTTPSPort = 443
+
+	l7PolicyActionRedirectToPool = "REDIRECT_TO_POOL"
+	l7RuleTypeHostName           = "HOST_NAME"
+	l7RuleTypePath               = "PATH"
+	l7CompareTypeEqualTo         = "EQUAL_TO"
+	l7CompareTypeStartsWith      = "STARTS_WITH"
+
+	defaultIngressPath = "/"
+)
+
+// IngressLoadBalancer contains all essential information of the ingresses in a namespace,
+// which share one load balancer.
+type IngressLoadBalancer struct {
+	Name     string
+	TenantID string
+	// SubnetID is the subnet of the VIP.
+	SubnetID string
+	// MemberSubnets are the subnets of the network, members are on the subnet
+	// containing their address, or on the VIP subnet.
+	MemberSubnets []*drivertypes.Subnet
+	// ExternalIP is the floating IP of the load balancer, a new one is
+	// allocated if it's empty.
+	ExternalIP string
+	// FloatingNetwork is the name or ID of the external network floating IPs
+	// are allocated from, defaults to the configured external network.
+	FloatingNetwork string
+	// TLSContainerRefs are certificates of the HTTPS listener, the first one
+	// is the default and all of them are selected by SNI. There is no HTTPS
+	// listener if it's empty.
+	TLSContainerRefs []string
+	// Backends are the pools of the load balancer.
+	Backends []IngressBackend
+	// Rules route requests to backends, the most specific rule wins.
+	Rules []IngressRule
+}
+
+// IngressBackend is a pool of the ingress load balancer.
+type IngressBackend struct {
+	Name      string
+	Endpoints []Endpoint
+}
+
+// IngressRule forwards requests matching the host and the path prefix to the backend.
+// An empty host matches all hosts and an empty path matches all paths.
+type IngressRule struct {
+	Host    string
+	Path    string
+	Backend string
+}
+
+// l7Policy is a LBaaS v2 L7 policy, which isn't supported by gophercloud yet.
+type l7Policy struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	ListenerID     string `json:"listener_id"`
+	Action         string `json:"action"`
+	RedirectPoolID string `json:"redirect_pool_id"`
+	Position       int    `json:"position"`
+}
+
+// l7Rule is a rule of a L7 policy, all rules of a policy must match.
+type l7Rule struct {
+	Type        string `json:"type"`
+	CompareType string `json:"compare_type"`
+	Value       string `json:"value"`
+}
+
+// sortIngressRules sorts ingress rules by precedence: rules with hosts go first,
+// and longer paths go before shorter ones.
+func sortIngressRules(rules []IngressRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if (rules[i].Host == "") != (rules[j].Host == "") {
+			return rules[i].Host != ""
+		}
+		return len(rules[i].getPath()) > len(rules[j].getPath())
+	})
+}
+
+// getPath returns the path prefix of the rule, which defaults to "/".
+func (r *IngressRule) getPath() string {
+	if r.Path == "" {
+		return defaultIngressPath
+	}
+	return r.Path
+}
+
+// buildL7PolicyName returns a name identifying the rule, so that a changed rule
+// gets a new policy.
+func buildL7PolicyName(lbName string, rule *IngressRule) string {
+	hash := sha256.Sum256([]byte(rule.Host + "\n" + rule.getPath() + "\n" + rule.Backend))
+	return fmt.Sprintf("%s-%s", lbName, hex.EncodeToString(hash[:])[:10])
+}
+
+// buildIngressPoolName returns the name of the backend pool.
+func buildIngressPoolName(lbName, backend string) string {
+	return fmt.Sprintf("%s-%s", lbName, backend)
+}
+
+// EnsureIngressLoadBalancer ensures the load balancer of ingresses is created.
+func (os *Client) EnsureIngressLoadBalancer(lb *IngressLoadBalancer) (*LoadBalancerStatus, error) {
+	loadbalancer, err := os.ensureLoadBalancerCreated(lb.Name, lb.SubnetID, lb.TenantID, "Stackube ingress")
+	if err != nil {
+		return nil, err
+	}
+
+	// create the backend pools, which are shared by the listeners.
+	poolIDs, err := os.ensureIngressPools(lb, loadbalancer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTPS is terminated by the load balancer if there are certificates.
+	wantedListeners := []LoadBalancerPort{{Protocol: protocolHTTP, Port: ingressHTTPPort}}
+	if len(lb.TLSContainerRefs) > 0 {
+		wantedListeners = append(wantedListeners, LoadBalancerPort{Protocol: protocolTerminatedHTTPS, Port: ingressHTTPSPort})
+	}
+	wantedKeys := make(map[string]bool)
+	for _, port := range wantedListeners {
+		wantedKeys[listenerKey(port.Protocol, port.Port)] = true
+	}
+	existingListeners := make(map[string]*listeners.Listener)
+	oldListeners, err := os.getListenersByLoadBalancerID(loadbalancer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting LB %s listeners: %v", loadbalancer.Name, err)
+	}
+	for i := range oldListeners {
+		l := oldListeners[i]
+		key := listenerKey(l.Protocol, l.ProtocolPort)
+		if wantedKeys[key] {
+			existingListeners[key] = &l
+		} else {
+			// delete the obsolete listener
+			if err := os.ensureListenerDeleted(loadbalancer.ID, l); err != nil {
+				return nil, fmt.Errorf("error deleting listener %q: %v", l.Name, err)
+			}
+		}
+	}
+
+	rules := make([]IngressRule, len(lb.Rules))
+	copy(rules, lb.Rules)
+	sortIngressRules(rules)
+	for _, port := range wantedListeners {
+		listener, err := os.ensureIngressListener(lb, loadbalancer.ID, port.Protocol, port.Port,
+			existingListeners[listenerKey(port.Protocol, port.Port)])
+		if err != nil {
+			return nil, err
+		}
+		if err := os.ensureL7Policies(lb.Name, loadbalancer.ID, listener.ID, rules, poolIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	// delete obsolete pools after the policies referring to them.
+	poolList, err := os.getPoolsByLoadBalancerID(loadbalancer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting LB %s pools: %v", loadbalancer.Name, err)
+	}
+	for i := range poolList {
+		if _, ok := poolIDs[poolList[i].Name]; ok {
+			continue
+		}
+		glog.V(4).Infof("Deleting obsolete pool %s of load balancer %s", poolList[i].Name, lb.Name)
+		if err := os.ensurePoolDeleted(loadbalancer.ID, &poolList[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// associate external IP for the vip.
+	fip, err := os.associateFloatingIP(&LoadBalancer{
+		Name:            lb.Name,
+		TenantID:        lb.TenantID,
+		ExternalIP:      lb.ExternalIP,
+		FloatingNetwork: lb.FloatingNetwork,
+	}, loadbalancer.VipPortID)
+	if err != nil {
+		glog.Errorf("associateFloatingIP for port %q failed: %v", loadbalancer.VipPortID, err)
+		return nil, err
+	}
+
+	return &LoadBalancerStatus{
+		InternalIP: loadbalancer.VipAddress,
+		ExternalIP: fip,
+	}, nil
+}
+
+// ensureIngressPools ensures the pools, members and monitors of backends, and returns
+// IDs of the pools by name.
+func (os *Client) ensureIngressPools(lb *IngressLoadBalancer, loadbalancerID string) (map[string]string, error) {
+	poolList, err := os.getPoolsByLoadBalancerID(loadbalancerID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting LB %s pools: %v", lb.Name, err)
+	}
+	existingPools := make(map[string]*pools.Pool)
+	for i := range poolList {
+		existingPools[poolList[i].Name] = &poolList[i]
+	}
+
+	poolIDs := make(map[string]string)
+	options := LoadBalancerOptions{}
+	for _, backend := range lb.Backends {
+		name := buildIngressPoolName(lb.Name, backend.Name)
+		pool, ok := existingPools[name]
+		if !ok {
+			pool, err = pools.Create(os.LoadBalancer, pools.CreateOpts{
+				Name:           name,
+				LoadbalancerID: loadbalancerID,
+				Protocol:       pools.ProtocolHTTP,
+				LBMethod:       options.getLBMethod(),
+				TenantID:       lb.TenantID,
+			}).Extract()
+			if err != nil {
+				glog.Errorf("Create pool %q failed: %v", name, err)
+				return nil, err
+			}
+			os.waitLoadBalancerStatus(loadbalancerID)
+		}
+		poolIDs[name] = pool.ID
+
+		if err := os.ensureMembers(loadbalancerID, lb.SubnetID, lb.MemberSubnets, pool.ID, name, backend.Endpoints); err != nil {
+			return nil, err
+		}
+
+		monitorOpts := options.buildMonitorOpts(protocolHTTP)
+		monitorOpts.Name = name
+		monitorOpts.TenantID = lb.TenantID
+		if err := os.ensureMonitor(loadbalancerID, pool, monitorOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	return poolIDs, nil
+}
+
+// ensureIngressListener creates the listener or updates its certificates, listener
+// is nil if not exists yet.
+func (os *Client) ensureIngressListener(lb *IngressLoadBalancer, loadbalancerID, protocol string, port int,
+	listener *listeners.Listener) (*listeners.Listener, error) {
+	name := fmt.Sprintf("%s-%s-%d", lb.Name, strings.ToLower(protocol), port)
+	var defaultTLSContainerRef string
+	var sniContainerRefs []string
+	if protocol == protocolTerminatedHTTPS {
+		defaultTLSContainerRef = lb.TLSContainerRefs[0]
+		sniContainerRefs = lb.TLSContainerRefs
+	}
+
+	if listener == nil {
+		listener, err := listeners.Create(os.LoadBalancer, listeners.CreateOpts{
+			LoadbalancerID:         loadbalancerID,
+			Protocol:               listeners.Protocol(protocol),
+			ProtocolPort:           port,
+			TenantID:               lb.TenantID,
+			Name:                   name,
+			DefaultTlsContainerRef: defaultTLSContainerRef,
+			SniContainerRefs:       sniContainerRefs,
+		}).Extract()
+		if err != nil {
+			glog.Errorf("Create listener %q failed: %v", name, err)
+			return nil, err
+		}
+		os.waitLoadBalancerStatus(loadbalancerID)
+		return listener, nil
+	}
+
+	if protocol == protocolTerminatedHTTPS && (listener.DefaultTlsContainerRef != defaultTLSContainerRef ||
+		!reflect.DeepEqual(listener.SniContainerRefs, sniContainerRefs)) {
+		// the certificates are rotated by updating the listener.
+		_, err := listeners.Update(os.LoadBalancer, listener.ID, listeners.UpdateOpts{
+			DefaultTlsContainerRef: defaultTLSContainerRef,
+			SniContainerRefs:       sniContainerRefs,
+		}).Extract()
+		if err != nil {
+			glog.Errorf("Update listener %q failed: %v", name, err)
+			return nil, err
+		}
+		os.waitLoadBalancerStatus(loadbalancerID)
+	}
+
+	return listener, nil
+}
+
+// ensureL7Policies ensures the listener has exactly one policy per rule, ordered by
+// the rules. Policies are named by their rules, so they are never updated except
+// their positions.
+func (os *Client) ensureL7Policies(lbName, loadbalancerID, listenerID string, rules []IngressRule,
+	poolIDs map[string]string) error {
+	policies, err := os.getL7PoliciesByListenerID(listenerID)
+	if err != nil {
+		return fmt.Errorf("error getting L7 policies of listener %s: %v", listenerID, err)
+	}
+
+	wantedPolicies := make(map[string]bool)
+	for i := range rules {
+		wantedPolicies[buildL7PolicyName(lbName, &rules[i])] = true
+	}
+	for _, policy := range policies {
+		if !wantedPolicies[policy.Name] {
+			glog.V(4).Infof("Deleting obsolete L7 policy %s of listener %s", policy.Name, listenerID)
+			if err := os.deleteL7Policy(loadbalancerID, policy.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		position := i + 1
+		name := buildL7PolicyName(lbName, rule)
+		poolID, ok := poolIDs[buildIngressPoolName(lbName, rule.Backend)]
+		if !ok {
+			return fmt.Errorf("backend %q of rule %s%s not found", rule.Backend, rule.Host, rule.Path)
+		}
+
+		// positions of policies are shifted by each change, so always refresh them.
+		policies, err = os.getL7PoliciesByListenerID(listenerID)
+		if err != nil {
+			return fmt.Errorf("error getting L7 policies of listener %s: %v", listenerID, err)
+		}
+		var existing *l7Policy
+		for j := range policies {
+			if policies[j].Name == name {
+				existing = &policies[j]
+			}
+		}
+
+		if existing == nil {
+			if err := os.createL7Policy(name, loadbalancerID, listenerID, poolID, position, rule); err != nil {
+				return err
+			}
+		} else if existing.Position != position {
+			if err := os.updateL7PolicyPosition(loadbalancerID, existing.ID, position); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteL7Policies deletes all L7 policies of the listener.
+func (os *Client) deleteL7Policies(loadbalancerID, listenerID string) error {
+	policies, err := os.getL7PoliciesByListenerID(listenerID)
+	if err != nil {
+		return fmt.Errorf("error getting L7 policies of listener %s: %v", listenerID, err)
+	}
+
+	for _, policy := range policies {
+		if err := os.deleteL7Policy(loadbalancerID, policy.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (os *Client) getL7PoliciesByListenerID(listenerID string) ([]l7Policy, error) {
+	var result struct {
+		L7Policies []l7Policy `json:"l7policies"`
+	}
+	url := os.LoadBalancer.ServiceURL("lbaas", "l7policies") + "?listener_id=" + listenerID
+	if _, err := os.LoadBalancer.Get(url, &result, nil); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// filter again in case the listener_id query isn't supported.
+	policies := make([]l7Policy, 0, len(result.L7Policies))
+	for _, policy := range result.L7Policies {
+		if policy.ListenerID == listenerID {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
+
+func (os *Client) createL7Policy(name, loadbalancerID, listenerID, poolID string, position int,
+	rule *IngressRule) error {
+	body := map[string]interface{}{
+		"l7policy": map[string]interface{}{
+			"name":             name,
+			"listener_id":      listenerID,
+			"action":           l7PolicyActionRedirectToPool,
+			"redirect_pool_id": poolID,
+			"position":         position,
+		},
+	}
+	var result struct {
+		L7Policy l7Policy `json:"l7policy"`
+	}
+	_, err := os.LoadBalancer.Post(os.LoadBalancer.ServiceURL("lbaas", "l7policies"), body, &result,
+		&gophercloud.RequestOpts{OkCodes: []int{201}})
+	if err != nil {
+		glog.Errorf("Create L7 policy %q failed: %v", name, err)
+		return err
+	}
+	os.waitLoadBalancerStatus(loadbalancerID)
+
+	l7Rules := []l7Rule{{Type: l7RuleTypePath, CompareType: l7CompareTypeStartsWith, Value: rule.getPath()}}
+	if rule.Host != "" {
+		l7Rules = append(l7Rules, l7Rule{Type: l7RuleTypeHostName, CompareType: l7CompareTypeEqualTo, Value: rule.Host})
+	}
+	for _, r := range l7Rules {
+		url := os.LoadBalancer.ServiceURL("lbaas", "l7policies", result.L7Policy.ID, "rules")
+		_, err := os.LoadBalancer.Post(url, map[string]interface{}{"rule": r}, nil,
+			&gophercloud.RequestOpts{OkCodes: []int{201}})
+		if err != nil {
+			glog.Errorf("Create %s rule of L7 policy %q failed: %v", r.Type, name, err)
+			// the policy without all rules matches too many requests.
+			os.deleteL7Policy(loadbalancerID, result.L7Policy.ID)
+			return err
+		}
+		os.waitLoadBalancerStatus(loadbalancerID)
+	}
+
+	return nil
+}
+
+func (os *Client) updateL7PolicyPosition(loadbalancerID, policyID string, position int) error {
+	body := map[string]interface{}{
+		"l7policy": map[string]interface{}{
+			"position": position,
+		},
+	}
+	_, err := os.LoadBalancer.Put(os.LoadBalancer.ServiceURL("lbaas", "l7policies", policyID), body, nil,
+		&gophercloud.RequestOpts{OkCodes: []int{200}})
+	if err != nil {
+		glog.Errorf("Update position of L7 policy %q failed: %v", policyID, err)
+		return err
+	}
+	os.waitLoadBalancerStatus(loadbalancerID)
+
+	return nil
+}
+
+func (os *Client) deleteL7Policy(loadbalancerID, policyID string) error {
+	_, err := os.LoadBalancer.Delete(os.LoadBalancer.ServiceURL("lbaas", "l7policies", policyID), nil)
+	if err != nil && !isNotFound(err) {
+		glog.Errorf("Delete L7 policy %q failed: %v", policyID, err)
+		return err
+	}
+	os.waitLoadBalancerStatus(loadbalancerID)
+
+	return nil
+}
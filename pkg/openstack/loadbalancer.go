@@ -18,8 +18,11 @@ package openstack
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/golang/glog"
@@ -55,19 +58,87 @@ const (
 
 	activeStatus = "ACTIVE"
 	errorStatus  = "ERROR"
+
+	protocolTCP  = "TCP"
+	protocolUDP  = "UDP"
+	protocolHTTP = "HTTP"
+
+	// protocolTerminatedHTTPS listeners terminate TLS and forward HTTP to pools.
+	protocolTerminatedHTTPS = "TERMINATED_HTTPS"
+
+	persistenceSourceIP   = "SOURCE_IP"
+	persistenceHTTPCookie = "HTTP_COOKIE"
+
+	defaultMonitorURLPath       = "/"
+	defaultMonitorExpectedCodes = "200"
+	unlimitedConnections        = -1
+
+	// monitorTypeUDPConnect is the health monitor type for UDP pools.
+	monitorTypeUDPConnect = "UDP-CONNECT"
+
+	// floatingIPDescription marks floating IPs allocated by stackube, only
+	// those are released together with the load balancer.
+	floatingIPDescription = "Allocated by stackube"
 )
 
 // LoadBalancer contains all essential information of kubernetes service.
 type LoadBalancer struct {
-	Name            string
-	ServicePort     int
-	TenantID        string
-	SubnetID        string
-	Protocol        string
-	InternalIP      string
-	ExternalIP      string
+	Name     string
+	TenantID string
+	// SubnetID is the subnet of the VIP.
+	SubnetID string
+	// MemberSubnets are the subnets of the network, members are on the subnet
+	// containing their address, or on the VIP subnet.
+	MemberSubnets []*drivertypes.Subnet
+	InternalIP    string
+	// ExternalIP is the floating IP of the load balancer, a new one is
+	// allocated if it's empty.
+	ExternalIP string
+	// FloatingNetwork is the name or ID of the external network floating IPs
+	// are allocated from, defaults to the configured external network.
+	FloatingNetwork string
 	SessionAffinity bool
-	Endpoints       []Endpoint
+	// Options of the pools, monitors and listeners.
+	Options LoadBalancerOptions
+	// Ports of the load balancer, each port has its own listener, pool and monitor.
+	Ports []LoadBalancerPort
+}
+
+// LoadBalancerPort is a service port exposed by the load balancer.
+type LoadBalancerPort struct {
+	Name string
+	// Protocol is TCP or UDP, defaults to TCP.
+	Protocol  string
+	Port      int
+	Endpoints []Endpoint
+	// HTTP balances the TCP port as HTTP.
+	HTTP bool
+	// TLSContainerRef refers to the certificate of the port, whose listener
+	// terminates HTTPS if it's set.
+	TLSContainerRef string
+}
+
+// LoadBalancerOptions tunes the pools, monitors and listeners of a load balancer,
+// zero values fall back to the defaults.
+type LoadBalancerOptions struct {
+	// LBMethod is ROUND_ROBIN, LEAST_CONNECTIONS or SOURCE_IP, defaults to ROUND_ROBIN.
+	LBMethod string
+	// Persistence is SOURCE_IP or HTTP_COOKIE, defaults to SOURCE_IP with session
+	// affinity and no persistence otherwise. HTTP_COOKIE requires all ports to be
+	// balanced as HTTP.
+	Persistence string
+	// ConnectionLimit is the maximum number of connections per listener, unlimited if zero.
+	ConnectionLimit int
+	// MonitorType is TCP, HTTP or HTTPS, defaults to TCP. UDP ports are always
+	// monitored with UDP-CONNECT.
+	MonitorType string
+	// MonitorURLPath and MonitorExpectedCodes are used by HTTP and HTTPS monitors,
+	// they default to "/" and "200".
+	MonitorURLPath       string
+	MonitorExpectedCodes string
+	MonitorDelay         int
+	MonitorTimeout       int
+	MonitorMaxRetries    int
 }
 
 // Endpoint represents a container endpoint.
@@ -82,117 +153,357 @@ type LoadBalancerStatus struct {
 	ExternalIP string
 }
 
+// floatingIPCreateOpts adds the description to floatingips.CreateOpts, which
+// is used to record floating IPs allocated by stackube.
+type floatingIPCreateOpts struct {
+	floatingips.CreateOpts
+	Description string
+}
+
+// ToFloatingIPCreateMap implements floatingips.CreateOptsBuilder.
+func (opts floatingIPCreateOpts) ToFloatingIPCreateMap() (map[string]interface{}, error) {
+	b, err := opts.CreateOpts.ToFloatingIPCreateMap()
+	if err != nil {
+		return nil, err
+	}
+
+	b["floatingip"].(map[string]interface{})["description"] = opts.Description
+	return b, nil
+}
+
+// poolUpdateOpts updates the algorithm and the session persistence of the pool,
+// pools.UpdateOpts can't change the session persistence.
+type poolUpdateOpts struct {
+	LBMethod    pools.LBMethod            `json:"lb_algorithm"`
+	Persistence *pools.SessionPersistence `json:"session_persistence"`
+}
+
+// ToPoolUpdateMap implements pools.UpdateOptsBuilder.
+func (opts poolUpdateOpts) ToPoolUpdateMap() (map[string]interface{}, error) {
+	return gophercloud.BuildRequestBody(opts, "pool")
+}
+
+// getProtocol returns the upper case protocol of the port, which defaults to TCP.
+func (p *LoadBalancerPort) getProtocol() string {
+	if p.Protocol == "" {
+		return protocolTCP
+	}
+	return strings.ToUpper(p.Protocol)
+}
+
+// listenerKey identifies a listener by its protocol and port.
+func listenerKey(protocol string, port int) string {
+	return fmt.Sprintf("%s:%d", strings.ToUpper(protocol), port)
+}
+
+// getListenerProtocol returns the protocol of the listener of the port. Ports with
+// certificates terminate HTTPS, and HTTP ports are balanced as HTTP.
+func (lb *LoadBalancer) getListenerProtocol(port *LoadBalancerPort) string {
+	protocol := port.getProtocol()
+	if port.TLSContainerRef != "" {
+		return protocolTerminatedHTTPS
+	}
+	if protocol == protocolTCP && port.HTTP {
+		return protocolHTTP
+	}
+	return protocol
+}
+
+// getPoolProtocol returns the protocol of the pool behind the listener.
+func getPoolProtocol(listenerProtocol string) string {
+	if listenerProtocol == protocolTerminatedHTTPS {
+		return protocolHTTP
+	}
+	return listenerProtocol
+}
+
+// getPersistence returns the session persistence type of pools with the protocol,
+// which is empty if sessions are not persisted.
+func (lb *LoadBalancer) getPersistence(protocol string) string {
+	persistence := strings.ToUpper(lb.Options.Persistence)
+	switch {
+	case persistence != "":
+		return persistence
+	case lb.SessionAffinity:
+		return persistenceSourceIP
+	}
+	return ""
+}
+
+// getLBMethod returns the pool algorithm, which defaults to ROUND_ROBIN.
+func (o *LoadBalancerOptions) getLBMethod() pools.LBMethod {
+	if o.LBMethod == "" {
+		return pools.LBMethodRoundRobin
+	}
+	return pools.LBMethod(strings.ToUpper(o.LBMethod))
+}
+
+// getConnectionLimit returns the connection limit of listeners, -1 means unlimited.
+func (o *LoadBalancerOptions) getConnectionLimit() int {
+	if o.ConnectionLimit <= 0 {
+		return unlimitedConnections
+	}
+	return o.ConnectionLimit
+}
+
+// buildMonitorOpts builds the health monitor of pools with the protocol.
+func (o *LoadBalancerOptions) buildMonitorOpts(protocol string) monitors.CreateOpts {
+	opts := monitors.CreateOpts{
+		Type:       monitors.TypeTCP,
+		Delay:      defaultMonitorDelay,
+		Timeout:    defaultMonotorTimeout,
+		MaxRetries: defaultMonitorRetry,
+	}
+	if o.MonitorDelay > 0 {
+		opts.Delay = o.MonitorDelay
+	}
+	if o.MonitorTimeout > 0 {
+		opts.Timeout = o.MonitorTimeout
+	}
+	if o.MonitorMaxRetries > 0 {
+		opts.MaxRetries = o.MonitorMaxRetries
+	}
+
+	monitorType := strings.ToUpper(o.MonitorType)
+	switch {
+	case protocol == protocolUDP:
+		opts.Type = monitorTypeUDPConnect
+	case monitorType == monitors.TypeHTTP || monitorType == monitors.TypeHTTPS:
+		opts.Type = monitorType
+		opts.URLPath = defaultMonitorURLPath
+		if o.MonitorURLPath != "" {
+			opts.URLPath = o.MonitorURLPath
+		}
+		opts.ExpectedCodes = defaultMonitorExpectedCodes
+		if o.MonitorExpectedCodes != "" {
+			opts.ExpectedCodes = o.MonitorExpectedCodes
+		}
+	}
+
+	return opts
+}
+
+// monitorNeedsUpdate returns whether the health monitor differs from the wanted one.
+func monitorNeedsUpdate(monitor *monitors.Monitor, opts monitors.CreateOpts) bool {
+	return monitor.Delay != opts.Delay || monitor.Timeout != opts.Timeout ||
+		monitor.MaxRetries != opts.MaxRetries || monitor.URLPath != opts.URLPath ||
+		monitor.ExpectedCodes != opts.ExpectedCodes
+}
+
 // EnsureLoadBalancer ensures a load balancer is created.
 func (os *Client) EnsureLoadBalancer(lb *LoadBalancer) (*LoadBalancerStatus, error) {
-	// removes old one if already exists.
-	loadbalancer, err := os.getLoadBalanceByName(lb.Name)
-	if err != nil {
-		if isNotFound(err) {
-			// create a new one.
-			lbOpts := loadbalancers.CreateOpts{
-				Name:        lb.Name,
-				Description: "Stackube service",
-				VipSubnetID: lb.SubnetID,
-				TenantID:    lb.TenantID,
-			}
-			loadbalancer, err = loadbalancers.Create(os.Network, lbOpts).Extract()
-			if err != nil {
-				glog.Errorf("Create load balancer %q failed: %v", lb.Name, err)
-				return nil, err
-			}
+	if len(lb.Ports) == 0 {
+		return nil, fmt.Errorf("no ports provided for load balancer %s", lb.Name)
+	}
+	// Neutron LBaaS v2 rejects UDP listeners, and HTTP cookies only persist
+	// sessions of HTTP pools, check before creating anything.
+	for i := range lb.Ports {
+		if !os.UseOctavia && lb.Ports[i].getProtocol() == protocolUDP {
+			return nil, fmt.Errorf("UDP port %d of load balancer %s requires Octavia, which is not enabled",
+				lb.Ports[i].Port, lb.Name)
+		}
+		protocol := getPoolProtocol(lb.getListenerProtocol(&lb.Ports[i]))
+		if strings.ToUpper(lb.Options.Persistence) == persistenceHTTPCookie && protocol != protocolHTTP {
+			return nil, fmt.Errorf("%s persistence of load balancer %s requires HTTP ports, but port %d is %s",
+				persistenceHTTPCookie, lb.Name, lb.Ports[i].Port, protocol)
 		}
-	} else {
-		glog.V(3).Infof("LoadBalancer %s already exists", lb.Name)
 	}
 
-	status, err := os.waitLoadBalancerStatus(loadbalancer.ID)
+	loadbalancer, err := os.ensureLoadBalancerCreated(lb.Name, lb.SubnetID, lb.TenantID, "Stackube service")
 	if err != nil {
-		glog.Errorf("Waiting for load balancer provision failed: %v", err)
 		return nil, err
 	}
 
-	glog.V(3).Infof("Load balancer %q becomes %q", lb.Name, status)
-
 	// get old listeners
-	var listener *listeners.Listener
+	wantedListeners := make(map[string]bool)
+	for i := range lb.Ports {
+		wantedListeners[listenerKey(lb.getListenerProtocol(&lb.Ports[i]), lb.Ports[i].Port)] = true
+	}
+	existingListeners := make(map[string]*listeners.Listener)
 	oldListeners, err := os.getListenersByLoadBalancerID(loadbalancer.ID)
 	if err != nil {
 		return nil, fmt.Errorf("error getting LB %s listeners: %v", loadbalancer.Name, err)
 	}
 	for i := range oldListeners {
 		l := oldListeners[i]
-		if l.ProtocolPort == lb.ServicePort {
-			listener = &l
+		key := listenerKey(l.Protocol, l.ProtocolPort)
+		if wantedListeners[key] {
+			existingListeners[key] = &l
 		} else {
 			// delete the obsolete listener
 			if err := os.ensureListenerDeleted(loadbalancer.ID, l); err != nil {
 				return nil, fmt.Errorf("error deleting listener %q: %v", l.Name, err)
 			}
-			os.waitLoadBalancerStatus(loadbalancer.ID)
 		}
 	}
 
+	for i := range lb.Ports {
+		port := &lb.Ports[i]
+		listener := existingListeners[listenerKey(lb.getListenerProtocol(port), port.Port)]
+		if err := os.ensureLoadBalancerPort(lb, loadbalancer.ID, port, listener); err != nil {
+			return nil, err
+		}
+	}
+
+	// associate external IP for the vip.
+	fip, err := os.associateFloatingIP(lb, loadbalancer.VipPortID)
+	if err != nil {
+		glog.Errorf("associateFloatingIP for port %q failed: %v", loadbalancer.VipPortID, err)
+		return nil, err
+	}
+
+	return &LoadBalancerStatus{
+		InternalIP: loadbalancer.VipAddress,
+		ExternalIP: fip,
+	}, nil
+}
+
+// ensureLoadBalancerCreated gets the load balancer by name or creates a new one,
+// and waits for it becoming active.
+func (os *Client) ensureLoadBalancerCreated(name, subnetID, tenantID, description string) (*loadbalancers.LoadBalancer, error) {
+	loadbalancer, err := os.getLoadBalanceByName(name)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, fmt.Errorf("error getting load balancer %q: %v", name, err)
+		}
+		// create a new one.
+		lbOpts := loadbalancers.CreateOpts{
+			Name:        name,
+			Description: description,
+			VipSubnetID: subnetID,
+			TenantID:    tenantID,
+			Provider:    os.LBProvider,
+		}
+		loadbalancer, err = loadbalancers.Create(os.LoadBalancer, lbOpts).Extract()
+		if err != nil {
+			glog.Errorf("Create load balancer %q failed: %v", name, err)
+			return nil, err
+		}
+	} else {
+		glog.V(3).Infof("LoadBalancer %s already exists", name)
+	}
+
+	status, err := os.waitLoadBalancerStatus(loadbalancer.ID)
+	if err != nil {
+		glog.Errorf("Waiting for load balancer provision failed: %v", err)
+		return nil, err
+	}
+
+	glog.V(3).Infof("Load balancer %q becomes %q", name, status)
+
+	return loadbalancer, nil
+}
+
+// ensureLoadBalancerPort ensures the listener, pool, members and monitor of the port,
+// listener is nil if not exists yet.
+func (os *Client) ensureLoadBalancerPort(lb *LoadBalancer, loadbalancerID string, port *LoadBalancerPort,
+	listener *listeners.Listener) error {
+	protocol := lb.getListenerProtocol(port)
+	poolProtocol := getPoolProtocol(protocol)
+	name := fmt.Sprintf("%s-%s-%d", lb.Name, strings.ToLower(protocol), port.Port)
+	connLimit := lb.Options.getConnectionLimit()
+
 	// create the listener.
 	if listener == nil {
 		lisOpts := listeners.CreateOpts{
-			LoadbalancerID: loadbalancer.ID,
-			// Only tcp is supported now.
-			Protocol:     listeners.ProtocolTCP,
-			ProtocolPort: lb.ServicePort,
-			TenantID:     lb.TenantID,
-			Name:         lb.Name,
-		}
-		listener, err = listeners.Create(os.Network, lisOpts).Extract()
+			LoadbalancerID:         loadbalancerID,
+			Protocol:               listeners.Protocol(protocol),
+			ProtocolPort:           port.Port,
+			TenantID:               lb.TenantID,
+			Name:                   name,
+			ConnLimit:              &connLimit,
+			DefaultTlsContainerRef: port.TLSContainerRef,
+		}
+		var err error
+		listener, err = listeners.Create(os.LoadBalancer, lisOpts).Extract()
 		if err != nil {
-			glog.Errorf("Create listener %q failed: %v", lb.Name, err)
-			return nil, err
+			glog.Errorf("Create listener %q failed: %v", name, err)
+			return err
 		}
-		os.waitLoadBalancerStatus(loadbalancer.ID)
+		os.waitLoadBalancerStatus(loadbalancerID)
+	} else if listener.ConnLimit != connLimit || listener.DefaultTlsContainerRef != port.TLSContainerRef {
+		// the certificate is rotated by updating the listener.
+		_, err := listeners.Update(os.LoadBalancer, listener.ID, listeners.UpdateOpts{
+			ConnLimit:              &connLimit,
+			DefaultTlsContainerRef: port.TLSContainerRef,
+		}).Extract()
+		if err != nil {
+			glog.Errorf("Update listener %q failed: %v", name, err)
+			return err
+		}
+		os.waitLoadBalancerStatus(loadbalancerID)
 	}
 
 	// create the load balancer pool.
-	pool, err := os.getPoolByListenerID(loadbalancer.ID, listener.ID)
+	pool, err := os.getPoolByListenerID(loadbalancerID, listener.ID)
 	if err != nil && !isNotFound(err) {
-		return nil, fmt.Errorf("error getting pool for listener %q: %v", listener.ID, err)
+		return fmt.Errorf("error getting pool for listener %q: %v", listener.ID, err)
+	}
+	lbMethod := lb.Options.getLBMethod()
+	var persistence *pools.SessionPersistence
+	if persistenceType := lb.getPersistence(poolProtocol); persistenceType != "" {
+		persistence = &pools.SessionPersistence{Type: persistenceType}
 	}
 	if pool == nil {
 		poolOpts := pools.CreateOpts{
-			Name:       lb.Name,
-			ListenerID: listener.ID,
-			Protocol:   pools.ProtocolTCP,
-			LBMethod:   pools.LBMethodRoundRobin,
-			TenantID:   lb.TenantID,
+			Name:        name,
+			ListenerID:  listener.ID,
+			Protocol:    pools.Protocol(poolProtocol),
+			LBMethod:    lbMethod,
+			TenantID:    lb.TenantID,
+			Persistence: persistence,
 		}
-		if lb.SessionAffinity {
-			poolOpts.Persistence = &pools.SessionPersistence{Type: "SOURCE_IP"}
+		pool, err = pools.Create(os.LoadBalancer, poolOpts).Extract()
+		if err != nil {
+			glog.Errorf("Create pool %q failed: %v", name, err)
+			return err
 		}
-		pool, err = pools.Create(os.Network, poolOpts).Extract()
+		os.waitLoadBalancerStatus(loadbalancerID)
+	} else if pool.LBMethod != string(lbMethod) ||
+		pool.Persistence.Type != lb.getPersistence(poolProtocol) {
+		_, err = pools.Update(os.LoadBalancer, pool.ID, poolUpdateOpts{
+			LBMethod:    lbMethod,
+			Persistence: persistence,
+		}).Extract()
 		if err != nil {
-			glog.Errorf("Create pool %q failed: %v", lb.Name, err)
-			return nil, err
+			glog.Errorf("Update pool %q failed: %v", name, err)
+			return err
 		}
-		os.waitLoadBalancerStatus(loadbalancer.ID)
+		os.waitLoadBalancerStatus(loadbalancerID)
 	}
 
-	// create load balancer members.
-	members, err := os.getMembersByPoolID(pool.ID)
+	if err := os.ensureMembers(loadbalancerID, lb.SubnetID, lb.MemberSubnets, pool.ID, name, port.Endpoints); err != nil {
+		return err
+	}
+
+	// create or update loadbalancer monitor.
+	monitorOpts := lb.Options.buildMonitorOpts(poolProtocol)
+	monitorOpts.Name = name
+	monitorOpts.TenantID = lb.TenantID
+	return os.ensureMonitor(loadbalancerID, pool, monitorOpts)
+}
+
+// ensureMembers ensures the members of the pool are exactly the endpoints. Members
+// are created on the subnet containing their address, or on subnetID.
+func (os *Client) ensureMembers(loadbalancerID, subnetID string, subnets []*drivertypes.Subnet, poolID, name string, endpoints []Endpoint) error {
+	members, err := os.getMembersByPoolID(poolID)
 	if err != nil && !isNotFound(err) {
-		return nil, fmt.Errorf("error getting members for pool %q: %v", pool.ID, err)
+		return fmt.Errorf("error getting members for pool %q: %v", poolID, err)
 	}
-	for _, ep := range lb.Endpoints {
+	for _, ep := range endpoints {
 		if !memberExists(members, ep.Address, ep.Port) {
-			memberName := fmt.Sprintf("%s-%s-%d", lb.Name, ep.Address, ep.Port)
-			_, err = pools.CreateMember(os.Network, pool.ID, pools.CreateMemberOpts{
+			memberName := fmt.Sprintf("%s-%s-%d", name, ep.Address, ep.Port)
+			_, err = pools.CreateMember(os.LoadBalancer, poolID, pools.CreateMemberOpts{
 				Name:         memberName,
 				ProtocolPort: ep.Port,
 				Address:      ep.Address,
-				SubnetID:     lb.SubnetID,
+				SubnetID:     memberSubnetID(ep.Address, subnetID, subnets),
 			}).Extract()
 			if err != nil {
 				glog.Errorf("Create member %q failed: %v", memberName, err)
-				return nil, err
+				return err
 			}
-			os.waitLoadBalancerStatus(loadbalancer.ID)
+			os.waitLoadBalancerStatus(loadbalancerID)
 		} else {
 			members = popMember(members, ep.Address, ep.Port)
 		}
@@ -200,42 +511,64 @@ func (os *Client) EnsureLoadBalancer(lb *LoadBalancer) (*LoadBalancerStatus, err
 	// delete obsolete members
 	for _, member := range members {
 		glog.V(4).Infof("Deleting obsolete member %s for pool %s address %s", member.ID,
-			pool.ID, member.Address)
-		err := pools.DeleteMember(os.Network, pool.ID, member.ID).ExtractErr()
+			poolID, member.Address)
+		err := pools.DeleteMember(os.LoadBalancer, poolID, member.ID).ExtractErr()
 		if err != nil && !isNotFound(err) {
-			return nil, fmt.Errorf("error deleting member %s for pool %s address %s: %v",
-				member.ID, pool.ID, member.Address, err)
+			return fmt.Errorf("error deleting member %s for pool %s address %s: %v",
+				member.ID, poolID, member.Address, err)
 		}
+		os.waitLoadBalancerStatus(loadbalancerID)
 	}
 
-	// create loadbalancer monitor.
-	if pool.MonitorID == "" {
-		_, err = monitors.Create(os.Network, monitors.CreateOpts{
-			Name:       lb.Name,
-			Type:       monitors.TypeTCP,
-			PoolID:     pool.ID,
-			TenantID:   lb.TenantID,
-			Delay:      defaultMonitorDelay,
-			Timeout:    defaultMonotorTimeout,
-			MaxRetries: defaultMonitorRetry,
-		}).Extract()
-		if err != nil {
-			glog.Errorf("Create monitor for pool %q failed: %v", pool.ID, err)
-			return nil, err
+	return nil
+}
+
+// ensureMonitor creates or updates the health monitor of the pool.
+func (os *Client) ensureMonitor(loadbalancerID string, pool *pools.Pool, monitorOpts monitors.CreateOpts) error {
+	monitorOpts.PoolID = pool.ID
+	if pool.MonitorID != "" {
+		monitor, err := monitors.Get(os.LoadBalancer, pool.MonitorID).Extract()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error getting monitor %q: %v", pool.MonitorID, err)
+		}
+
+		if monitor != nil && monitor.Type == monitorOpts.Type {
+			if monitorNeedsUpdate(monitor, monitorOpts) {
+				_, err = monitors.Update(os.LoadBalancer, monitor.ID, monitors.UpdateOpts{
+					Delay:         monitorOpts.Delay,
+					Timeout:       monitorOpts.Timeout,
+					MaxRetries:    monitorOpts.MaxRetries,
+					URLPath:       monitorOpts.URLPath,
+					ExpectedCodes: monitorOpts.ExpectedCodes,
+				}).Extract()
+				if err != nil {
+					glog.Errorf("Update monitor for pool %q failed: %v", pool.ID, err)
+					return err
+				}
+				os.waitLoadBalancerStatus(loadbalancerID)
+			}
+			return nil
+		}
+
+		if monitor != nil {
+			// the type of a monitor can't be updated, so recreate it.
+			glog.V(4).Infof("Deleting monitor %s for pool %s with type %s", monitor.ID, pool.ID, monitor.Type)
+			err = monitors.Delete(os.LoadBalancer, monitor.ID).ExtractErr()
+			if err != nil && !isNotFound(err) {
+				return fmt.Errorf("error deleting monitor %s for pool %s: %v", monitor.ID, pool.ID, err)
+			}
+			os.waitLoadBalancerStatus(loadbalancerID)
 		}
 	}
 
-	// associate external IP for the vip.
-	fip, err := os.associateFloatingIP(lb.TenantID, loadbalancer.VipPortID, lb.ExternalIP)
+	_, err := monitors.Create(os.LoadBalancer, monitorOpts).Extract()
 	if err != nil {
-		glog.Errorf("associateFloatingIP for port %q failed: %v", loadbalancer.VipPortID, err)
-		return nil, err
+		glog.Errorf("Create monitor for pool %q failed: %v", pool.ID, err)
+		return err
 	}
+	os.waitLoadBalancerStatus(loadbalancerID)
 
-	return &LoadBalancerStatus{
-		InternalIP: loadbalancer.VipAddress,
-		ExternalIP: fip,
-	}, nil
+	return nil
 }
 
 // GetLoadBalancer gets a load balancer by name.
@@ -246,33 +579,51 @@ func (os *Client) GetLoadBalancer(name string) (*LoadBalancer, error) {
 		return nil, err
 	}
 
-	// get listener
-	listener, err := os.getListenerByName(name)
+	result := &LoadBalancer{
+		Name:       lb.Name,
+		TenantID:   lb.TenantID,
+		SubnetID:   lb.VipSubnetID,
+		InternalIP: lb.VipAddress,
+	}
+
+	// get listeners
+	listenerList, err := os.getListenersByLoadBalancerID(lb.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	// get members
-	endpoints := make([]Endpoint, 0)
-	for _, pool := range listener.Pools {
-		for _, m := range pool.Members {
-			endpoints = append(endpoints, Endpoint{
-				Address: m.Address,
-				Port:    m.ProtocolPort,
-			})
+	for _, listener := range listenerList {
+		port := LoadBalancerPort{
+			Name:            listener.Name,
+			Protocol:        listener.Protocol,
+			Port:            listener.ProtocolPort,
+			Endpoints:       make([]Endpoint, 0),
+			TLSContainerRef: listener.DefaultTlsContainerRef,
+		}
+
+		// get members
+		pool, err := os.getPoolByListenerID(lb.ID, listener.ID)
+		if err != nil && !isNotFound(err) {
+			return nil, err
 		}
+		if pool != nil {
+			result.SessionAffinity = pool.Persistence.Type != ""
+			members, err := os.getMembersByPoolID(pool.ID)
+			if err != nil && !isNotFound(err) {
+				return nil, err
+			}
+			for _, m := range members {
+				port.Endpoints = append(port.Endpoints, Endpoint{
+					Address: m.Address,
+					Port:    m.ProtocolPort,
+				})
+			}
+		}
+
+		result.Ports = append(result.Ports, port)
 	}
 
-	return &LoadBalancer{
-		Name:            lb.Name,
-		ServicePort:     listener.ProtocolPort,
-		TenantID:        lb.TenantID,
-		SubnetID:        lb.VipSubnetID,
-		Protocol:        listener.Protocol,
-		InternalIP:      lb.VipAddress,
-		SessionAffinity: listener.Pools[0].Persistence.Type != "",
-		Endpoints:       endpoints,
-	}, nil
+	return result, nil
 }
 
 // LoadBalancerExist returns whether a load balancer has already been exist.
@@ -301,86 +652,56 @@ func (os *Client) EnsureLoadBalancerDeleted(name string) error {
 		return err
 	}
 
-	// delete floatingip
+	return os.deleteLoadBalancer(lb)
+}
+
+// deleteLoadBalancer deletes the load balancer with its children and releases
+// its floating IP.
+func (os *Client) deleteLoadBalancer(lb *loadbalancers.LoadBalancer) error {
+	// release floatingip
 	floatingIP, err := os.getFloatingIPByPortID(lb.VipPortID)
 	if err != nil && !isNotFound(err) {
 		return fmt.Errorf("error getting floating ip by port %q: %v", lb.VipPortID, err)
 	}
 	if floatingIP != nil {
-		err = floatingips.Delete(os.Network, floatingIP.ID).ExtractErr()
+		if err := os.releaseFloatingIP(floatingIP); err != nil {
+			return err
+		}
+	}
+
+	if os.UseOctavia {
+		// Octavia deletes listeners, pools, members and monitors with the load balancer.
+		err = os.deleteLoadBalancerCascade(lb.ID)
 		if err != nil && !isNotFound(err) {
-			return fmt.Errorf("error deleting floating ip %q: %v", floatingIP.ID, err)
+			return fmt.Errorf("error deleting load balancer %s: %v", lb.ID, err)
 		}
+		return os.waitLoadbalancerDeleted(lb.ID)
 	}
 
-	// get listeners and corelative pools and members
-	var poolIDs []string
-	var monitorIDs []string
-	var memberIDs []string
+	// delete all listeners with their pools, members and monitors
 	listenerList, err := os.getListenersByLoadBalancerID(lb.ID)
 	if err != nil {
 		return fmt.Errorf("Error getting load balancer %s listeners: %v", lb.ID, err)
 	}
-
 	for _, listener := range listenerList {
-		pool, err := os.getPoolByListenerID(lb.ID, listener.ID)
-		if err != nil && !isNotFound(err) {
-			return fmt.Errorf("error getting pool for listener %s: %v", listener.ID, err)
-		}
-		poolIDs = append(poolIDs, pool.ID)
-		if pool.MonitorID != "" {
-			monitorIDs = append(monitorIDs, pool.MonitorID)
-		}
-	}
-	for _, pool := range poolIDs {
-		membersList, err := os.getMembersByPoolID(pool)
-		if err != nil && !isNotFound(err) {
-			return fmt.Errorf("Error getting pool members %s: %v", pool, err)
-		}
-		for _, member := range membersList {
-			memberIDs = append(memberIDs, member.ID)
-		}
-	}
-
-	// delete all monitors
-	for _, monitorID := range monitorIDs {
-		err := monitors.Delete(os.Network, monitorID).ExtractErr()
-		if err != nil && !isNotFound(err) {
+		if err := os.ensureListenerDeleted(lb.ID, listener); err != nil {
 			return err
 		}
-		os.waitLoadBalancerStatus(lb.ID)
 	}
 
-	// delete all members and pools
-	for _, poolID := range poolIDs {
-		// delete all members for this pool
-		for _, memberID := range memberIDs {
-			err := pools.DeleteMember(os.Network, poolID, memberID).ExtractErr()
-			if err != nil && !isNotFound(err) {
-				return err
-			}
-			os.waitLoadBalancerStatus(lb.ID)
-		}
-
-		// delete pool
-		err := pools.Delete(os.Network, poolID).ExtractErr()
-		if err != nil && !isNotFound(err) {
-			return err
-		}
-		os.waitLoadBalancerStatus(lb.ID)
+	// delete pools without listeners, e.g. backends of ingresses
+	poolList, err := os.getPoolsByLoadBalancerID(lb.ID)
+	if err != nil {
+		return fmt.Errorf("Error getting load balancer %s pools: %v", lb.ID, err)
 	}
-
-	// delete all listeners
-	for _, listener := range listenerList {
-		err := listeners.Delete(os.Network, listener.ID).ExtractErr()
-		if err != nil && !isNotFound(err) {
+	for i := range poolList {
+		if err := os.ensurePoolDeleted(lb.ID, &poolList[i]); err != nil {
 			return err
 		}
-		os.waitLoadBalancerStatus(lb.ID)
 	}
 
 	// delete the load balancer
-	err = loadbalancers.Delete(os.Network, lb.ID).ExtractErr()
+	err = loadbalancers.Delete(os.LoadBalancer, lb.ID).ExtractErr()
 	if err != nil && !isNotFound(err) {
 		return err
 	}
@@ -389,31 +710,65 @@ func (os *Client) EnsureLoadBalancerDeleted(name string) error {
 	return nil
 }
 
+// deleteLoadBalancerCascade deletes the load balancer with all its children, which
+// is only supported by Octavia.
+func (os *Client) deleteLoadBalancerCascade(loadbalancerID string) error {
+	url := os.LoadBalancer.ServiceURL("lbaas", "loadbalancers", loadbalancerID) + "?cascade=true"
+	_, err := os.LoadBalancer.Delete(url, nil)
+	return err
+}
+
+// ensureListenerDeleted deletes the listener with its pool, members and monitor.
 func (os *Client) ensureListenerDeleted(loadbalancerID string, listener listeners.Listener) error {
-	for _, pool := range listener.Pools {
-		for _, member := range pool.Members {
-			// delete member
-			if err := pools.DeleteMember(os.Network, pool.ID, member.ID).ExtractErr(); err != nil && !isNotFound(err) {
-				return err
-			}
-			os.waitLoadBalancerStatus(loadbalancerID)
+	pool, err := os.getPoolByListenerID(loadbalancerID, listener.ID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error getting pool for listener %s: %v", listener.ID, err)
+	}
+
+	// delete L7 policies of ingresses, they may refer to the pool
+	if err := os.deleteL7Policies(loadbalancerID, listener.ID); err != nil {
+		return err
+	}
+
+	if pool != nil {
+		if err := os.ensurePoolDeleted(loadbalancerID, pool); err != nil {
+			return err
 		}
+	}
+
+	// delete listener
+	if err := listeners.Delete(os.LoadBalancer, listener.ID).ExtractErr(); err != nil && !isNotFound(err) {
+		return err
+	}
+	os.waitLoadBalancerStatus(loadbalancerID)
 
-		// delete monitor
-		if err := monitors.Delete(os.Network, pool.MonitorID).ExtractErr(); err != nil && !isNotFound(err) {
+	return nil
+}
+
+// ensurePoolDeleted deletes the pool with its members and monitor.
+func (os *Client) ensurePoolDeleted(loadbalancerID string, pool *pools.Pool) error {
+	members, err := os.getMembersByPoolID(pool.ID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error getting pool members %s: %v", pool.ID, err)
+	}
+	for _, member := range members {
+		// delete member
+		if err := pools.DeleteMember(os.LoadBalancer, pool.ID, member.ID).ExtractErr(); err != nil && !isNotFound(err) {
 			return err
 		}
 		os.waitLoadBalancerStatus(loadbalancerID)
+	}
 
-		// delete pool
-		if err := pools.Delete(os.Network, pool.ID).ExtractErr(); err != nil && !isNotFound(err) {
+	// delete monitor
+	if pool.MonitorID != "" {
+		if err := monitors.Delete(os.LoadBalancer, pool.MonitorID).ExtractErr(); err != nil && !isNotFound(err) {
 			return err
 		}
 		os.waitLoadBalancerStatus(loadbalancerID)
 	}
 
-	// delete listener
-	if err := listeners.Delete(os.Network, listener.ID).ExtractErr(); err != nil && !isNotFound(err) {
+	// delete pool
+	if err := pools.Delete(os.LoadBalancer, pool.ID).ExtractErr(); err != nil && !isNotFound(err) {
 		return err
 	}
 	os.waitLoadBalancerStatus(loadbalancerID)
@@ -430,7 +785,7 @@ func (os *Client) waitLoadBalancerStatus(loadbalancerID string) (string, error)
 
 	var provisioningStatus string
 	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		loadbalancer, err := loadbalancers.Get(os.Network, loadbalancerID).Extract()
+		loadbalancer, err := loadbalancers.Get(os.LoadBalancer, loadbalancerID).Extract()
 		if err != nil {
 			return false, err
 		}
@@ -458,9 +813,9 @@ func (os *Client) waitLoadbalancerDeleted(loadbalancerID string) error {
 		Steps:    loadbalancerDeleteSteps,
 	}
 	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		_, err := loadbalancers.Get(os.Network, loadbalancerID).Extract()
+		_, err := loadbalancers.Get(os.LoadBalancer, loadbalancerID).Extract()
 		if err != nil {
-			if err == ErrNotFound {
+			if isNotFound(err) {
 				return true, nil
 			} else {
 				return false, err
@@ -479,7 +834,7 @@ func (os *Client) waitLoadbalancerDeleted(loadbalancerID string) error {
 
 func (os *Client) getListenersByLoadBalancerID(id string) ([]listeners.Listener, error) {
 	var existingListeners []listeners.Listener
-	err := listeners.List(os.Network, listeners.ListOpts{LoadbalancerID: id}).EachPage(func(page pagination.Page) (bool, error) {
+	err := listeners.List(os.LoadBalancer, listeners.ListOpts{LoadbalancerID: id}).EachPage(func(page pagination.Page) (bool, error) {
 		listenerList, err := listeners.ExtractListeners(page)
 		if err != nil {
 			return false, err
@@ -506,7 +861,7 @@ func (os *Client) getLoadBalanceByName(name string) (*loadbalancers.LoadBalancer
 	var lb *loadbalancers.LoadBalancer
 
 	opts := loadbalancers.ListOpts{Name: name}
-	pager := loadbalancers.List(os.Network, opts)
+	pager := loadbalancers.List(os.LoadBalancer, opts)
 	err := pager.EachPage(func(page pagination.Page) (bool, error) {
 		lbs, err := loadbalancers.ExtractLoadBalancers(page)
 		if err != nil {
@@ -536,7 +891,7 @@ func (os *Client) getLoadBalanceByName(name string) (*loadbalancers.LoadBalancer
 
 func (os *Client) getPoolByListenerID(loadbalancerID string, listenerID string) (*pools.Pool, error) {
 	listenerPools := make([]pools.Pool, 0, 1)
-	err := pools.List(os.Network, pools.ListOpts{LoadbalancerID: loadbalancerID}).EachPage(
+	err := pools.List(os.LoadBalancer, pools.ListOpts{LoadbalancerID: loadbalancerID}).EachPage(
 		func(page pagination.Page) (bool, error) {
 			poolsList, err := pools.ExtractPools(page)
 			if err != nil {
@@ -571,11 +926,28 @@ func (os *Client) getPoolByListenerID(loadbalancerID string, listenerID string)
 }
 
 // getPoolByName gets openstack pool by name.
+func (os *Client) getPoolsByLoadBalancerID(id string) ([]pools.Pool, error) {
+	var poolList []pools.Pool
+	err := pools.List(os.LoadBalancer, pools.ListOpts{LoadbalancerID: id}).EachPage(func(page pagination.Page) (bool, error) {
+		ps, err := pools.ExtractPools(page)
+		if err != nil {
+			return false, err
+		}
+		poolList = append(poolList, ps...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return poolList, nil
+}
+
 func (os *Client) getPoolByName(name string) (*pools.Pool, error) {
 	var pool *pools.Pool
 
 	opts := pools.ListOpts{Name: name}
-	pager := pools.List(os.Network, opts)
+	pager := pools.List(os.LoadBalancer, opts)
 	err := pager.EachPage(func(page pagination.Page) (bool, error) {
 		ps, err := pools.ExtractPools(page)
 		if err != nil {
@@ -607,7 +979,7 @@ func (os *Client) getListenerByName(name string) (*listeners.Listener, error) {
 	var listener *listeners.Listener
 
 	opts := listeners.ListOpts{Name: name}
-	pager := listeners.List(os.Network, opts)
+	pager := listeners.List(os.LoadBalancer, opts)
 	err := pager.EachPage(func(page pagination.Page) (bool, error) {
 		lists, err := listeners.ExtractListeners(page)
 		if err != nil {
@@ -637,7 +1009,7 @@ func (os *Client) getListenerByName(name string) (*listeners.Listener, error) {
 
 func (os *Client) getMembersByPoolID(id string) ([]pools.Member, error) {
 	var members []pools.Member
-	err := pools.ListMembers(os.Network, id, pools.ListMembersOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+	err := pools.ListMembers(os.LoadBalancer, id, pools.ListMembersOpts{}).EachPage(func(page pagination.Page) (bool, error) {
 		membersList, err := pools.ExtractMembers(page)
 		if err != nil {
 			return false, err
@@ -654,9 +1026,14 @@ func (os *Client) getMembersByPoolID(id string) ([]pools.Member, error) {
 }
 
 func (os *Client) getFloatingIPByPortID(portID string) (*floatingips.FloatingIP, error) {
-	opts := floatingips.ListOpts{
-		PortID: portID,
-	}
+	return os.getFloatingIP(floatingips.ListOpts{PortID: portID})
+}
+
+func (os *Client) getFloatingIPByAddress(address string) (*floatingips.FloatingIP, error) {
+	return os.getFloatingIP(floatingips.ListOpts{FloatingIP: address})
+}
+
+func (os *Client) getFloatingIP(opts floatingips.ListOpts) (*floatingips.FloatingIP, error) {
 	pager := floatingips.List(os.Network, opts)
 
 	floatingIPList := make([]floatingips.FloatingIP, 0, 1)
@@ -699,61 +1076,135 @@ func memberExists(members []pools.Member, addr string, port int) bool {
 	return false
 }
 
-func (os *Client) associateFloatingIP(tenantID, portID, floatingIPAddress string) (string, error) {
-	var fip *floatingips.FloatingIP
-	opts := floatingips.ListOpts{FloatingIP: floatingIPAddress}
-	pager := floatingips.List(os.Network, opts)
-	err := pager.EachPage(func(page pagination.Page) (bool, error) {
-		floatingipList, err := floatingips.ExtractFloatingIPs(page)
-		if err != nil {
-			return false, err
-		}
-
-		if len(floatingipList) > 0 {
-			fip = &floatingipList[0]
-		}
-
-		return true, nil
-	})
+// associateFloatingIP associates the vip port with the external IP of the load balancer.
+// An existing floating IP with that address is reused, otherwise a new one is allocated
+// from the floating network and marked as owned by stackube.
+func (os *Client) associateFloatingIP(lb *LoadBalancer, portID string) (string, error) {
+	networkID, err := os.getFloatingNetworkID(lb.FloatingNetwork)
 	if err != nil {
+		glog.Errorf("Get floating network %q failed: %v", lb.FloatingNetwork, err)
 		return "", err
 	}
 
-	if fip != nil {
-		if fip.PortID != "" {
-			if fip.PortID == portID {
-				glog.V(3).Infof("FIP %q has already been associated with port %q", floatingIPAddress, portID)
-				return fip.FloatingIP, nil
-			}
-			// fip has already been used
-			return fip.FloatingIP, fmt.Errorf("FloatingIP %v is already been binded to %v", floatingIPAddress, fip.PortID)
+	// Keep the floating IP already associated with the port if it's still wanted.
+	current, err := os.getFloatingIPByPortID(portID)
+	if err != nil && !isNotFound(err) {
+		return "", fmt.Errorf("error getting floating ip by port %q: %v", portID, err)
+	}
+	if current != nil {
+		if current.FloatingIP == lb.ExternalIP ||
+			(lb.ExternalIP == "" && current.FloatingNetworkID == networkID) {
+			glog.V(3).Infof("FIP %q has already been associated with port %q", current.FloatingIP, portID)
+			return current.FloatingIP, nil
 		}
 
-		// Update floatingip
-		floatOpts := floatingips.UpdateOpts{PortID: &portID}
-		_, err = floatingips.Update(os.Network, fip.ID, floatOpts).Extract()
-		if err != nil {
-			glog.Errorf("Bind floatingip %v to %v failed: %v", floatingIPAddress, portID, err)
+		if err := os.releaseFloatingIP(current); err != nil {
 			return "", err
 		}
-	} else {
-		// Create floatingip
-		opts := floatingips.CreateOpts{
-			FloatingNetworkID: os.ExtNetID,
-			TenantID:          tenantID,
-			FloatingIP:        floatingIPAddress,
-			PortID:            portID,
-		}
-		fip, err = floatingips.Create(os.Network, opts).Extract()
-		if err != nil {
-			glog.Errorf("Create floatingip failed: %v", err)
+	}
+
+	if lb.ExternalIP != "" {
+		fip, err := os.getFloatingIPByAddress(lb.ExternalIP)
+		if err != nil && !isNotFound(err) {
 			return "", err
 		}
+
+		if fip != nil {
+			if fip.PortID != "" {
+				// fip has already been used
+				return fip.FloatingIP, fmt.Errorf("FloatingIP %v is already been binded to %v", lb.ExternalIP, fip.PortID)
+			}
+
+			// Update floatingip
+			floatOpts := floatingips.UpdateOpts{PortID: &portID}
+			_, err = floatingips.Update(os.Network, fip.ID, floatOpts).Extract()
+			if err != nil {
+				glog.Errorf("Bind floatingip %v to %v failed: %v", lb.ExternalIP, portID, err)
+				return "", err
+			}
+
+			return fip.FloatingIP, nil
+		}
 	}
 
+	// Create floatingip
+	opts := floatingIPCreateOpts{
+		CreateOpts: floatingips.CreateOpts{
+			FloatingNetworkID: networkID,
+			TenantID:          lb.TenantID,
+			FloatingIP:        lb.ExternalIP,
+			PortID:            portID,
+		},
+		Description: floatingIPDescription,
+	}
+	fip, err := floatingips.Create(os.Network, opts).Extract()
+	if err != nil {
+		glog.Errorf("Create floatingip failed: %v", err)
+		return "", err
+	}
+
+	glog.V(3).Infof("FIP %q allocated for port %q", fip.FloatingIP, portID)
 	return fip.FloatingIP, nil
 }
 
+// releaseFloatingIP deletes the floating IP if stackube allocated it, floating IPs
+// created by users are only disassociated.
+func (os *Client) releaseFloatingIP(fip *floatingips.FloatingIP) error {
+	owned, err := os.isFloatingIPOwned(fip.ID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting floating ip %q: %v", fip.ID, err)
+	}
+
+	if owned {
+		err = floatingips.Delete(os.Network, fip.ID).ExtractErr()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error deleting floating ip %q: %v", fip.ID, err)
+		}
+		return nil
+	}
+
+	_, err = floatingips.Update(os.Network, fip.ID, floatingips.UpdateOpts{PortID: nil}).Extract()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error disassociating floating ip %q: %v", fip.ID, err)
+	}
+	return nil
+}
+
+// isFloatingIPOwned returns whether the floating IP was allocated by stackube.
+func (os *Client) isFloatingIPOwned(id string) (bool, error) {
+	var s struct {
+		FloatingIP struct {
+			Description string `json:"description"`
+		} `json:"floatingip"`
+	}
+	if err := floatingips.Get(os.Network, id).ExtractInto(&s); err != nil {
+		return false, err
+	}
+
+	return s.FloatingIP.Description == floatingIPDescription, nil
+}
+
+// getFloatingNetworkID returns the ID of the external network by its name or ID,
+// the configured external network is used if it's empty.
+func (os *Client) getFloatingNetworkID(network string) (string, error) {
+	if network == "" {
+		return os.ExtNetID, nil
+	}
+
+	osNetwork, err := os.getOpenStackNetworkByName(network)
+	if err == ErrNotFound {
+		osNetwork, err = os.getOpenStackNetworkByID(network)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return osNetwork.ID, nil
+}
+
 func popMember(members []pools.Member, addr string, port int) []pools.Member {
 	for i, member := range members {
 		if member.Address == addr && member.ProtocolPort == port {
@@ -778,5 +1229,10 @@ func isNotFound(err error) bool {
 		return true
 	}
 
+	// Requests of service clients return 404 errors by value.
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return true
+	}
+
 	return false
 }
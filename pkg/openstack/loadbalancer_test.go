@@ -0,0 +1,582 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+)
+
+// singulars maps the collections of fakeNeutron to the JSON key of their objects.
+var singulars = map[string]string{
+	"loadbalancers":  "loadbalancer",
+	"listeners":      "listener",
+	"pools":          "pool",
+	"members":        "member",
+	"healthmonitors": "healthmonitor",
+	"l7policies":     "l7policy",
+	"floatingips":    "floatingip",
+	"subnets":        "subnet",
+}
+
+// fakeNeutron is an in-memory Neutron serving the LBaaS v2, floating IP and
+// subnet resources used by load balancers and networks.
+type fakeNeutron struct {
+	sync.Mutex
+	nextID int
+	// objects are the objects of each collection by ID, collections are keyed
+	// by their path, e.g. "lbaas/pools/<id>/members".
+	objects map[string]map[string]map[string]interface{}
+	// requests are "<method> <path>" of all requests served.
+	requests []string
+}
+
+func newFakeNeutron() *fakeNeutron {
+	return &fakeNeutron{objects: make(map[string]map[string]map[string]interface{})}
+}
+
+// newTestServiceClient returns a service client sending requests to server.
+func newTestServiceClient(server *httptest.Server) *gophercloud.ServiceClient {
+	return &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "admin-token"},
+		Endpoint:       server.URL + "/",
+	}
+}
+
+// add injects the object with id into the collection. The object is stored as
+// decoded from JSON, like the created ones.
+func (f *fakeNeutron) add(collection, id string, object map[string]interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	data, _ := json.Marshal(object)
+	object = make(map[string]interface{})
+	json.Unmarshal(data, &object)
+	object["id"] = id
+	if f.objects[collection] == nil {
+		f.objects[collection] = make(map[string]map[string]interface{})
+	}
+	f.objects[collection][id] = object
+}
+
+// list returns the objects of the collection sorted by ID.
+func (f *fakeNeutron) list(collection string) []map[string]interface{} {
+	var ids []string
+	for id := range f.objects[collection] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var objects []map[string]interface{}
+	for _, id := range ids {
+		objects = append(objects, f.objects[collection][id])
+	}
+	return objects
+}
+
+func (f *fakeNeutron) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+
+	collection, id := strings.Trim(r.URL.Path, "/"), ""
+	if _, ok := singulars[path.Base(collection)]; !ok {
+		collection, id = path.Dir(collection), path.Base(collection)
+	}
+	plural := path.Base(collection)
+	singular, ok := singulars[plural]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	objects := f.objects[collection]
+	if objects == nil {
+		objects = make(map[string]map[string]interface{})
+		f.objects[collection] = objects
+	}
+	object := objects[id]
+	if id != "" && object == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		result := []map[string]interface{}{}
+		for _, o := range f.list(collection) {
+			if matchesQuery(o, r) {
+				result = append(result, o)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{plural: result})
+	case r.Method == "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{singular: object})
+	case r.Method == "POST" && id == "":
+		body := make(map[string]map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		object = body[singular]
+		object["id"] = fmt.Sprintf("%s-%d", singular, f.nextID)
+		f.created(singular, object)
+		objects[object["id"].(string)] = object
+		writeJSON(w, http.StatusCreated, map[string]interface{}{singular: object})
+	case r.Method == "PUT" && id != "":
+		body := make(map[string]map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range body[singular] {
+			object[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{singular: object})
+	case r.Method == "DELETE" && id != "":
+		if singular == "loadbalancer" {
+			if r.URL.Query().Get("cascade") == "true" {
+				f.objects = map[string]map[string]map[string]interface{}{"lbaas/loadbalancers": objects}
+			} else if len(f.objects["lbaas/listeners"]) > 0 || len(f.objects["lbaas/pools"]) > 0 {
+				http.Error(w, "load balancer is in use", http.StatusConflict)
+				return
+			}
+		}
+		delete(objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
+
+// created sets the fields Neutron derives from the created object.
+func (f *fakeNeutron) created(singular string, object map[string]interface{}) {
+	switch singular {
+	case "listener":
+		object["loadbalancers"] = []interface{}{map[string]interface{}{"id": object["loadbalancer_id"]}}
+	case "pool":
+		object["listeners"] = []interface{}{map[string]interface{}{"id": object["listener_id"]}}
+	case "healthmonitor":
+		if pool := f.objects["lbaas/pools"][object["pool_id"].(string)]; pool != nil {
+			pool["healthmonitor_id"] = object["id"]
+		}
+	case "floatingip":
+		object["floating_ip_address"] = fmt.Sprintf("172.24.4.%d", f.nextID)
+	}
+}
+
+// matchesQuery returns whether the fields of object match the query of the
+// request, fields the object doesn't have are ignored.
+func matchesQuery(object map[string]interface{}, r *http.Request) bool {
+	for key, values := range r.URL.Query() {
+		if v, ok := object[key]; ok && fmt.Sprint(v) != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// addListener injects a listener of the load balancer with a pool, a member and
+// a health monitor.
+func (f *fakeNeutron) addListener(loadbalancerID, protocol string, port int) string {
+	id := fmt.Sprintf("existing-%s-%d", strings.ToLower(protocol), port)
+	f.add("lbaas/listeners", id, map[string]interface{}{
+		"protocol":         protocol,
+		"protocol_port":    port,
+		"connection_limit": unlimitedConnections,
+		"loadbalancers":    []map[string]interface{}{{"id": loadbalancerID}},
+	})
+	f.add("lbaas/pools", id+"-pool", map[string]interface{}{
+		"protocol":         protocol,
+		"lb_algorithm":     "ROUND_ROBIN",
+		"listeners":        []map[string]interface{}{{"id": id}},
+		"healthmonitor_id": id + "-monitor",
+	})
+	f.add("lbaas/pools/"+id+"-pool/members", id+"-member", map[string]interface{}{
+		"address":       "10.0.0.5",
+		"protocol_port": 8080,
+	})
+	f.add("lbaas/healthmonitors", id+"-monitor", map[string]interface{}{
+		"type":        monitorTypeFor(protocol),
+		"pool_id":     id + "-pool",
+		"delay":       defaultMonitorDelay,
+		"timeout":     defaultMonotorTimeout,
+		"max_retries": defaultMonitorRetry,
+	})
+	return id
+}
+
+func monitorTypeFor(protocol string) string {
+	if protocol == protocolUDP {
+		return monitorTypeUDPConnect
+	}
+	return "TCP"
+}
+
+// newTestClient returns a client of the fake Neutron with a load balancer.
+func newTestClient(t *testing.T, useOctavia bool) (*Client, *fakeNeutron, func()) {
+	neutron := newFakeNeutron()
+	neutron.add("lbaas/loadbalancers", "lb-1", map[string]interface{}{
+		"name":                "stackube-test-svc",
+		"provisioning_status": activeStatus,
+		"vip_port_id":         "vip-port",
+		"vip_address":         "10.0.0.10",
+	})
+	server := httptest.NewServer(neutron)
+	serviceClient := newTestServiceClient(server)
+	client := &Client{
+		Network:      serviceClient,
+		LoadBalancer: serviceClient,
+		UseOctavia:   useOctavia,
+		ExtNetID:     "ext-net",
+	}
+	return client, neutron, server.Close
+}
+
+func TestEnsureLoadBalancerRejectsUDPWithoutOctavia(t *testing.T) {
+	// No service clients are set, so any request to Neutron would panic.
+	client := &Client{}
+	lb := &LoadBalancer{
+		Name: "stackube-test-dns",
+		Ports: []LoadBalancerPort{
+			{Name: "dns-tcp", Protocol: "TCP", Port: 53},
+			{Name: "dns-udp", Protocol: "udp", Port: 53},
+		},
+	}
+
+	_, err := client.EnsureLoadBalancer(lb)
+	if err == nil || !strings.Contains(err.Error(), "requires Octavia") {
+		t.Errorf("Expected UDP port to require Octavia, got %v", err)
+	}
+}
+
+func TestEnsureLoadBalancerRejectsCookieOnNonHTTPPorts(t *testing.T) {
+	// No service clients are set, so any request to Neutron would panic.
+	client := &Client{UseOctavia: true}
+	testCases := []struct {
+		name  string
+		ports []LoadBalancerPort
+	}{
+		{
+			name:  "TCP port",
+			ports: []LoadBalancerPort{{Protocol: "TCP", Port: 80, HTTP: true}, {Protocol: "TCP", Port: 5432}},
+		},
+		{
+			name:  "UDP port",
+			ports: []LoadBalancerPort{{Protocol: "UDP", Port: 53, HTTP: true}},
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := client.EnsureLoadBalancer(&LoadBalancer{
+			Name:    "stackube-test-svc",
+			Ports:   tc.ports,
+			Options: LoadBalancerOptions{Persistence: persistenceHTTPCookie},
+		})
+		if err == nil || !strings.Contains(err.Error(), "requires HTTP ports") {
+			t.Errorf("%s: expected cookie persistence to be rejected, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestEnsureLoadBalancerListeners(t *testing.T) {
+	endpoints := []Endpoint{{Address: "10.0.0.5", Port: 8080}}
+	testCases := []struct {
+		name        string
+		useOctavia  bool
+		existing    []LoadBalancerPort
+		ports       []LoadBalancerPort
+		persistence string
+		// expected are protocol:port of the listeners after ensuring.
+		expected []string
+		// kept are protocol:port of the existing listeners which are not recreated.
+		kept []string
+	}{
+		{
+			name:     "wanted listener is kept and obsolete one is deleted",
+			existing: []LoadBalancerPort{{Protocol: "TCP", Port: 80}, {Protocol: "TCP", Port: 8080}},
+			ports:    []LoadBalancerPort{{Protocol: "TCP", Port: 80}},
+			expected: []string{"TCP:80"},
+			kept:     []string{"TCP:80"},
+		},
+		{
+			name:     "new port gets a listener",
+			existing: []LoadBalancerPort{{Protocol: "TCP", Port: 80}},
+			ports:    []LoadBalancerPort{{Protocol: "TCP", Port: 80}, {Protocol: "TCP", Port: 443}},
+			expected: []string{"TCP:443", "TCP:80"},
+			kept:     []string{"TCP:80"},
+		},
+		{
+			name:       "listener of the same port with another protocol is replaced",
+			useOctavia: true,
+			existing:   []LoadBalancerPort{{Protocol: "TCP", Port: 53}},
+			ports:      []LoadBalancerPort{{Protocol: "UDP", Port: 53}},
+			expected:   []string{"UDP:53"},
+		},
+		{
+			name:       "listeners of both protocols on the same port",
+			useOctavia: true,
+			existing:   []LoadBalancerPort{{Protocol: "UDP", Port: 53}},
+			ports:      []LoadBalancerPort{{Protocol: "TCP", Port: 53}, {Protocol: "UDP", Port: 53}},
+			expected:   []string{"TCP:53", "UDP:53"},
+			kept:       []string{"UDP:53"},
+		},
+		{
+			name:        "TCP listener is replaced by HTTP for HTTP port",
+			existing:    []LoadBalancerPort{{Protocol: "TCP", Port: 80}},
+			ports:       []LoadBalancerPort{{Protocol: "TCP", Port: 80, HTTP: true}},
+			persistence: persistenceHTTPCookie,
+			expected:    []string{"HTTP:80"},
+		},
+	}
+
+	for _, tc := range testCases {
+		client, neutron, stop := newTestClient(t, tc.useOctavia)
+		existingIDs := make(map[string]string)
+		for _, port := range tc.existing {
+			existingIDs[listenerKey(port.Protocol, port.Port)] = neutron.addListener("lb-1", port.Protocol, port.Port)
+		}
+		for i := range tc.ports {
+			tc.ports[i].Endpoints = endpoints
+		}
+
+		status, err := client.EnsureLoadBalancer(&LoadBalancer{
+			Name:     "stackube-test-svc",
+			SubnetID: "subnet",
+			Ports:    tc.ports,
+			Options:  LoadBalancerOptions{Persistence: tc.persistence},
+		})
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if status.InternalIP != "10.0.0.10" || status.ExternalIP == "" {
+			t.Errorf("%s: unexpected status %+v", tc.name, status)
+		}
+
+		var listenerKeys []string
+		listenerIDs := make(map[string]bool)
+		for _, l := range neutron.list("lbaas/listeners") {
+			listenerKeys = append(listenerKeys, listenerKey(l["protocol"].(string), int(l["protocol_port"].(float64))))
+			listenerIDs[l["id"].(string)] = true
+		}
+		sort.Strings(listenerKeys)
+		if !reflect.DeepEqual(listenerKeys, tc.expected) {
+			t.Errorf("%s: expected listeners %v, got %v", tc.name, tc.expected, listenerKeys)
+		}
+		for _, key := range tc.kept {
+			if !listenerIDs[existingIDs[key]] {
+				t.Errorf("%s: expected listener %s to be kept", tc.name, key)
+			}
+		}
+
+		// Pools, members and monitors of deleted listeners are deleted with them.
+		pools := neutron.list("lbaas/pools")
+		if len(pools) != len(tc.expected) {
+			t.Errorf("%s: expected %d pools, got %d", tc.name, len(tc.expected), len(pools))
+		}
+		poolIDs := make(map[string]bool)
+		for _, pool := range pools {
+			poolIDs[pool["id"].(string)] = true
+			listener := pool["listeners"].([]interface{})[0].(map[string]interface{})["id"].(string)
+			if !listenerIDs[listener] {
+				t.Errorf("%s: pool %s of deleted listener %s is not deleted", tc.name, pool["id"], listener)
+			}
+		}
+		for _, monitor := range neutron.list("lbaas/healthmonitors") {
+			if !poolIDs[monitor["pool_id"].(string)] {
+				t.Errorf("%s: monitor %s of deleted pool is not deleted", tc.name, monitor["id"])
+			}
+		}
+		for _, id := range existingIDs {
+			if !poolIDs[id+"-pool"] && len(neutron.list("lbaas/pools/"+id+"-pool/members")) != 0 {
+				t.Errorf("%s: members of deleted pool %s-pool are not deleted", tc.name, id)
+			}
+		}
+	}
+}
+
+func TestEnsureLoadBalancerMemberSubnets(t *testing.T) {
+	client, neutron, stop := newTestClient(t, false)
+	defer stop()
+
+	_, err := client.EnsureLoadBalancer(&LoadBalancer{
+		Name:     "stackube-test-svc",
+		SubnetID: "subnet-0",
+		MemberSubnets: []*drivertypes.Subnet{
+			{Uid: "subnet-0", Cidr: "10.0.0.0/24"},
+			{Uid: "subnet-1", Cidr: "10.0.1.0/24"},
+		},
+		Ports: []LoadBalancerPort{{
+			Protocol: "TCP",
+			Port:     80,
+			Endpoints: []Endpoint{
+				{Address: "10.0.0.5", Port: 8080},
+				{Address: "10.0.1.5", Port: 8080},
+				{Address: "192.168.0.5", Port: 8080},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pools := neutron.list("lbaas/pools")
+	if len(pools) != 1 {
+		t.Fatalf("Expected 1 pool, got %d", len(pools))
+	}
+	// Members are on the subnet of their address, or on the VIP subnet.
+	expected := map[string]string{
+		"10.0.0.5":    "subnet-0",
+		"10.0.1.5":    "subnet-1",
+		"192.168.0.5": "subnet-0",
+	}
+	subnetIDs := make(map[string]string)
+	for _, member := range neutron.list("lbaas/pools/" + pools[0]["id"].(string) + "/members") {
+		subnetIDs[member["address"].(string)] = member["subnet_id"].(string)
+	}
+	if !reflect.DeepEqual(subnetIDs, expected) {
+		t.Errorf("Expected subnets of members %v, got %v", expected, subnetIDs)
+	}
+}
+
+func TestEnsureLoadBalancerDeleted(t *testing.T) {
+	testCases := []struct {
+		name       string
+		useOctavia bool
+		// expected are requests which must have been sent.
+		expected []string
+	}{
+		{
+			name:       "Octavia deletes in cascade",
+			useOctavia: true,
+			expected:   []string{"DELETE /lbaas/loadbalancers/lb-1?cascade=true"},
+		},
+		{
+			name: "Neutron LBaaS deletes children first",
+			expected: []string{
+				"DELETE /lbaas/pools/existing-tcp-80-pool/members/existing-tcp-80-member",
+				"DELETE /lbaas/healthmonitors/existing-tcp-80-monitor",
+				"DELETE /lbaas/pools/existing-tcp-80-pool",
+				"DELETE /lbaas/listeners/existing-tcp-80",
+				"DELETE /lbaas/loadbalancers/lb-1",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		client, neutron, stop := newTestClient(t, tc.useOctavia)
+		neutron.addListener("lb-1", "TCP", 80)
+
+		err := client.EnsureLoadBalancerDeleted("stackube-test-svc")
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		var deletes []string
+		for _, request := range neutron.requests {
+			if strings.HasPrefix(request, "DELETE ") {
+				deletes = append(deletes, request)
+			}
+		}
+		if !reflect.DeepEqual(deletes, tc.expected) {
+			t.Errorf("%s: expected deletes %v, got %v", tc.name, tc.expected, deletes)
+		}
+		if len(neutron.list("lbaas/loadbalancers")) != 0 || len(neutron.list("lbaas/listeners")) != 0 {
+			t.Errorf("%s: expected load balancer and listeners to be deleted", tc.name)
+		}
+	}
+}
+
+func TestReleaseFloatingIP(t *testing.T) {
+	testCases := []struct {
+		name        string
+		description string
+		exists      bool
+		// expectDeleted means the floating IP is deleted, otherwise it's disassociated.
+		expectDeleted bool
+	}{
+		{
+			name:          "allocated by stackube",
+			description:   floatingIPDescription,
+			exists:        true,
+			expectDeleted: true,
+		},
+		{
+			name:        "created by user",
+			description: "my service IP",
+			exists:      true,
+		},
+		{
+			name:        "created by user without description",
+			description: "",
+			exists:      true,
+		},
+		{
+			name:          "already deleted",
+			expectDeleted: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		client, neutron, stop := newTestClient(t, false)
+		if tc.exists {
+			neutron.add("floatingips", "fip-1", map[string]interface{}{
+				"floating_ip_address": "172.24.4.100",
+				"port_id":             "vip-port",
+				"description":         tc.description,
+			})
+		}
+
+		err := client.releaseFloatingIP(&floatingips.FloatingIP{ID: "fip-1", PortID: "vip-port"})
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		fip := neutron.objects["floatingips"]["fip-1"]
+		switch {
+		case tc.expectDeleted && fip != nil:
+			t.Errorf("%s: expected floating IP to be deleted", tc.name)
+		case !tc.expectDeleted && fip == nil:
+			t.Errorf("%s: expected floating IP to be kept", tc.name)
+		case !tc.expectDeleted && fip["port_id"] != nil:
+			t.Errorf("%s: expected floating IP to be disassociated, got port %v", tc.name, fip["port_id"])
+		}
+	}
+}
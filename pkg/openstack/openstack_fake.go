@@ -45,15 +45,28 @@ type CalledDetail struct {
 // can be run for testing without requiring a real openstack setup.
 type FakeOSClient struct {
 	sync.Mutex
-	called            []CalledDetail
-	errors            map[string]error
-	Tenants           map[string]*tenants.Tenant
-	Users             map[string]*users.User
-	Networks          map[string]*drivertypes.Network
-	Subnets           map[string]*subnets.Subnet
-	Routers           map[string]*routers.Router
-	Ports             map[string][]ports.Port
-	LoadBalancers     map[string]*LoadBalancer
+	called  []CalledDetail
+	errors  map[string]error
+	Tenants map[string]*tenants.Tenant
+	Users   map[string]*users.User
+	// UserPasswords are passwords of users by username.
+	UserPasswords  map[string]string
+	Networks       map[string]*drivertypes.Network
+	Subnets        map[string]*subnets.Subnet
+	Routers        map[string]*routers.Router
+	Ports          map[string][]ports.Port
+	LoadBalancers  map[string]*LoadBalancer
+	SecurityGroups map[string]*SecurityGroup
+	// IngressLoadBalancers are load balancers of ingresses by name.
+	IngressLoadBalancers map[string]*IngressLoadBalancer
+	// PortSecurityGroups are security group IDs of ports by port name.
+	PortSecurityGroups map[string][]string
+	// PodPorts are port names of pods by device ID.
+	PodPorts map[string][]string
+	// TokenIdentities are identities of valid tokens by token.
+	TokenIdentities map[string]*TokenIdentity
+	// CertificateStore is nil unless set by tests, e.g. to a file certificate store.
+	CertificateStore  CertificateStore
 	CRDClient         crdClient.Interface
 	PluginName        string
 	IntegrationBridge string
@@ -64,17 +77,23 @@ var _ = Interface(&FakeOSClient{})
 // NewFake creates a new FakeOSClient.
 func NewFake(crdClient crdClient.Interface) *FakeOSClient {
 	return &FakeOSClient{
-		errors:            make(map[string]error),
-		Tenants:           make(map[string]*tenants.Tenant),
-		Users:             make(map[string]*users.User),
-		Networks:          make(map[string]*drivertypes.Network),
-		Subnets:           make(map[string]*subnets.Subnet),
-		Routers:           make(map[string]*routers.Router),
-		Ports:             make(map[string][]ports.Port),
-		LoadBalancers:     make(map[string]*LoadBalancer),
-		CRDClient:         crdClient,
-		PluginName:        "ovs",
-		IntegrationBridge: "bi-int",
+		errors:               make(map[string]error),
+		Tenants:              make(map[string]*tenants.Tenant),
+		Users:                make(map[string]*users.User),
+		UserPasswords:        make(map[string]string),
+		Networks:             make(map[string]*drivertypes.Network),
+		Subnets:              make(map[string]*subnets.Subnet),
+		Routers:              make(map[string]*routers.Router),
+		Ports:                make(map[string][]ports.Port),
+		LoadBalancers:        make(map[string]*LoadBalancer),
+		SecurityGroups:       make(map[string]*SecurityGroup),
+		IngressLoadBalancers: make(map[string]*IngressLoadBalancer),
+		PortSecurityGroups:   make(map[string][]string),
+		PodPorts:             make(map[string][]string),
+		TokenIdentities:      make(map[string]*TokenIdentity),
+		CRDClient:            crdClient,
+		PluginName:           "ovs",
+		IntegrationBridge:    "bi-int",
 	}
 }
 
@@ -192,6 +211,26 @@ func (f *FakeOSClient) SetLoadbalancer(lb *LoadBalancer) {
 	f.LoadBalancers[lb.Name] = lb
 }
 
+// SetPodPort injects fake port of the pod with its security groups.
+func (f *FakeOSClient) SetPodPort(namespace, podName, portName string, securityGroupIDs []string) {
+	f.Lock()
+	defer f.Unlock()
+
+	deviceID := util.BuildPodDeviceID(namespace, podName)
+	if _, ok := f.PortSecurityGroups[portName]; !ok {
+		f.PodPorts[deviceID] = append(f.PodPorts[deviceID], portName)
+	}
+	f.PortSecurityGroups[portName] = securityGroupIDs
+}
+
+// SetTokenIdentity injects fake token with the identity it's issued to.
+func (f *FakeOSClient) SetTokenIdentity(token string, identity *TokenIdentity) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.TokenIdentities[token] = identity
+}
+
 func tenantIDHash(tenantName string) string {
 	return idHash(tenantName)
 }
@@ -212,6 +251,10 @@ func routerIDHash(routerName string) string {
 	return idHash(routerName)
 }
 
+func securityGroupIDHash(name, tenantID string) string {
+	return idHash(name, tenantID)
+}
+
 func portdeviceIDHash(networkID, deviceOwner string) string {
 	return idHash(networkID, deviceOwner)
 }
@@ -321,6 +364,23 @@ func (f *FakeOSClient) CreateUser(username, password, tenantID string) error {
 		ID:       userIDHash(username, tenantID),
 	}
 	f.Users[tenantID] = user
+	f.UserPasswords[username] = password
+	return nil
+}
+
+// UpdateUserPassword is a test implementation of Interface.UpdateUserPassword.
+func (f *FakeOSClient) UpdateUserPassword(username, password string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("UpdateUserPassword", username, password)
+	if err := f.getError("UpdateUserPassword"); err != nil {
+		return err
+	}
+
+	if _, ok := f.UserPasswords[username]; !ok {
+		return ErrNotFound
+	}
+	f.UserPasswords[username] = password
 	return nil
 }
 
@@ -333,12 +393,28 @@ func (f *FakeOSClient) DeleteAllUsersOnTenant(tenantName string) error {
 		return err
 	}
 
-	tenant := f.Tenants[tenantName]
-
-	delete(f.Users, tenant.ID)
+	if tenant, ok := f.Tenants[tenantName]; ok {
+		delete(f.Users, tenant.ID)
+	}
 	return nil
 }
 
+// AuthenticateToken is a test implementation of Interface.AuthenticateToken.
+func (f *FakeOSClient) AuthenticateToken(token string) (*TokenIdentity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("AuthenticateToken", token)
+	if err := f.getError("AuthenticateToken"); err != nil {
+		return nil, err
+	}
+
+	identity, ok := f.TokenIdentities[token]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return identity, nil
+}
+
 func (f *FakeOSClient) createNetwork(networkName, tenantID string) error {
 	f.Lock()
 	defer f.Unlock()
@@ -462,12 +538,36 @@ func (f *FakeOSClient) CreateNetwork(network *drivertypes.Network) error {
 		return err
 	}
 	// create subnets and connect them to router
-	err = f.createSubnet(network.Subnets[0].Name, network.Uid, network.TenantID)
-	if err != nil {
-		f.deleteRouter(network.Name)
-		f.deleteNetwork(network.Name)
+	networkID := networkIDHash(network.Name)
+	for _, sub := range network.Subnets {
+		err = f.createSubnet(sub.Name, networkID, network.TenantID)
+		if err != nil {
+			for _, s := range network.Subnets {
+				f.deleteSubnet(s.Name)
+			}
+			f.deleteRouter(network.Name)
+			f.deleteNetwork(network.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateNetwork is a test implementation of Interface.UpdateNetwork.
+func (f *FakeOSClient) UpdateNetwork(network *drivertypes.Network) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("UpdateNetwork", network)
+	if err := f.getError("UpdateNetwork"); err != nil {
 		return err
 	}
+
+	net, ok := f.Networks[network.Name]
+	if !ok {
+		return ErrNotFound
+	}
+
+	net.Subnets = network.Subnets
 	return nil
 }
 
@@ -506,18 +606,112 @@ func (f *FakeOSClient) DeleteNetwork(networkName string) error {
 	}
 
 	f.deleteRouter(networkName)
-	f.deleteSubnet(networkName + "-subnet")
+	networkID := networkIDHash(networkName)
+	for name, subnet := range f.Subnets {
+		if subnet.NetworkID == networkID {
+			f.deleteSubnet(name)
+		}
+	}
 	f.deleteNetwork(networkName)
 	return nil
 }
 
+// fakeNetworkID returns the ID of the network by networkName.
+func (f *FakeOSClient) fakeNetworkID(networkName string) string {
+	if network, ok := f.Networks[networkName]; ok && network.Uid != "" {
+		return network.Uid
+	}
+	return networkIDHash(networkName)
+}
+
+// DeleteLoadBalancersOnNetwork is a test implementation of Interface.DeleteLoadBalancersOnNetwork.
+func (f *FakeOSClient) DeleteLoadBalancersOnNetwork(networkName string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("DeleteLoadBalancersOnNetwork", networkName)
+	if err := f.getError("DeleteLoadBalancersOnNetwork"); err != nil {
+		return err
+	}
+
+	subnetIDs := make(map[string]bool)
+	networkID := f.fakeNetworkID(networkName)
+	for _, subnet := range f.Subnets {
+		if subnet.NetworkID == networkID {
+			subnetIDs[subnet.ID] = true
+		}
+	}
+	if network, ok := f.Networks[networkName]; ok {
+		for _, subnet := range network.Subnets {
+			subnetIDs[subnet.Uid] = true
+		}
+	}
+	for name, lb := range f.LoadBalancers {
+		if subnetIDs[lb.SubnetID] {
+			delete(f.LoadBalancers, name)
+		}
+	}
+	return nil
+}
+
+// DeleteFloatingIPsOnNetwork is a test implementation of Interface.DeleteFloatingIPsOnNetwork.
+func (f *FakeOSClient) DeleteFloatingIPsOnNetwork(networkName string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("DeleteFloatingIPsOnNetwork", networkName)
+	if err := f.getError("DeleteFloatingIPsOnNetwork"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeletePortsOnNetwork is a test implementation of Interface.DeletePortsOnNetwork.
+func (f *FakeOSClient) DeletePortsOnNetwork(networkName string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("DeletePortsOnNetwork", networkName)
+	if err := f.getError("DeletePortsOnNetwork"); err != nil {
+		return err
+	}
+
+	networkID := f.fakeNetworkID(networkName)
+	var remained []ports.Port
+	for _, port := range f.Ports[networkID] {
+		if port.DeviceOwner == deviceOwnerRouterInterface {
+			remained = append(remained, port)
+		}
+	}
+	f.Ports[networkID] = remained
+	return nil
+}
+
+// DeleteRouterInterfaces is a test implementation of Interface.DeleteRouterInterfaces.
+func (f *FakeOSClient) DeleteRouterInterfaces(networkName string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("DeleteRouterInterfaces", networkName)
+	if err := f.getError("DeleteRouterInterfaces"); err != nil {
+		return err
+	}
+
+	networkID := f.fakeNetworkID(networkName)
+	var remained []ports.Port
+	for _, port := range f.Ports[networkID] {
+		if port.DeviceOwner != deviceOwnerRouterInterface {
+			remained = append(remained, port)
+		}
+	}
+	f.Ports[networkID] = remained
+	return nil
+}
+
 // GetProviderSubnet is a test implementation of Interface.GetProviderSubnet.
 func (f *FakeOSClient) GetProviderSubnet(osSubnetID string) (*drivertypes.Subnet, error) {
 	return nil, fmt.Errorf("Not implemented")
 }
 
 // CreatePort is a test implementation of Interface.CreatePort.
-func (f *FakeOSClient) CreatePort(networkID, tenantID, portName string) (*portsbinding.Port, error) {
+func (f *FakeOSClient) CreatePort(networkID, tenantID, portName, deviceID string) (*portsbinding.Port, error) {
 	return nil, fmt.Errorf("Not implemented")
 }
 
@@ -549,6 +743,28 @@ func (f *FakeOSClient) ListPorts(networkID, deviceOwner string) ([]ports.Port, e
 	return results, nil
 }
 
+// ListPodPorts is a test implementation of Interface.ListPodPorts.
+func (f *FakeOSClient) ListPodPorts(namespace, podName string) ([]ports.Port, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("ListPodPorts", namespace, podName)
+	if err := f.getError("ListPodPorts"); err != nil {
+		return nil, err
+	}
+
+	deviceID := util.BuildPodDeviceID(namespace, podName)
+	var results []ports.Port
+	for _, portName := range f.PodPorts[deviceID] {
+		results = append(results, ports.Port{
+			ID:             portName,
+			Name:           portName,
+			DeviceID:       deviceID,
+			SecurityGroups: f.PortSecurityGroups[portName],
+		})
+	}
+	return results, nil
+}
+
 // DeletePortByName is a test implementation of Interface.DeletePortByName.
 func (f *FakeOSClient) DeletePortByName(portName string) error {
 	return fmt.Errorf("Not implemented")
@@ -564,6 +780,78 @@ func (f *FakeOSClient) UpdatePortsBinding(portID, deviceOwner string) error {
 	return fmt.Errorf("Not implemented")
 }
 
+// UpdatePortSecurityGroups is a test implementation of Interface.UpdatePortSecurityGroups.
+func (f *FakeOSClient) UpdatePortSecurityGroups(port *ports.Port, securityGroupIDs []string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("UpdatePortSecurityGroups", port.Name, securityGroupIDs)
+	if err := f.getError("UpdatePortSecurityGroups"); err != nil {
+		return err
+	}
+
+	if _, ok := f.PortSecurityGroups[port.Name]; !ok {
+		return ErrNotFound
+	}
+
+	f.PortSecurityGroups[port.Name] = securityGroupIDs
+	return nil
+}
+
+// EnsureSecurityGroup is a test implementation of Interface.EnsureSecurityGroup.
+func (f *FakeOSClient) EnsureSecurityGroup(sg *SecurityGroup) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("EnsureSecurityGroup", sg)
+	if err := f.getError("EnsureSecurityGroup"); err != nil {
+		return "", err
+	}
+
+	f.SecurityGroups[securityGroupIDHash(sg.Name, sg.TenantID)] = sg
+	return securityGroupIDHash(sg.Name, sg.TenantID), nil
+}
+
+// DeleteSecurityGroup is a test implementation of Interface.DeleteSecurityGroup.
+func (f *FakeOSClient) DeleteSecurityGroup(name, tenantID string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("DeleteSecurityGroup", name, tenantID)
+	if err := f.getError("DeleteSecurityGroup"); err != nil {
+		return err
+	}
+
+	delete(f.SecurityGroups, securityGroupIDHash(name, tenantID))
+	return nil
+}
+
+// GetSecurityGroupID is a test implementation of Interface.GetSecurityGroupID.
+func (f *FakeOSClient) GetSecurityGroupID(name, tenantID string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("GetSecurityGroupID", name, tenantID)
+	if err := f.getError("GetSecurityGroupID"); err != nil {
+		return "", err
+	}
+
+	id := securityGroupIDHash(name, tenantID)
+	if _, ok := f.SecurityGroups[id]; !ok {
+		return "", ErrNotFound
+	}
+
+	return id, nil
+}
+
+// GetDefaultSecurityGroupID is a test implementation of Interface.GetDefaultSecurityGroupID.
+func (f *FakeOSClient) GetDefaultSecurityGroupID(tenantID string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("GetDefaultSecurityGroupID", tenantID)
+	if err := f.getError("GetDefaultSecurityGroupID"); err != nil {
+		return "", err
+	}
+
+	return securityGroupIDHash(securitygroupName, tenantID), nil
+}
+
 // LoadBalancerExist is a test implementation of Interface.LoadBalancerExist.
 func (f *FakeOSClient) LoadBalancerExist(name string) (bool, error) {
 	f.Lock()
@@ -573,11 +861,14 @@ func (f *FakeOSClient) LoadBalancerExist(name string) (bool, error) {
 		return false, err
 	}
 
-	if _, ok := f.LoadBalancers[name]; !ok {
-		return false, nil
+	if _, ok := f.LoadBalancers[name]; ok {
+		return true, nil
+	}
+	if _, ok := f.IngressLoadBalancers[name]; ok {
+		return true, nil
 	}
 
-	return true, nil
+	return false, nil
 }
 
 // EnsureLoadBalancer is a test implementation of Interface.EnsureLoadBalancer.
@@ -589,14 +880,51 @@ func (f *FakeOSClient) EnsureLoadBalancer(lb *LoadBalancer) (*LoadBalancerStatus
 		return nil, err
 	}
 
-	f.LoadBalancers[lb.Name] = lb
+	// Allocates a floating IP if not specified, which is kept until the load balancer is deleted.
+	allocated := *lb
+	if allocated.ExternalIP == "" {
+		if old, ok := f.LoadBalancers[lb.Name]; ok {
+			allocated.ExternalIP = old.ExternalIP
+		} else {
+			allocated.ExternalIP = f.allocateExternalIP()
+		}
+	}
+	f.LoadBalancers[lb.Name] = &allocated
+
+	return &LoadBalancerStatus{
+		InternalIP: allocated.InternalIP,
+		ExternalIP: allocated.ExternalIP,
+	}, nil
+}
+
+// EnsureIngressLoadBalancer is a test implementation of Interface.EnsureIngressLoadBalancer.
+func (f *FakeOSClient) EnsureIngressLoadBalancer(lb *IngressLoadBalancer) (*LoadBalancerStatus, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("EnsureIngressLoadBalancer", lb)
+	if err := f.getError("EnsureIngressLoadBalancer"); err != nil {
+		return nil, err
+	}
+
+	allocated := *lb
+	if allocated.ExternalIP == "" {
+		if old, ok := f.IngressLoadBalancers[lb.Name]; ok {
+			allocated.ExternalIP = old.ExternalIP
+		} else {
+			allocated.ExternalIP = f.allocateExternalIP()
+		}
+	}
+	f.IngressLoadBalancers[lb.Name] = &allocated
 
 	return &LoadBalancerStatus{
-		InternalIP: lb.InternalIP,
-		ExternalIP: lb.ExternalIP,
+		ExternalIP: allocated.ExternalIP,
 	}, nil
 }
 
+func (f *FakeOSClient) allocateExternalIP() string {
+	return fmt.Sprintf("172.24.4.%d", len(f.LoadBalancers)+len(f.IngressLoadBalancers)+1)
+}
+
 // EnsureLoadBalancerDeleted is a test implementation of Interface.EnsureLoadBalancerDeleted.
 func (f *FakeOSClient) EnsureLoadBalancerDeleted(name string) error {
 	f.Lock()
@@ -607,9 +935,15 @@ func (f *FakeOSClient) EnsureLoadBalancerDeleted(name string) error {
 	}
 
 	delete(f.LoadBalancers, name)
+	delete(f.IngressLoadBalancers, name)
 	return nil
 }
 
+// GetCertificateStore is a test implementation of Interface.GetCertificateStore.
+func (f *FakeOSClient) GetCertificateStore() CertificateStore {
+	return f.CertificateStore
+}
+
 // GetCRDClient is a test implementation of Interface.GetCRDClient.
 func (f *FakeOSClient) GetCRDClient() crdClient.Interface {
 	return f.CRDClient
@@ -0,0 +1,256 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// SecurityGroup contains all essential information of a security group
+// managed by stackube, e.g. the one translated from a NetworkPolicy.
+type SecurityGroup struct {
+	Name     string
+	TenantID string
+	Rules    []SecurityGroupRule
+}
+
+// SecurityGroupRule is a rule of SecurityGroup. Empty Protocol matches
+// all protocols, zero port range matches all ports.
+type SecurityGroupRule struct {
+	Direction      string
+	EtherType      string
+	Protocol       string
+	PortRangeMin   int
+	PortRangeMax   int
+	RemoteIPPrefix string
+	RemoteGroupID  string
+}
+
+// portSecurityGroupsUpdateOpts only updates security groups of the port,
+// ports.UpdateOpts always resets the allowed address pairs.
+type portSecurityGroupsUpdateOpts struct {
+	SecurityGroups []string `json:"security_groups"`
+}
+
+// ToPortUpdateMap implements ports.UpdateOptsBuilder.
+func (opts portSecurityGroupsUpdateOpts) ToPortUpdateMap() (map[string]interface{}, error) {
+	return gophercloud.BuildRequestBody(opts, "port")
+}
+
+func ruleFromOSRule(r rules.SecGroupRule) SecurityGroupRule {
+	return SecurityGroupRule{
+		Direction:      r.Direction,
+		EtherType:      r.EtherType,
+		Protocol:       r.Protocol,
+		PortRangeMin:   r.PortRangeMin,
+		PortRangeMax:   r.PortRangeMax,
+		RemoteIPPrefix: r.RemoteIPPrefix,
+		RemoteGroupID:  r.RemoteGroupID,
+	}
+}
+
+func (os *Client) getSecurityGroupByName(name, tenantID string) (*groups.SecGroup, error) {
+	var result *groups.SecGroup
+
+	opts := groups.ListOpts{
+		TenantID: tenantID,
+		Name:     name,
+	}
+	pager := groups.List(os.Network, opts)
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		sg, err := groups.ExtractGroups(page)
+		if err != nil {
+			glog.Errorf("Get openstack securitygroups error: %v", err)
+			return false, err
+		}
+
+		if len(sg) > 1 {
+			return false, ErrMultipleResults
+		} else if len(sg) == 1 {
+			result = &sg[0]
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, ErrNotFound
+	}
+
+	return result, nil
+}
+
+// GetSecurityGroupID gets the ID of security group by name in the tenant.
+func (os *Client) GetSecurityGroupID(name, tenantID string) (string, error) {
+	sg, err := os.getSecurityGroupByName(name, tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	return sg.ID, nil
+}
+
+// GetDefaultSecurityGroupID gets the ID of the allow-all security group of the tenant,
+// which is used by pods not isolated by any NetworkPolicy. It's created if not exists.
+func (os *Client) GetDefaultSecurityGroupID(tenantID string) (string, error) {
+	return os.ensureSecurityGroup(tenantID)
+}
+
+// EnsureSecurityGroup ensures the security group exists and contains exactly
+// the rules of sg, missing rules are created and obsolete rules are deleted.
+func (os *Client) EnsureSecurityGroup(sg *SecurityGroup) (string, error) {
+	securitygroup, err := os.getSecurityGroupByName(sg.Name, sg.TenantID)
+	if err == ErrNotFound {
+		securitygroup, err = groups.Create(os.Network, groups.CreateOpts{
+			Name:        sg.Name,
+			TenantID:    sg.TenantID,
+			Description: "stackube",
+		}).Extract()
+		if err != nil {
+			glog.Errorf("Create openstack securitygroup %s failed: %v", sg.Name, err)
+			return "", err
+		}
+		glog.V(4).Infof("Securitygroup %s created", sg.Name)
+	} else if err != nil {
+		return "", err
+	}
+
+	// Neutron adds default egress rules to new groups, they are treated
+	// as other rules and deleted if not wanted.
+	wanted := make(map[SecurityGroupRule]bool)
+	for _, r := range sg.Rules {
+		wanted[r] = true
+	}
+
+	existing := make(map[SecurityGroupRule]bool)
+	listopts := rules.ListOpts{SecGroupID: securitygroup.ID}
+	err = rules.List(os.Network, listopts).EachPage(func(page pagination.Page) (bool, error) {
+		ruleList, err := rules.ExtractRules(page)
+		if err != nil {
+			glog.Errorf("Get openstack securitygroup rules error: %v", err)
+			return false, err
+		}
+
+		for _, r := range ruleList {
+			rule := ruleFromOSRule(r)
+			if wanted[rule] && !existing[rule] {
+				existing[rule] = true
+				continue
+			}
+
+			err = rules.Delete(os.Network, r.ID).ExtractErr()
+			if err != nil && !isNotFound(err) {
+				glog.Errorf("Delete openstack securitygroup rule %s failed: %v", r.ID, err)
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range sg.Rules {
+		if existing[r] {
+			continue
+		}
+
+		_, err = rules.Create(os.Network, rules.CreateOpts{
+			TenantID:       sg.TenantID,
+			SecGroupID:     securitygroup.ID,
+			Direction:      rules.RuleDirection(r.Direction),
+			EtherType:      rules.RuleEtherType(r.EtherType),
+			Protocol:       rules.RuleProtocol(r.Protocol),
+			PortRangeMin:   r.PortRangeMin,
+			PortRangeMax:   r.PortRangeMax,
+			RemoteIPPrefix: r.RemoteIPPrefix,
+			RemoteGroupID:  r.RemoteGroupID,
+		}).Extract()
+		if err != nil && !IsAlreadyExists(err) {
+			glog.Errorf("Create openstack securitygroup rule for %s failed: %v", sg.Name, err)
+			return "", err
+		}
+		existing[r] = true
+	}
+
+	return securitygroup.ID, nil
+}
+
+// DeleteSecurityGroup deletes security group by name in the tenant.
+func (os *Client) DeleteSecurityGroup(name, tenantID string) error {
+	sg, err := os.getSecurityGroupByName(name, tenantID)
+	if err == ErrNotFound {
+		glog.V(4).Infof("Securitygroup %s already deleted", name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = groups.Delete(os.Network, sg.ID).ExtractErr()
+	if err != nil && !isNotFound(err) {
+		glog.Errorf("Delete openstack securitygroup %s failed: %v", name, err)
+		return err
+	}
+
+	return nil
+}
+
+// UpdatePortSecurityGroups replaces security groups of the port.
+func (os *Client) UpdatePortSecurityGroups(port *ports.Port, securityGroupIDs []string) error {
+	if securityGroupsEqual(port.SecurityGroups, securityGroupIDs) {
+		return nil
+	}
+
+	opts := portSecurityGroupsUpdateOpts{SecurityGroups: securityGroupIDs}
+	_, err := ports.Update(os.Network, port.ID, opts).Extract()
+	if err != nil {
+		glog.Errorf("Update securitygroups of port %s failed: %v", port.Name, err)
+		return fmt.Errorf("update securitygroups of port %s failed: %v", port.Name, err)
+	}
+
+	glog.V(4).Infof("Securitygroups of port %s updated to %v", port.Name, securityGroupIDs)
+	return nil
+}
+
+func securityGroupsEqual(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+
+	set := make(map[string]bool)
+	for _, id := range x {
+		set[id] = true
+	}
+	for _, id := range y {
+		if !set[id] {
+			return false
+		}
+	}
+
+	return true
+}
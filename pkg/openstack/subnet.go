@@ -0,0 +1,318 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+)
+
+// subnetUpdateOpts always sends DNS nameservers and host routes, so that they
+// could be cleared, which is not possible with subnets.UpdateOpts.
+type subnetUpdateOpts struct {
+	GatewayIP       *string                  `json:"gateway_ip,omitempty"`
+	AllocationPools []subnets.AllocationPool `json:"allocation_pools,omitempty"`
+	DNSNameservers  []string                 `json:"dns_nameservers"`
+	HostRoutes      []subnets.HostRoute      `json:"host_routes"`
+	EnableDHCP      *bool                    `json:"enable_dhcp,omitempty"`
+}
+
+// ToSubnetUpdateMap implements subnets.UpdateOptsBuilder.
+func (opts subnetUpdateOpts) ToSubnetUpdateMap() (map[string]interface{}, error) {
+	return gophercloud.BuildRequestBody(opts, "subnet")
+}
+
+// subnetCreateOpts adds IPv6 modes to subnets.CreateOpts.
+type subnetCreateOpts struct {
+	subnets.CreateOpts
+	IPv6AddressMode string
+	IPv6RAMode      string
+}
+
+// ToSubnetCreateMap implements subnets.CreateOptsBuilder.
+func (opts subnetCreateOpts) ToSubnetCreateMap() (map[string]interface{}, error) {
+	b, err := opts.CreateOpts.ToSubnetCreateMap()
+	if err != nil {
+		return nil, err
+	}
+
+	m := b["subnet"].(map[string]interface{})
+	if opts.IPv6AddressMode != "" {
+		m["ipv6_address_mode"] = opts.IPv6AddressMode
+	}
+	if opts.IPv6RAMode != "" {
+		m["ipv6_ra_mode"] = opts.IPv6RAMode
+	}
+
+	return b, nil
+}
+
+// getIPVersion returns the IP version of sub, which is derived from its CIDR if not set.
+func getIPVersion(sub *drivertypes.Subnet) gophercloud.IPVersion {
+	if sub.IPVersion == 6 {
+		return gophercloud.IPv6
+	}
+	if sub.IPVersion == 0 {
+		ip, _, err := net.ParseCIDR(sub.Cidr)
+		if err == nil && ip.To4() == nil {
+			return gophercloud.IPv6
+		}
+	}
+
+	return gophercloud.IPv4
+}
+
+// VIPSubnet returns the subnet of the network VIPs of load balancers are allocated
+// from, which is the primary IPv4 subnet "<network>-subnet", or the first IPv4
+// subnet of networks without it.
+func VIPSubnet(network *drivertypes.Network) (*drivertypes.Subnet, error) {
+	var result *drivertypes.Subnet
+	for _, s := range network.Subnets {
+		if getIPVersion(s) != gophercloud.IPv4 {
+			continue
+		}
+		if s.Name == network.Name+"-subnet" {
+			return s, nil
+		}
+		if result == nil {
+			result = s
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("network %s has no IPv4 subnet", network.Name)
+	}
+
+	return result, nil
+}
+
+// memberSubnetID returns the ID of the subnet containing address, or defaultID if
+// none of the subnets contains it.
+func memberSubnetID(address, defaultID string, subnets []*drivertypes.Subnet) string {
+	ip := net.ParseIP(address)
+	for _, s := range subnets {
+		_, cidr, err := net.ParseCIDR(s.Cidr)
+		if err == nil && ip != nil && cidr.Contains(ip) {
+			return s.Uid
+		}
+	}
+
+	return defaultID
+}
+
+// createSubnet creates subnet in the network and connects it to router.
+func (os *Client) createSubnet(networkID, routerID, tenantID string, sub *drivertypes.Subnet) (*subnets.Subnet, error) {
+	subnetOpts := subnetCreateOpts{
+		CreateOpts: subnets.CreateOpts{
+			NetworkID:       networkID,
+			CIDR:            sub.Cidr,
+			Name:            sub.Name,
+			IPVersion:       getIPVersion(sub),
+			TenantID:        tenantID,
+			DNSNameservers:  sub.Dnsservers,
+			HostRoutes:      toHostRoutes(sub.Routes),
+			AllocationPools: toAllocationPools(sub.Pools, sub.Cidr),
+			EnableDHCP:      &sub.EnableDHCP,
+		},
+	}
+	if subnetOpts.IPVersion == gophercloud.IPv6 {
+		subnetOpts.IPv6AddressMode = sub.IPv6AddressMode
+		subnetOpts.IPv6RAMode = sub.IPv6RAMode
+	}
+	// Neutron picks the first IP of the CIDR if gateway is not set.
+	if sub.Gateway != "" {
+		subnetOpts.GatewayIP = &sub.Gateway
+	}
+	s, err := subnets.Create(os.Network, subnetOpts).Extract()
+	if err != nil {
+		glog.Errorf("Create openstack subnet %s failed: %v", sub.Name, err)
+		return nil, err
+	}
+
+	// add subnet to router
+	opts := routers.AddInterfaceOpts{
+		SubnetID: s.ID,
+	}
+	_, err = routers.AddInterface(os.Network, routerID, opts).Extract()
+	if err != nil {
+		glog.Errorf("Add openstack subnet %s to router %s failed: %v", sub.Name, routerID, err)
+		delErr := subnets.Delete(os.Network, s.ID).ExtractErr()
+		if delErr != nil {
+			glog.Errorf("Delete openstack subnet %s failed: %v", s.ID, delErr)
+		}
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// updateSubnet updates gateway, DNS nameservers, host routes, allocation pools and DHCP of subnet s.
+func (os *Client) updateSubnet(routerID string, s *subnets.Subnet, sub *drivertypes.Subnet) error {
+	opts := subnetUpdateOpts{
+		DNSNameservers:  make([]string, 0, len(sub.Dnsservers)),
+		HostRoutes:      toHostRoutes(sub.Routes),
+		AllocationPools: toAllocationPools(sub.Pools, s.CIDR),
+		EnableDHCP:      &sub.EnableDHCP,
+	}
+	opts.DNSNameservers = append(opts.DNSNameservers, sub.Dnsservers...)
+	if opts.HostRoutes == nil {
+		opts.HostRoutes = []subnets.HostRoute{}
+	}
+
+	gatewayChanged := sub.Gateway != "" && sub.Gateway != s.GatewayIP
+	if gatewayChanged {
+		opts.GatewayIP = &sub.Gateway
+
+		// The old gateway is held by the router interface, so the interface
+		// must be removed before changing gateway.
+		_, err := routers.RemoveInterface(os.Network, routerID, routers.RemoveInterfaceOpts{SubnetID: s.ID}).Extract()
+		if err != nil {
+			glog.Errorf("Remove openstack subnet %s from router %s failed: %v", s.Name, routerID, err)
+			return err
+		}
+	}
+
+	_, err := subnets.Update(os.Network, s.ID, opts).Extract()
+	if err != nil {
+		glog.Errorf("Update openstack subnet %s failed: %v", s.Name, err)
+	}
+
+	if gatewayChanged {
+		// Always connect the subnet back to router, even if update failed.
+		_, addErr := routers.AddInterface(os.Network, routerID, routers.AddInterfaceOpts{SubnetID: s.ID}).Extract()
+		if addErr != nil {
+			glog.Errorf("Add openstack subnet %s to router %s failed: %v", s.Name, routerID, addErr)
+			if err == nil {
+				err = addErr
+			}
+		}
+	}
+
+	return err
+}
+
+// expandSubnet expands subnet s to the CIDR of sub, by creating subnets for the
+// rest of the new CIDR. They are named with an index suffix, e.g. "<name>-1".
+// Existing expansion subnets are updated with the changes of sub except gateway.
+func (os *Client) expandSubnet(networkID, routerID, tenantID string, s *subnets.Subnet, sub *drivertypes.Subnet, existingSubnets map[string]*subnets.Subnet) error {
+	_, oldCIDR, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return err
+	}
+	_, newCIDR, err := net.ParseCIDR(sub.Cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %v", sub.Cidr, err)
+	}
+
+	oldSize, _ := oldCIDR.Mask.Size()
+	newSize, _ := newCIDR.Mask.Size()
+	if newSize > oldSize || !newCIDR.Contains(oldCIDR.IP) {
+		return fmt.Errorf("CIDR of subnet %s can only be expanded, but %s doesn't contain %s", s.Name, sub.Cidr, s.CIDR)
+	}
+
+	for i, block := range subtractCIDR(newCIDR, oldCIDR) {
+		// The gateway of sub is in the CIDR of s, expansion subnets keep the
+		// gateway picked by Neutron.
+		expansion := &drivertypes.Subnet{
+			Name:            fmt.Sprintf("%s-%d", sub.Name, i+1),
+			Cidr:            block.String(),
+			Dnsservers:      sub.Dnsservers,
+			Routes:          sub.Routes,
+			Pools:           sub.Pools,
+			EnableDHCP:      sub.EnableDHCP,
+			IPVersion:       sub.IPVersion,
+			IPv6AddressMode: sub.IPv6AddressMode,
+			IPv6RAMode:      sub.IPv6RAMode,
+		}
+		if existing, ok := existingSubnets[expansion.Name]; ok {
+			if err := os.updateSubnet(routerID, existing, expansion); err != nil {
+				return err
+			}
+			continue
+		}
+
+		glog.V(4).Infof("Expanding subnet %s with %s", s.Name, block.String())
+		if _, err := os.createSubnet(networkID, routerID, tenantID, expansion); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// subtractCIDR returns the CIDRs which cover outer except inner, inner must be within outer.
+func subtractCIDR(outer, inner *net.IPNet) []*net.IPNet {
+	outerSize, bits := outer.Mask.Size()
+	innerSize, _ := inner.Mask.Size()
+
+	var result []*net.IPNet
+	for size := innerSize; size > outerSize; size-- {
+		mask := net.CIDRMask(size, bits)
+		ip := inner.IP.Mask(mask)
+		// The sibling block differs from inner at the last bit of the prefix.
+		bit := size - 1
+		ip[bit/8] ^= 0x80 >> uint(bit%8)
+		result = append(result, &net.IPNet{IP: ip, Mask: mask})
+	}
+
+	return result
+}
+
+func toHostRoutes(routes []*drivertypes.Route) []subnets.HostRoute {
+	var result []subnets.HostRoute
+	for _, r := range routes {
+		result = append(result, subnets.HostRoute{
+			DestinationCIDR: r.DestinationCIDR,
+			NextHop:         r.Nexthop,
+		})
+	}
+
+	return result
+}
+
+// toAllocationPools returns the pools within cidr, pools whose start is after
+// their end are ignored.
+func toAllocationPools(pools []*drivertypes.AllocationPool, cidr string) []subnets.AllocationPool {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+
+	var result []subnets.AllocationPool
+	for _, p := range pools {
+		start, end := net.ParseIP(p.Start), net.ParseIP(p.End)
+		if start == nil || end == nil || !ipNet.Contains(start) || !ipNet.Contains(end) {
+			continue
+		}
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			continue
+		}
+		result = append(result, subnets.AllocationPool{
+			Start: p.Start,
+			End:   p.End,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+)
+
+func TestToAllocationPools(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pools    []*drivertypes.AllocationPool
+		expected []subnets.AllocationPool
+	}{
+		{
+			name:     "pool within CIDR",
+			pools:    []*drivertypes.AllocationPool{{Start: "10.0.0.10", End: "10.0.0.20"}},
+			expected: []subnets.AllocationPool{{Start: "10.0.0.10", End: "10.0.0.20"}},
+		},
+		{
+			name:  "pool of another CIDR",
+			pools: []*drivertypes.AllocationPool{{Start: "10.0.1.10", End: "10.0.1.20"}},
+		},
+		{
+			name:  "pool ending outside CIDR",
+			pools: []*drivertypes.AllocationPool{{Start: "10.0.0.10", End: "10.0.1.20"}},
+		},
+		{
+			name:  "pool starting after its end",
+			pools: []*drivertypes.AllocationPool{{Start: "10.0.0.20", End: "10.0.0.10"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		pools := toAllocationPools(tc.pools, "10.0.0.0/24")
+		if !reflect.DeepEqual(pools, tc.expected) {
+			t.Errorf("%s: expected pools %v, got %v", tc.name, tc.expected, pools)
+		}
+	}
+}
+
+func TestVIPSubnet(t *testing.T) {
+	primary := &drivertypes.Subnet{Name: "net-subnet", Uid: "primary", Cidr: "10.0.0.0/24"}
+	expansion := &drivertypes.Subnet{Name: "net-subnet-1", Uid: "expansion", Cidr: "10.0.1.0/24"}
+	ipv6 := &drivertypes.Subnet{Name: "net-v6-subnet", Uid: "ipv6", Cidr: "fd00::/64", IPVersion: 6}
+	testCases := []struct {
+		name      string
+		subnets   []*drivertypes.Subnet
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "primary subnet after others",
+			subnets:  []*drivertypes.Subnet{ipv6, expansion, primary},
+			expected: "primary",
+		},
+		{
+			name:     "first IPv4 subnet without primary subnet",
+			subnets:  []*drivertypes.Subnet{ipv6, expansion},
+			expected: "expansion",
+		},
+		{
+			name:      "no IPv4 subnet",
+			subnets:   []*drivertypes.Subnet{ipv6},
+			expectErr: true,
+		},
+		{
+			name:      "no subnet",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		subnet, err := VIPSubnet(&drivertypes.Network{Name: "net", Subnets: tc.subnets})
+		if tc.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.expectErr, err)
+			continue
+		}
+		if err == nil && subnet.Uid != tc.expected {
+			t.Errorf("%s: expected subnet %s, got %s", tc.name, tc.expected, subnet.Uid)
+		}
+	}
+}
+
+func TestExpandSubnetUpdatesExpansions(t *testing.T) {
+	neutron := newFakeNeutron()
+	neutron.add("subnets", "subnet-1", map[string]interface{}{
+		"name":            "net-subnet-1",
+		"cidr":            "10.0.1.0/24",
+		"gateway_ip":      "10.0.1.1",
+		"dns_nameservers": []string{"8.8.8.8"},
+	})
+	server := httptest.NewServer(neutron)
+	defer server.Close()
+	client := &Client{Network: newTestServiceClient(server)}
+
+	s := &subnets.Subnet{ID: "subnet-0", Name: "net-subnet", CIDR: "10.0.0.0/24", GatewayIP: "10.0.0.1"}
+	sub := &drivertypes.Subnet{
+		Name:       "net-subnet",
+		Cidr:       "10.0.0.0/23",
+		Gateway:    "10.0.0.1",
+		Dnsservers: []string{"1.1.1.1"},
+		Routes:     []*drivertypes.Route{{DestinationCIDR: "192.168.0.0/24", Nexthop: "10.0.0.254"}},
+		Pools:      []*drivertypes.AllocationPool{{Start: "10.0.1.10", End: "10.0.1.20"}},
+		EnableDHCP: true,
+	}
+	existingSubnets := map[string]*subnets.Subnet{
+		"net-subnet-1": {ID: "subnet-1", Name: "net-subnet-1", CIDR: "10.0.1.0/24", GatewayIP: "10.0.1.1"},
+	}
+	if err := client.expandSubnet("net", "router", "tenant", s, sub, existingSubnets); err != nil {
+		t.Fatalf("Failed expand subnet: %v", err)
+	}
+
+	// The existing expansion subnet gets the spec changes but keeps its gateway.
+	expansion := neutron.objects["subnets"]["subnet-1"]
+	if !reflect.DeepEqual(expansion["dns_nameservers"], []interface{}{"1.1.1.1"}) {
+		t.Errorf("Expected DNS nameservers of expansion subnet to be updated, got %v", expansion["dns_nameservers"])
+	}
+	expectedRoutes := []interface{}{map[string]interface{}{"destination": "192.168.0.0/24", "nexthop": "10.0.0.254"}}
+	if !reflect.DeepEqual(expansion["host_routes"], expectedRoutes) {
+		t.Errorf("Expected host routes %v, got %v", expectedRoutes, expansion["host_routes"])
+	}
+	expectedPools := []interface{}{map[string]interface{}{"start": "10.0.1.10", "end": "10.0.1.20"}}
+	if !reflect.DeepEqual(expansion["allocation_pools"], expectedPools) {
+		t.Errorf("Expected allocation pools %v, got %v", expectedPools, expansion["allocation_pools"])
+	}
+	if expansion["gateway_ip"] != "10.0.1.1" {
+		t.Errorf("Expected gateway of expansion subnet to be kept, got %v", expansion["gateway_ip"])
+	}
+	expectedRequests := []string{"PUT /subnets/subnet-1"}
+	if !reflect.DeepEqual(neutron.requests, expectedRequests) {
+		t.Errorf("Expected requests %v, got %v", expectedRequests, neutron.requests)
+	}
+}
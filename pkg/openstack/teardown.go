@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+const (
+	// deviceOwnerRouterInterface is the device owner of ports attaching subnets to routers.
+	deviceOwnerRouterInterface = "network:router_interface"
+)
+
+// The methods below tear down the resources on a network step by step. Each of
+// them is idempotent and returns nil if the network doesn't exist, so that an
+// interrupted teardown could be resumed.
+
+// getNetworkForTeardown gets the network by name, it returns nil if the network
+// is already deleted.
+func (os *Client) getNetworkForTeardown(networkName string) (*networks.Network, error) {
+	osNetwork, err := os.getOpenStackNetworkByName(networkName)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting network %s: %v", networkName, err)
+	}
+	return osNetwork, nil
+}
+
+// listNetworkPorts lists all ports on the network.
+func (os *Client) listNetworkPorts(networkID string) ([]ports.Port, error) {
+	var result []ports.Port
+	err := ports.List(os.Network, ports.ListOpts{NetworkID: networkID}).EachPage(func(page pagination.Page) (bool, error) {
+		portList, err := ports.ExtractPorts(page)
+		if err != nil {
+			return false, err
+		}
+		result = append(result, portList...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing ports of network %s: %v", networkID, err)
+	}
+	return result, nil
+}
+
+// DeleteLoadBalancersOnNetwork deletes the load balancers whose VIPs are on the
+// subnets of the network.
+func (os *Client) DeleteLoadBalancersOnNetwork(networkName string) error {
+	osNetwork, err := os.getNetworkForTeardown(networkName)
+	if err != nil || osNetwork == nil {
+		return err
+	}
+
+	for _, subnetID := range osNetwork.Subnets {
+		var lbList []loadbalancers.LoadBalancer
+		opts := loadbalancers.ListOpts{VipSubnetID: subnetID}
+		err := loadbalancers.List(os.LoadBalancer, opts).EachPage(func(page pagination.Page) (bool, error) {
+			lbs, err := loadbalancers.ExtractLoadBalancers(page)
+			if err != nil {
+				return false, err
+			}
+			lbList = append(lbList, lbs...)
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error listing load balancers on subnet %s: %v", subnetID, err)
+		}
+
+		for i := range lbList {
+			if err := os.deleteLoadBalancer(&lbList[i]); err != nil {
+				return fmt.Errorf("error deleting load balancer %s: %v", lbList[i].Name, err)
+			}
+			glog.V(4).Infof("Load balancer %s on network %s deleted", lbList[i].Name, networkName)
+		}
+	}
+
+	return nil
+}
+
+// DeleteFloatingIPsOnNetwork releases the floating IPs associated with ports on
+// the network.
+func (os *Client) DeleteFloatingIPsOnNetwork(networkName string) error {
+	osNetwork, err := os.getNetworkForTeardown(networkName)
+	if err != nil || osNetwork == nil {
+		return err
+	}
+
+	portList, err := os.listNetworkPorts(osNetwork.ID)
+	if err != nil {
+		return err
+	}
+	for _, port := range portList {
+		var fipList []floatingips.FloatingIP
+		opts := floatingips.ListOpts{PortID: port.ID}
+		err := floatingips.List(os.Network, opts).EachPage(func(page pagination.Page) (bool, error) {
+			fips, err := floatingips.ExtractFloatingIPs(page)
+			if err != nil {
+				return false, err
+			}
+			fipList = append(fipList, fips...)
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error listing floating ips of port %s: %v", port.ID, err)
+		}
+
+		for i := range fipList {
+			if err := os.releaseFloatingIP(&fipList[i]); err != nil {
+				return err
+			}
+			glog.V(4).Infof("Floating ip %s of port %s released", fipList[i].FloatingIP, port.ID)
+		}
+	}
+
+	return nil
+}
+
+// DeletePortsOnNetwork deletes the ports on the network except router interfaces.
+func (os *Client) DeletePortsOnNetwork(networkName string) error {
+	osNetwork, err := os.getNetworkForTeardown(networkName)
+	if err != nil || osNetwork == nil {
+		return err
+	}
+
+	portList, err := os.listNetworkPorts(osNetwork.ID)
+	if err != nil {
+		return err
+	}
+	for _, port := range portList {
+		if port.DeviceOwner == deviceOwnerRouterInterface {
+			continue
+		}
+
+		err := ports.Delete(os.Network, port.ID).ExtractErr()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error deleting port %s: %v", port.ID, err)
+		}
+		glog.V(4).Infof("Port %s on network %s deleted", port.ID, networkName)
+	}
+
+	return nil
+}
+
+// DeleteRouterInterfaces removes the subnets of the network from the router of
+// the network.
+func (os *Client) DeleteRouterInterfaces(networkName string) error {
+	osNetwork, err := os.getNetworkForTeardown(networkName)
+	if err != nil || osNetwork == nil {
+		return err
+	}
+
+	router, err := os.getRouterByName(networkName)
+	if err != nil {
+		return fmt.Errorf("error getting router %s: %v", networkName, err)
+	}
+	if router == nil {
+		return nil
+	}
+
+	portList, err := os.listNetworkPorts(osNetwork.ID)
+	if err != nil {
+		return err
+	}
+	for _, port := range portList {
+		if port.DeviceOwner != deviceOwnerRouterInterface || port.DeviceID != router.ID {
+			continue
+		}
+
+		opts := routers.RemoveInterfaceOpts{PortID: port.ID}
+		_, err := routers.RemoveInterface(os.Network, router.ID, opts).Extract()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error removing interface %s from router %s: %v", port.ID, networkName, err)
+		}
+		glog.V(4).Infof("Interface %s removed from router %s", port.ID, networkName)
+	}
+
+	return nil
+}
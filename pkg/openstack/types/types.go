@@ -36,6 +36,18 @@ type Subnet struct {
 	Tenantid   string
 	Dnsservers []string
 	Routes     []*Route
+	Pools      []*AllocationPool
+	EnableDHCP bool
+	// IPVersion is 4 or 6, derived from Cidr if not set.
+	IPVersion       int
+	IPv6AddressMode string
+	IPv6RAMode      string
+}
+
+// AllocationPool is a range of IPs allocated from a subnet.
+type AllocationPool struct {
+	Start string
+	End   string
 }
 
 // Route is a representation of an advanced routing rule.
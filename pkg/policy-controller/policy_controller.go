@@ -0,0 +1,462 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	informersV1 "k8s.io/client-go/informers/core/v1"
+	networkinginformers "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+	"github.com/golang/glog"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+
+	concurrentPolicySyncs = 1
+	concurrentPodSyncs    = 1
+)
+
+// Controller translates NetworkPolicy objects to Neutron security groups and keeps
+// security groups of pod ports in sync with NetworkPolicies, pod and namespace labels.
+//
+// Each policy is translated to a security group with its rules, which is attached to
+// the pods selected by the policy in place of the tenant's allow-all security group,
+// and a security group without rules for each peer of its ingress rules, which is
+// attached to the pods selected by the peer and used as remote group of the rules.
+type Controller struct {
+	kubeClient        kubernetes.Interface
+	osClient          openstack.Interface
+	factory           informers.SharedInformerFactory
+	policyInformer    networkinginformers.NetworkPolicyInformer
+	podInformer       informersV1.PodInformer
+	namespaceInformer informersV1.NamespaceInformer
+
+	// policies and pods that need to be synced
+	policyQueue workqueue.RateLimitingInterface
+	podQueue    workqueue.RateLimitingInterface
+
+	mu sync.Mutex // protects policyGroups
+	// policyGroups holds names of security groups managed for each policy.
+	policyGroups map[string][]string
+}
+
+// NewPolicyController returns a new NetworkPolicy controller.
+func NewPolicyController(kubeClient kubernetes.Interface, osClient openstack.Interface) (*Controller, error) {
+	factory := informers.NewSharedInformerFactory(kubeClient, resyncPeriod)
+	c := &Controller{
+		kubeClient:        kubeClient,
+		osClient:          osClient,
+		factory:           factory,
+		policyInformer:    factory.Networking().V1().NetworkPolicies(),
+		podInformer:       factory.Core().V1().Pods(),
+		namespaceInformer: factory.Core().V1().Namespaces(),
+		policyQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "networkpolicy"),
+		podQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "networkpolicy-pod"),
+		policyGroups:      make(map[string][]string),
+	}
+
+	c.policyInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePolicy,
+		UpdateFunc: func(old, cur interface{}) {
+			oldPolicy := old.(*networkingv1.NetworkPolicy)
+			curPolicy := cur.(*networkingv1.NetworkPolicy)
+			if reflect.DeepEqual(oldPolicy.Spec, curPolicy.Spec) {
+				return
+			}
+			// Pods selected by the old spec may need to leave the groups.
+			c.enqueuePodsForPolicy(oldPolicy)
+			c.enqueuePolicy(cur)
+		},
+		DeleteFunc: c.onPolicyDelete,
+	})
+
+	c.podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePod,
+		UpdateFunc: func(old, cur interface{}) {
+			oldPod := old.(*v1.Pod)
+			curPod := cur.(*v1.Pod)
+			// Pod's ports are created by kubestack before it gets IP.
+			if oldPod.Status.PodIP != curPod.Status.PodIP || !reflect.DeepEqual(oldPod.Labels, curPod.Labels) {
+				c.enqueuePod(cur)
+			}
+		},
+	})
+
+	c.namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			oldNamespace := old.(*v1.Namespace)
+			curNamespace := cur.(*v1.Namespace)
+			if !reflect.DeepEqual(oldNamespace.Labels, curNamespace.Labels) {
+				c.enqueuePodsInNamespace(curNamespace.Name)
+			}
+		},
+	})
+
+	return c, nil
+}
+
+// Run starts workers which sync NetworkPolicies and pods.
+func (c *Controller) Run(stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.policyQueue.ShutDown()
+	defer c.podQueue.ShutDown()
+
+	glog.Info("Starting network policy controller")
+	defer glog.Info("Shutting down network policy controller")
+
+	go c.factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.policyInformer.Informer().HasSynced,
+		c.podInformer.Informer().HasSynced, c.namespaceInformer.Informer().HasSynced) {
+		return fmt.Errorf("failed to cache network policies, pods and namespaces")
+	}
+
+	for i := 0; i < concurrentPolicySyncs; i++ {
+		go wait.Until(c.policyWorker, time.Second, stopCh)
+	}
+	for i := 0; i < concurrentPodSyncs; i++ {
+		go wait.Until(c.podWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	return nil
+}
+
+func (c *Controller) enqueuePolicy(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", obj, err)
+		return
+	}
+	c.policyQueue.Add(key)
+}
+
+func (c *Controller) enqueuePod(obj interface{}) {
+	pod := obj.(*v1.Pod)
+	if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", obj, err)
+		return
+	}
+	c.podQueue.Add(key)
+}
+
+func (c *Controller) enqueuePodsInNamespace(namespace string) {
+	pods, err := c.podInformer.Lister().Pods(namespace).List(labels.Everything())
+	if err != nil {
+		glog.Errorf("List pods in namespace %s failed: %v", namespace, err)
+		return
+	}
+
+	for _, pod := range pods {
+		c.enqueuePod(pod)
+	}
+}
+
+// enqueuePodsForPolicy enqueues all pods which may be selected by policy or its peers.
+func (c *Controller) enqueuePodsForPolicy(policy *networkingv1.NetworkPolicy) {
+	if !hasNamespaceSelector(policy) {
+		c.enqueuePodsInNamespace(policy.Namespace)
+		return
+	}
+
+	c.enqueuePodsInNamespace(v1.NamespaceAll)
+}
+
+func (c *Controller) onPolicyDelete(obj interface{}) {
+	policy, ok := obj.(*networkingv1.NetworkPolicy)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Warningf("Receiving an unkown object: %v", obj)
+			return
+		}
+		policy, ok = tombstone.Obj.(*networkingv1.NetworkPolicy)
+		if !ok {
+			glog.Warningf("Tombstone contains an unkown object: %v", tombstone.Obj)
+			return
+		}
+	}
+
+	// Remember the groups, so that they could be deleted even if the policy
+	// was not synced by this controller.
+	key, err := cache.MetaNamespaceKeyFunc(policy)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", policy, err)
+		return
+	}
+	c.mu.Lock()
+	c.policyGroups[key] = getGroupNames(policy)
+	c.mu.Unlock()
+
+	c.enqueuePodsForPolicy(policy)
+	c.policyQueue.Add(key)
+}
+
+func (c *Controller) policyWorker() {
+	for c.processNextItem(c.policyQueue, c.syncPolicy) {
+	}
+}
+
+func (c *Controller) podWorker() {
+	for c.processNextItem(c.podQueue, c.syncPod) {
+	}
+}
+
+func (c *Controller) processNextItem(queue workqueue.RateLimitingInterface, sync func(string) error) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	if err := sync(key.(string)); err != nil {
+		glog.Errorf("Error syncing %q (will retry): %v", key, err)
+		queue.AddRateLimited(key)
+		return true
+	}
+
+	queue.Forget(key)
+	return true
+}
+
+// syncPolicy ensures security groups of the NetworkPolicy with the given key.
+func (c *Controller) syncPolicy(key string) error {
+	startTime := time.Now()
+	defer func() {
+		glog.V(4).Infof("Finished syncing network policy %q (%v)", key, time.Now().Sub(startTime))
+	}()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	tenantID, err := c.osClient.GetTenantIDFromName(namespace)
+	if err != nil {
+		return fmt.Errorf("get tenant of namespace %s failed: %v", namespace, err)
+	}
+
+	policy, err := c.policyInformer.Lister().NetworkPolicies(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		glog.V(3).Infof("Network policy %s has been deleted", key)
+		if err := c.deleteGroups(key, tenantID, nil); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		delete(c.policyGroups, key)
+		c.mu.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Peer groups are created first, they are remote groups of the policy group.
+	peerGroupIDs := make(map[string]string)
+	for i, rule := range policy.Spec.Ingress {
+		for j := range rule.From {
+			peerName := buildPeerGroupName(policy, i, j)
+			id, err := c.osClient.EnsureSecurityGroup(&openstack.SecurityGroup{
+				Name:     peerName,
+				TenantID: tenantID,
+			})
+			if err != nil {
+				return fmt.Errorf("ensure securitygroup %s failed: %v", peerName, err)
+			}
+			peerGroupIDs[peerName] = id
+		}
+	}
+
+	policyGroupName := buildPolicyGroupName(policy)
+	_, err = c.osClient.EnsureSecurityGroup(&openstack.SecurityGroup{
+		Name:     policyGroupName,
+		TenantID: tenantID,
+		Rules:    buildPolicyRules(policy, peerGroupIDs),
+	})
+	if err != nil {
+		return fmt.Errorf("ensure securitygroup %s failed: %v", policyGroupName, err)
+	}
+
+	c.enqueuePodsForPolicy(policy)
+
+	// Groups of the removed peers are not used anymore.
+	groupNames := getGroupNames(policy)
+	if err := c.deleteGroups(key, tenantID, groupNames); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.policyGroups[key] = groupNames
+	c.mu.Unlock()
+
+	return nil
+}
+
+// deleteGroups deletes security groups managed for the policy by key except the ones in keep.
+// Groups which are still attached to ports could not be deleted, they are retried after
+// the pods are synced.
+func (c *Controller) deleteGroups(key, tenantID string, keep []string) error {
+	c.mu.Lock()
+	groupNames := c.policyGroups[key]
+	c.mu.Unlock()
+
+	keepSet := make(map[string]bool)
+	for _, name := range keep {
+		keepSet[name] = true
+	}
+
+	for _, name := range groupNames {
+		if keepSet[name] {
+			continue
+		}
+		if err := c.osClient.DeleteSecurityGroup(name, tenantID); err != nil {
+			return fmt.Errorf("delete securitygroup %s failed: %v", name, err)
+		}
+		glog.V(4).Infof("Securitygroup %s of network policy %s deleted", name, key)
+	}
+
+	return nil
+}
+
+// syncPod ensures security groups of the ports of the pod with the given key.
+func (c *Controller) syncPod(key string) error {
+	startTime := time.Now()
+	defer func() {
+		glog.V(4).Infof("Finished syncing securitygroups of pod %q (%v)", key, time.Now().Sub(startTime))
+	}()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pod, err := c.podInformer.Lister().Pods(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		// Ports of the pod are deleted by kubestack.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+		return nil
+	}
+
+	securityGroupIDs, err := c.getPodSecurityGroupIDs(pod)
+	if err != nil {
+		return err
+	}
+
+	podPorts, err := c.osClient.ListPodPorts(pod.Namespace, pod.Name)
+	if err != nil {
+		return fmt.Errorf("list ports of pod %s failed: %v", key, err)
+	}
+	for i := range podPorts {
+		if err := c.osClient.UpdatePortSecurityGroups(&podPorts[i], securityGroupIDs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPodSecurityGroupIDs returns IDs of security groups the pod's ports should have.
+// Security groups belong to the tenant of the policy, so policies of other tenants
+// never apply to the pod even if their namespace selectors select its namespace.
+// Tenants are only resolved for other namespaces of policies selecting the pod,
+// once per namespace.
+func (c *Controller) getPodSecurityGroupIDs(pod *v1.Pod) ([]string, error) {
+	namespace, err := c.namespaceInformer.Lister().Get(pod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	podTenantID, err := c.osClient.GetTenantIDFromName(pod.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("get tenant of namespace %s failed: %v", pod.Namespace, err)
+	}
+
+	policies, err := c.policyInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var securityGroupIDs []string
+	isolated := false
+	tenantIDs := map[string]string{pod.Namespace: podTenantID}
+	for _, policy := range policies {
+		names := getPodGroupNames(policy, pod, namespace.Labels)
+		if len(names) == 0 {
+			continue
+		}
+
+		tenantID, ok := tenantIDs[policy.Namespace]
+		if !ok {
+			tenantID, err = c.osClient.GetTenantIDFromName(policy.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("get tenant of namespace %s failed: %v", policy.Namespace, err)
+			}
+			tenantIDs[policy.Namespace] = tenantID
+		}
+		if tenantID != podTenantID {
+			glog.V(4).Infof("Network policy %s/%s of tenant %s is ignored for pod %s/%s of tenant %s",
+				policy.Namespace, policy.Name, tenantID, pod.Namespace, pod.Name, podTenantID)
+			continue
+		}
+
+		if policySelectsPod(policy, pod) {
+			isolated = true
+		}
+		for _, name := range names {
+			// Not found means the policy has not been synced yet, so the pod is retried.
+			id, err := c.osClient.GetSecurityGroupID(name, tenantID)
+			if err != nil {
+				return nil, fmt.Errorf("get securitygroup %s failed: %v", name, err)
+			}
+			securityGroupIDs = append(securityGroupIDs, id)
+		}
+	}
+
+	// Pods not isolated by any policy accept all traffic.
+	if !isolated {
+		id, err := c.osClient.GetDefaultSecurityGroupID(podTenantID)
+		if err != nil {
+			return nil, fmt.Errorf("get default securitygroup of tenant %s failed: %v", podTenantID, err)
+		}
+		securityGroupIDs = append([]string{id}, securityGroupIDs...)
+	}
+
+	return securityGroupIDs, nil
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	sgPrefix = "kube-np"
+
+	directionIngress = "ingress"
+	directionEgress  = "egress"
+)
+
+var etherTypes = []string{"IPv4", "IPv6"}
+
+// buildPolicyGroupName returns the name of security group which holds the
+// rules of policy, it's attached to the ports of pods selected by policy.
+func buildPolicyGroupName(policy *networkingv1.NetworkPolicy) string {
+	return fmt.Sprintf("%s-%s-%s", sgPrefix, policy.Namespace, policy.Name)
+}
+
+// buildPeerGroupName returns the name of security group of the peer of ingress rule,
+// it has no rules and is attached to the ports of pods selected by the peer, so that
+// it could be used as remote group of the rules.
+func buildPeerGroupName(policy *networkingv1.NetworkPolicy, ruleIndex, peerIndex int) string {
+	return fmt.Sprintf("%s-%d-%d", buildPolicyGroupName(policy), ruleIndex, peerIndex)
+}
+
+// getGroupNames returns names of all security groups translated from policy.
+func getGroupNames(policy *networkingv1.NetworkPolicy) []string {
+	names := []string{buildPolicyGroupName(policy)}
+	for i, rule := range policy.Spec.Ingress {
+		for j := range rule.From {
+			names = append(names, buildPeerGroupName(policy, i, j))
+		}
+	}
+
+	return names
+}
+
+// hasNamespaceSelector returns true if any peer of policy selects namespaces,
+// which means pods in other namespaces may be affected by policy.
+func hasNamespaceSelector(policy *networkingv1.NetworkPolicy) bool {
+	for _, rule := range policy.Spec.Ingress {
+		for _, peer := range rule.From {
+			if peer.NamespaceSelector != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func selectorMatches(selector *metav1.LabelSelector, objLabels map[string]string) bool {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		glog.Warningf("Invalid label selector %v: %v", selector, err)
+		return false
+	}
+
+	return s.Matches(labels.Set(objLabels))
+}
+
+// policySelectsPod returns true if pod is isolated by policy.
+func policySelectsPod(policy *networkingv1.NetworkPolicy, pod *v1.Pod) bool {
+	if policy.Namespace != pod.Namespace {
+		return false
+	}
+
+	return selectorMatches(&policy.Spec.PodSelector, pod.Labels)
+}
+
+// peerSelectsPod returns true if pod is selected by the peer of policy.
+func peerSelectsPod(policy *networkingv1.NetworkPolicy, peer *networkingv1.NetworkPolicyPeer,
+	pod *v1.Pod, namespaceLabels map[string]string) bool {
+	if peer.PodSelector != nil {
+		return policy.Namespace == pod.Namespace && selectorMatches(peer.PodSelector, pod.Labels)
+	}
+	if peer.NamespaceSelector != nil {
+		return selectorMatches(peer.NamespaceSelector, namespaceLabels)
+	}
+
+	return false
+}
+
+// getPodGroupNames returns names of security groups translated from policy which pod belongs to.
+func getPodGroupNames(policy *networkingv1.NetworkPolicy, pod *v1.Pod, namespaceLabels map[string]string) []string {
+	var names []string
+	if policySelectsPod(policy, pod) {
+		names = append(names, buildPolicyGroupName(policy))
+	}
+
+	for i, rule := range policy.Spec.Ingress {
+		for j := range rule.From {
+			if peerSelectsPod(policy, &rule.From[j], pod, namespaceLabels) {
+				names = append(names, buildPeerGroupName(policy, i, j))
+			}
+		}
+	}
+
+	return names
+}
+
+type portRange struct {
+	protocol string
+	min      int
+	max      int
+}
+
+// translatePorts translates ports of ingress rule to port ranges, empty protocol means all
+// traffic. Named ports are not supported and skipped.
+func translatePorts(policyPorts []networkingv1.NetworkPolicyPort) []portRange {
+	if len(policyPorts) == 0 {
+		return []portRange{{}}
+	}
+
+	var results []portRange
+	for _, p := range policyPorts {
+		protocol := v1.ProtocolTCP
+		if p.Protocol != nil {
+			protocol = *p.Protocol
+		}
+
+		r := portRange{protocol: strings.ToLower(string(protocol))}
+		if p.Port != nil {
+			if p.Port.IntValue() == 0 {
+				glog.Warningf("Named port %q is not supported, skipped", p.Port.String())
+				continue
+			}
+			r.min = p.Port.IntValue()
+			r.max = r.min
+		}
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// buildPolicyRules translates policy to security group rules, peerGroupIDs are IDs of
+// peer groups by name. Egress traffic is always allowed.
+func buildPolicyRules(policy *networkingv1.NetworkPolicy, peerGroupIDs map[string]string) []openstack.SecurityGroupRule {
+	var results []openstack.SecurityGroupRule
+	added := make(map[openstack.SecurityGroupRule]bool)
+	add := func(rule openstack.SecurityGroupRule) {
+		if !added[rule] {
+			added[rule] = true
+			results = append(results, rule)
+		}
+	}
+
+	for _, etherType := range etherTypes {
+		add(openstack.SecurityGroupRule{
+			Direction: directionEgress,
+			EtherType: etherType,
+		})
+	}
+
+	for i, rule := range policy.Spec.Ingress {
+		// Empty from allows all sources.
+		remoteGroupIDs := []string{""}
+		if len(rule.From) > 0 {
+			remoteGroupIDs = []string{}
+			for j := range rule.From {
+				// Never fall back to all sources for unknown peers.
+				if id := peerGroupIDs[buildPeerGroupName(policy, i, j)]; id != "" {
+					remoteGroupIDs = append(remoteGroupIDs, id)
+				}
+			}
+		}
+
+		for _, etherType := range etherTypes {
+			for _, ports := range translatePorts(rule.Ports) {
+				for _, remoteGroupID := range remoteGroupIDs {
+					add(openstack.SecurityGroupRule{
+						Direction:     directionIngress,
+						EtherType:     etherType,
+						Protocol:      ports.protocol,
+						PortRangeMin:  ports.min,
+						PortRangeMax:  ports.max,
+						RemoteGroupID: remoteGroupID,
+					})
+				}
+			}
+		}
+	}
+
+	return results
+}
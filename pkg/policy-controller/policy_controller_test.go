@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	crv1 "git.openstack.org/openstack/stackube/pkg/apis/v1"
+	crdClient "git.openstack.org/openstack/stackube/pkg/kubecrd"
+	"git.openstack.org/openstack/stackube/pkg/openstack"
+
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	namespace = "test"
+	tenantID  = "123"
+
+	otherNamespace = "other"
+	otherTenantID  = "456"
+)
+
+func newController(t *testing.T) (*Controller, *openstack.FakeOSClient) {
+	kubeCRDClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatalf("Create fake CRD client failed: %v", err)
+	}
+	kubeCRDClient.SetTenants(&crv1.Tenant{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace, Namespace: namespace},
+		Spec:       crv1.TenantSpec{TenantID: tenantID},
+	})
+	kubeCRDClient.SetTenants(&crv1.Tenant{
+		ObjectMeta: metav1.ObjectMeta{Name: otherNamespace, Namespace: otherNamespace},
+		Spec:       crv1.TenantSpec{TenantID: otherTenantID},
+	})
+	osClient := openstack.NewFake(kubeCRDClient)
+
+	controller, err := NewPolicyController(fake.NewSimpleClientset(), osClient)
+	if err != nil {
+		t.Fatalf("Create policy controller failed: %v", err)
+	}
+
+	controller.namespaceInformer.Informer().GetStore().Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{"team": "a"},
+		},
+	})
+	// The namespace of another tenant is selected by the namespace selector of newPolicy.
+	controller.namespaceInformer.Informer().GetStore().Add(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   otherNamespace,
+			Labels: map[string]string{"team": "b"},
+		},
+	})
+
+	return controller, osClient
+}
+
+func newPod(name string, podLabels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    podLabels,
+		},
+		Status: v1.PodStatus{PodIP: "10.244.0.10"},
+	}
+}
+
+func newPolicy() *networkingv1.NetworkPolicy {
+	tcp := v1.ProtocolTCP
+	port := intstr.FromInt(80)
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "web"},
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+				From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}},
+					{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}},
+				},
+			}},
+		},
+	}
+}
+
+func TestBuildPolicyRules(t *testing.T) {
+	policy := newPolicy()
+	peerGroupIDs := map[string]string{
+		"kube-np-test-web-0-0": "peer0",
+		"kube-np-test-web-0-1": "peer1",
+	}
+
+	var expected []openstack.SecurityGroupRule
+	for _, etherType := range []string{"IPv4", "IPv6"} {
+		expected = append(expected, openstack.SecurityGroupRule{Direction: "egress", EtherType: etherType})
+	}
+	for _, etherType := range []string{"IPv4", "IPv6"} {
+		for _, remote := range []string{"peer0", "peer1"} {
+			expected = append(expected, openstack.SecurityGroupRule{
+				Direction:     "ingress",
+				EtherType:     etherType,
+				Protocol:      "tcp",
+				PortRangeMin:  80,
+				PortRangeMax:  80,
+				RemoteGroupID: remote,
+			})
+		}
+	}
+
+	rules := buildPolicyRules(policy, peerGroupIDs)
+	if !reflect.DeepEqual(expected, rules) {
+		t.Errorf("Expected rules %v, got %v", expected, rules)
+	}
+
+	// Unknown peers never allow all sources.
+	rules = buildPolicyRules(policy, nil)
+	for _, rule := range rules {
+		if rule.Direction == "ingress" {
+			t.Errorf("Unexpected ingress rule %v", rule)
+		}
+	}
+
+	// Empty ports and from allow all traffic.
+	policy.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{{}}
+	rules = buildPolicyRules(policy, nil)
+	allowAll := openstack.SecurityGroupRule{Direction: "ingress", EtherType: "IPv4"}
+	if len(rules) != 4 || rules[2] != allowAll {
+		t.Errorf("Expected allow all rules, got %v", rules)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	controller, osClient := newController(t)
+	policy := newPolicy()
+	controller.policyInformer.Informer().GetStore().Add(policy)
+
+	if err := controller.syncPolicy("test/web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(osClient.SecurityGroups) != 3 {
+		t.Errorf("Expected 3 securitygroups, got %v", osClient.SecurityGroups)
+	}
+
+	// Removed peers are deleted.
+	policy.Spec.Ingress[0].From = policy.Spec.Ingress[0].From[:1]
+	if err := controller.syncPolicy("test/web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(osClient.SecurityGroups) != 2 {
+		t.Errorf("Expected 2 securitygroups, got %v", osClient.SecurityGroups)
+	}
+
+	// All groups are deleted with the policy.
+	controller.policyInformer.Informer().GetStore().Delete(policy)
+	if err := controller.syncPolicy("test/web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(osClient.SecurityGroups) != 0 {
+		t.Errorf("Expected no securitygroups, got %v", osClient.SecurityGroups)
+	}
+}
+
+func TestSyncPod(t *testing.T) {
+	controller, osClient := newController(t)
+	policy := newPolicy()
+	controller.policyInformer.Informer().GetStore().Add(policy)
+	if err := controller.syncPolicy("test/web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	policyGroupID, _ := osClient.GetSecurityGroupID("kube-np-test-web", tenantID)
+	peerGroupID, _ := osClient.GetSecurityGroupID("kube-np-test-web-0-0", tenantID)
+	defaultGroupID, _ := osClient.GetDefaultSecurityGroupID(tenantID)
+	otherDefaultGroupID, _ := osClient.GetDefaultSecurityGroupID(otherTenantID)
+
+	// Port of pod web-1 must not be touched by syncing pod web.
+	osClient.SetPodPort(namespace, "web-1", "kube-test-web-1", []string{"unrelated"})
+
+	testCases := []struct {
+		pod      *v1.Pod
+		expected []string
+	}{
+		{
+			// Isolated pods don't get the default group.
+			pod:      newPod("web", map[string]string{"app": "web"}),
+			expected: []string{policyGroupID},
+		},
+		{
+			pod:      newPod("client", map[string]string{"app": "client"}),
+			expected: []string{defaultGroupID, peerGroupID},
+		},
+		{
+			pod:      newPod("other", nil),
+			expected: []string{defaultGroupID},
+		},
+		{
+			// Security groups of other tenants are never attached.
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: otherNamespace},
+				Status:     v1.PodStatus{PodIP: "10.244.1.10"},
+			},
+			expected: []string{otherDefaultGroupID},
+		},
+	}
+
+	for _, tc := range testCases {
+		controller.podInformer.Informer().GetStore().Add(tc.pod)
+		prefix := "kube-" + tc.pod.Namespace + "-" + tc.pod.Name
+		portNames := []string{prefix, prefix + "_if1"}
+		for _, portName := range portNames {
+			osClient.SetPodPort(tc.pod.Namespace, tc.pod.Name, portName, nil)
+		}
+
+		key := tc.pod.Namespace + "/" + tc.pod.Name
+		if err := controller.syncPod(key); err != nil {
+			t.Errorf("Pod %s: unexpected error: %v", key, err)
+			continue
+		}
+		for _, portName := range portNames {
+			if !reflect.DeepEqual(tc.expected, osClient.PortSecurityGroups[portName]) {
+				t.Errorf("Port %s: expected securitygroups %v, got %v", portName, tc.expected,
+					osClient.PortSecurityGroups[portName])
+			}
+		}
+	}
+
+	if groups := osClient.PortSecurityGroups["kube-test-web-1"]; !reflect.DeepEqual(groups, []string{"unrelated"}) {
+		t.Errorf("Expected securitygroups of pod web-1 unchanged, got %v", groups)
+	}
+
+	// Policies of the pod's namespace don't resolve the tenant again.
+	calls := len(osClient.GetCalledNames())
+	if err := controller.syncPod("test/client"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lookups := 0
+	for _, name := range osClient.GetCalledNames()[calls:] {
+		if name == "GetTenantIDFromName" {
+			lookups++
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected 1 tenant lookup, got %d", lookups)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// cleanupStaleNetns removes stackube rules from the router netns on the node which
+// are not owned by any namespace, e.g. routers of namespaces deleted while
+// stackube-proxy was down.
+func (p *Proxier) cleanupStaleNetns() {
+	netnsList, err := p.iptables.listNetns()
+	if err != nil {
+		glog.Errorf("List netns failed: %v", err)
+		return
+	}
+
+	owned := sets.NewString()
+	for _, nsInfo := range p.namespaceMap {
+		for _, router := range nsInfo.routers {
+			owned.Insert(getRouterNetns(router))
+		}
+	}
+
+	for _, netns := range netnsList {
+		if !strings.HasPrefix(netns, routerNetnsPrefix) || owned.Has(netns) {
+			continue
+		}
+		if err := p.cleanupNetns(netns); err != nil {
+			glog.Errorf("Cleanup stale netns %q failed: %v", netns, err)
+		}
+	}
+}
+
+// cleanupNetns removes rules written by stackube-proxy from netns.
+func (p *Proxier) cleanupNetns(netns string) error {
+	if p.proxyMode == ProxyModeIPVS {
+		if err := p.cleanupIPVSRules(netns); err != nil {
+			return err
+		}
+		p.metrics.deleteRules(netns)
+		return nil
+	}
+
+	for _, ipt := range []iptablesInterface{p.iptables, p.ip6tables} {
+		if err := cleanupIPTablesRules(ipt, netns); err != nil {
+			return err
+		}
+	}
+	p.metrics.deleteRules(netns)
+	return nil
+}
+
+// cleanupIPTablesRules unlinks and deletes chain STACKUBE-PREROUTING and the chains
+// of services in netns. Netns without those chains are not touched.
+func cleanupIPTablesRules(ipt iptablesInterface, netns string) error {
+	ipt.setNetns(netns)
+	if !ipt.netnsExist() {
+		return nil
+	}
+
+	chains, err := ipt.listChains()
+	if err != nil {
+		return err
+	}
+	var staleChains []string
+	for _, chain := range chains {
+		if chain == ChainSKPrerouting || isServiceChain(chain) {
+			staleChains = append(staleChains, chain)
+		}
+	}
+	if len(staleChains) == 0 {
+		return nil
+	}
+	glog.V(2).Infof("Removing stale chains %v from netns %q", staleChains, netns)
+
+	if err := ipt.deleteRule(ChainPrerouting, skPreroutingJumpArgs); err != nil {
+		return err
+	}
+
+	// Chains must be flushed before deleted, since they may refer each other.
+	iptablesData := bytes.NewBuffer(nil)
+	writeLine(iptablesData, "*nat")
+	for _, chain := range staleChains {
+		writeLine(iptablesData, ":"+chain, "-", "[0:0]")
+	}
+	for _, chain := range staleChains {
+		writeLine(iptablesData, opDeleteChain, chain)
+	}
+	writeLine(iptablesData, "COMMIT")
+	return ipt.restoreAll(iptablesData.Bytes())
+}
+
+// cleanupIPVSRules deletes the virtual servers of the virtual IPs bound to the
+// dummy device in netns and unbinds them. Netns without addresses on the dummy
+// device are not touched, and neither are virtual servers of other addresses.
+func (p *Proxier) cleanupIPVSRules(netns string) error {
+	p.ipvs.setNetns(netns)
+	if !p.ipvs.netnsExist() {
+		return nil
+	}
+
+	boundAddresses, err := p.ipvs.listAddresses(ipvsDummyDevice)
+	if err != nil {
+		return err
+	}
+	if len(boundAddresses) == 0 {
+		return nil
+	}
+	bound := sets.NewString(boundAddresses...)
+
+	currentServers, err := p.ipvs.listVirtualServers()
+	if err != nil {
+		return err
+	}
+	var staleServers []*virtualServer
+	for _, vs := range currentServers {
+		if ip, _, err := net.SplitHostPort(vs.address); err == nil && bound.Has(ip) {
+			staleServers = append(staleServers, vs)
+		}
+	}
+	if len(staleServers) > 0 {
+		glog.V(2).Infof("Removing stale virtual servers from netns %q", netns)
+		ipvsData := bytes.NewBuffer(nil)
+		writeIPVSRules(ipvsData, staleServers, nil)
+		if err := p.ipvs.restoreAll(ipvsData.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range boundAddresses {
+		if err := p.ipvs.unbindAddress(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
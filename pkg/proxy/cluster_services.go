@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultClusterServices are the cluster-wide services by default: pods reach the
+// kube-dns of their namespace at the cluster IP of kube-system/kube-dns, which is
+// the cluster DNS of kubelet.
+var DefaultClusterServices = []string{clusterDNSService}
+
+// clusterDNSService is the cluster service of DNS, whose virtual IP is derived from
+// the cluster IP of the kubernetes service if kube-system/kube-dns doesn't exist.
+const clusterDNSService = "kube-dns"
+
+// clusterService is a cluster-wide service reachable at a fixed virtual IP in every
+// tenant router.
+type clusterService struct {
+	// virtualIP is empty if it's not given, then it's the cluster IP of the service
+	// of the same name as the cluster service in kube-system.
+	virtualIP string
+	// backingService is the name of the service backing the cluster service in the
+	// namespace of each router.
+	backingService string
+}
+
+// parseClusterServices parses cluster-wide services by name. Services are given as
+// "name=VIP:backing", where the virtual IP is bracketed if it's IPv6, e.g.
+// "dns=[fd00::10]:kube-dns". The backing service defaults to the service of the same
+// name if ":backing" is omitted, the virtual IP defaults to the cluster IP of the
+// service of the same name in kube-system if it's empty or "=VIP:backing" is omitted.
+func parseClusterServices(clusterServices []string) (map[string]*clusterService, error) {
+	services := make(map[string]*clusterService)
+	backed := make(map[string]string)
+	for _, spec := range clusterServices {
+		parts := strings.SplitN(strings.TrimSpace(spec), "=", 2)
+		name := parts[0]
+		if name == "" {
+			return nil, fmt.Errorf("cluster service %q has no name", spec)
+		}
+		if _, ok := services[name]; ok {
+			return nil, fmt.Errorf("cluster service %q is given more than once", name)
+		}
+
+		service := &clusterService{backingService: name}
+		if len(parts) == 2 {
+			vip, backingService, err := splitVirtualIP(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid cluster service %q: %v", spec, err)
+			}
+			service.virtualIP = vip
+			if backingService != "" {
+				service.backingService = backingService
+			}
+		}
+		if other, ok := backed[service.backingService]; ok {
+			return nil, fmt.Errorf("service %q backs both cluster services %q and %q", service.backingService, other, name)
+		}
+		backed[service.backingService] = name
+		services[name] = service
+	}
+
+	return services, nil
+}
+
+// splitVirtualIP splits "VIP:backing" into the virtual IP and the backing service,
+// either of them may be empty. IPv6 virtual IPs are bracketed if the backing service
+// is given.
+func splitVirtualIP(value string) (string, string, error) {
+	vip, backingService := value, ""
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']' in %q", value)
+		}
+		vip = value[1:end]
+		if rest := value[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", "", fmt.Errorf("unexpected %q after virtual IP", rest)
+			}
+			backingService = rest[1:]
+		}
+	} else if net.ParseIP(value) == nil {
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			vip, backingService = value[:i], value[i+1:]
+			if backingService == "" {
+				return "", "", fmt.Errorf("empty backing service")
+			}
+		}
+	}
+
+	if vip != "" {
+		ip := net.ParseIP(vip)
+		if ip == nil {
+			return "", "", fmt.Errorf("invalid virtual IP %q", vip)
+		}
+		vip = ip.String()
+	}
+	if backingService != "" {
+		if errs := validation.IsDNS1035Label(backingService); len(errs) > 0 {
+			return "", "", fmt.Errorf("invalid backing service %q: %s", backingService, strings.Join(errs, ", "))
+		}
+	}
+	return vip, backingService, nil
+}
+
+// getClusterServices parses cluster-wide services and looks up the virtual IPs not
+// given from the services in kube-system. It returns the virtual IPs by the names of
+// the backing services. Cluster services whose service doesn't exist in kube-system
+// are skipped, except DNS which falls back to the IP derived from the kubernetes
+// service.
+func getClusterServices(client kubernetes.Interface, clusterServices []string) (map[string]string, error) {
+	services, err := parseClusterServices(clusterServices)
+	if err != nil {
+		return nil, err
+	}
+
+	virtualIPs := make(map[string]string)
+	for name, service := range services {
+		if service.virtualIP == "" {
+			vip, err := lookupClusterServiceIP(client, name)
+			if err != nil {
+				return nil, err
+			}
+			if vip == "" {
+				glog.Warningf("Service %s/%s not found, skipping cluster service %q without virtual IP",
+					metav1.NamespaceSystem, name, name)
+				continue
+			}
+			service.virtualIP = vip
+		}
+		virtualIPs[service.backingService] = service.virtualIP
+	}
+
+	return virtualIPs, nil
+}
+
+// lookupClusterServiceIP returns the cluster IP of the service name in kube-system, or
+// empty if the service doesn't exist.
+func lookupClusterServiceIP(client kubernetes.Interface, name string) (string, error) {
+	svc, err := client.CoreV1().Services(metav1.NamespaceSystem).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if name == clusterDNSService {
+			return getDefaultClusterDNS(client)
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't fetch the virtual IP of cluster service %q: %v", name, err)
+	}
+
+	ip := net.ParseIP(svc.Spec.ClusterIP)
+	if ip == nil {
+		return "", fmt.Errorf("service %s/%s has no cluster IP, set the virtual IP of cluster service %q as %s=<VIP>",
+			metav1.NamespaceSystem, name, name, name)
+	}
+	return ip.String(), nil
+}
+
+// getDefaultClusterDNS builds the DNS IP by appending a "0" to the cluster IP of
+// the kubernetes service, e.g. 10.96.0.10 for 10.96.0.1.
+func getDefaultClusterDNS(client kubernetes.Interface) (string, error) {
+	k8ssvc, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("kubernetes", metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("couldn't fetch information about the kubernetes service: %v", err)
+	}
+
+	dnsIP := net.ParseIP(fmt.Sprintf("%s0", k8ssvc.Spec.ClusterIP))
+	if dnsIP == nil {
+		return "", fmt.Errorf("could not build the DNS IP from the kubernetes service IP %q", k8ssvc.Spec.ClusterIP)
+	}
+	return dnsIP.String(), nil
+}
+
+// getClusterServiceIP returns the virtual IP at which the service is reachable as a
+// cluster-wide service, or empty if it isn't backing one.
+func (p *Proxier) getClusterServiceIP(svcInfo *serviceInfo) string {
+	return p.clusterServices[svcInfo.name]
+}
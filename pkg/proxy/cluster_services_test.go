@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseClusterServices(t *testing.T) {
+	testCases := []struct {
+		clusterServices []string
+		expected        map[string]*clusterService
+		expectError     bool
+	}{{
+		clusterServices: []string{"kube-dns", "metrics=10.96.0.20"},
+		expected: map[string]*clusterService{
+			"kube-dns": {backingService: "kube-dns"},
+			"metrics":  {virtualIP: "10.96.0.20", backingService: "metrics"},
+		},
+	}, {
+		clusterServices: []string{"metrics=fd00::20"},
+		expected:        map[string]*clusterService{"metrics": {virtualIP: "fd00::20", backingService: "metrics"}},
+	}, {
+		// The backing service is named differently than the cluster service.
+		clusterServices: []string{"dns=10.96.0.10:coredns", "metrics=[fd00::20]:metrics-server"},
+		expected: map[string]*clusterService{
+			"dns":     {virtualIP: "10.96.0.10", backingService: "coredns"},
+			"metrics": {virtualIP: "fd00::20", backingService: "metrics-server"},
+		},
+	}, {
+		// The virtual IP is looked up if it's empty.
+		clusterServices: []string{"kube-dns=:coredns"},
+		expected:        map[string]*clusterService{"kube-dns": {backingService: "coredns"}},
+	}, {
+		clusterServices: []string{"metrics=foo"},
+		expectError:     true,
+	}, {
+		clusterServices: []string{"metrics=10.96.0.20:"},
+		expectError:     true,
+	}, {
+		clusterServices: []string{"metrics=10.96.0.20:Invalid_Name"},
+		expectError:     true,
+	}, {
+		clusterServices: []string{"metrics=[fd00::20"},
+		expectError:     true,
+	}, {
+		clusterServices: []string{"=10.96.0.20"},
+		expectError:     true,
+	}, {
+		clusterServices: []string{"kube-dns", "kube-dns=10.96.0.10"},
+		expectError:     true,
+	}, {
+		// A service backs at most one cluster service.
+		clusterServices: []string{"kube-dns", "dns=10.96.0.20:kube-dns"},
+		expectError:     true,
+	}}
+
+	for i, tc := range testCases {
+		services, err := parseClusterServices(tc.clusterServices)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("Case[%d] expected error, got %v", i, services)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case[%d] expected success, got %v", i, err)
+		}
+		if !reflect.DeepEqual(services, tc.expected) {
+			t.Errorf("Case[%d] expected %v, got %v", i, tc.expected, services)
+		}
+	}
+}
+
+func TestGetClusterServices(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: metav1.NamespaceSystem},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10"},
+	})
+
+	services, err := getClusterServices(client, []string{"kube-dns", "metrics=10.96.0.20"})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	expected := map[string]string{"kube-dns": "10.96.0.10", "metrics": "10.96.0.20"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected %v, got %v", expected, services)
+	}
+
+	// Virtual IPs are keyed by the backing services, which are named differently
+	// than the cluster services here.
+	services, err = getClusterServices(client, []string{"kube-dns=:coredns", "metrics=10.96.0.20:metrics-server"})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	expected = map[string]string{"coredns": "10.96.0.10", "metrics-server": "10.96.0.20"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected %v, got %v", expected, services)
+	}
+
+	// Cluster services are skipped if the virtual IP isn't given and the service
+	// doesn't exist in kube-system.
+	services, err = getClusterServices(client, []string{"kube-dns", "metrics"})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	expected = map[string]string{"kube-dns": "10.96.0.10"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected %v, got %v", expected, services)
+	}
+
+	// The virtual IP of DNS is derived from the kubernetes service without kube-dns.
+	client = fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: metav1.NamespaceDefault},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.1"},
+	})
+	services, err = getClusterServices(client, []string{"kube-dns=:coredns"})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	expected = map[string]string{"coredns": "10.96.0.10"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected %v, got %v", expected, services)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package proxy
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
@@ -30,6 +31,16 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 )
 
+const (
+	// sessionAffinityTimeoutAnnotation sets the timeout in seconds of ClientIP
+	// session affinity.
+	sessionAffinityTimeoutAnnotation = "stackube.kubernetes.io/session-affinity-timeout"
+	// defaultStickyMaxAgeSeconds is the default timeout of ClientIP session affinity.
+	defaultStickyMaxAgeSeconds = 180 * 60
+	// ipvsSchedulerAnnotation overrides the IPVS scheduler of the proxier for the service.
+	ipvsSchedulerAnnotation = "stackube.kubernetes.io/ipvs-scheduler"
+)
+
 // Translates single Endpoints object to proxyEndpointsMap.
 // This function is used for incremental updated of endpointsMap.
 //
@@ -113,7 +124,7 @@ func portProtoHash(servicePortName string, protocol string) string {
 // returns the associated iptables chain.  This is computed by hashing (sha256)
 // then encoding to base32 and truncating with the prefix "KUBE-SVC-".
 func servicePortChainName(servicePortName string, protocol string) string {
-	return "KUBE-SVC-" + portProtoHash(servicePortName, protocol)
+	return serviceChainPrefix + portProtoHash(servicePortName, protocol)
 }
 
 // serviceFirewallChainName takes the servicePortName for a service and
@@ -129,14 +140,14 @@ func serviceFirewallChainName(servicePortName string, protocol string) string {
 // this because IPTables Chain Names must be <= 28 chars long, and the longer
 // they are the harder they are to read.
 func serviceLBChainName(servicePortName string, protocol string) string {
-	return "KUBE-XLB-" + portProtoHash(servicePortName, protocol)
+	return lbChainPrefix + portProtoHash(servicePortName, protocol)
 }
 
 // This is the same as servicePortChainName but with the endpoint included.
 func servicePortEndpointChainName(servicePortName string, protocol string, endpoint string) string {
 	hash := sha256.Sum256([]byte(servicePortName + protocol + endpoint))
 	encoded := base32.StdEncoding.EncodeToString(hash[:])
-	return "KUBE-SEP-" + encoded[:16]
+	return endpointChainPrefix + encoded[:16]
 }
 
 type endpointServicePair struct {
@@ -213,10 +224,65 @@ func getServiceHealthCheckNodePort(service *v1.Service) int32 {
 	return service.Spec.HealthCheckNodePort
 }
 
+// getSessionAffinityTimeout returns the timeout in seconds of ClientIP session
+// affinity of service.
+func getSessionAffinityTimeout(service *v1.Service) int {
+	l, ok := service.Annotations[sessionAffinityTimeoutAnnotation]
+	if !ok {
+		return defaultStickyMaxAgeSeconds
+	}
+
+	timeout, err := strconv.Atoi(l)
+	if err != nil || timeout <= 0 {
+		glog.Errorf("Invalid value for annotation %v: %v", sessionAffinityTimeoutAnnotation, l)
+		return defaultStickyMaxAgeSeconds
+	}
+	return timeout
+}
+
+// getIPVSScheduler returns the IPVS scheduler of service, empty means the scheduler
+// of the proxier.
+func getIPVSScheduler(service *v1.Service) string {
+	scheduler, ok := service.Annotations[ipvsSchedulerAnnotation]
+	if !ok {
+		return ""
+	}
+
+	if !isValidIPVSScheduler(scheduler) {
+		glog.Errorf("Invalid value for annotation %v: %v", ipvsSchedulerAnnotation, scheduler)
+		return ""
+	}
+	return scheduler
+}
+
+// isServiceChain returns true if chain is a per service or per endpoint chain.
+func isServiceChain(chain string) bool {
+	return strings.HasPrefix(chain, serviceChainPrefix) ||
+		strings.HasPrefix(chain, endpointChainPrefix) ||
+		strings.HasPrefix(chain, lbChainPrefix)
+}
+
+// countRules returns the number of rules appended by iptables-restore data.
+func countRules(data []byte) int {
+	n := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte(opAddpendRule+" ")) {
+			n++
+		}
+	}
+	return n
+}
+
 func getRouterNetns(routerID string) string {
-	return "qrouter-" + routerID
+	return routerNetnsPrefix + routerID
 }
 
 func probability(n int) string {
 	return fmt.Sprintf("%0.5f", 1.0/float64(n))
 }
+
+// isIPv6 returns true if ip is a valid IPv6 address.
+func isIPv6(ip string) bool {
+	netIP := net.ParseIP(ip)
+	return netIP != nil && netIP.To4() == nil
+}
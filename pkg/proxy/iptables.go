@@ -19,6 +19,7 @@ package proxy
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/golang/glog"
 	utilexec "k8s.io/utils/exec"
@@ -30,11 +31,23 @@ const (
 	ChainPrerouting   = "PREROUTING"
 	ChainSKPrerouting = "STACKUBE-PREROUTING"
 
+	// routerNetnsPrefix is the prefix of the netns of neutron routers.
+	routerNetnsPrefix = "qrouter-"
+
+	// routerGatewayInterfaces matches the external gateway devices of neutron routers.
+	routerGatewayInterfaces = "qg-+"
+
+	// Prefixes of the per service and per endpoint chains.
+	serviceChainPrefix  = "KUBE-SVC-"
+	endpointChainPrefix = "KUBE-SEP-"
+	lbChainPrefix       = "KUBE-XLB-"
+
 	opCreateChain = "-N"
 	opFlushChain  = "-F"
 	opAddpendRule = "-A"
 	opCheckRule   = "-C"
 	opDeleteRule  = "-D"
+	opDeleteChain = "-X"
 )
 
 // iptablesInterface is an injectable interface for running iptables commands.
@@ -43,17 +56,31 @@ type iptablesInterface interface {
 	ensureChain() error
 	// ensureRule links STACKUBE-PREROUTING chain.
 	ensureRule(op, chain string, args []string) error
-	// restoreAll runs `iptables-restore` passing data through []byte.
+	// restoreAll runs `iptables-restore` (or `ip6tables-restore`) passing data through []byte.
 	restoreAll(data []byte) error
+	// listChains lists the chains of nat table.
+	listChains() ([]string, error)
+	// deleteRule deletes the rule from chain if it exists.
+	deleteRule(chain string, args []string) error
+	// listNetns lists the netns on the node.
+	listNetns() ([]string, error)
 	// netnsExist checks netns exist or not.
 	netnsExist() bool
 	// setNetns populates namespace of iptables.
 	setNetns(netns string)
 }
 
+// skPreroutingJumpArgs are the args of the rule linking chain STACKUBE-PREROUTING
+// from chain PREROUTING.
+var skPreroutingJumpArgs = []string{
+	"-m", "comment", "--comment", "stackube service portals", "-j", ChainSKPrerouting,
+}
+
 type Iptables struct {
 	exec      utilexec.Interface
 	namespace string
+	// ipv6 selects ip6tables instead of iptables.
+	ipv6 bool
 }
 
 func NewIptables(exec utilexec.Interface) iptablesInterface {
@@ -62,31 +89,76 @@ func NewIptables(exec utilexec.Interface) iptablesInterface {
 	}
 }
 
+// NewIp6tables returns an iptablesInterface running ip6tables commands.
+func NewIp6tables(exec utilexec.Interface) iptablesInterface {
+	return &Iptables{
+		exec: exec,
+		ipv6: true,
+	}
+}
+
+func (r *Iptables) iptablesCmd() string {
+	if r.ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (r *Iptables) restoreCmd() string {
+	return r.iptablesCmd() + "-restore"
+}
+
+func (r *Iptables) saveCmd() string {
+	return r.iptablesCmd() + "-save"
+}
+
 func (r *Iptables) setNetns(netns string) {
 	r.namespace = netns
 }
 
 // runInNat executes iptables command in nat table.
 func (r *Iptables) runInNat(op, chain string, args []string) ([]byte, error) {
-	fullArgs := []string{"netns", "exec", r.namespace, "iptables", "-t", TableNAT, op, chain}
+	fullArgs := []string{"netns", "exec", r.namespace, r.iptablesCmd(), "-t", TableNAT, op, chain}
 	fullArgs = append(fullArgs, args...)
 	return r.exec.Command("ip", fullArgs...).CombinedOutput()
 }
 
 func (r *Iptables) restoreAll(data []byte) error {
-	glog.V(3).Infof("running iptables-restore with data %s", data)
+	glog.V(3).Infof("running %s with data %s", r.restoreCmd(), data)
 
-	fullArgs := []string{"netns", "exec", r.namespace, "iptables-restore", "--noflush", "--counters"}
+	fullArgs := []string{"netns", "exec", r.namespace, r.restoreCmd(), "--noflush", "--counters"}
 	cmd := r.exec.Command("ip", fullArgs...)
 	cmd.SetStdin(bytes.NewBuffer(data))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("iptables-restore failed: %s: %v", output, err)
+		return fmt.Errorf("%s failed: %s: %v", r.restoreCmd(), output, err)
 	}
 
 	return nil
 }
 
+// listChains lists the chains of nat table by parsing the chain lines of
+// `iptables-save` (or `ip6tables-save`), e.g. ":STACKUBE-PREROUTING - [0:0]".
+func (r *Iptables) listChains() ([]string, error) {
+	fullArgs := []string{"netns", "exec", r.namespace, r.saveCmd(), "-t", TableNAT}
+	output, err := r.exec.Command("ip", fullArgs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %v", r.saveCmd(), output, err)
+	}
+
+	var chains []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(line, ":") {
+			continue
+		}
+		if fields := strings.Fields(line[1:]); len(fields) > 0 {
+			chains = append(chains, fields[0])
+		}
+	}
+
+	return chains, nil
+}
+
 // ensureChain ensures chain STACKUBE-PREROUTING is created.
 func (r *Iptables) ensureChain() error {
 	output, err := r.runInNat(opCreateChain, ChainSKPrerouting, nil)
@@ -135,6 +207,41 @@ func (r *Iptables) ensureRule(op, chain string, args []string) error {
 	return nil
 }
 
+func (r *Iptables) deleteRule(chain string, args []string) error {
+	exists, err := r.checkRule(chain, args)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	out, err := r.runInNat(opDeleteRule, chain, args)
+	if err != nil {
+		return fmt.Errorf("error deleting rule: %v: %s", err, out)
+	}
+
+	return nil
+}
+
+// listNetns parses the output of `ip netns list`, e.g. "qrouter-1234 (id: 3)".
+func (r *Iptables) listNetns() ([]string, error) {
+	out, err := r.exec.Command("ip", "netns", "list").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error listing netns: %v: %s", err, out)
+	}
+
+	var netns []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			netns = append(netns, fields[0])
+		}
+	}
+
+	return netns, nil
+}
+
 // Join all words with spaces, terminate with newline and write to buf.
 func writeLine(buf *bytes.Buffer, words ...string) {
 	// We avoid strings.Join for performance reasons.
@@ -149,10 +256,15 @@ func writeLine(buf *bytes.Buffer, words ...string) {
 }
 
 func (r *Iptables) netnsExist() bool {
-	args := []string{"netns", "pids", r.namespace}
-	out, err := r.exec.Command("ip", args...).CombinedOutput()
+	return netnsExist(r.exec, r.namespace)
+}
+
+// netnsExist checks netns exist or not.
+func netnsExist(exec utilexec.Interface, netns string) bool {
+	args := []string{"netns", "pids", netns}
+	out, err := exec.Command("ip", args...).CombinedOutput()
 	if err != nil {
-		glog.V(5).Infof("Checking netns %q failed: %s: %v", r.namespace, out, err)
+		glog.V(5).Infof("Checking netns %q failed: %s: %v", netns, out, err)
 		return false
 	}
 
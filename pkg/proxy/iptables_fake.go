@@ -25,10 +25,12 @@ import (
 const (
 	Destination = "-d "
 	Source      = "-s "
+	InInterface = "-i "
 	DPort       = "--dport "
 	Protocol    = "-p "
 	Jump        = "-j "
 	ToDest      = "--to-destination "
+	Recent      = "--name "
 )
 
 // Rule represents chain's rule.
@@ -39,12 +41,15 @@ type FakeIPTables struct {
 	sync.Mutex
 	namespace string
 	NSLines   map[string][]byte
+	// NSChains tracks the chains declared in each namespace.
+	NSChains map[string]map[string]bool
 }
 
 // NewFake return new FakeIPTables.
 func NewFake() *FakeIPTables {
 	return &FakeIPTables{
-		NSLines: make(map[string][]byte),
+		NSLines:  make(map[string][]byte),
+		NSChains: make(map[string]map[string]bool),
 	}
 }
 
@@ -56,15 +61,55 @@ func (f *FakeIPTables) ensureRule(op, chain string, args []string) error {
 	return nil
 }
 
+func (f *FakeIPTables) deleteRule(chain string, args []string) error {
+	return nil
+}
+
+// listNetns returns the namespaces restored by the fake.
+func (f *FakeIPTables) listNetns() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	var netns []string
+	for namespace := range f.NSChains {
+		netns = append(netns, namespace)
+	}
+	return netns, nil
+}
+
 func (f *FakeIPTables) restoreAll(data []byte) error {
 	f.Lock()
 	defer f.Unlock()
 	d := make([]byte, len(data))
 	copy(d, data)
 	f.NSLines[f.namespace] = d
+
+	chains, ok := f.NSChains[f.namespace]
+	if !ok {
+		chains = make(map[string]bool)
+		f.NSChains[f.namespace] = chains
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		switch {
+		case len(fields) > 0 && strings.HasPrefix(fields[0], ":"):
+			chains[fields[0][1:]] = true
+		case len(fields) > 1 && fields[0] == opDeleteChain:
+			delete(chains, fields[1])
+		}
+	}
 	return nil
 }
 
+func (f *FakeIPTables) listChains() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	var chains []string
+	for chain := range f.NSChains[f.namespace] {
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
 func (f *FakeIPTables) netnsExist() bool {
 	return true
 }
@@ -88,7 +133,7 @@ func (f *FakeIPTables) GetRules(chainName, namespace string) (rules []Rule) {
 	for _, l := range strings.Split(string(f.NSLines[namespace]), "\n") {
 		if strings.Contains(l, fmt.Sprintf("-A %v", chainName)) {
 			newRule := Rule(map[string]string{})
-			for _, arg := range []string{Destination, Source, DPort, Protocol, Jump, ToDest} {
+			for _, arg := range []string{Destination, Source, InInterface, DPort, Protocol, Jump, ToDest, Recent} {
 				tok := getToken(l, arg)
 				if tok != "" {
 					newRule[arg] = tok
@@ -18,6 +18,7 @@ package proxy
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -205,6 +206,43 @@ func TestRestoreAll(t *testing.T) {
 	}
 }
 
+func TestIp6tablesRestoreAll(t *testing.T) {
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte{}, nil },
+		},
+	}
+	fexec := fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	ipt := NewIp6tables(&fexec)
+	ipt.setNetns("FOO")
+
+	err := ipt.ensureChain()
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	err = ipt.restoreAll([]byte{})
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	if fcmd.CombinedOutputCalls != 2 {
+		t.Errorf("expected 2 CombinedOutput() calls, got %d", fcmd.CombinedOutputCalls)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "exec", "FOO", "ip6tables", "-t", "nat", "-N", ChainSKPrerouting) {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("ip", "netns", "exec", "FOO", "ip6tables-restore", "--noflush", "--counters") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+}
+
 func TestNetnsExist(t *testing.T) {
 	fcmd := fakeexec.FakeCmd{
 		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
@@ -232,3 +270,72 @@ func TestNetnsExist(t *testing.T) {
 		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
 	}
 }
+
+func TestListChains(t *testing.T) {
+	output := `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:STACKUBE-PREROUTING - [0:0]
+:KUBE-SVC-AAAAAAAAAAAAAAAA - [0:0]
+-A PREROUTING -m comment --comment "stackube service portals" -j STACKUBE-PREROUTING
+COMMIT
+`
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(output), nil },
+		},
+	}
+	fexec := fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	ipt := NewIptables(&fexec)
+	ipt.setNetns("FOO")
+
+	chains, err := ipt.listChains()
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	expected := []string{"PREROUTING", ChainSKPrerouting, "KUBE-SVC-AAAAAAAAAAAAAAAA"}
+	if !reflect.DeepEqual(chains, expected) {
+		t.Errorf("expected chains %v, got %v", expected, chains)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "exec", "FOO", "iptables-save", "-t", "nat") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+}
+
+func TestListNetns(t *testing.T) {
+	output := `qrouter-1234 (id: 1)
+qdhcp-5678 (id: 0)
+qrouter-abcd
+`
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(output), nil },
+		},
+	}
+	fexec := fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	ipt := NewIptables(&fexec)
+
+	netns, err := ipt.listNetns()
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	expected := []string{"qrouter-1234", "qdhcp-5678", "qrouter-abcd"}
+	if !reflect.DeepEqual(netns, expected) {
+		t.Errorf("expected netns %v, got %v", expected, netns)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "list") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+}
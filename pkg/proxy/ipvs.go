@@ -0,0 +1,354 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// ipvsDummyDevice holds the virtual IPs of services in router netns, so that
+	// connections to them are delivered locally to IPVS.
+	ipvsDummyDevice = "stackube-ipvs0"
+
+	// routerGatewayDevicePrefix is the prefix of the external gateway devices of
+	// neutron routers.
+	routerGatewayDevicePrefix = "qg-"
+
+	// Supported IPVS schedulers.
+	ipvsSchedulerRoundRobin      = "rr"
+	ipvsSchedulerLeastConnection = "lc"
+	ipvsSchedulerSourceHashing   = "sh"
+	defaultIPVSScheduler         = ipvsSchedulerRoundRobin
+
+	ipvsOpAddVirtualServer    = "-A"
+	ipvsOpEditVirtualServer   = "-E"
+	ipvsOpDeleteVirtualServer = "-D"
+	ipvsOpAddRealServer       = "-a"
+	ipvsOpDeleteRealServer    = "-d"
+	// ipvsMasquerading forwards connections to real servers by NAT.
+	ipvsMasquerading = "-m"
+)
+
+// isValidIPVSScheduler returns true if scheduler is supported.
+func isValidIPVSScheduler(scheduler string) bool {
+	switch scheduler {
+	case ipvsSchedulerRoundRobin, ipvsSchedulerLeastConnection, ipvsSchedulerSourceHashing:
+		return true
+	}
+	return false
+}
+
+// virtualServer is an IPVS virtual server with its real servers.
+type virtualServer struct {
+	// protocol is "tcp" or "udp".
+	protocol string
+	// address is ip:port of the virtual server.
+	address   string
+	scheduler string
+	// persistence is the timeout in seconds of persistent connections,
+	// 0 means connections are not persistent.
+	persistence int
+	// realServers are ip:port of the real servers, sorted.
+	realServers []string
+}
+
+func (vs *virtualServer) key() string {
+	return vs.protocol + "/" + vs.address
+}
+
+// serviceArgs returns the ipvsadm arguments selecting the virtual server.
+func (vs *virtualServer) serviceArgs() []string {
+	if vs.protocol == "udp" {
+		return []string{"-u", vs.address}
+	}
+	return []string{"-t", vs.address}
+}
+
+// optionArgs returns the ipvsadm arguments of the virtual server options.
+func (vs *virtualServer) optionArgs() []string {
+	args := []string{"-s", vs.scheduler}
+	if vs.persistence > 0 {
+		args = append(args, "-p", strconv.Itoa(vs.persistence))
+	}
+	return args
+}
+
+// ipvsInterface is an injectable interface for running ipvsadm and ip commands.
+type ipvsInterface interface {
+	// listVirtualServers lists the virtual servers with their real servers.
+	listVirtualServers() ([]*virtualServer, error)
+	// restoreAll runs `ipvsadm --restore` passing data through []byte.
+	restoreAll(data []byte) error
+	// ensureDummyDevice ensures the device holding virtual IPs is created.
+	ensureDummyDevice() error
+	// listAddresses lists the IPs of devices whose name starts with devicePrefix.
+	listAddresses(devicePrefix string) ([]string, error)
+	// bindAddress adds ip to the dummy device.
+	bindAddress(ip string) error
+	// unbindAddress removes ip from the dummy device.
+	unbindAddress(ip string) error
+	// netnsExist checks netns exist or not.
+	netnsExist() bool
+	// setNetns populates namespace of ipvs.
+	setNetns(netns string)
+}
+
+type Ipvs struct {
+	exec      utilexec.Interface
+	namespace string
+}
+
+// NewIpvs returns an ipvsInterface running ipvsadm commands.
+func NewIpvs(exec utilexec.Interface) ipvsInterface {
+	return &Ipvs{
+		exec: exec,
+	}
+}
+
+func (r *Ipvs) setNetns(netns string) {
+	r.namespace = netns
+}
+
+// runInNetns executes cmd in the netns.
+func (r *Ipvs) runInNetns(cmd string, args ...string) ([]byte, error) {
+	fullArgs := []string{"netns", "exec", r.namespace, cmd}
+	fullArgs = append(fullArgs, args...)
+	return r.exec.Command("ip", fullArgs...).CombinedOutput()
+}
+
+func (r *Ipvs) listVirtualServers() ([]*virtualServer, error) {
+	output, err := r.runInNetns("ipvsadm", "--save", "--numeric")
+	if err != nil {
+		return nil, fmt.Errorf("ipvsadm --save failed: %s: %v", output, err)
+	}
+
+	servers := make(map[string]*virtualServer)
+	applyIPVSRules(servers, output)
+	return sortVirtualServers(servers), nil
+}
+
+func (r *Ipvs) restoreAll(data []byte) error {
+	glog.V(3).Infof("running ipvsadm --restore with data %s", data)
+
+	fullArgs := []string{"netns", "exec", r.namespace, "ipvsadm", "--restore"}
+	cmd := r.exec.Command("ip", fullArgs...)
+	cmd.SetStdin(bytes.NewBuffer(data))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipvsadm --restore failed: %s: %v", output, err)
+	}
+
+	return nil
+}
+
+func (r *Ipvs) ensureDummyDevice() error {
+	if _, err := r.runInNetns("ip", "link", "show", ipvsDummyDevice); err == nil {
+		return nil
+	}
+
+	output, err := r.runInNetns("ip", "link", "add", ipvsDummyDevice, "type", "dummy")
+	if err != nil {
+		return fmt.Errorf("create device %s failed: %s: %v", ipvsDummyDevice, output, err)
+	}
+
+	return nil
+}
+
+// listAddresses parses the output of `ip -o addr show`, which has a line per address, e.g.
+// "5: qg-1234    inet 172.24.4.5/24 brd 172.24.4.255 scope global qg-1234".
+func (r *Ipvs) listAddresses(devicePrefix string) ([]string, error) {
+	output, err := r.runInNetns("ip", "-o", "addr", "show")
+	if err != nil {
+		return nil, fmt.Errorf("list addresses failed: %s: %v", output, err)
+	}
+
+	var ips []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], devicePrefix) {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			glog.Warningf("Ignoring invalid address %q: %v", fields[3], err)
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+
+	return ips, nil
+}
+
+// bindAddress adds ip to the dummy device. The router must not answer ARP requests
+// of the addresses on the dummy device, nor use them as sources of ARP requests.
+func (r *Ipvs) bindAddress(ip string) error {
+	output, err := r.runInNetns("sysctl", "-w", "net.ipv4.conf.all.arp_ignore=1", "net.ipv4.conf.all.arp_announce=2")
+	if err != nil {
+		return fmt.Errorf("set arp_ignore and arp_announce failed: %s: %v", output, err)
+	}
+
+	output, err = r.runInNetns("ip", "addr", "add", hostCIDR(ip), "dev", ipvsDummyDevice)
+	if err != nil {
+		return fmt.Errorf("bind address %s failed: %s: %v", ip, output, err)
+	}
+
+	return nil
+}
+
+func (r *Ipvs) unbindAddress(ip string) error {
+	output, err := r.runInNetns("ip", "addr", "del", hostCIDR(ip), "dev", ipvsDummyDevice)
+	if err != nil {
+		return fmt.Errorf("unbind address %s failed: %s: %v", ip, output, err)
+	}
+
+	return nil
+}
+
+func (r *Ipvs) netnsExist() bool {
+	return netnsExist(r.exec, r.namespace)
+}
+
+// hostCIDR returns the CIDR of the single ip.
+func hostCIDR(ip string) string {
+	if isIPv6(ip) {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// applyIPVSRules applies the ipvsadm commands in data, in the format of
+// `ipvsadm --save`, to servers.
+func applyIPVSRules(servers map[string]*virtualServer, data []byte) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		vs := &virtualServer{}
+		var realServer string
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "-t":
+				vs.protocol, vs.address = "tcp", fields[i+1]
+			case "-u":
+				vs.protocol, vs.address = "udp", fields[i+1]
+			case "-s":
+				vs.scheduler = fields[i+1]
+			case "-p":
+				vs.persistence, _ = strconv.Atoi(fields[i+1])
+			case "-r":
+				realServer = fields[i+1]
+			default:
+				continue
+			}
+			i++
+		}
+		if vs.address == "" {
+			continue
+		}
+
+		switch fields[0] {
+		case ipvsOpAddVirtualServer:
+			servers[vs.key()] = vs
+		case ipvsOpEditVirtualServer:
+			if current, ok := servers[vs.key()]; ok {
+				current.scheduler, current.persistence = vs.scheduler, vs.persistence
+			}
+		case ipvsOpDeleteVirtualServer:
+			delete(servers, vs.key())
+		case ipvsOpAddRealServer:
+			if current, ok := servers[vs.key()]; ok && realServer != "" {
+				current.realServers = append(current.realServers, realServer)
+				sort.Strings(current.realServers)
+			}
+		case ipvsOpDeleteRealServer:
+			if current, ok := servers[vs.key()]; ok {
+				for i, rs := range current.realServers {
+					if rs == realServer {
+						current.realServers = append(current.realServers[:i], current.realServers[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// sortVirtualServers returns servers sorted by key.
+func sortVirtualServers(servers map[string]*virtualServer) []*virtualServer {
+	result := make([]*virtualServer, 0, len(servers))
+	for _, vs := range servers {
+		result = append(result, vs)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].key() < result[j].key()
+	})
+	return result
+}
+
+// writeIPVSRules writes the ipvsadm commands changing current virtual servers to wanted.
+func writeIPVSRules(buf *bytes.Buffer, current []*virtualServer, wanted map[string]*virtualServer) {
+	currentServers := make(map[string]*virtualServer)
+	for _, vs := range current {
+		currentServers[vs.key()] = vs
+		if _, ok := wanted[vs.key()]; !ok {
+			writeLine(buf, append([]string{ipvsOpDeleteVirtualServer}, vs.serviceArgs()...)...)
+		}
+	}
+
+	for _, vs := range sortVirtualServers(wanted) {
+		existing, ok := currentServers[vs.key()]
+		if !ok {
+			existing = &virtualServer{}
+			writeLine(buf, append(append([]string{ipvsOpAddVirtualServer}, vs.serviceArgs()...), vs.optionArgs()...)...)
+		} else if existing.scheduler != vs.scheduler || existing.persistence != vs.persistence {
+			writeLine(buf, append(append([]string{ipvsOpEditVirtualServer}, vs.serviceArgs()...), vs.optionArgs()...)...)
+		}
+
+		existingRealServers := make(map[string]bool)
+		for _, rs := range existing.realServers {
+			existingRealServers[rs] = true
+		}
+		wantedRealServers := make(map[string]bool)
+		for _, rs := range vs.realServers {
+			wantedRealServers[rs] = true
+			if !existingRealServers[rs] {
+				args := append([]string{ipvsOpAddRealServer}, vs.serviceArgs()...)
+				writeLine(buf, append(args, "-r", rs, ipvsMasquerading)...)
+			}
+		}
+		for _, rs := range existing.realServers {
+			if !wantedRealServers[rs] {
+				args := append([]string{ipvsOpDeleteRealServer}, vs.serviceArgs()...)
+				writeLine(buf, append(args, "-r", rs)...)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"sync"
+)
+
+// FakeIPVS keeps virtual servers and addresses of each namespace in memory.
+type FakeIPVS struct {
+	sync.Mutex
+	namespace string
+	// NSServers maps namespace to its virtual servers by key.
+	NSServers map[string]map[string]*virtualServer
+	// NSAddresses maps namespace to the addresses bound to the dummy device.
+	NSAddresses map[string]map[string]bool
+	// GatewayAddresses maps namespace to the addresses of router gateway devices.
+	GatewayAddresses map[string][]string
+}
+
+// NewFakeIPVS return new FakeIPVS.
+func NewFakeIPVS() *FakeIPVS {
+	return &FakeIPVS{
+		NSServers:        make(map[string]map[string]*virtualServer),
+		NSAddresses:      make(map[string]map[string]bool),
+		GatewayAddresses: make(map[string][]string),
+	}
+}
+
+func (f *FakeIPVS) listVirtualServers() ([]*virtualServer, error) {
+	f.Lock()
+	defer f.Unlock()
+	var servers []*virtualServer
+	for _, vs := range sortVirtualServers(f.NSServers[f.namespace]) {
+		copied := *vs
+		copied.realServers = append([]string{}, vs.realServers...)
+		servers = append(servers, &copied)
+	}
+	return servers, nil
+}
+
+func (f *FakeIPVS) restoreAll(data []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.NSServers[f.namespace]; !ok {
+		f.NSServers[f.namespace] = make(map[string]*virtualServer)
+	}
+	applyIPVSRules(f.NSServers[f.namespace], data)
+	return nil
+}
+
+func (f *FakeIPVS) ensureDummyDevice() error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.NSAddresses[f.namespace]; !ok {
+		f.NSAddresses[f.namespace] = make(map[string]bool)
+	}
+	return nil
+}
+
+func (f *FakeIPVS) listAddresses(devicePrefix string) ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	var ips []string
+	if strings.HasPrefix(ipvsDummyDevice, devicePrefix) {
+		for ip := range f.NSAddresses[f.namespace] {
+			ips = append(ips, ip)
+		}
+	}
+	if strings.HasPrefix(routerGatewayDevicePrefix, devicePrefix) {
+		ips = append(ips, f.GatewayAddresses[f.namespace]...)
+	}
+	return ips, nil
+}
+
+func (f *FakeIPVS) bindAddress(ip string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.NSAddresses[f.namespace][ip] = true
+	return nil
+}
+
+func (f *FakeIPVS) unbindAddress(ip string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.NSAddresses[f.namespace], ip)
+	return nil
+}
+
+func (f *FakeIPVS) netnsExist() bool {
+	return true
+}
+
+func (f *FakeIPVS) setNetns(netns string) {
+	f.namespace = netns
+}
+
+// GetVirtualServer returns the virtual server of protocol and address in namespace.
+func (f *FakeIPVS) GetVirtualServer(protocol, address, namespace string) *virtualServer {
+	f.Lock()
+	defer f.Unlock()
+	return f.NSServers[namespace][protocol+"/"+address]
+}
+
+var _ = ipvsInterface(&FakeIPVS{})
@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+func newFakeIpvs(outputs ...fakeexec.FakeCombinedOutputAction) (*fakeexec.FakeCmd, ipvsInterface) {
+	fcmd := &fakeexec.FakeCmd{CombinedOutputScript: outputs}
+	fexec := &fakeexec.FakeExec{}
+	for range outputs {
+		fexec.CommandScript = append(fexec.CommandScript,
+			func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(fcmd, cmd, args...) })
+	}
+	ipvs := NewIpvs(fexec)
+	ipvs.setNetns("FOO")
+	return fcmd, ipvs
+}
+
+func TestListVirtualServers(t *testing.T) {
+	output := `-A -t 10.0.0.1:80 -s rr
+-a -t 10.0.0.1:80 -r 192.168.0.2:80 -m -w 1
+-a -t 10.0.0.1:80 -r 192.168.0.1:80 -m -w 1
+-A -u [fd00::10]:53 -s sh -p 600
+`
+	fcmd, ipvs := newFakeIpvs(func() ([]byte, error) { return []byte(output), nil })
+
+	servers, err := ipvs.listVirtualServers()
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	expected := []*virtualServer{
+		{protocol: "tcp", address: "10.0.0.1:80", scheduler: "rr", realServers: []string{"192.168.0.1:80", "192.168.0.2:80"}},
+		{protocol: "udp", address: "[fd00::10]:53", scheduler: "sh", persistence: 600},
+	}
+	if !reflect.DeepEqual(servers, expected) {
+		t.Errorf("expected virtual servers %v, got %v", expected, servers)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "exec", "FOO", "ipvsadm", "--save", "--numeric") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+}
+
+func TestIpvsRestoreAll(t *testing.T) {
+	fcmd, ipvs := newFakeIpvs(func() ([]byte, error) { return []byte{}, nil })
+
+	err := ipvs.restoreAll([]byte{})
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "exec", "FOO", "ipvsadm", "--restore") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+}
+
+func TestEnsureDummyDevice(t *testing.T) {
+	fcmd, ipvs := newFakeIpvs(
+		// Not found.
+		func() ([]byte, error) { return nil, &fakeexec.FakeExitError{Status: 1} },
+		// Created.
+		func() ([]byte, error) { return []byte{}, nil },
+	)
+
+	err := ipvs.ensureDummyDevice()
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	if fcmd.CombinedOutputCalls != 2 {
+		t.Errorf("expected 2 CombinedOutput() calls, got %d", fcmd.CombinedOutputCalls)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("ip", "netns", "exec", "FOO", "link", "add", ipvsDummyDevice, "dummy") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	fcmd, ipvs := newFakeIpvs(
+		// arp_ignore and arp_announce set.
+		func() ([]byte, error) { return []byte{}, nil },
+		// Bound.
+		func() ([]byte, error) { return []byte{}, nil },
+	)
+
+	err := ipvs.bindAddress("10.0.0.1")
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	if fcmd.CombinedOutputCalls != 2 {
+		t.Errorf("expected 2 CombinedOutput() calls, got %d", fcmd.CombinedOutputCalls)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "netns", "exec", "FOO", "sysctl",
+		"net.ipv4.conf.all.arp_ignore=1", "net.ipv4.conf.all.arp_announce=2") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("ip", "netns", "exec", "FOO", "addr", "add", "10.0.0.1/32", ipvsDummyDevice) {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+}
+
+func TestListAddresses(t *testing.T) {
+	output := `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+5: qg-1234    inet 172.24.4.5/24 brd 172.24.4.255 scope global qg-1234\       valid_lft forever preferred_lft forever
+5: qg-1234    inet6 2001:db8::5/64 scope global \       valid_lft forever preferred_lft forever
+6: qr-5678    inet 10.244.0.1/16 brd 10.244.255.255 scope global qr-5678\       valid_lft forever preferred_lft forever
+`
+	_, ipvs := newFakeIpvs(func() ([]byte, error) { return []byte(output), nil })
+
+	ips, err := ipvs.listAddresses(routerGatewayDevicePrefix)
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	expected := []string{"172.24.4.5", "2001:db8::5"}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, ips)
+	}
+}
+
+func TestWriteIPVSRules(t *testing.T) {
+	current := []*virtualServer{
+		{protocol: "tcp", address: "10.0.0.1:80", scheduler: "rr", realServers: []string{"192.168.0.1:80", "192.168.0.2:80"}},
+		{protocol: "tcp", address: "10.0.0.2:80", scheduler: "rr", realServers: []string{"192.168.0.3:80"}},
+	}
+	wanted := map[string]*virtualServer{
+		"tcp/10.0.0.1:80": {protocol: "tcp", address: "10.0.0.1:80", scheduler: "lc", realServers: []string{"192.168.0.1:80", "192.168.0.4:80"}},
+		"udp/10.0.0.3:53": {protocol: "udp", address: "10.0.0.3:53", scheduler: "sh", persistence: 600, realServers: []string{"192.168.0.5:53"}},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writeIPVSRules(buf, current, wanted)
+
+	expected := `-D -t 10.0.0.2:80
+-E -t 10.0.0.1:80 -s lc
+-a -t 10.0.0.1:80 -r 192.168.0.4:80 -m
+-d -t 10.0.0.1:80 -r 192.168.0.2:80
+-A -u 10.0.0.3:53 -s sh -p 600
+-a -u 10.0.0.3:53 -r 192.168.0.5:53 -m
+`
+	if buf.String() != expected {
+		t.Errorf("expected rules:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// Applying the rules results in the wanted virtual servers.
+	servers := make(map[string]*virtualServer)
+	for _, vs := range current {
+		servers[vs.key()] = vs
+	}
+	applyIPVSRules(servers, buf.Bytes())
+	if !reflect.DeepEqual(servers, wanted) {
+		t.Errorf("expected virtual servers %v, got %v", wanted, servers)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	metricsNamespace = "stackube_proxy"
+
+	// Backends of rules.
+	backendIPTables  = "iptables"
+	backendIP6Tables = "ip6tables"
+	backendIPVS      = "ipvs"
+
+	// Reasons of skipping namespaces.
+	skippedNetnsMissing   = "netns_missing"
+	skippedRouterNotReady = "router_not_ready"
+)
+
+// syncDurationBuckets are the upper bounds in seconds of sync duration buckets.
+var syncDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricVec is a counter or gauge partitioned by labels.
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	// values maps the escaped label pairs to value.
+	values map[string]float64
+}
+
+func newMetricVec(name, help, metricType string, labelNames ...string) *metricVec {
+	return &metricVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+}
+
+func (m *metricVec) labels(labelValues []string) string {
+	pairs := make([]string, len(m.labelNames))
+	for i, name := range m.labelNames {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labelValues[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metricVec) add(delta float64, labelValues ...string) {
+	m.values[m.labels(labelValues)] += delta
+}
+
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.values[m.labels(labelValues)] = value
+}
+
+func (m *metricVec) delete(labelValues ...string) {
+	delete(m.values, m.labels(labelValues))
+}
+
+func (m *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.metricType)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, key, formatFloat(m.values[key]))
+	}
+}
+
+// histogram counts observations in buckets.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    metricsNamespace + "_" + name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// proxyMetrics are the metrics of stackube-proxy, exposed in the Prometheus
+// text format.
+type proxyMetrics struct {
+	mu                sync.Mutex
+	syncDuration      *histogram
+	restoreFailures   *metricVec
+	rules             *metricVec
+	skippedNamespaces *metricVec
+	// lastSuccessfulSync is the time of the last sync without failures, it
+	// starts with the creation time so that proxy is healthy while starting.
+	lastSuccessfulSync time.Time
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		syncDuration: newHistogram("sync_duration_seconds",
+			"Duration of syncing proxy rules in seconds.", syncDurationBuckets),
+		restoreFailures: newMetricVec("restore_failures_total",
+			"Number of failed restores of proxy rules.", "counter", "backend"),
+		rules: newMetricVec("rules",
+			"Number of iptables rules or IPVS virtual servers in router netns.", "gauge", "netns", "backend"),
+		skippedNamespaces: newMetricVec("skipped_namespaces_total",
+			"Number of namespaces skipped while syncing because the netns is missing or the router isn't ready.",
+			"counter", "reason"),
+		lastSuccessfulSync: time.Now(),
+	}
+}
+
+// observeSync records a sync started at start.
+func (m *proxyMetrics) observeSync(start time.Time, succeeded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.syncDuration.observe(now.Sub(start).Seconds())
+	if succeeded {
+		m.lastSuccessfulSync = now
+	}
+}
+
+func (m *proxyMetrics) incRestoreFailures(backend string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restoreFailures.add(1, backend)
+}
+
+func (m *proxyMetrics) setRules(netns, backend string, rules int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules.set(float64(rules), netns, backend)
+}
+
+// deleteRules deletes the rules of netns, which is cleaned up.
+func (m *proxyMetrics) deleteRules(netns string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, backend := range []string{backendIPTables, backendIP6Tables, backendIPVS} {
+		m.rules.delete(netns, backend)
+	}
+}
+
+func (m *proxyMetrics) incSkippedNamespaces(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.skippedNamespaces.add(1, reason)
+}
+
+// checkHealth returns an error if the last successful sync is older than timeout.
+func (m *proxyMetrics) checkHealth(timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elapsed := time.Since(m.lastSuccessfulSync); elapsed > timeout {
+		return fmt.Errorf("last successful sync was %v ago, longer than %v", elapsed, timeout)
+	}
+	return nil
+}
+
+func (m *proxyMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncDuration.write(w)
+	m.restoreFailures.write(w)
+	m.rules.write(w)
+	m.skippedNamespaces.write(w)
+}
+
+// newMetricsHandler returns the handler serving /metrics and /healthz, /healthz
+// fails if the last successful sync is older than healthzTimeout.
+func newMetricsHandler(metrics *proxyMetrics, healthzTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.NewBuffer(nil)
+		metrics.write(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := metrics.checkHealth(healthzTimeout); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+// ServeMetrics serves Prometheus metrics on /metrics and health checks on /healthz at
+// address. /healthz fails if the last successful sync is older than healthzTimeout.
+func (p *Proxier) ServeMetrics(address string, healthzTimeout time.Duration) error {
+	glog.Infof("Serving metrics and healthz on %s", address)
+	return http.ListenAndServe(address, newMetricsHandler(p.metrics, healthzTimeout))
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	testNamespace := "test"
+	_, fp := newTestProxier(t, testNamespace)
+	makeServiceMap(fp,
+		makeTestService(testNamespace, "svc1", func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     "80",
+				Port:     80,
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+	makeEndpointsMap(fp,
+		makeTestEndpoints(testNamespace, "svc1", func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+				Ports:     []v1.EndpointPort{{Name: "80", Port: 80}},
+			}}
+		}),
+	)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+	fp.syncProxyRules()
+	fp.metrics.incSkippedNamespaces(skippedRouterNotReady)
+
+	handler := newMetricsHandler(fp.metrics, time.Minute)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"stackube_proxy_sync_duration_seconds_count 1\n",
+		// The jump rule, the service chain rule and the endpoint chain rule.
+		`stackube_proxy_rules{netns="qrouter-123",backend="iptables"} 3` + "\n",
+		`stackube_proxy_rules{netns="qrouter-123",backend="ip6tables"} 0` + "\n",
+		`stackube_proxy_skipped_namespaces_total{reason="router_not_ready"} 1` + "\n",
+		"# TYPE stackube_proxy_restore_failures_total counter\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in metrics, got:\n%s", expected, body)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected healthy, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Healthz fails when the last successful sync is too old.
+	fp.metrics.lastSuccessfulSync = time.Now().Add(-2 * time.Minute)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unhealthy, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -19,7 +19,7 @@ package proxy
 import (
 	"bytes"
 	"fmt"
-	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,9 +27,8 @@ import (
 	"time"
 
 	"k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	informersV1 "k8s.io/client-go/informers/core/v1"
@@ -48,15 +47,29 @@ const (
 	minSyncPeriod       = 5 * time.Second
 	syncPeriod          = 30 * time.Second
 	burstSyncs          = 2
+	// fullSyncPeriod is the period of syncing all namespaces, other syncs
+	// only cover namespaces touched by changes.
+	fullSyncPeriod = 5 * time.Minute
+
+	// ProxyModeIPTables proxies services by iptables rules.
+	ProxyModeIPTables = "iptables"
+	// ProxyModeIPVS proxies services by IPVS virtual servers.
+	ProxyModeIPVS = "ipvs"
 )
 
-// Proxier is an iptables based proxy for connections between a localhost:port
+// Proxier is an iptables or IPVS based proxy for connections between a localhost:port
 // and services that provide the actual backends in each network.
 type Proxier struct {
-	clusterDNS        string
+	// clusterServices maps the names of services backing cluster-wide services
+	// to their virtual IPs.
+	clusterServices   map[string]string
 	kubeClientset     *kubernetes.Clientset
 	osClient          openstack.Interface
+	proxyMode         string
 	iptables          iptablesInterface
+	ip6tables         iptablesInterface
+	ipvs              ipvsInterface
+	ipvsScheduler     string
 	factory           informers.SharedInformerFactory
 	namespaceInformer informersV1.NamespaceInformer
 	serviceInformer   informersV1.ServiceInformer
@@ -83,12 +96,31 @@ type Proxier struct {
 	namespaceMap    map[string]*namespaceInfo
 	// service grouping by namespace.
 	serviceNSMap map[string]proxyServiceMap
+	// dirtyNamespaces are namespaces whose rules should be synced.
+	dirtyNamespaces sets.String
+	// lastFullSync is the time of the last sync of all namespaces.
+	lastFullSync time.Time
+	// staleNetns are netns of routers of deleted namespaces, whose rules
+	// should be removed.
+	staleNetns sets.String
+	metrics    *proxyMetrics
 	// governs calls to syncProxyRules
 	syncRunner *async.BoundedFrequencyRunner
 }
 
-// NewProxier creates a new Proxier.
-func NewProxier(kubeConfig, openstackConfig string) (*Proxier, error) {
+// NewProxier creates a new Proxier. hostname is the name of the node, which decides
+// the local endpoints of services, the hostname of the machine is used if it's empty.
+// proxyMode selects iptables or IPVS, ipvsScheduler is the default scheduler of IPVS.
+// clusterServices are the cluster-wide services reachable in every tenant router, see
+// parseClusterServices for the format.
+func NewProxier(kubeConfig, openstackConfig, hostname, proxyMode, ipvsScheduler string, clusterServices []string) (*Proxier, error) {
+	if proxyMode != ProxyModeIPTables && proxyMode != ProxyModeIPVS {
+		return nil, fmt.Errorf("unknown proxy mode %q", proxyMode)
+	}
+	if !isValidIPVSScheduler(ipvsScheduler) {
+		return nil, fmt.Errorf("unknown IPVS scheduler %q", ipvsScheduler)
+	}
+
 	// Create OpenStack client from config file.
 	osClient, err := openstack.NewClient(openstackConfig, kubeConfig)
 	if err != nil {
@@ -105,9 +137,15 @@ func NewProxier(kubeConfig, openstackConfig string) (*Proxier, error) {
 		return nil, fmt.Errorf("failed to build clientset: %v", err)
 	}
 
-	clusterDNS, err := getClusterDNS(clientset)
+	clusterServiceIPs, err := getClusterServices(clientset, clusterServices)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get cluster DNS: %v", err)
+		return nil, fmt.Errorf("failed to get cluster services: %v", err)
+	}
+
+	if hostname == "" {
+		if hostname, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %v", err)
+		}
 	}
 
 	factory := informers.NewSharedInformerFactory(clientset, defaultResyncPeriod)
@@ -117,16 +155,23 @@ func NewProxier(kubeConfig, openstackConfig string) (*Proxier, error) {
 	proxier := &Proxier{
 		kubeClientset:    clientset,
 		osClient:         osClient,
+		proxyMode:        proxyMode,
 		iptables:         NewIptables(execer),
+		ip6tables:        NewIp6tables(execer),
+		ipvs:             NewIpvs(execer),
+		ipvsScheduler:    ipvsScheduler,
 		factory:          factory,
-		clusterDNS:       clusterDNS,
-		endpointsChanges: newEndpointsChangeMap(""),
+		clusterServices:  clusterServiceIPs,
+		endpointsChanges: newEndpointsChangeMap(strings.ToLower(strings.TrimSpace(hostname))),
 		serviceChanges:   newServiceChangeMap(),
 		namespaceChanges: newNamespaceChangeMap(),
 		serviceMap:       make(proxyServiceMap),
 		endpointsMap:     make(proxyEndpointsMap),
 		namespaceMap:     make(map[string]*namespaceInfo),
 		serviceNSMap:     make(map[string]proxyServiceMap),
+		dirtyNamespaces:  sets.NewString(),
+		staleNetns:       sets.NewString(),
+		metrics:          newProxyMetrics(),
 	}
 	proxier.syncRunner = async.NewBoundedFrequencyRunner("sync-runner",
 		proxier.syncProxyRules, minSyncPeriod, syncPeriod, burstSyncs)
@@ -197,17 +242,15 @@ func (p *Proxier) onServiceDeleted(obj interface{}) {
 	}
 }
 
-func (p *Proxier) getRouterForNamespace(namespace string) (string, error) {
-	// Only support one network and network's name is same with namespace.
-	// TODO: make it general after multi-network is supported.
-	networkName := util.BuildNetworkName(namespace, namespace)
-	network, err := p.osClient.GetNetworkByName(networkName)
+func (p *Proxier) getRouterForNetwork(namespace, network string) (string, error) {
+	networkName := util.BuildNetworkName(namespace, network)
+	osNetwork, err := p.osClient.GetNetworkByName(networkName)
 	if err != nil {
 		glog.Errorf("Get network by name %q failed: %v", networkName, err)
 		return "", err
 	}
 
-	ports, err := p.osClient.ListPorts(network.Uid, "network:router_interface")
+	ports, err := p.osClient.ListPorts(osNetwork.Uid, "network:router_interface")
 	if err != nil {
 		glog.Errorf("Get port list for network %q failed: %v", networkName, err)
 		return "", err
@@ -221,6 +264,21 @@ func (p *Proxier) getRouterForNamespace(namespace string) (string, error) {
 	return ports[0].DeviceID, nil
 }
 
+// getRouter returns the router of network in namespace, the result is cached in nsInfo.
+func (p *Proxier) getRouter(namespace, network string, nsInfo *namespaceInfo) (string, error) {
+	if router, ok := nsInfo.routers[network]; ok {
+		return router, nil
+	}
+
+	router, err := p.getRouterForNetwork(namespace, network)
+	if err != nil {
+		return "", err
+	}
+
+	nsInfo.routers[network] = router
+	return router, nil
+}
+
 func (p *Proxier) onEndpointsAdded(obj interface{}) {
 	endpoints, ok := obj.(*v1.Endpoints)
 	if !ok {
@@ -419,38 +477,45 @@ func (p *Proxier) SyncLoop() error {
 	return nil
 }
 
+// updateCaches applies the accumulated changes to local caches and records the
+// namespaces touched by them in dirtyNamespaces.
 func (p *Proxier) updateCaches() {
-	// Update serviceMap.
+	// Update serviceMap and services grouping by namespace.
 	func() {
 		p.serviceChanges.lock.Lock()
 		defer p.serviceChanges.lock.Unlock()
-		for _, change := range p.serviceChanges.items {
+		for name, change := range p.serviceChanges.items {
 			existingPorts := p.serviceMap.merge(change.current)
 			p.serviceMap.unmerge(change.previous, existingPorts)
-		}
-
-		p.serviceChanges.items = make(map[types.NamespacedName]*serviceChange)
-	}()
+			p.dirtyNamespaces.Insert(name.Namespace)
 
-	// Update services grouping by namespace.
-	func() {
-		for svc := range p.serviceMap {
-			info := p.serviceMap[svc]
-			if v, ok := p.serviceNSMap[svc.Namespace]; ok {
-				v[svc] = info
-			} else {
-				p.serviceNSMap[svc.Namespace] = proxyServiceMap{svc: info}
+			services, ok := p.serviceNSMap[name.Namespace]
+			if !ok {
+				services = make(proxyServiceMap)
+				p.serviceNSMap[name.Namespace] = services
+			}
+			for _, changed := range []proxyServiceMap{change.previous, change.current} {
+				for svcPortName := range changed {
+					if info, ok := p.serviceMap[svcPortName]; ok {
+						services[svcPortName] = info
+					} else {
+						delete(services, svcPortName)
+					}
+				}
 			}
 		}
+
+		p.serviceChanges.items = make(map[types.NamespacedName]*serviceChange)
 	}()
 
 	// Update endpointsMap.
 	func() {
 		p.endpointsChanges.lock.Lock()
 		defer p.endpointsChanges.lock.Unlock()
-		for _, change := range p.endpointsChanges.items {
+		for name, change := range p.endpointsChanges.items {
 			p.endpointsMap.unmerge(change.previous)
 			p.endpointsMap.merge(change.current)
+			p.dirtyNamespaces.Insert(name.Namespace)
 		}
 
 		p.endpointsChanges.items = make(map[types.NamespacedName]*endpointsChange)
@@ -461,22 +526,24 @@ func (p *Proxier) updateCaches() {
 		p.namespaceChanges.lock.Lock()
 		defer p.namespaceChanges.lock.Unlock()
 		for n, change := range p.namespaceChanges.items {
+			p.dirtyNamespaces.Insert(n)
 			if change.current == nil {
+				if old, ok := p.namespaceMap[n]; ok {
+					for _, router := range old.routers {
+						p.staleNetns.Insert(getRouterNetns(router))
+					}
+				}
 				delete(p.namespaceMap, n)
 			} else {
-				if _, ok := p.namespaceMap[n]; !ok {
-					p.namespaceMap[n] = change.current
+				// Routers are per network, so keep those already resolved.
+				if old, ok := p.namespaceMap[n]; ok {
+					change.current.routers = old.routers
 				}
+				p.namespaceMap[n] = change.current
 
-				// get router for the namespace
-				if p.namespaceMap[n].router == "" {
-					router, err := p.getRouterForNamespace(n)
-					if err != nil {
-						glog.Warningf("Get router for namespace %q failed: %v. This may be caused by network not ready yet.", n, err)
-						continue
-					}
-
-					p.namespaceMap[n].router = router
+				// get router for the default network of the namespace
+				if _, err := p.getRouter(n, change.current.network, change.current); err != nil {
+					glog.Warningf("Get router for network %q in namespace %q failed: %v. This may be caused by network not ready yet.", change.current.network, n, err)
 				}
 			}
 		}
@@ -485,6 +552,8 @@ func (p *Proxier) updateCaches() {
 	}()
 }
 
+// syncProxyRules syncs rules of the namespaces touched by changes since the last
+// sync, or of all namespaces every fullSyncPeriod to heal drift.
 func (p *Proxier) syncProxyRules() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -495,156 +564,387 @@ func (p *Proxier) syncProxyRules() {
 		return
 	}
 
+	start := time.Now()
+	succeeded := true
+	defer func() {
+		p.metrics.observeSync(start, succeeded)
+	}()
+
 	// update local caches.
 	p.updateCaches()
 
-	glog.V(3).Infof("Syncing iptables rules")
+	namespaces := p.dirtyNamespaces
+	fullSync := time.Since(p.lastFullSync) >= fullSyncPeriod
+	if fullSync {
+		glog.V(3).Infof("Syncing iptables rules of all namespaces")
+		for namespace := range p.serviceNSMap {
+			namespaces.Insert(namespace)
+		}
+		p.lastFullSync = time.Now()
+	} else {
+		glog.V(3).Infof("Syncing iptables rules of namespaces %v", namespaces.List())
+	}
+	p.dirtyNamespaces = sets.NewString()
 
 	// iptablesData contains the iptables rules for netns.
 	iptablesData := bytes.NewBuffer(nil)
 
 	// Sync iptables rules for services.
-	for namespace := range p.serviceNSMap {
-		iptablesData.Reset()
+	for namespace := range namespaces {
+		if err := p.syncNamespaceRules(iptablesData, namespace); err != nil {
+			// Retry in the next sync.
+			p.dirtyNamespaces.Insert(namespace)
+			succeeded = false
+		}
+	}
 
-		// Step 1: get namespace info.
-		nsInfo, ok := p.namespaceMap[namespace]
-		if !ok {
-			glog.Errorf("Namespace %q doesn't exist in caches", namespace)
+	// Remove rules from the netns of routers of deleted namespaces.
+	for netns := range p.staleNetns {
+		if err := p.cleanupNetns(netns); err != nil {
+			glog.Errorf("Cleanup netns %q failed: %v", netns, err)
+			succeeded = false
 			continue
 		}
-		glog.V(3).Infof("Syncing iptables for namespace %q: %v", namespace, nsInfo)
+		p.staleNetns.Delete(netns)
+	}
 
-		// Step 2: try to get router again since router may be created late after namespaces.
-		if nsInfo.router == "" {
-			router, err := p.getRouterForNamespace(namespace)
-			if err != nil {
-				glog.Warningf("Get router for namespace %q failed: %v. This may be caused by network not ready yet.", namespace, err)
-				continue
-			}
-			nsInfo.router = router
-		}
+	// Routers of all namespaces are known after a successful full sync, so
+	// that netns not owned by any of them can be cleaned up.
+	if fullSync && p.dirtyNamespaces.Len() == 0 {
+		p.cleanupStaleNetns()
+	}
+}
 
-		// Step 3: compose iptables chain.
-		netns := getRouterNetns(nsInfo.router)
+// syncNamespaceRules writes rules of services in namespace into the netns of their
+// routers. Namespaces whose routers aren't ready are synced again in the next sync.
+func (p *Proxier) syncNamespaceRules(iptablesData *bytes.Buffer, namespace string) error {
+	services := p.serviceNSMap[namespace]
 
-		// populates netns to iptables.
-		p.iptables.setNetns(netns)
-		if !p.iptables.netnsExist() {
-			glog.V(3).Infof("Netns %q doesn't exist, omit the services in namespace %q", netns, namespace)
-			continue
+	// Step 1: get namespace info.
+	nsInfo, ok := p.namespaceMap[namespace]
+	if !ok {
+		if len(services) == 0 {
+			delete(p.serviceNSMap, namespace)
+		} else {
+			glog.Errorf("Namespace %q doesn't exist in caches", namespace)
 		}
+		return nil
+	}
+	glog.V(3).Infof("Syncing iptables for namespace %q: %v", namespace, nsInfo)
+
+	// Step 2: group services by network, services without network
+	// annotation belong to the default network of the namespace. Networks
+	// with known routers are always synced, so that rules of deleted
+	// services are flushed.
+	networkServices := make(map[string]proxyServiceMap)
+	for network := range nsInfo.routers {
+		networkServices[network] = make(proxyServiceMap)
+	}
+	for svcName, svcInfo := range services {
+		network := svcInfo.network
+		if network == "" {
+			network = nsInfo.network
+		}
+		if _, ok := networkServices[network]; !ok {
+			networkServices[network] = make(proxyServiceMap)
+		}
+		networkServices[network][svcName] = svcInfo
+	}
 
-		// ensure chain STACKUBE-PREROUTING created.
-		err := p.iptables.ensureChain()
+	var syncErr error
+	routersReady := true
+	for network, services := range networkServices {
+		// Step 3: try to get router again since router may be created late after namespaces.
+		router, err := p.getRouter(namespace, network, nsInfo)
 		if err != nil {
-			glog.Errorf("EnsureChain %q in netns %q failed: %v", ChainSKPrerouting, netns, err)
+			glog.Warningf("Get router for network %q in namespace %q failed: %v. This may be caused by network not ready yet.", network, namespace, err)
+			p.metrics.incSkippedNamespaces(skippedRouterNotReady)
+			p.dirtyNamespaces.Insert(namespace)
+			routersReady = false
 			continue
 		}
-		// link STACKUBE-PREROUTING chain.
-		err = p.iptables.ensureRule(opAddpendRule, ChainPrerouting, []string{
-			"-m", "comment", "--comment", "stackube service portals", "-j", ChainSKPrerouting,
-		})
-		if err != nil {
-			glog.Errorf("Link chain %q in netns %q failed: %v", ChainSKPrerouting, netns, err)
+
+		if err := p.syncNetworkRules(iptablesData, router, services); err != nil {
+			syncErr = err
+		}
+	}
+
+	// Services of the namespace are all gone and their rules flushed.
+	if syncErr == nil && routersReady && len(services) == 0 {
+		delete(p.serviceNSMap, namespace)
+	}
+	return syncErr
+}
+
+// syncNetworkRules writes iptables rules of services into the netns of router.
+func (p *Proxier) syncNetworkRules(iptablesData *bytes.Buffer, router string, services proxyServiceMap) error {
+	netns := getRouterNetns(router)
+	if p.proxyMode == ProxyModeIPVS {
+		return p.syncIPVSRules(netns, services)
+	}
+
+	// Step 4: split services by IP family of cluster IP, rules of IPv6 services
+	// are written by ip6tables. Both families are always synced, so that rules
+	// of deleted services are flushed.
+	ipv4Services := make(proxyServiceMap)
+	ipv6Services := make(proxyServiceMap)
+	for svcName, svcInfo := range services {
+		if isIPv6(svcInfo.clusterIP.String()) {
+			ipv6Services[svcName] = svcInfo
+		} else {
+			ipv4Services[svcName] = svcInfo
+		}
+	}
+
+	if err := p.syncFamilyRules(p.iptables, iptablesData, netns, ipv4Services, false); err != nil {
+		return err
+	}
+	return p.syncFamilyRules(p.ip6tables, iptablesData, netns, ipv6Services, true)
+}
+
+// syncFamilyRules writes rules of services of one IP family into netns by ipt.
+func (p *Proxier) syncFamilyRules(ipt iptablesInterface, iptablesData *bytes.Buffer, netns string, services proxyServiceMap, ipv6 bool) error {
+	iptablesData.Reset()
+	hostMask := 32
+	if ipv6 {
+		hostMask = 128
+	}
+
+	// populates netns to iptables.
+	ipt.setNetns(netns)
+	if !ipt.netnsExist() {
+		glog.V(3).Infof("Netns %q doesn't exist, omit the services %v", netns, services)
+		p.metrics.incSkippedNamespaces(skippedNetnsMissing)
+		return nil
+	}
+
+	// ensure chain STACKUBE-PREROUTING created.
+	err := ipt.ensureChain()
+	if err != nil {
+		glog.Errorf("EnsureChain %q in netns %q failed: %v", ChainSKPrerouting, netns, err)
+		return err
+	}
+	// link STACKUBE-PREROUTING chain.
+	err = ipt.ensureRule(opAddpendRule, ChainPrerouting, skPreroutingJumpArgs)
+	if err != nil {
+		glog.Errorf("Link chain %q in netns %q failed: %v", ChainSKPrerouting, netns, err)
+		return err
+	}
+
+	// Step 5: flush chain STACKUBE-PREROUTING.
+	writeLine(iptablesData, []string{"*nat"}...)
+	writeLine(iptablesData, []string{":" + ChainSKPrerouting, "-", "[0:0]"}...)
+	writeLine(iptablesData, []string{opFlushChain, ChainSKPrerouting}...)
+	writeLine(iptablesData, []string{"COMMIT"}...)
+
+	// Chains of removed services and endpoints are found among existing chains.
+	existingChains, err := ipt.listChains()
+	if err != nil {
+		glog.Errorf("List chains in netns %q failed: %v", netns, err)
+		return err
+	}
+
+	// Step 6: compose rules for each services. Chains are declared (and
+	// flushed) before all rules, so that rules could jump to any of them.
+	glog.V(5).Infof("Syncing iptables for services %v", services)
+	natChains := bytes.NewBuffer(nil)
+	natRules := bytes.NewBuffer(nil)
+	activeChains := make(map[string]bool)
+	for svcName, svcInfo := range services {
+		// Step 6.1: check service type.
+		// ClusterIP and NodePort are handled here, note that:
+		// - NodePort is exposed on the router's external gateway since networks are L2 isolated.
+		// - LoadBalancer service is handled in service controller, its ingress IPs
+		//   are only translated here for connections passing the router.
+		// - ExternalName service is resolved by kube-dns of the namespace, it's never proxied.
+		if svcInfo.serviceType == v1.ServiceTypeLoadBalancer {
+			glog.V(3).Infof("Load balancer of service %q is handled by service controller", svcName.NamespacedName)
+		}
+
+		// Step 6.2: check endpoints.
+		// If the service has no endpoints then do nothing.
+		if len(p.endpointsMap[svcName]) == 0 {
+			glog.V(3).Infof("No endpoints found for service %q", svcName.NamespacedName)
 			continue
 		}
 
-		// Step 4: flush chain STACKUBE-PREROUTING.
-		writeLine(iptablesData, []string{"*nat"}...)
-		writeLine(iptablesData, []string{":" + ChainSKPrerouting, "-", "[0:0]"}...)
-		writeLine(iptablesData, []string{opFlushChain, ChainSKPrerouting}...)
-		writeLine(iptablesData, []string{"COMMIT"}...)
-
-		// Step 5: compose rules for each services.
-		glog.V(5).Infof("Syncing iptables for services %v", p.serviceNSMap[namespace])
-		writeLine(iptablesData, []string{"*nat"}...)
-		for svcName, svcInfo := range p.serviceNSMap[namespace] {
-			protocol := strings.ToLower(string(svcInfo.protocol))
-			svcNameString := svcInfo.serviceNameString
-
-			// Step 5.1: check service type.
-			// Only ClusterIP service is supported. We also handles clusterIP for other typed services, but note that:
-			// - NodePort service is not supported since networks are L2 isolated.
-			// - LoadBalancer service is handled in service controller.
-			if svcInfo.serviceType != v1.ServiceTypeClusterIP {
-				glog.V(3).Infof("Only service's clusterIP is handled here, omitting other fields of service %q (type=%q)", svcName.NamespacedName, svcInfo.serviceType)
+		// Step 6.3: generate the service chain and the per-endpoint chains.
+		p.writeServiceChains(natChains, natRules, activeChains, svcName, svcInfo)
+
+		// Step 6.4: jump to the service chain from the cluster IP, the virtual IP of
+		// the cluster-wide service it backs and external IPs.
+		// -A STACKUBE-PREROUTING -m comment --comment "default/http: cluster IP"
+		// -m tcp -p tcp -d 10.108.230.103/32 --dport 80 -j KUBE-SVC-XXX
+		clusterIP := svcInfo.clusterIP.String()
+		writeJumpRule(natRules, svcInfo, svcInfo.servicePortChainName, "cluster IP", []string{
+			"-d", fmt.Sprintf("%s/%d", clusterIP, hostMask),
+			"--dport", strconv.Itoa(svcInfo.port),
+		})
+		if vip := p.getClusterServiceIP(svcInfo); vip != "" && vip != clusterIP {
+			if isIPv6(vip) == ipv6 {
+				writeJumpRule(natRules, svcInfo, svcInfo.servicePortChainName, "cluster service IP", []string{
+					"-d", fmt.Sprintf("%s/%d", vip, hostMask),
+					"--dport", strconv.Itoa(svcInfo.port),
+				})
+			} else {
+				glog.Warningf("Virtual IP %q of cluster service %q isn't in the IP family of service %q", vip, svcInfo.name, svcName.NamespacedName)
 			}
-
-			// Step 5.2: check endpoints.
-			// If the service has no endpoints then do nothing.
-			if len(p.endpointsMap[svcName]) == 0 {
-				glog.V(3).Infof("No endpoints found for service %q", svcName.NamespacedName)
+		}
+		for _, ip := range svcInfo.externalIPs {
+			if isIPv6(ip) != ipv6 {
 				continue
 			}
+			writeJumpRule(natRules, svcInfo, svcInfo.servicePortChainName, "external IP", []string{
+				"-d", fmt.Sprintf("%s/%d", ip, hostMask),
+				"--dport", strconv.Itoa(svcInfo.port),
+			})
+		}
 
-			// Step 5.3: Generate the per-endpoint rules.
-			// -A STACKUBE-PREROUTING -d 10.108.230.103  -m comment --comment "default/http: cluster IP"
-			// -m tcp -p tcp --dport 80 -m statistic --mode random --probability 1.0
-			// -j DNAT --to-destination 192.168.1.7:80
-			n := len(p.endpointsMap[svcName])
-			for i, ep := range p.endpointsMap[svcName] {
-				args := []string{
-					"-A", ChainSKPrerouting,
-					"-m", "comment", "--comment", svcNameString,
-					"-m", protocol, "-p", protocol,
-					"-d", fmt.Sprintf("%s/32", p.getServiceIP(svcInfo)),
-					"--dport", strconv.Itoa(svcInfo.port),
-				}
-
-				if i < (n - 1) {
-					// Each rule is a probabilistic match.
-					args = append(args,
-						"-m", "statistic",
-						"--mode", "random",
-						"--probability", probability(n-i))
-				}
-
-				// The final (or only if n == 1) rule is a guaranteed match.
-				args = append(args, "-j", "DNAT", "--to-destination", ep.endpoint)
-				writeLine(iptablesData, args...)
+		// Step 6.5: jump from the load balancer ingress IPs and the node port, which
+		// matches connections to the router's own addresses on its external gateway.
+		// Services with external traffic policy Local only balance them to local endpoints.
+		// -A STACKUBE-PREROUTING -m comment --comment "default/http: node port"
+		// -m tcp -p tcp -i qg-+ -m addrtype --dst-type LOCAL --dport 30080 -j KUBE-XLB-XXX
+		externalChain := svcInfo.servicePortChainName
+		if svcInfo.onlyNodeLocalEndpoints {
+			externalChain = svcInfo.serviceLBChainName
+		}
+		for _, ingress := range svcInfo.loadBalancerStatus.Ingress {
+			if ingress.IP == "" || isIPv6(ingress.IP) != ipv6 {
+				continue
 			}
+			writeJumpRule(natRules, svcInfo, externalChain, "loadbalancer IP", []string{
+				"-d", fmt.Sprintf("%s/%d", ingress.IP, hostMask),
+				"--dport", strconv.Itoa(svcInfo.port),
+			})
+		}
+		if svcInfo.nodePort != 0 {
+			writeJumpRule(natRules, svcInfo, externalChain, "node port", []string{
+				"-i", routerGatewayInterfaces,
+				"-m", "addrtype", "--dst-type", "LOCAL",
+				"--dport", strconv.Itoa(svcInfo.nodePort),
+			})
 		}
-		writeLine(iptablesData, []string{"COMMIT"}...)
+	}
 
-		// Step 6: execute iptables-restore.
-		err = p.iptables.restoreAll(iptablesData.Bytes())
-		if err != nil {
-			glog.Errorf("Failed to execute iptables-restore: %v", err)
+	// Step 7: delete chains of removed services and endpoints, they are
+	// flushed by declaring them first.
+	for _, chain := range existingChains {
+		if activeChains[chain] || !isServiceChain(chain) {
 			continue
 		}
+		writeLine(natChains, []string{":" + chain, "-", "[0:0]"}...)
+		writeLine(natRules, []string{opDeleteChain, chain}...)
+	}
+
+	writeLine(iptablesData, []string{"*nat"}...)
+	iptablesData.Write(natChains.Bytes())
+	iptablesData.Write(natRules.Bytes())
+	writeLine(iptablesData, []string{"COMMIT"}...)
+
+	// Step 8: execute iptables-restore or ip6tables-restore.
+	backend := backendIPTables
+	if ipv6 {
+		backend = backendIP6Tables
 	}
+	err = ipt.restoreAll(iptablesData.Bytes())
+	if err != nil {
+		glog.Errorf("Failed to execute iptables-restore: %v", err)
+		p.metrics.incRestoreFailures(backend)
+		return err
+	}
+	p.metrics.setRules(netns, backend, countRules(natRules.Bytes()))
+	return nil
 }
 
-func (p *Proxier) getServiceIP(serviceInfo *serviceInfo) string {
-	if serviceInfo.name == "kube-dns" {
-		return p.clusterDNS
+// writeServiceChains writes the chain of each endpoint of the service and the
+// service chain balancing connections among them. Services with external traffic
+// policy Local get a KUBE-XLB chain balancing connections among local endpoints too,
+// which stays empty (i.e. connections are not translated) without local endpoints.
+func (p *Proxier) writeServiceChains(natChains, natRules *bytes.Buffer, activeChains map[string]bool, svcName servicePortName, svcInfo *serviceInfo) {
+	protocol := strings.ToLower(string(svcInfo.protocol))
+	var endpointChains, localEndpointChains []string
+	for _, ep := range p.endpointsMap[svcName] {
+		epChain := ep.endpointChain(svcInfo.serviceNameString, protocol)
+		endpointChains = append(endpointChains, epChain)
+		if ep.isLocal {
+			localEndpointChains = append(localEndpointChains, epChain)
+		}
+
+		// -A KUBE-SEP-XXX -m comment --comment default/http: -m tcp -p tcp
+		// -m recent --name KUBE-SEP-XXX --set -j DNAT --to-destination 192.168.1.7:80
+		writeLine(natChains, []string{":" + epChain, "-", "[0:0]"}...)
+		activeChains[epChain] = true
+		args := []string{
+			"-A", epChain,
+			"-m", "comment", "--comment", svcInfo.serviceNameString,
+			"-m", protocol, "-p", protocol,
+		}
+		if svcInfo.sessionAffinityType == v1.ServiceAffinityClientIP {
+			args = append(args, "-m", "recent", "--name", epChain, "--set")
+		}
+		args = append(args, "-j", "DNAT", "--to-destination", ep.endpoint)
+		writeLine(natRules, args...)
 	}
 
-	return serviceInfo.clusterIP.String()
+	writeBalancingChain(natChains, natRules, activeChains, svcInfo, svcInfo.servicePortChainName, endpointChains)
+	if svcInfo.onlyNodeLocalEndpoints {
+		writeBalancingChain(natChains, natRules, activeChains, svcInfo, svcInfo.serviceLBChainName, localEndpointChains)
+	}
 }
 
-func getClusterDNS(client *kubernetes.Clientset) (string, error) {
-	dnssvc, err := client.CoreV1().Services(metav1.NamespaceSystem).Get("kube-dns", metav1.GetOptions{})
-	if err == nil && len(dnssvc.Spec.ClusterIP) > 0 {
-		return dnssvc.Spec.ClusterIP, nil
+// writeBalancingChain writes chain balancing connections among endpointChains. With
+// ClientIP session affinity, connections of a client seen by an endpoint within the
+// timeout go to the same endpoint.
+func writeBalancingChain(natChains, natRules *bytes.Buffer, activeChains map[string]bool, svcInfo *serviceInfo, chain string, endpointChains []string) {
+	writeLine(natChains, []string{":" + chain, "-", "[0:0]"}...)
+	activeChains[chain] = true
+
+	// -A KUBE-SVC-XXX -m comment --comment default/http: -m recent --name KUBE-SEP-XXX
+	// --rcheck --seconds 10800 --reap -j KUBE-SEP-XXX
+	if svcInfo.sessionAffinityType == v1.ServiceAffinityClientIP {
+		for _, epChain := range endpointChains {
+			writeLine(natRules, []string{
+				"-A", chain,
+				"-m", "comment", "--comment", svcInfo.serviceNameString,
+				"-m", "recent", "--name", epChain,
+				"--rcheck", "--seconds", strconv.Itoa(svcInfo.stickyMaxAgeSeconds), "--reap",
+				"-j", epChain,
+			}...)
+		}
 	}
 
-	if apierrors.IsNotFound(err) {
-		// get from default namespace.
-		k8ssvc, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("kubernetes", metav1.GetOptions{})
-		if err != nil {
-			return "", fmt.Errorf("couldn't fetch information about the kubernetes service: %v", err)
+	// -A KUBE-SVC-XXX -m comment --comment default/http: -m statistic --mode random
+	// --probability 0.50000 -j KUBE-SEP-XXX
+	n := len(endpointChains)
+	for i, epChain := range endpointChains {
+		args := []string{
+			"-A", chain,
+			"-m", "comment", "--comment", svcInfo.serviceNameString,
 		}
-
-		// Build an IP by taking the kubernetes service's clusterIP and appending a "0" and checking that it's valid
-		dnsIP := net.ParseIP(fmt.Sprintf("%s0", k8ssvc.Spec.ClusterIP))
-		if dnsIP == nil {
-			return "", fmt.Errorf("could not parse dns ip %q: %v", dnsIP, err)
+		if i < (n - 1) {
+			// Each rule is a probabilistic match.
+			args = append(args,
+				"-m", "statistic",
+				"--mode", "random",
+				"--probability", probability(n-i))
 		}
-
-		return dnsIP.String(), nil
+		// The final (or only if n == 1) rule is a guaranteed match.
+		args = append(args, "-j", epChain)
+		writeLine(natRules, args...)
 	}
+}
 
-	return "", err
+// writeJumpRule writes rule jumping from STACKUBE-PREROUTING to chain for connections
+// to the service matched by args.
+func writeJumpRule(natRules *bytes.Buffer, svcInfo *serviceInfo, chain, comment string, args []string) {
+	protocol := strings.ToLower(string(svcInfo.protocol))
+	ruleArgs := []string{
+		"-A", ChainSKPrerouting,
+		"-m", "comment", "--comment", fmt.Sprintf(`"%s %s"`, svcInfo.serviceNameString, comment),
+		"-m", protocol, "-p", protocol,
+	}
+	ruleArgs = append(ruleArgs, args...)
+	ruleArgs = append(ruleArgs, "-j", chain)
+	writeLine(natRules, ruleArgs...)
 }
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// syncIPVSRules writes virtual servers of services into the netns of router. Only
+// the differences with existing virtual servers are applied, so that unchanged
+// services are not touched.
+func (p *Proxier) syncIPVSRules(netns string, services proxyServiceMap) error {
+	// populates netns to ipvs.
+	p.ipvs.setNetns(netns)
+	if !p.ipvs.netnsExist() {
+		glog.V(3).Infof("Netns %q doesn't exist, omit the services %v", netns, services)
+		p.metrics.incSkippedNamespaces(skippedNetnsMissing)
+		return nil
+	}
+
+	// Step 4: ensure the dummy device holding virtual IPs, connections to local
+	// addresses are handled by IPVS.
+	err := p.ipvs.ensureDummyDevice()
+	if err != nil {
+		glog.Errorf("Ensure device %q in netns %q failed: %v", ipvsDummyDevice, netns, err)
+		return err
+	}
+	gatewayAddresses, err := p.ipvs.listAddresses(routerGatewayDevicePrefix)
+	if err != nil {
+		glog.Errorf("List gateway addresses in netns %q failed: %v", netns, err)
+		return err
+	}
+	boundAddresses, err := p.ipvs.listAddresses(ipvsDummyDevice)
+	if err != nil {
+		glog.Errorf("List addresses of %q in netns %q failed: %v", ipvsDummyDevice, netns, err)
+		return err
+	}
+	currentServers, err := p.ipvs.listVirtualServers()
+	if err != nil {
+		glog.Errorf("List virtual servers in netns %q failed: %v", netns, err)
+		return err
+	}
+
+	// Step 5: compose virtual servers for each services.
+	wantedServers := make(map[string]*virtualServer)
+	wantedAddresses := make(map[string]bool)
+	for svcName, svcInfo := range services {
+		// Step 5.1: check endpoints.
+		// If the service has no endpoints then do nothing.
+		endpoints := p.endpointsMap[svcName]
+		if len(endpoints) == 0 {
+			glog.V(3).Infof("No endpoints found for service %q", svcName.NamespacedName)
+			continue
+		}
+
+		// Step 5.2: compose the real servers, services with external traffic policy
+		// Local only send connections from outside to local endpoints.
+		var realServers, localRealServers []string
+		for _, ep := range endpoints {
+			realServers = append(realServers, ep.endpoint)
+			if ep.isLocal {
+				localRealServers = append(localRealServers, ep.endpoint)
+			}
+		}
+		sort.Strings(realServers)
+		sort.Strings(localRealServers)
+		externalRealServers := realServers
+		if svcInfo.onlyNodeLocalEndpoints {
+			externalRealServers = localRealServers
+		}
+
+		scheduler := svcInfo.ipvsScheduler
+		if scheduler == "" {
+			scheduler = p.ipvsScheduler
+		}
+		persistence := 0
+		if svcInfo.sessionAffinityType == v1.ServiceAffinityClientIP {
+			persistence = svcInfo.stickyMaxAgeSeconds
+		}
+
+		// Virtual servers and real servers must be in the same IP family.
+		serviceIP := svcInfo.clusterIP.String()
+		ipv6 := isIPv6(serviceIP)
+		addVirtualServer := func(ip string, port int, realServers []string, bind bool) {
+			if isIPv6(ip) != ipv6 {
+				return
+			}
+			vs := &virtualServer{
+				protocol:    strings.ToLower(string(svcInfo.protocol)),
+				address:     net.JoinHostPort(ip, strconv.Itoa(port)),
+				scheduler:   scheduler,
+				persistence: persistence,
+				realServers: realServers,
+			}
+			wantedServers[vs.key()] = vs
+			if bind {
+				wantedAddresses[ip] = true
+			}
+		}
+
+		// Step 5.3: virtual servers of the cluster IP, the virtual IP of the
+		// cluster-wide service it backs and external IPs. Only cluster IPs are
+		// bound, external IPs are owned by Neutron and must not be answered by
+		// the router.
+		addVirtualServer(serviceIP, svcInfo.port, realServers, true)
+		if vip := p.getClusterServiceIP(svcInfo); vip != "" {
+			addVirtualServer(vip, svcInfo.port, realServers, true)
+		}
+		for _, ip := range svcInfo.externalIPs {
+			addVirtualServer(ip, svcInfo.port, realServers, false)
+		}
+
+		// Step 5.4: virtual servers of the load balancer ingress IPs and the
+		// node port on the router's own addresses on its external gateway.
+		for _, ingress := range svcInfo.loadBalancerStatus.Ingress {
+			if ingress.IP != "" {
+				addVirtualServer(ingress.IP, svcInfo.port, externalRealServers, false)
+			}
+		}
+		if svcInfo.nodePort != 0 {
+			for _, ip := range gatewayAddresses {
+				addVirtualServer(ip, svcInfo.nodePort, externalRealServers, false)
+			}
+		}
+	}
+
+	// Step 6: bind the new virtual IPs before adding their virtual servers.
+	// Failures of binding addresses are retried in the next sync.
+	var bindErr error
+	bound := make(map[string]bool)
+	for _, ip := range boundAddresses {
+		bound[ip] = true
+	}
+	for ip := range wantedAddresses {
+		if bound[ip] {
+			continue
+		}
+		if err := p.ipvs.bindAddress(ip); err != nil {
+			glog.Errorf("Bind address %q in netns %q failed: %v", ip, netns, err)
+			bindErr = err
+		}
+	}
+
+	// Step 7: execute ipvsadm --restore with the differences.
+	ipvsData := bytes.NewBuffer(nil)
+	writeIPVSRules(ipvsData, currentServers, wantedServers)
+	if ipvsData.Len() > 0 {
+		if err := p.ipvs.restoreAll(ipvsData.Bytes()); err != nil {
+			glog.Errorf("Failed to execute ipvsadm --restore: %v", err)
+			p.metrics.incRestoreFailures(backendIPVS)
+			return err
+		}
+	}
+	p.metrics.setRules(netns, backendIPVS, len(wantedServers))
+
+	// Step 8: unbind the virtual IPs of removed services.
+	for _, ip := range boundAddresses {
+		if wantedAddresses[ip] {
+			continue
+		}
+		if err := p.ipvs.unbindAddress(ip); err != nil {
+			glog.Errorf("Unbind address %q in netns %q failed: %v", ip, netns, err)
+			bindErr = err
+		}
+	}
+
+	return bindErr
+}
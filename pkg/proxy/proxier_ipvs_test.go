@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2017 OpenStack Foundation.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestIPVSVirtualServers(t *testing.T) {
+	testNamespace := "test"
+	svcPortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc1"),
+		Port:           "80",
+	}
+	_, fp := newTestProxier(t, testNamespace)
+	fp.proxyMode = ProxyModeIPVS
+	ipvs := fp.ipvs.(*FakeIPVS)
+	ipvs.GatewayAddresses["qrouter-123"] = []string{"172.24.4.5"}
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName.Namespace, svcPortName.Name, func(svc *v1.Service) {
+			svc.Annotations[ipvsSchedulerAnnotation] = ipvsSchedulerLeastConnection
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.ExternalIPs = []string{"5.6.7.8"}
+			svc.Spec.Type = v1.ServiceTypeNodePort
+			svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+			svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName.Port,
+				Port:     80,
+				NodePort: 30080,
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+	localNode := testHostname
+	endpoints := makeTestEndpoints(svcPortName.Namespace, svcPortName.Name, func(ept *v1.Endpoints) {
+		ept.Subsets = []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.1", NodeName: &localNode}, {IP: "192.168.0.2"}},
+			Ports: []v1.EndpointPort{{
+				Name: svcPortName.Port,
+				Port: 8080,
+			}},
+		}}
+	})
+	makeEndpointsMap(fp, endpoints)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+
+	expected := map[string]*virtualServer{
+		"tcp/1.2.3.4:80": {
+			protocol:    "tcp",
+			address:     "1.2.3.4:80",
+			scheduler:   ipvsSchedulerLeastConnection,
+			persistence: defaultStickyMaxAgeSeconds,
+			realServers: []string{"192.168.0.1:8080", "192.168.0.2:8080"},
+		},
+		"tcp/5.6.7.8:80": {
+			protocol:    "tcp",
+			address:     "5.6.7.8:80",
+			scheduler:   ipvsSchedulerLeastConnection,
+			persistence: defaultStickyMaxAgeSeconds,
+			realServers: []string{"192.168.0.1:8080", "192.168.0.2:8080"},
+		},
+		"tcp/172.24.4.5:30080": {
+			protocol:    "tcp",
+			address:     "172.24.4.5:30080",
+			scheduler:   ipvsSchedulerLeastConnection,
+			persistence: defaultStickyMaxAgeSeconds,
+			realServers: []string{"192.168.0.1:8080"},
+		},
+	}
+	if !reflect.DeepEqual(expected, ipvs.NSServers["qrouter-123"]) {
+		t.Errorf("Expected virtual servers %v, got %v", expected, ipvs.NSServers["qrouter-123"])
+	}
+	if !reflect.DeepEqual(map[string]bool{"1.2.3.4": true}, ipvs.NSAddresses["qrouter-123"]) {
+		t.Errorf("Expected cluster IP bound, got %v", ipvs.NSAddresses["qrouter-123"])
+	}
+
+	// Virtual servers and addresses are removed with the endpoints.
+	fp.onEndpointDeleted(endpoints)
+	fp.syncProxyRules()
+	if len(ipvs.NSServers["qrouter-123"]) != 0 || len(ipvs.NSAddresses["qrouter-123"]) != 0 {
+		t.Errorf("Expected no virtual servers, got %v and addresses %v",
+			ipvs.NSServers["qrouter-123"], ipvs.NSAddresses["qrouter-123"])
+	}
+}
+
+func TestIPVSCleanupNetns(t *testing.T) {
+	_, fp := newTestProxier(t, "test")
+	fp.proxyMode = ProxyModeIPVS
+	ipvs := fp.ipvs.(*FakeIPVS)
+	ipvs.setNetns("qrouter-999")
+	ipvs.ensureDummyDevice()
+	ipvs.bindAddress("1.2.3.4")
+	ipvs.restoreAll([]byte("-A -t 1.2.3.4:80 -s rr\n-a -t 1.2.3.4:80 -r 192.168.0.1:80 -m\n" +
+		"-A -t 172.24.4.5:8080 -s rr\n-a -t 172.24.4.5:8080 -r 10.0.0.10:8080 -m\n"))
+	// Virtual servers of netns without addresses on the dummy device aren't owned
+	// by stackube-proxy.
+	ipvs.setNetns("qrouter-888")
+	ipvs.restoreAll([]byte("-A -t 10.0.0.1:80 -s rr\n-a -t 10.0.0.1:80 -r 10.0.0.10:80 -m\n"))
+
+	for _, netns := range []string{"qrouter-999", "qrouter-888"} {
+		if err := fp.cleanupNetns(netns); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+	}
+	if _, ok := ipvs.NSServers["qrouter-999"]["tcp/1.2.3.4:80"]; ok || len(ipvs.NSAddresses["qrouter-999"]) != 0 {
+		t.Errorf("Expected no virtual servers of bound addresses, got %v and addresses %v",
+			ipvs.NSServers["qrouter-999"], ipvs.NSAddresses["qrouter-999"])
+	}
+	if _, ok := ipvs.NSServers["qrouter-999"]["tcp/172.24.4.5:8080"]; !ok {
+		t.Errorf("Expected virtual server of unbound address kept, got %v", ipvs.NSServers["qrouter-999"])
+	}
+	if len(ipvs.NSServers["qrouter-888"]) != 1 {
+		t.Errorf("Expected virtual servers of netns without dummy device kept, got %v", ipvs.NSServers["qrouter-888"])
+	}
+}
@@ -19,6 +19,8 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,6 +34,7 @@ import (
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/kubernetes/pkg/util/async"
 )
 
@@ -55,7 +58,7 @@ func defaultNetwork(networkName, uid string) *drivertypes.Network {
 	}
 }
 
-func Test_getServiceIP(t *testing.T) {
+func Test_getClusterServiceIP(t *testing.T) {
 	fp := NewFakeProxier(nil, nil)
 
 	testCases := []struct {
@@ -68,45 +71,60 @@ func Test_getServiceIP(t *testing.T) {
 	}, {
 		// Case[1]: other service.
 		serviceInfo: newFakeServiceInfo("test", net.IPv4(1, 2, 3, 4)),
-		expected:    "1.2.3.4",
+		expected:    "",
 	},
 	}
 
 	for tci, tc := range testCases {
 		// outputs
-		clusterIP := fp.getServiceIP(tc.serviceInfo)
+		vip := fp.getClusterServiceIP(tc.serviceInfo)
 
-		if clusterIP != tc.expected {
-			t.Errorf("Case[%d] expected %#v, got %#v", tci, tc.expected, clusterIP)
+		if vip != tc.expected {
+			t.Errorf("Case[%d] expected %#v, got %#v", tci, tc.expected, vip)
 		}
 	}
 }
 
-const testclusterDNS = "10.20.30.40"
+const (
+	testclusterDNS = "10.20.30.40"
+	testHostname   = "node1"
+)
 
 func NewFakeProxier(ipt iptablesInterface, osClient openstack.Interface) *Proxier {
 	p := &Proxier{
-		clusterDNS:       testclusterDNS,
+		clusterServices:  map[string]string{"kube-dns": testclusterDNS},
 		osClient:         osClient,
 		iptables:         ipt,
-		endpointsChanges: newEndpointsChangeMap(""),
+		ip6tables:        NewFake(),
+		ipvs:             NewFakeIPVS(),
+		proxyMode:        ProxyModeIPTables,
+		ipvsScheduler:    defaultIPVSScheduler,
+		endpointsChanges: newEndpointsChangeMap(testHostname),
 		serviceChanges:   newServiceChangeMap(),
 		namespaceChanges: newNamespaceChangeMap(),
 		serviceMap:       make(proxyServiceMap),
 		endpointsMap:     make(proxyEndpointsMap),
 		namespaceMap:     make(map[string]*namespaceInfo),
 		serviceNSMap:     make(map[string]proxyServiceMap),
+		dirtyNamespaces:  sets.NewString(),
+		staleNetns:       sets.NewString(),
+		metrics:          newProxyMetrics(),
 	}
 
 	p.syncRunner = async.NewBoundedFrequencyRunner("test-sync-runner", p.syncProxyRules, 0, time.Minute, 1)
 	return p
 }
 
-func hasDNAT(rules []Rule, endpoint string) bool {
+// hasDNAT returns true if rules translate connections to endpoint, following
+// the jumps to service and endpoint chains.
+func hasDNAT(ipt *FakeIPTables, namespace string, rules []Rule, endpoint string) bool {
 	for _, r := range rules {
 		if r[ToDest] == endpoint {
 			return true
 		}
+		if isServiceChain(r[Jump]) && hasDNAT(ipt, namespace, ipt.GetRules(r[Jump], namespace), endpoint) {
+			return true
+		}
 	}
 	return false
 }
@@ -371,11 +389,170 @@ func TestClusterIPEndpointsJump(t *testing.T) {
 	if len(stackubeRules) == 0 {
 		errorf(fmt.Sprintf("Unexpected rule for chain %v with endpoints in namespace %v", ChainSKPrerouting, svcPortName.Namespace), stackubeRules, t)
 	}
-	if !hasDNAT(stackubeRules, epStr) {
+	if !hasDNAT(ipt, "qrouter-123", stackubeRules, epStr) {
 		errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", ChainSKPrerouting, epStr), stackubeRules, t)
 	}
 }
 
+func TestNodePortEndpointsJump(t *testing.T) {
+	testNamespace := "test"
+	svcIP := "1.2.3.4"
+	svcPort := 80
+	svcNodePort := 30080
+	svcPortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc1"),
+		Port:           "80",
+	}
+
+	// Creates fake iptables.
+	ipt := NewFake()
+	// Creates fake CRD client.
+	crdClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatal("Failed init fake CRD client")
+	}
+	// Create a fake openstack client.
+	osClient := openstack.NewFake(crdClient)
+	// Injects fake network.
+	networkName := util.BuildNetworkName(testNamespace, testNamespace)
+	osClient.SetNetwork(defaultNetwork(networkName, defaultNetworkID))
+	// Injects fake port.
+	osClient.SetPort(defaultNetworkID, deviceOwner, defaultPortID)
+	// Creates a new fake proxier.
+	fp := NewFakeProxier(ipt, osClient)
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName.Namespace, svcPortName.Name, func(svc *v1.Service) {
+			svc.Spec.ClusterIP = svcIP
+			svc.Spec.Type = v1.ServiceTypeNodePort
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName.Port,
+				Port:     int32(svcPort),
+				NodePort: int32(svcNodePort),
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+		// ExternalName services are resolved by kube-dns, they never get rules.
+		makeTestService(svcPortName.Namespace, "external", func(svc *v1.Service) {
+			svc.Spec.Type = v1.ServiceTypeExternalName
+			svc.Spec.ExternalName = "example.com"
+		}),
+	)
+
+	epIP := "192.168.0.1"
+	makeEndpointsMap(fp,
+		makeTestEndpoints(svcPortName.Namespace, svcPortName.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{
+					IP: epIP,
+				}},
+				Ports: []v1.EndpointPort{{
+					Name: svcPortName.Port,
+					Port: int32(svcPort),
+				}},
+			}}
+		}),
+	)
+
+	makeNamespaceMap(fp, makeTestNamespace(svcPortName.Namespace))
+
+	fp.syncProxyRules()
+
+	epStr := fmt.Sprintf("%s:%d", epIP, svcPort)
+	stackubeRules := ipt.GetRules(ChainSKPrerouting, "qrouter-123")
+	if len(stackubeRules) != 2 {
+		errorf(fmt.Sprintf("Expected cluster IP and node port rules for chain %v", ChainSKPrerouting), stackubeRules, t)
+	}
+	found := false
+	for _, r := range stackubeRules {
+		if r[InInterface] == routerGatewayInterfaces && r[DPort] == strconv.Itoa(svcNodePort) &&
+			hasDNAT(ipt, "qrouter-123", []Rule{r}, epStr) {
+			found = true
+		}
+	}
+	if !found {
+		errorf(fmt.Sprintf("Chain %v lacks DNAT from node port %d to %v", ChainSKPrerouting, svcNodePort, epStr), stackubeRules, t)
+	}
+}
+
+func TestDualStackService(t *testing.T) {
+	testNamespace := "test"
+	svcPort := 80
+	svc4PortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc4"),
+		Port:           "80",
+	}
+	svc6PortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc6"),
+		Port:           "80",
+	}
+
+	// Creates fake iptables.
+	ipt := NewFake()
+	// Creates fake CRD client.
+	crdClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatal("Failed init fake CRD client")
+	}
+	// Create a fake openstack client.
+	osClient := openstack.NewFake(crdClient)
+	// Injects fake network.
+	networkName := util.BuildNetworkName(testNamespace, testNamespace)
+	osClient.SetNetwork(defaultNetwork(networkName, defaultNetworkID))
+	// Injects fake port.
+	osClient.SetPort(defaultNetworkID, deviceOwner, defaultPortID)
+	// Creates a new fake proxier.
+	fp := NewFakeProxier(ipt, osClient)
+	ip6t := fp.ip6tables.(*FakeIPTables)
+
+	makeService := func(portName servicePortName, clusterIP string) *v1.Service {
+		return makeTestService(portName.Namespace, portName.Name, func(svc *v1.Service) {
+			svc.Spec.ClusterIP = clusterIP
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     portName.Port,
+				Port:     int32(svcPort),
+				Protocol: v1.ProtocolTCP,
+			}}
+		})
+	}
+	makeServiceMap(fp,
+		makeService(svc4PortName, "1.2.3.4"),
+		makeService(svc6PortName, "fd00::10"),
+	)
+
+	makeEndpoints := func(portName servicePortName, epIP string) *v1.Endpoints {
+		return makeTestEndpoints(portName.Namespace, portName.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{
+					IP: epIP,
+				}},
+				Ports: []v1.EndpointPort{{
+					Name: portName.Port,
+					Port: int32(svcPort),
+				}},
+			}}
+		})
+	}
+	makeEndpointsMap(fp,
+		makeEndpoints(svc4PortName, "192.168.0.1"),
+		makeEndpoints(svc6PortName, "fd00:1::5"),
+	)
+
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+
+	ipv4Rules := ipt.GetRules(string(ChainSKPrerouting), "qrouter-123")
+	if len(ipv4Rules) != 1 || ipv4Rules[0][Destination] != "1.2.3.4/32" || !hasDNAT(ipt, "qrouter-123", ipv4Rules, "192.168.0.1:80") {
+		errorf("Expected only the IPv4 service in iptables", ipv4Rules, t)
+	}
+
+	ipv6Rules := ip6t.GetRules(string(ChainSKPrerouting), "qrouter-123")
+	if len(ipv6Rules) != 1 || ipv6Rules[0][Destination] != "fd00::10/128" || !hasDNAT(ip6t, "qrouter-123", ipv6Rules, "[fd00:1::5]:80") {
+		errorf("Expected only the IPv6 service in ip6tables", ipv6Rules, t)
+	}
+}
+
 func TestMultiNamespacesService(t *testing.T) {
 	ns1 := "ns1"
 	svcIP1 := "1.2.3.4"
@@ -472,7 +649,7 @@ func TestMultiNamespacesService(t *testing.T) {
 	if len(ns1Rules) == 0 {
 		errorf(fmt.Sprintf("Unexpected rule for chain %v with endpoints in namespace %v", ChainSKPrerouting, svcPortName1.Namespace), ns1Rules, t)
 	}
-	if !hasDNAT(ns1Rules, epStr1) {
+	if !hasDNAT(ipt, "qrouter-123", ns1Rules, epStr1) {
 		errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", ChainSKPrerouting, epStr1), ns1Rules, t)
 	}
 
@@ -481,11 +658,468 @@ func TestMultiNamespacesService(t *testing.T) {
 	if len(ns2Rules) == 0 {
 		errorf(fmt.Sprintf("Unexpected rule for chain %v with endpoints in namespace %v", ChainSKPrerouting, svcPortName2.Namespace), ns2Rules, t)
 	}
-	if !hasDNAT(ns2Rules, epStr2) {
+	if !hasDNAT(ipt, "qrouter-456", ns2Rules, epStr2) {
 		errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", ChainSKPrerouting, epStr2), ns2Rules, t)
 	}
 }
 
+func TestMultiNetworksService(t *testing.T) {
+	ns := "ns1"
+	svcIP1 := "1.2.3.4"
+	svcPort1 := 80
+	svcPortName1 := servicePortName{
+		NamespacedName: makeNSN(ns, "frontend"),
+		Port:           "80",
+	}
+
+	svcIP2 := "1.2.3.5"
+	svcPort2 := 3306
+	svcPortName2 := servicePortName{
+		NamespacedName: makeNSN(ns, "db"),
+		Port:           "3306",
+	}
+
+	// Creates fake iptables.
+	ipt := NewFake()
+	// Creates fake CRD client.
+	crdClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatal("Failed init fake CRD client")
+	}
+	// Create a fake openstack client.
+	osClient := openstack.NewFake(crdClient)
+	// Injects fake networks, "web" is the default network of the namespace.
+	osClient.SetNetwork(defaultNetwork(util.BuildNetworkName(ns, "web"), "123"))
+	osClient.SetNetwork(defaultNetwork(util.BuildNetworkName(ns, "db"), "456"))
+	// Injects fake port.
+	osClient.SetPort("123", deviceOwner, "123")
+	osClient.SetPort("456", deviceOwner, "456")
+	// Creates a new fake proxier.
+	fp := NewFakeProxier(ipt, osClient)
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName1.Namespace, svcPortName1.Name, func(svc *v1.Service) {
+			svc.Spec.ClusterIP = svcIP1
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName1.Port,
+				Port:     int32(svcPort1),
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+		makeTestService(svcPortName2.Namespace, svcPortName2.Name, func(svc *v1.Service) {
+			svc.Annotations[util.NetworkAnnotation] = "db"
+			svc.Spec.ClusterIP = svcIP2
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName2.Port,
+				Port:     int32(svcPort2),
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+
+	epIP1 := "192.168.0.1"
+	epIP2 := "192.168.1.1"
+	makeEndpointsMap(fp,
+		makeTestEndpoints(svcPortName1.Namespace, svcPortName1.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{
+					IP: epIP1,
+				}},
+				Ports: []v1.EndpointPort{{
+					Name: svcPortName1.Port,
+					Port: int32(svcPort1),
+				}},
+			}}
+		}),
+		makeTestEndpoints(svcPortName2.Namespace, svcPortName2.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{
+					IP: epIP2,
+				}},
+				Ports: []v1.EndpointPort{{
+					Name: svcPortName2.Port,
+					Port: int32(svcPort2),
+				}},
+			}}
+		}),
+	)
+
+	namespace := makeTestNamespace(ns)
+	namespace.Annotations[util.DefaultNetworkAnnotation] = "web"
+	makeNamespaceMap(fp, namespace)
+
+	fp.syncProxyRules()
+
+	epStr1 := fmt.Sprintf("%s:%d", epIP1, svcPort1)
+	epStr2 := fmt.Sprintf("%s:%d", epIP2, svcPort2)
+
+	webRules := ipt.GetRules(string(ChainSKPrerouting), "qrouter-123")
+	if !hasDNAT(ipt, "qrouter-123", webRules, epStr1) {
+		errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", ChainSKPrerouting, epStr1), webRules, t)
+	}
+	if hasDNAT(ipt, "qrouter-123", webRules, epStr2) {
+		errorf(fmt.Sprintf("Chain %v has unexpected DNAT to %v", ChainSKPrerouting, epStr2), webRules, t)
+	}
+
+	dbRules := ipt.GetRules(string(ChainSKPrerouting), "qrouter-456")
+	if !hasDNAT(ipt, "qrouter-456", dbRules, epStr2) {
+		errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", ChainSKPrerouting, epStr2), dbRules, t)
+	}
+	if hasDNAT(ipt, "qrouter-456", dbRules, epStr1) {
+		errorf(fmt.Sprintf("Chain %v has unexpected DNAT to %v", ChainSKPrerouting, epStr1), dbRules, t)
+	}
+}
+
+// newTestProxier creates a fake proxier with the default network of namespace.
+func newTestProxier(t *testing.T, namespace string) (*FakeIPTables, *Proxier) {
+	ipt := NewFake()
+	crdClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatal("Failed init fake CRD client")
+	}
+	osClient := openstack.NewFake(crdClient)
+	networkName := util.BuildNetworkName(namespace, namespace)
+	osClient.SetNetwork(defaultNetwork(networkName, defaultNetworkID))
+	osClient.SetPort(defaultNetworkID, deviceOwner, defaultPortID)
+	return ipt, NewFakeProxier(ipt, osClient)
+}
+
+func TestClusterServiceJump(t *testing.T) {
+	testNamespace := "test"
+	ipt, fp := newTestProxier(t, testNamespace)
+
+	makeServiceMap(fp,
+		makeTestService(testNamespace, "kube-dns", func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     "dns",
+				Port:     53,
+				Protocol: v1.ProtocolUDP,
+			}}
+		}),
+	)
+	makeEndpointsMap(fp,
+		makeTestEndpoints(testNamespace, "kube-dns", func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+				Ports:     []v1.EndpointPort{{Name: "dns", Port: 53}},
+			}}
+		}),
+	)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+
+	// The backing service is reachable at both its cluster IP and the virtual IP
+	// of the cluster service.
+	destinations := sets.NewString()
+	for _, rule := range ipt.GetRules(ChainSKPrerouting, "qrouter-123") {
+		destinations.Insert(rule[Destination])
+	}
+	if !destinations.HasAll("1.2.3.4/32", testclusterDNS+"/32") {
+		t.Errorf("Expected rules to %v and %v, got %v", "1.2.3.4/32", testclusterDNS+"/32", destinations.List())
+	}
+}
+
+func TestSessionAffinity(t *testing.T) {
+	testNamespace := "test"
+	svcPortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc1"),
+		Port:           "80",
+	}
+	ipt, fp := newTestProxier(t, testNamespace)
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName.Namespace, svcPortName.Name, func(svc *v1.Service) {
+			svc.Annotations[sessionAffinityTimeoutAnnotation] = "600"
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName.Port,
+				Port:     80,
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+	makeEndpointsMap(fp,
+		makeTestEndpoints(svcPortName.Namespace, svcPortName.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}},
+				Ports: []v1.EndpointPort{{
+					Name: svcPortName.Port,
+					Port: 80,
+				}},
+			}}
+		}),
+	)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+
+	svcInfo := fp.serviceMap[svcPortName]
+	svcRules := ipt.GetRules(svcInfo.servicePortChainName, "qrouter-123")
+	// One affinity rule and one balancing rule per endpoint.
+	if len(svcRules) != 4 {
+		errorf(fmt.Sprintf("Expected 4 rules for chain %v", svcInfo.servicePortChainName), svcRules, t)
+	}
+	for i, ep := range fp.endpointsMap[svcPortName] {
+		epChain := ep.endpointChain(svcInfo.serviceNameString, "tcp")
+		if svcRules[i][Recent] != epChain || svcRules[i][Jump] != epChain {
+			errorf(fmt.Sprintf("Chain %v lacks affinity rule for %v", svcInfo.servicePortChainName, epChain), svcRules, t)
+		}
+		epRules := ipt.GetRules(epChain, "qrouter-123")
+		if len(epRules) != 1 || epRules[0][Recent] != epChain || epRules[0][ToDest] != ep.endpoint {
+			errorf(fmt.Sprintf("Chain %v lacks DNAT to %v", epChain, ep.endpoint), epRules, t)
+		}
+	}
+	if !strings.Contains(string(ipt.NSLines["qrouter-123"]), "--rcheck --seconds 600 --reap") {
+		t.Errorf("Expected affinity timeout of 600 seconds, got %s", ipt.NSLines["qrouter-123"])
+	}
+}
+
+func TestOnlyLocalExternalTraffic(t *testing.T) {
+	testNamespace := "test"
+	svcPortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc1"),
+		Port:           "80",
+	}
+	ipt, fp := newTestProxier(t, testNamespace)
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName.Namespace, svcPortName.Name, func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Type = v1.ServiceTypeLoadBalancer
+			svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+			svc.Spec.ExternalIPs = []string{"5.6.7.8", "fd00::8"}
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName.Port,
+				Port:     80,
+				NodePort: 30080,
+				Protocol: v1.ProtocolTCP,
+			}}
+			svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "172.24.4.10"}}
+		}),
+	)
+	localNode, otherNode := testHostname, "node2"
+	makeEndpointsMap(fp,
+		makeTestEndpoints(svcPortName.Namespace, svcPortName.Name, func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{
+					{IP: "192.168.0.1", NodeName: &localNode},
+					{IP: "192.168.0.2", NodeName: &otherNode},
+				},
+				Ports: []v1.EndpointPort{{
+					Name: svcPortName.Port,
+					Port: 80,
+				}},
+			}}
+		}),
+	)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+
+	svcInfo := fp.serviceMap[svcPortName]
+	expected := map[string]string{
+		"1.2.3.4/32":     svcInfo.servicePortChainName,
+		"5.6.7.8/32":     svcInfo.servicePortChainName,
+		"172.24.4.10/32": svcInfo.serviceLBChainName,
+		"":               svcInfo.serviceLBChainName,
+	}
+	stackubeRules := ipt.GetRules(ChainSKPrerouting, "qrouter-123")
+	if len(stackubeRules) != len(expected) {
+		errorf(fmt.Sprintf("Expected %d rules for chain %v", len(expected), ChainSKPrerouting), stackubeRules, t)
+	}
+	for _, r := range stackubeRules {
+		if chain, ok := expected[r[Destination]]; !ok || r[Jump] != chain {
+			errorf(fmt.Sprintf("Unexpected rule %v for chain %v", r, ChainSKPrerouting), stackubeRules, t)
+		}
+	}
+
+	lbRules := ipt.GetRules(svcInfo.serviceLBChainName, "qrouter-123")
+	if !hasDNAT(ipt, "qrouter-123", lbRules, "192.168.0.1:80") || hasDNAT(ipt, "qrouter-123", lbRules, "192.168.0.2:80") {
+		errorf(fmt.Sprintf("Expected chain %v to only DNAT to local endpoints", svcInfo.serviceLBChainName), lbRules, t)
+	}
+}
+
+func TestStaleChainsDeleted(t *testing.T) {
+	testNamespace := "test"
+	svcPortName := servicePortName{
+		NamespacedName: makeNSN(testNamespace, "svc1"),
+		Port:           "80",
+	}
+	ipt, fp := newTestProxier(t, testNamespace)
+
+	makeServiceMap(fp,
+		makeTestService(svcPortName.Namespace, svcPortName.Name, func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     svcPortName.Port,
+				Port:     80,
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+	endpoints := makeTestEndpoints(svcPortName.Namespace, svcPortName.Name, func(ept *v1.Endpoints) {
+		ept.Subsets = []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+			Ports: []v1.EndpointPort{{
+				Name: svcPortName.Port,
+				Port: 80,
+			}},
+		}}
+	})
+	makeEndpointsMap(fp, endpoints)
+	makeNamespaceMap(fp, makeTestNamespace(testNamespace))
+
+	fp.syncProxyRules()
+	svcChain := fp.serviceMap[svcPortName].servicePortChainName
+	if !ipt.NSChains["qrouter-123"][svcChain] {
+		t.Fatalf("Expected chain %v, got %v", svcChain, ipt.NSChains["qrouter-123"])
+	}
+
+	// Chains are deleted with the endpoints.
+	fp.onEndpointDeleted(endpoints)
+	fp.syncProxyRules()
+	for chain := range ipt.NSChains["qrouter-123"] {
+		if isServiceChain(chain) {
+			t.Errorf("Unexpected stale chain %v", chain)
+		}
+	}
+}
+
+func TestCleanupStaleNetns(t *testing.T) {
+	testNamespace := "test"
+	ipt, fp := newTestProxier(t, testNamespace)
+
+	namespace := makeTestNamespace(testNamespace)
+	makeServiceMap(fp,
+		makeTestService(testNamespace, "svc1", func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     "80",
+				Port:     80,
+				Protocol: v1.ProtocolTCP,
+			}}
+		}),
+	)
+	makeEndpointsMap(fp,
+		makeTestEndpoints(testNamespace, "svc1", func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+				Ports:     []v1.EndpointPort{{Name: "80", Port: 80}},
+			}}
+		}),
+	)
+	makeNamespaceMap(fp, namespace)
+
+	// Rules left in the netns of a router not owned by any namespace.
+	ipt.setNetns("qrouter-999")
+	ipt.restoreAll([]byte("*nat\n:STACKUBE-PREROUTING - [0:0]\n:KUBE-SVC-AAAAAAAAAAAAAAAA - [0:0]\nCOMMIT\n"))
+	fp.metrics.setRules("qrouter-999", backendIPTables, 1)
+
+	// Stale netns are cleaned up by the full sync.
+	fp.syncProxyRules()
+	if len(ipt.NSChains["qrouter-999"]) != 0 {
+		t.Errorf("Expected no chains in stale netns, got %v", ipt.NSChains["qrouter-999"])
+	}
+	if !ipt.NSChains["qrouter-123"][ChainSKPrerouting] {
+		t.Errorf("Expected chain %v in owned netns, got %v", ChainSKPrerouting, ipt.NSChains["qrouter-123"])
+	}
+	if _, ok := fp.metrics.rules.values[fp.metrics.rules.labels([]string{"qrouter-999", backendIPTables})]; ok {
+		t.Errorf("Expected rules metric of stale netns deleted")
+	}
+
+	// Netns of routers of deleted namespaces are cleaned up by the next sync.
+	fp.onNamespaceDeleted(namespace)
+	fp.syncProxyRules()
+	if len(ipt.NSChains["qrouter-123"]) != 0 {
+		t.Errorf("Expected no chains in netns of deleted namespace, got %v", ipt.NSChains["qrouter-123"])
+	}
+	if fp.staleNetns.Len() != 0 {
+		t.Errorf("Expected no stale netns left, got %v", fp.staleNetns.List())
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	ipt := NewFake()
+	crdClient, err := crdClient.NewFake()
+	if err != nil {
+		t.Fatal("Failed init fake CRD client")
+	}
+	osClient := openstack.NewFake(crdClient)
+	osClient.SetNetwork(defaultNetwork(util.BuildNetworkName("ns1", "ns1"), "123"))
+	osClient.SetNetwork(defaultNetwork(util.BuildNetworkName("ns2", "ns2"), "456"))
+	osClient.SetPort("123", deviceOwner, "123")
+	osClient.SetPort("456", deviceOwner, "456")
+	fp := NewFakeProxier(ipt, osClient)
+
+	makeService := func(namespace string) *v1.Service {
+		return makeTestService(namespace, "svc1", func(svc *v1.Service) {
+			svc.Spec.ClusterIP = "1.2.3.4"
+			svc.Spec.Ports = []v1.ServicePort{{
+				Name:     "80",
+				Port:     80,
+				Protocol: v1.ProtocolTCP,
+			}}
+		})
+	}
+	makeEndpoints := func(namespace, epIP string) *v1.Endpoints {
+		return makeTestEndpoints(namespace, "svc1", func(ept *v1.Endpoints) {
+			ept.Subsets = []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: epIP}},
+				Ports:     []v1.EndpointPort{{Name: "80", Port: 80}},
+			}}
+		})
+	}
+	service2 := makeService("ns2")
+	endpoints2 := makeEndpoints("ns2", "192.168.1.1")
+	makeServiceMap(fp, makeService("ns1"), service2)
+	makeEndpointsMap(fp, makeEndpoints("ns1", "192.168.0.1"), endpoints2)
+	makeNamespaceMap(fp, makeTestNamespace("ns1"), makeTestNamespace("ns2"))
+
+	// The first sync covers all namespaces.
+	fp.syncProxyRules()
+	if len(ipt.NSLines) != 2 {
+		t.Fatalf("Expected rules in 2 netns, got %v", ipt.NSLines)
+	}
+
+	// Only the netns of changed namespaces is synced.
+	ipt.NSLines = make(map[string][]byte)
+	updated := makeEndpoints("ns2", "192.168.1.2")
+	fp.onEndpointUpdated(endpoints2, updated)
+	fp.syncProxyRules()
+	if _, ok := ipt.NSLines["qrouter-123"]; ok || len(ipt.NSLines) != 1 {
+		t.Errorf("Expected only netns qrouter-456 synced, got %v", ipt.NSLines)
+	}
+	rules := ipt.GetRules(ChainSKPrerouting, "qrouter-456")
+	if !hasDNAT(ipt, "qrouter-456", rules, "192.168.1.2:80") || hasDNAT(ipt, "qrouter-456", rules, "192.168.1.1:80") {
+		errorf("Expected DNAT to the updated endpoint", rules, t)
+	}
+
+	// Rules of deleted services are flushed.
+	fp.onServiceDeleted(service2)
+	fp.syncProxyRules()
+	if rules := ipt.GetRules(ChainSKPrerouting, "qrouter-456"); len(rules) != 0 {
+		errorf("Unexpected rules of deleted service", rules, t)
+	}
+	if _, ok := fp.serviceNSMap["ns2"]; ok {
+		t.Errorf("Expected no services in namespace ns2, got %v", fp.serviceNSMap["ns2"])
+	}
+
+	// Nothing is synced without changes until the next full sync.
+	ipt.NSLines = make(map[string][]byte)
+	fp.syncProxyRules()
+	if len(ipt.NSLines) != 0 {
+		t.Errorf("Expected no netns synced, got %v", ipt.NSLines)
+	}
+	fp.lastFullSync = time.Now().Add(-fullSyncPeriod)
+	fp.syncProxyRules()
+	if _, ok := ipt.NSLines["qrouter-123"]; !ok {
+		t.Errorf("Expected netns qrouter-123 synced, got %v", ipt.NSLines)
+	}
+}
+
 // This is a coarse test, but it offers some modicum of confidence as the code is evolved.
 func Test_endpointsToEndpointsMap(t *testing.T) {
 	testCases := []struct {
@@ -52,11 +52,17 @@ type serviceInfo struct {
 	serviceType              v1.ServiceType
 	loadBalancerStatus       v1.LoadBalancerStatus
 	sessionAffinityType      v1.ServiceAffinity
-	stickyMaxAgeMinutes      int
+	stickyMaxAgeSeconds      int
 	externalIPs              []string
 	loadBalancerSourceRanges []string
 	onlyNodeLocalEndpoints   bool
 	healthCheckNodePort      int
+	// ipvsScheduler is the scheduler selected by the service's annotation, empty
+	// means the scheduler of the proxier.
+	ipvsScheduler string
+	// network is the network selected by the service's annotation, empty
+	// means the default network of the namespace.
+	network string
 	// The following fields are computed and stored for performance reasons.
 	serviceNameString        string
 	servicePortChainName     string
@@ -76,8 +82,17 @@ type endpointsInfo struct {
 }
 
 type namespaceInfo struct {
+	// network is the default network of the namespace.
 	network string
-	router  string
+	// routers maps network name to its router.
+	routers map[string]string
+}
+
+func newNamespaceInfo(namespace *v1.Namespace) *namespaceInfo {
+	return &namespaceInfo{
+		network: util.DefaultNetworkName(namespace),
+		routers: make(map[string]string),
+	}
 }
 
 // Returns just the IP part of the endpoint.
@@ -103,7 +118,7 @@ func (e *endpointsInfo) String() string {
 
 // returns a new serviceInfo struct
 func newServiceInfo(svcPortName servicePortName, port *v1.ServicePort, service *v1.Service) *serviceInfo {
-	onlyNodeLocalEndpoints := false
+	onlyNodeLocalEndpoints := requestsOnlyLocalTraffic(service)
 	info := &serviceInfo{
 		name:        service.Name,
 		clusterIP:   net.ParseIP(service.Spec.ClusterIP),
@@ -114,10 +129,12 @@ func newServiceInfo(svcPortName servicePortName, port *v1.ServicePort, service *
 		// Deep-copy in case the service instance changes
 		loadBalancerStatus:       *util.LoadBalancerStatusDeepCopy(&service.Status.LoadBalancer),
 		sessionAffinityType:      service.Spec.SessionAffinity,
-		stickyMaxAgeMinutes:      180,
+		stickyMaxAgeSeconds:      getSessionAffinityTimeout(service),
 		externalIPs:              make([]string, len(service.Spec.ExternalIPs)),
 		loadBalancerSourceRanges: make([]string, len(service.Spec.LoadBalancerSourceRanges)),
 		onlyNodeLocalEndpoints:   onlyNodeLocalEndpoints,
+		network:                  service.Annotations[util.NetworkAnnotation],
+		ipvsScheduler:            getIPVSScheduler(service),
 	}
 	copy(info.loadBalancerSourceRanges, service.Spec.LoadBalancerSourceRanges)
 	copy(info.externalIPs, service.Spec.ExternalIPs)
@@ -288,14 +305,18 @@ func (ncm *namespaceChangeMap) update(name string, previous, current *v1.Namespa
 	change, exists := ncm.items[name]
 	if !exists {
 		change = &namespaceChange{}
-		change.previous = &namespaceInfo{network: name}
+		if previous != nil {
+			change.previous = newNamespaceInfo(previous)
+		}
 		ncm.items[name] = change
 	}
+	change.current = nil
 	if current != nil {
-		change.current = &namespaceInfo{network: name, router: change.previous.router}
+		change.current = newNamespaceInfo(current)
 	}
 
-	if previous != nil && current != nil {
+	// Only the default network matters here, routers are resolved later.
+	if change.previous != nil && change.current != nil && change.previous.network == change.current.network {
 		delete(ncm.items, name)
 	}
 	return len(ncm.items) > 0
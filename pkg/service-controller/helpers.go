@@ -17,9 +17,16 @@ limitations under the License.
 package service
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"git.openstack.org/openstack/stackube/pkg/openstack"
 )
 
 const (
@@ -33,3 +40,139 @@ func buildServiceName(service *v1.Service) string {
 func buildLoadBalancerName(service *v1.Service) string {
 	return fmt.Sprintf("%s_%s_%s", lbPrefix, service.Namespace, service.Name)
 }
+
+// buildCertificatePrefix returns the name prefix of the certificates of the service,
+// which doesn't match other services as their names can't contain underscores.
+func buildCertificatePrefix(service *v1.Service) string {
+	return buildLoadBalancerName(service) + "_"
+}
+
+// buildCertificateName names the certificate by its content, so a changed secret
+// gets a new certificate.
+func buildCertificateName(service *v1.Service, certificate, privateKey []byte) string {
+	hash := sha256.Sum256(append(append([]byte{}, certificate...), privateKey...))
+	return fmt.Sprintf("%s%x", buildCertificatePrefix(service), hash[:5])
+}
+
+const (
+	// lbMethodAnnotation selects the algorithm of the pools: ROUND_ROBIN,
+	// LEAST_CONNECTIONS or SOURCE_IP.
+	lbMethodAnnotation = "stackube.kubernetes.io/lb-method"
+	// lbPersistenceAnnotation selects the session persistence of the pools:
+	// SOURCE_IP or HTTP_COOKIE, which requires all ports to be HTTP or TLS ports.
+	lbPersistenceAnnotation = "stackube.kubernetes.io/lb-session-persistence"
+	// lbHTTPPortsAnnotation is a comma separated list of TCP ports balanced as HTTP.
+	lbHTTPPortsAnnotation = "stackube.kubernetes.io/lb-http-ports"
+	// lbConnectionLimitAnnotation limits the connections of each listener.
+	lbConnectionLimitAnnotation = "stackube.kubernetes.io/lb-connection-limit"
+	// lbMonitor* annotations configure the health monitors of the pools.
+	lbMonitorTypeAnnotation          = "stackube.kubernetes.io/lb-monitor-type"
+	lbMonitorURLPathAnnotation       = "stackube.kubernetes.io/lb-monitor-url-path"
+	lbMonitorExpectedCodesAnnotation = "stackube.kubernetes.io/lb-monitor-expected-codes"
+	lbMonitorDelayAnnotation         = "stackube.kubernetes.io/lb-monitor-delay"
+	lbMonitorTimeoutAnnotation       = "stackube.kubernetes.io/lb-monitor-timeout"
+	lbMonitorMaxRetriesAnnotation    = "stackube.kubernetes.io/lb-monitor-max-retries"
+	// lbTLSSecretAnnotation names the kubernetes.io/tls Secret in the namespace of the
+	// service, whose certificate terminates HTTPS on the TLS ports.
+	lbTLSSecretAnnotation = "stackube.kubernetes.io/lb-tls-secret"
+	// lbTLSPortsAnnotation is a comma separated list of TLS ports, defaults to 443.
+	lbTLSPortsAnnotation = "stackube.kubernetes.io/lb-tls-ports"
+
+	defaultTLSPort = 443
+)
+
+var (
+	lbMethods    = sets.NewString("ROUND_ROBIN", "LEAST_CONNECTIONS", "SOURCE_IP")
+	persistences = sets.NewString("SOURCE_IP", "HTTP_COOKIE")
+	monitorTypes = sets.NewString("TCP", "HTTP", "HTTPS")
+
+	// expectedCodesRegexp matches a single code, a list or a range, e.g. 200, 200,202 or 200-204.
+	expectedCodesRegexp = regexp.MustCompile(`^[0-9]{3}(-[0-9]{3}|(,[0-9]{3})*)$`)
+)
+
+// getLoadBalancerOptions builds the load balancer options from the annotations of the service.
+func getLoadBalancerOptions(service *v1.Service) (openstack.LoadBalancerOptions, error) {
+	annotations := service.Annotations
+	options := openstack.LoadBalancerOptions{
+		LBMethod:             strings.ToUpper(annotations[lbMethodAnnotation]),
+		Persistence:          strings.ToUpper(annotations[lbPersistenceAnnotation]),
+		MonitorType:          strings.ToUpper(annotations[lbMonitorTypeAnnotation]),
+		MonitorURLPath:       annotations[lbMonitorURLPathAnnotation],
+		MonitorExpectedCodes: annotations[lbMonitorExpectedCodesAnnotation],
+	}
+
+	if options.LBMethod != "" && !lbMethods.Has(options.LBMethod) {
+		return options, fmt.Errorf("invalid %s %q, must be one of %v", lbMethodAnnotation,
+			options.LBMethod, lbMethods.List())
+	}
+	if options.Persistence != "" && !persistences.Has(options.Persistence) {
+		return options, fmt.Errorf("invalid %s %q, must be one of %v", lbPersistenceAnnotation,
+			options.Persistence, persistences.List())
+	}
+	if options.MonitorType != "" && !monitorTypes.Has(options.MonitorType) {
+		return options, fmt.Errorf("invalid %s %q, must be one of %v", lbMonitorTypeAnnotation,
+			options.MonitorType, monitorTypes.List())
+	}
+	if options.MonitorURLPath != "" && !strings.HasPrefix(options.MonitorURLPath, "/") {
+		return options, fmt.Errorf("invalid %s %q, must start with /", lbMonitorURLPathAnnotation,
+			options.MonitorURLPath)
+	}
+	if options.MonitorExpectedCodes != "" && !expectedCodesRegexp.MatchString(options.MonitorExpectedCodes) {
+		return options, fmt.Errorf("invalid %s %q", lbMonitorExpectedCodesAnnotation,
+			options.MonitorExpectedCodes)
+	}
+
+	for annotation, value := range map[string]*int{
+		lbConnectionLimitAnnotation:   &options.ConnectionLimit,
+		lbMonitorDelayAnnotation:      &options.MonitorDelay,
+		lbMonitorTimeoutAnnotation:    &options.MonitorTimeout,
+		lbMonitorMaxRetriesAnnotation: &options.MonitorMaxRetries,
+	} {
+		if annotations[annotation] == "" {
+			continue
+		}
+		i, err := strconv.Atoi(annotations[annotation])
+		if err != nil || i <= 0 {
+			return options, fmt.Errorf("invalid %s %q, must be a positive integer", annotation,
+				annotations[annotation])
+		}
+		*value = i
+	}
+	if options.MonitorDelay > 0 && options.MonitorTimeout > options.MonitorDelay {
+		return options, fmt.Errorf("%s must not be greater than %s", lbMonitorTimeoutAnnotation,
+			lbMonitorDelayAnnotation)
+	}
+
+	return options, nil
+}
+
+// getTLSPorts returns the TLS ports of the service.
+func getTLSPorts(service *v1.Service) (sets.Int, error) {
+	if service.Annotations[lbTLSPortsAnnotation] == "" {
+		return sets.NewInt(defaultTLSPort), nil
+	}
+	return getAnnotationPorts(service, lbTLSPortsAnnotation)
+}
+
+// getHTTPPorts returns the HTTP ports of the service.
+func getHTTPPorts(service *v1.Service) (sets.Int, error) {
+	return getAnnotationPorts(service, lbHTTPPortsAnnotation)
+}
+
+// getAnnotationPorts returns the ports listed by the annotation of the service.
+func getAnnotationPorts(service *v1.Service, annotation string) (sets.Int, error) {
+	ports := sets.NewInt()
+	value := service.Annotations[annotation]
+	if value == "" {
+		return ports, nil
+	}
+
+	for _, p := range strings.Split(value, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s %q, must be a list of ports", annotation, value)
+		}
+		ports.Insert(port)
+	}
+	return ports, nil
+}
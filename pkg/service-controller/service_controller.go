@@ -25,6 +25,7 @@ import (
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
@@ -77,9 +78,15 @@ type ServiceController struct {
 	factory          informers.SharedInformerFactory
 	serviceInformer  informersV1.ServiceInformer
 	endpointInformer informersV1.EndpointsInformer
+	secretInformer   informersV1.SecretInformer
 
 	// services that need to be synced
 	workingQueue workqueue.DelayingInterface
+
+	certificatesLock sync.Mutex
+	// certificates maps services to the certificates kept by the last cleanup,
+	// which is skipped while the service keeps using the same certificate.
+	certificates map[string]string
 }
 
 // NewServiceController returns a new service controller to keep openstack lbaas resources
@@ -95,6 +102,8 @@ func NewServiceController(kubeClient kubernetes.Interface,
 		workingQueue:     workqueue.NewNamedDelayingQueue("service"),
 		serviceInformer:  factory.Core().V1().Services(),
 		endpointInformer: factory.Core().V1().Endpoints(),
+		secretInformer:   factory.Core().V1().Secrets(),
+		certificates:     make(map[string]string),
 	}
 
 	s.serviceInformer.Informer().AddEventHandlerWithResyncPeriod(
@@ -127,6 +136,20 @@ func NewServiceController(kubeClient kubernetes.Interface,
 		serviceSyncPeriod,
 	)
 
+	// Changed TLS secrets rotate the certificates of their services.
+	s.secretInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: s.enqueueServicesForSecret,
+			UpdateFunc: func(old, cur interface{}) {
+				oldSecret, ok1 := old.(*v1.Secret)
+				curSecret, ok2 := cur.(*v1.Secret)
+				if ok1 && ok2 && oldSecret.ResourceVersion != curSecret.ResourceVersion {
+					s.enqueueServicesForSecret(cur)
+				}
+			},
+		},
+	)
+
 	return s, nil
 }
 
@@ -163,6 +186,9 @@ func (s *ServiceController) Run(stopCh <-chan struct{}) error {
 	if !cache.WaitForCacheSync(stopCh, s.endpointInformer.Informer().HasSynced) {
 		return fmt.Errorf("failed to cache endpoints")
 	}
+	if !cache.WaitForCacheSync(stopCh, s.secretInformer.Informer().HasSynced) {
+		return fmt.Errorf("failed to cache secrets")
+	}
 
 	glog.Infof("Service informer cached")
 
@@ -184,6 +210,25 @@ func (s *ServiceController) enqueueEndpoints(obj interface{}) {
 	s.workingQueue.Add(key)
 }
 
+// enqueueServicesForSecret enqueues load balancer services which terminate TLS with the secret.
+func (s *ServiceController) enqueueServicesForSecret(obj interface{}) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return
+	}
+
+	services, err := s.serviceInformer.Lister().Services(secret.Namespace).List(labels.Everything())
+	if err != nil {
+		glog.Errorf("List services of namespace %q failed: %v", secret.Namespace, err)
+		return
+	}
+	for _, service := range services {
+		if wantsLoadBalancer(service) && service.Annotations[lbTLSSecretAnnotation] == secret.Name {
+			s.enqueueService(service)
+		}
+	}
+}
+
 // worker runs a worker thread that just dequeues items, processes them, and marks them done.
 // It enforces that the syncHandler is never invoked concurrently with the same key.
 func (s *ServiceController) worker() {
@@ -256,6 +301,9 @@ func (s *ServiceController) createLoadBalancerIfNeeded(key string, service *v1.S
 				glog.Errorf("EnsureLoadBalancerDeleted %q failed: %v", lbName, err)
 				return err, retryable
 			}
+			if err := s.deleteObsoleteCertificates(service, ""); err != nil {
+				return err, retryable
+			}
 		}
 
 		newState = &v1.LoadBalancerStatus{}
@@ -322,72 +370,221 @@ func (s *ServiceController) persistUpdate(service *v1.Service) error {
 }
 
 func (s *ServiceController) createLoadBalancer(service *v1.Service) (*v1.LoadBalancerStatus, error) {
-	// Only one protocol and one externalIPs supported per service.
+	// Only one externalIPs supported per service.
 	if len(service.Spec.ExternalIPs) > 1 {
 		return nil, fmt.Errorf("multiple floatingips are not supported")
 	}
-	if len(service.Spec.Ports) > 1 {
-		return nil, fmt.Errorf("multiple floatingips are not supported")
+	if len(service.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("no ports provided for service %s", buildServiceName(service))
+	}
+
+	options, err := getLoadBalancerOptions(service)
+	if err != nil {
+		glog.Errorf("Get load balancer options for service %q failed: %v", buildServiceName(service), err)
+		return nil, err
 	}
 
-	// Only support one network and network's name is same with namespace.
-	networkName := util.BuildNetworkName(service.Namespace, service.Namespace)
+	// The service selects its network by annotation, or uses the namespace's default network.
+	name, err := util.GetNetworkName(s.kubeClient, service.Namespace, service.Annotations)
+	if err != nil {
+		glog.Errorf("Get network name for service %q failed: %v", buildServiceName(service), err)
+		return nil, err
+	}
+	networkName := util.BuildNetworkName(service.Namespace, name)
 	network, err := s.osClient.GetNetworkByName(networkName)
 	if err != nil {
 		glog.Errorf("Get network by name %q failed: %v", networkName, err)
 		return nil, err
 	}
+	vipSubnet, err := openstack.VIPSubnet(network)
+	if err != nil {
+		glog.Errorf("Get VIP subnet for service %q failed: %v", buildServiceName(service), err)
+		return nil, err
+	}
 
-	// get endpoints for the service.
-	endpoints, err := s.getEndpoints(service)
+	// get endpoints for each port of the service.
+	ports, err := s.getLoadBalancerPorts(service)
 	if err != nil {
 		glog.Errorf("Get endpoints for service %q failed: %v", buildServiceName(service), err)
 		return nil, err
 	}
 
+	// TLS ports terminate HTTPS with the certificate of the secret.
+	certificateRef, err := s.ensureCertificate(service)
+	if err != nil {
+		glog.Errorf("Ensure certificate for service %q failed: %v", buildServiceName(service), err)
+		return nil, err
+	}
+	if certificateRef != "" {
+		tlsPorts, err := getTLSPorts(service)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for i := range ports {
+			if tlsPorts.Has(ports[i].Port) && ports[i].Protocol != string(v1.ProtocolUDP) {
+				ports[i].TLSContainerRef = certificateRef
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no TCP ports of service %s in TLS ports %v", buildServiceName(service),
+				tlsPorts.List())
+		}
+	}
+
+	// HTTP ports are balanced as HTTP, HTTP cookies can't persist sessions of other ports.
+	httpPorts, err := getHTTPPorts(service)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ports {
+		if httpPorts.Has(ports[i].Port) && ports[i].Protocol != string(v1.ProtocolUDP) {
+			ports[i].HTTP = true
+		}
+		if options.Persistence == "HTTP_COOKIE" && !ports[i].HTTP && ports[i].TLSContainerRef == "" {
+			return nil, fmt.Errorf("%s HTTP_COOKIE of service %s requires HTTP ports, but port %d is not in %s",
+				lbPersistenceAnnotation, buildServiceName(service), ports[i].Port, lbHTTPPortsAnnotation)
+		}
+	}
+
 	// create the loadbalancer.
 	lbName := buildLoadBalancerName(service)
-	svcPort := service.Spec.Ports[0]
-	externalIP := service.Spec.ExternalIPs[0]
+	// The floating IP is allocated if neither externalIPs nor loadBalancerIP is specified.
+	externalIP := service.Spec.LoadBalancerIP
+	if len(service.Spec.ExternalIPs) > 0 {
+		externalIP = service.Spec.ExternalIPs[0]
+	}
 
 	lb, err := s.osClient.EnsureLoadBalancer(&openstack.LoadBalancer{
 		Name:            lbName,
-		Endpoints:       endpoints,
-		ServicePort:     int(svcPort.Port),
+		Ports:           ports,
 		TenantID:        network.TenantID,
-		SubnetID:        network.Subnets[0].Uid,
-		Protocol:        string(svcPort.Protocol),
+		SubnetID:        vipSubnet.Uid,
+		MemberSubnets:   network.Subnets,
 		ExternalIP:      externalIP,
+		FloatingNetwork: service.Annotations[util.FloatingNetworkAnnotation],
 		SessionAffinity: service.Spec.SessionAffinity != v1.ServiceAffinityNone,
+		Options:         options,
 	})
 	if err != nil {
 		glog.Errorf("EnsureLoadBalancer %q failed: %v", lbName, err)
 		return nil, err
 	}
 
+	// the listeners don't refer to old certificates any more.
+	if err := s.deleteObsoleteCertificates(service, certificateRef); err != nil {
+		return nil, err
+	}
+
 	return &v1.LoadBalancerStatus{
 		Ingress: []v1.LoadBalancerIngress{{IP: lb.ExternalIP}},
 	}, nil
 
 }
 
-func (s *ServiceController) getEndpoints(service *v1.Service) ([]openstack.Endpoint, error) {
+// ensureCertificate stores the certificate of the TLS secret of the service and returns
+// its reference, which is empty if the service doesn't terminate TLS.
+func (s *ServiceController) ensureCertificate(service *v1.Service) (string, error) {
+	secretName := service.Annotations[lbTLSSecretAnnotation]
+	if secretName == "" {
+		return "", nil
+	}
+
+	store := s.osClient.GetCertificateStore()
+	if store == nil {
+		return "", fmt.Errorf("certificate store is not available")
+	}
+
+	secret, err := s.secretInformer.Lister().Secrets(service.Namespace).Get(secretName)
+	if err != nil {
+		return "", err
+	}
+	if secret.Type != v1.SecretTypeTLS {
+		return "", fmt.Errorf("secret %s/%s is not of type %s", secret.Namespace, secret.Name, v1.SecretTypeTLS)
+	}
+	certificate, privateKey := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(certificate) == 0 || len(privateKey) == 0 {
+		return "", fmt.Errorf("secret %s/%s has no certificate or private key", secret.Namespace, secret.Name)
+	}
+
+	return store.EnsureCertificate(buildCertificateName(service, certificate, privateKey), certificate, privateKey)
+}
+
+// deleteObsoleteCertificates deletes certificates of the service except the one in use.
+func (s *ServiceController) deleteObsoleteCertificates(service *v1.Service, ref string) error {
+	store := s.osClient.GetCertificateStore()
+	if store == nil {
+		return nil
+	}
+
+	key := buildServiceName(service)
+	s.certificatesLock.Lock()
+	defer s.certificatesLock.Unlock()
+	if kept, ok := s.certificates[key]; ok && kept == ref {
+		return nil
+	}
+
+	refs, err := store.ListCertificates(buildCertificatePrefix(service))
+	if err != nil {
+		glog.Errorf("List certificates of service %q failed: %v", key, err)
+		return err
+	}
+	for name, r := range refs {
+		if r == ref {
+			continue
+		}
+		if err := store.DeleteCertificate(r); err != nil {
+			glog.Errorf("Delete certificate %q failed: %v", name, err)
+			return err
+		}
+		glog.V(3).Infof("Certificate %q of service %q deleted", name, key)
+	}
+	s.certificates[key] = ref
+
+	return nil
+}
+
+// forgetCertificates drops the certificates kept for the deleted service.
+func (s *ServiceController) forgetCertificates(service *v1.Service) {
+	s.certificatesLock.Lock()
+	defer s.certificatesLock.Unlock()
+	delete(s.certificates, buildServiceName(service))
+}
+
+// getLoadBalancerPorts returns ports of the load balancer with their endpoints. Endpoint
+// ports are matched with service ports by name, which may be empty for single port services.
+func (s *ServiceController) getLoadBalancerPorts(service *v1.Service) ([]openstack.LoadBalancerPort, error) {
 	endpoints, err := s.kubeClient.Core().Endpoints(service.Namespace).Get(service.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	results := make([]openstack.Endpoint, 0)
-	for i := range endpoints.Subsets {
-		ep := endpoints.Subsets[i]
-		for _, ip := range ep.Addresses {
+	results := make([]openstack.LoadBalancerPort, 0, len(service.Spec.Ports))
+	for _, svcPort := range service.Spec.Ports {
+		lbPort := openstack.LoadBalancerPort{
+			Name:      svcPort.Name,
+			Protocol:  string(svcPort.Protocol),
+			Port:      int(svcPort.Port),
+			Endpoints: make([]openstack.Endpoint, 0),
+		}
+
+		for i := range endpoints.Subsets {
+			ep := endpoints.Subsets[i]
 			for _, port := range ep.Ports {
-				results = append(results, openstack.Endpoint{
-					Address: ip.IP,
-					Port:    int(port.Port),
-				})
+				if port.Name != svcPort.Name {
+					continue
+				}
+				for _, ip := range ep.Addresses {
+					lbPort.Endpoints = append(lbPort.Endpoints, openstack.Endpoint{
+						Address: ip.IP,
+						Port:    int(port.Port),
+					})
+				}
 			}
 		}
+
+		results = append(results, lbPort)
 	}
 
 	return results, nil
@@ -677,7 +874,12 @@ func (s *ServiceController) processServiceDeletion(key string) (error, time.Dura
 		glog.Errorf("Error deleting load balancer (will retry): %v", err)
 		return err, cachedService.nextRetryDelay()
 	}
+	if err := s.deleteObsoleteCertificates(service, ""); err != nil {
+		glog.Errorf("Error deleting certificates (will retry): %v", err)
+		return err, cachedService.nextRetryDelay()
+	}
 	glog.V(3).Infof("Loadbalancer %q deleted", lbName)
+	s.forgetCertificates(service)
 	s.cache.delete(key)
 
 	cachedService.resetRetryDelay()
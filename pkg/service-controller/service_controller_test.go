@@ -18,13 +18,17 @@ package service
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
 	"git.openstack.org/openstack/stackube/pkg/openstack"
 	drivertypes "git.openstack.org/openstack/stackube/pkg/openstack/types"
+	"git.openstack.org/openstack/stackube/pkg/util"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -179,9 +183,10 @@ func TestServiceTypeNoLoadBalancer(t *testing.T) {
 
 func TestCreateExternalLoadBalancer(t *testing.T) {
 	table := []struct {
-		service       *v1.Service
-		expectErr     bool
-		expectCreated bool
+		service          *v1.Service
+		expectErr        bool
+		expectCreated    bool
+		expectExternalIP string
 	}{
 		{
 			service: &v1.Service{
@@ -193,17 +198,24 @@ func TestCreateExternalLoadBalancer(t *testing.T) {
 				Spec: v1.ServiceSpec{
 					Ports: []v1.ServicePort{
 						{
+							Name: "http",
 							Port: 80,
 						},
 						{
-							Port: 8080,
+							Name:     "dns",
+							Port:     53,
+							Protocol: v1.ProtocolUDP,
 						},
 					},
+					ExternalIPs: []string{
+						"1.1.1.1",
+					},
 					Type: v1.ServiceTypeLoadBalancer,
 				},
 			},
-			expectErr:     true,
-			expectCreated: false,
+			expectErr:        false,
+			expectCreated:    true,
+			expectExternalIP: "1.1.1.1",
 		},
 		{
 			service: &v1.Service{
@@ -243,8 +255,48 @@ func TestCreateExternalLoadBalancer(t *testing.T) {
 					Type: v1.ServiceTypeLoadBalancer,
 				},
 			},
-			expectErr:     false,
-			expectCreated: true,
+			expectErr:        false,
+			expectCreated:    true,
+			expectExternalIP: "1.1.1.1",
+		},
+		{
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc4",
+					Namespace: "default",
+					SelfLink:  testapi.Default.SelfLink("services", "svc4"),
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{
+						Port: 80,
+					}},
+					LoadBalancerIP: "2.2.2.2",
+					Type:           v1.ServiceTypeLoadBalancer,
+				},
+			},
+			expectErr:        false,
+			expectCreated:    true,
+			expectExternalIP: "2.2.2.2",
+		},
+		{
+			// The floating IP is allocated from the annotated network.
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "svc5",
+					Namespace:   "default",
+					SelfLink:    testapi.Default.SelfLink("services", "svc5"),
+					Annotations: map[string]string{util.FloatingNetworkAnnotation: "public"},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{
+						Port: 80,
+					}},
+					Type: v1.ServiceTypeLoadBalancer,
+				},
+			},
+			expectErr:        false,
+			expectCreated:    true,
+			expectExternalIP: "172.24.4.1",
 		},
 	}
 
@@ -280,16 +332,69 @@ func TestCreateExternalLoadBalancer(t *testing.T) {
 			}
 			if balancer == nil {
 				t.Errorf("expected one load balancer to be created, got none")
-			} else if balancer.Name != buildLoadBalancerName(item.service) &&
-				balancer.ServicePort != int(item.service.Spec.Ports[0].Port) &&
-				balancer.ExternalIP != item.service.Spec.ExternalIPs[0] {
+			} else if balancer.Name != buildLoadBalancerName(item.service) ||
+				len(balancer.Ports) != len(item.service.Spec.Ports) ||
+				balancer.ExternalIP != item.expectExternalIP ||
+				balancer.FloatingNetwork != item.service.Annotations[util.FloatingNetworkAnnotation] {
 				t.Errorf("created load balancer has incorrect parameters: %v", balancer)
+			} else {
+				for i, port := range balancer.Ports {
+					svcPort := item.service.Spec.Ports[i]
+					if port.Port != int(svcPort.Port) || port.Protocol != string(svcPort.Protocol) {
+						t.Errorf("created load balancer has incorrect port %v, expected %v", port, svcPort)
+					}
+				}
 			}
 			endpointsHandler.ValidateRequestCount(t, 2)
 		}
 	}
 }
 
+func TestGetLoadBalancerPorts(t *testing.T) {
+	controller, _, client := newController()
+	service := newService("multi-port", types.UID("123"), v1.ServiceTypeLoadBalancer)
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+	}
+	client.Core().Endpoints("default").Create(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "multi-port",
+			Namespace: "default",
+		},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "3.3.3.3"}, {IP: "4.4.4.4"}},
+			Ports: []v1.EndpointPort{
+				{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP},
+				{Name: "dns", Port: 5353, Protocol: v1.ProtocolUDP},
+			},
+		}},
+	})
+
+	ports, err := controller.getLoadBalancerPorts(service)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []openstack.LoadBalancerPort{
+		{
+			Name:      "http",
+			Protocol:  "TCP",
+			Port:      80,
+			Endpoints: []openstack.Endpoint{{Address: "3.3.3.3", Port: 8080}, {Address: "4.4.4.4", Port: 8080}},
+		},
+		{
+			Name:      "dns",
+			Protocol:  "UDP",
+			Port:      53,
+			Endpoints: []openstack.Endpoint{{Address: "3.3.3.3", Port: 5353}, {Address: "4.4.4.4", Port: 5353}},
+		},
+	}
+	if !reflect.DeepEqual(expected, ports) {
+		t.Errorf("expected ports %v, got %v", expected, ports)
+	}
+}
+
 func TestProcessServiceUpdate(t *testing.T) {
 
 	var controller *ServiceController
@@ -827,3 +932,221 @@ func TestServiceCache(t *testing.T) {
 		}
 	}
 }
+
+func TestGetLoadBalancerOptions(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		expected    openstack.LoadBalancerOptions
+		expectErr   bool
+	}{
+		{
+			annotations: nil,
+			expected:    openstack.LoadBalancerOptions{},
+		},
+		{
+			annotations: map[string]string{
+				lbMethodAnnotation:               "least_connections",
+				lbPersistenceAnnotation:          "HTTP_COOKIE",
+				lbConnectionLimitAnnotation:      "100",
+				lbMonitorTypeAnnotation:          "http",
+				lbMonitorURLPathAnnotation:       "/healthz",
+				lbMonitorExpectedCodesAnnotation: "200-204",
+				lbMonitorDelayAnnotation:         "5",
+				lbMonitorTimeoutAnnotation:       "5",
+				lbMonitorMaxRetriesAnnotation:    "2",
+			},
+			expected: openstack.LoadBalancerOptions{
+				LBMethod:             "LEAST_CONNECTIONS",
+				Persistence:          "HTTP_COOKIE",
+				ConnectionLimit:      100,
+				MonitorType:          "HTTP",
+				MonitorURLPath:       "/healthz",
+				MonitorExpectedCodes: "200-204",
+				MonitorDelay:         5,
+				MonitorTimeout:       5,
+				MonitorMaxRetries:    2,
+			},
+		},
+		{
+			annotations: map[string]string{lbMethodAnnotation: "RANDOM"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbPersistenceAnnotation: "APP_COOKIE"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbMonitorTypeAnnotation: "PING"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbMonitorURLPathAnnotation: "healthz"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbMonitorExpectedCodesAnnotation: "2xx"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbConnectionLimitAnnotation: "-1"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{
+				lbMonitorDelayAnnotation:   "3",
+				lbMonitorTimeoutAnnotation: "5",
+			},
+			expectErr: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		service := defaultExternalService()
+		service.Annotations = tc.annotations
+		options, err := getLoadBalancerOptions(service)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("case %d: expected error, got options %v", i, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(tc.expected, options) {
+			t.Errorf("case %d: expected options %v, got %v", i, tc.expected, options)
+		}
+	}
+}
+
+func TestCreateHTTPLoadBalancer(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		// expected are HTTP flags of ports 80 and 5432.
+		expected  []bool
+		expectErr bool
+	}{
+		{
+			annotations: map[string]string{lbHTTPPortsAnnotation: "80"},
+			expected:    []bool{true, false},
+		},
+		{
+			annotations: map[string]string{lbHTTPPortsAnnotation: "80,5432", lbPersistenceAnnotation: "HTTP_COOKIE"},
+			expected:    []bool{true, true},
+		},
+		{
+			// HTTP cookies don't turn TCP ports into HTTP ports.
+			annotations: map[string]string{lbHTTPPortsAnnotation: "80", lbPersistenceAnnotation: "HTTP_COOKIE"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{lbHTTPPortsAnnotation: "http"},
+			expectErr:   true,
+		},
+	}
+
+	for i, tc := range testCases {
+		controller, osClient, client := newController()
+		osClient.SetNetwork(defaultNetwork())
+		service := newService("web", types.UID("123"), v1.ServiceTypeLoadBalancer)
+		service.Annotations = tc.annotations
+		service.Spec.Ports = []v1.ServicePort{
+			{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+			{Name: "db", Port: 5432, Protocol: v1.ProtocolTCP},
+		}
+		client.Core().Endpoints("default").Create(&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		})
+
+		_, err := controller.createLoadBalancer(service)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("case %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		ports := osClient.LoadBalancers[buildLoadBalancerName(service)].Ports
+		if ports[0].HTTP != tc.expected[0] || ports[1].HTTP != tc.expected[1] {
+			t.Errorf("case %d: expected HTTP ports %v, got %v", i, tc.expected, ports)
+		}
+	}
+}
+
+func TestCreateTLSLoadBalancer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stackube-certificates")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := openstack.NewFileCertificateStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	controller, osClient, client := newController()
+	osClient.SetNetwork(defaultNetwork())
+	osClient.CertificateStore = store
+
+	service := newService("web", types.UID("123"), v1.ServiceTypeLoadBalancer)
+	service.Annotations = map[string]string{lbTLSSecretAnnotation: "web-tls"}
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+	}
+	client.Core().Endpoints("default").Create(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "3.3.3.3"}},
+			Ports: []v1.EndpointPort{
+				{Name: "https", Port: 8080, Protocol: v1.ProtocolTCP},
+				{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP},
+			},
+		}},
+	})
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: "default"},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       []byte("cert1"),
+			v1.TLSPrivateKeyKey: []byte("key1"),
+		},
+	}
+	controller.secretInformer.Informer().GetStore().Add(secret)
+
+	lbName := buildLoadBalancerName(service)
+	var refs []string
+	for i, cert := range []string{"cert1", "cert2"} {
+		// The certificate is rotated when the secret changes.
+		secret.Data[v1.TLSCertKey] = []byte(cert)
+		if _, err := controller.createLoadBalancer(service); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		ports := osClient.LoadBalancers[lbName].Ports
+		if ports[0].TLSContainerRef == "" || ports[1].TLSContainerRef != "" {
+			t.Errorf("case %d: expected only port 443 to terminate TLS, got %v", i, ports)
+		}
+		certificates, _ := store.ListCertificates(buildCertificatePrefix(service))
+		if len(certificates) != 1 {
+			t.Errorf("case %d: expected one certificate, got %v", i, certificates)
+		}
+		refs = append(refs, ports[0].TLSContainerRef)
+	}
+	if refs[0] == refs[1] {
+		t.Errorf("expected certificate to be rotated, got %v", refs)
+	}
+
+	// Certificates are deleted with the service.
+	key := "default/web"
+	controller.cache.set(key, &cachedService{state: service})
+	if err, _ := controller.processServiceDeletion(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	certificates, _ := store.ListCertificates(buildCertificatePrefix(service))
+	if len(certificates) != 0 {
+		t.Errorf("expected certificates to be deleted, got %v", certificates)
+	}
+}
@@ -18,14 +18,17 @@ package util
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"k8s.io/api/core/v1"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -85,6 +88,80 @@ func WaitForCRDReady(clientset apiextensionsclient.Interface, crdName string) er
 	return nil
 }
 
+// GetNetworkName returns the name of the Network which an object (pod or service)
+// in the namespace is attached to. The object's NetworkAnnotation wins, otherwise
+// the namespace's default network is used. All system namespaces share the system network.
+func GetNetworkName(client kubernetes.Interface, namespace string, annotations map[string]string) (string, error) {
+	if IsSystemNamespace(namespace) {
+		return SystemNetwork, nil
+	}
+	if name := annotations[NetworkAnnotation]; name != "" {
+		return name, nil
+	}
+
+	return GetDefaultNetworkName(client, namespace)
+}
+
+// GetNetworkNames returns the names of all Networks a pod in the namespace is
+// attached to, the primary network comes first. Pods select them by NetworksAnnotation,
+// otherwise the pod is only attached to the network returned by GetNetworkName.
+func GetNetworkNames(client kubernetes.Interface, namespace string, annotations map[string]string) ([]string, error) {
+	if IsSystemNamespace(namespace) {
+		return []string{SystemNetwork}, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(annotations[NetworksAnnotation], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for _, n := range names {
+			if n == name {
+				return nil, fmt.Errorf("network %q is listed more than once", name)
+			}
+		}
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		return names, nil
+	}
+
+	name, err := GetNetworkName(client, namespace, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{name}, nil
+}
+
+// GetDefaultNetworkName returns the name of the default Network of the namespace.
+func GetDefaultNetworkName(client kubernetes.Interface, namespace string) (string, error) {
+	if IsSystemNamespace(namespace) {
+		return SystemNetwork, nil
+	}
+
+	ns, err := client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return namespace, nil
+		}
+		return "", err
+	}
+
+	return DefaultNetworkName(ns), nil
+}
+
+// DefaultNetworkName returns the default Network name of the namespace. It is
+// selected by DefaultNetworkAnnotation and falls back to the namespace name.
+func DefaultNetworkName(ns *v1.Namespace) string {
+	if name := ns.Annotations[DefaultNetworkAnnotation]; name != "" {
+		return name
+	}
+
+	return ns.Name
+}
+
 func LoadBalancerStatusDeepCopy(lb *v1.LoadBalancerStatus) *v1.LoadBalancerStatus {
 	c := &v1.LoadBalancerStatus{}
 	c.Ingress = make([]v1.LoadBalancerIngress, len(lb.Ingress))
@@ -119,3 +196,24 @@ func ingressEqual(lhs, rhs *v1.LoadBalancerIngress) bool {
 	}
 	return true
 }
+
+// HasFinalizer returns whether the finalizer is in finalizers.
+func HasFinalizer(finalizers []string, finalizer string) bool {
+	for _, f := range finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveFinalizer returns finalizers without the finalizer.
+func RemoveFinalizer(finalizers []string, finalizer string) []string {
+	var result []string
+	for _, f := range finalizers {
+		if f != finalizer {
+			result = append(result, f)
+		}
+	}
+	return result
+}
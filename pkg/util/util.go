@@ -28,10 +28,23 @@ import (
 const (
 	namePrefix = "kube"
 
-	SystemTenant   = apiv1.NamespaceDefault
-	SystemPassword = "password"
+	SystemTenant = apiv1.NamespaceDefault
 
 	SystemNetwork = apiv1.NamespaceDefault
+
+	// NetworkAnnotation is set on pods and services to select the Network
+	// they are attached to in their namespace.
+	NetworkAnnotation = "stackube.kubernetes.io/network"
+	// DefaultNetworkAnnotation is set on namespaces to select the Network
+	// used by pods and services which don't select one themselves.
+	DefaultNetworkAnnotation = "stackube.kubernetes.io/default-network"
+	// NetworksAnnotation is set on pods to attach them to several Networks,
+	// the value is a comma separated list of Network names. The first one is
+	// the primary network which holds the pod IP and the default route.
+	NetworksAnnotation = "stackube.kubernetes.io/networks"
+	// FloatingNetworkAnnotation is set on LoadBalancer services to allocate
+	// their floating IP from another external network than the configured one.
+	FloatingNetworkAnnotation = "stackube.kubernetes.io/floating-network"
 )
 
 var ErrNotFound = errors.New("NotFound")
@@ -59,6 +72,24 @@ func BuildPortName(namespace, podName string) string {
 	return namePrefix + "-" + namespace + "-" + podName
 }
 
+// BuildInterfacePortName returns the port name of the pod's interface with index.
+// The primary interface (index 0) uses the same name as BuildPortName. Others are
+// suffixed with "_if<index>", which can't clash with ports of other pods since pod
+// names never contain "_".
+func BuildInterfacePortName(namespace, podName string, index int) string {
+	portName := BuildPortName(namespace, podName)
+	if index == 0 {
+		return portName
+	}
+	return fmt.Sprintf("%s_if%d", portName, index)
+}
+
+// BuildPodDeviceID returns the device ID of the pod's ports, which identifies
+// all ports of the pod regardless of their names.
+func BuildPodDeviceID(namespace, podName string) string {
+	return fmt.Sprintf("%s/%s", namespace, podName)
+}
+
 func BuildFullPodName(namespace, name string) string {
 	return fmt.Sprintf("%s-%s", namespace, name)
 }